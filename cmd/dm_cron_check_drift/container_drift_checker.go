@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/registryclient"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/docker/distribution/registry/client/auth"
+	oci_digest "github.com/opencontainers/go-digest"
+)
+
+// containerDriftChecker checks whether container images stored in the
+// mirror can still be resolved by digest by their upstream registries.
+// As images are addressed by digest, their contents cannot change
+// upstream. They can only disappear.
+type containerDriftChecker struct {
+	upstreamTransport http.RoundTripper
+}
+
+func newContainerDriftChecker(upstreamTransport http.RoundTripper) *containerDriftChecker {
+	return &containerDriftChecker{
+		upstreamTransport: upstreamTransport,
+	}
+}
+
+func (dc *containerDriftChecker) check(ctx context.Context, registryUrl string, repositoryName string, digest string, creds auth.CredentialStore) (string, string) {
+	repository, err := registryclient.NewRepository(registryUrl, repositoryName, dc.upstreamTransport, creds)
+	if err != nil {
+		return schema.DriftStatusError, err.Error()
+	}
+	manifestService, err := repository.Manifests(ctx)
+	if err != nil {
+		return schema.DriftStatusError, err.Error()
+	}
+	exists, err := manifestService.Exists(ctx, oci_digest.Digest(digest))
+	if err != nil {
+		return schema.DriftStatusError, err.Error()
+	}
+	if !exists {
+		return schema.DriftStatusMissing, "Upstream registry no longer serves a manifest with this digest"
+	}
+	return schema.DriftStatusUnchanged, ""
+}
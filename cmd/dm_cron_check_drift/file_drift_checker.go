@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+)
+
+// fileDriftChecker compares files stored in the mirror against the
+// ones currently served by their upstream servers.
+type fileDriftChecker struct {
+	httpClient  *http.Client
+	alwaysFetch bool
+}
+
+func newFileDriftChecker(httpClient *http.Client, alwaysFetch bool) *fileDriftChecker {
+	return &fileDriftChecker{
+		httpClient:  httpClient,
+		alwaysFetch: alwaysFetch,
+	}
+}
+
+// newRequest creates a HTTP request for an upstream server. Like the
+// downloader, only the identity encoding is accepted, so that responses
+// can be compared against the stored contents byte for byte.
+func newRequest(ctx context.Context, method string, uri string) (*http.Request, error) {
+	req, err := http.NewRequest(method, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+	return req.WithContext(ctx), nil
+}
+
+// compareHeader compares the value of a response header against the
+// value observed when the file was downloaded. Differences are
+// appended to a list.
+func compareHeader(differences []string, resp *http.Response, name string, expected *string) []string {
+	var expectedValue string
+	if expected != nil {
+		expectedValue = *expected
+	}
+	if actualValue := resp.Header.Get(name); actualValue != expectedValue {
+		return append(differences, fmt.Sprintf("%s changed from %#v to %#v", name, expectedValue, actualValue))
+	}
+	return differences
+}
+
+// checkStatus converts the status code returned by the upstream server
+// to the outcome of a check, if the response does not contain the file.
+func checkStatus(resp *http.Response) (string, string, bool) {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return "", "", true
+	case http.StatusNotFound, http.StatusGone:
+		return schema.DriftStatusMissing, fmt.Sprintf("Upstream server returned %s", resp.Status), false
+	default:
+		return schema.DriftStatusError, fmt.Sprintf("Upstream server returned %s", resp.Status), false
+	}
+}
+
+// check determines whether a file has drifted from the version that
+// was downloaded. The most recent download of the file is used to
+// compare response headers. A HEAD request is sent first. The file is
+// only fetched and hashed if the response headers don't provide
+// sufficient evidence that the file is unchanged.
+func (dc *fileDriftChecker) check(ctx context.Context, file *schema.File, download *schema.FileDownload) (string, string) {
+	var differences []string
+	if !dc.alwaysFetch {
+		req, err := newRequest(ctx, http.MethodHead, file.Uri)
+		if err != nil {
+			return schema.DriftStatusError, err.Error()
+		}
+		resp, err := dc.httpClient.Do(req)
+		if err != nil {
+			return schema.DriftStatusError, err.Error()
+		}
+		resp.Body.Close()
+
+		// Some servers don't implement HEAD properly. Only
+		// trust responses that indicate the file is missing,
+		// and fall back to fetching the file otherwise.
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+			status, details, _ := checkStatus(resp)
+			return status, details
+		}
+		if resp.StatusCode == http.StatusOK {
+			if resp.ContentLength >= 0 && resp.Header.Get("Content-Encoding") == "" && file.ContentEncoding == nil && uint64(resp.ContentLength) != *file.Size {
+				return schema.DriftStatusChanged, fmt.Sprintf("Upstream server now returns %d bytes, whereas %d bytes were stored", resp.ContentLength, *file.Size)
+			}
+			if download != nil {
+				differences = dc.compareHeaders(resp, download)
+
+				// Validators that are present and
+				// identical imply identical contents.
+				if len(differences) == 0 && (download.Etag != nil || download.LastModified != nil) {
+					return schema.DriftStatusUnchanged, ""
+				}
+			}
+		}
+	}
+
+	// Fetch the file and compare its checksum.
+	req, err := newRequest(ctx, http.MethodGet, file.Uri)
+	if err != nil {
+		return schema.DriftStatusError, err.Error()
+	}
+	resp, err := dc.httpClient.Do(req)
+	if err != nil {
+		return schema.DriftStatusError, err.Error()
+	}
+	defer resp.Body.Close()
+	if status, details, ok := checkStatus(resp); !ok {
+		return status, details
+	}
+	if download != nil {
+		differences = dc.compareHeaders(resp, download)
+	}
+	hasher := sha256.New()
+	fileSize, err := io.Copy(hasher, resp.Body)
+	if err != nil {
+		return schema.DriftStatusError, err.Error()
+	}
+	if checksum := hex.EncodeToString(hasher.Sum(nil)); checksum != *file.Sha256 {
+		return schema.DriftStatusChanged, fmt.Sprintf("Upstream server now returns %d bytes with checksum %s, whereas %d bytes with checksum %s were stored", fileSize, checksum, *file.Size, *file.Sha256)
+	}
+	if len(differences) > 0 {
+		return schema.DriftStatusHeadersChanged, strings.Join(differences, "; ")
+	}
+	return schema.DriftStatusUnchanged, ""
+}
+
+func (dc *fileDriftChecker) compareHeaders(resp *http.Response, download *schema.FileDownload) []string {
+	var differences []string
+	differences = compareHeader(differences, resp, "ETag", download.Etag)
+	differences = compareHeader(differences, resp, "Last-Modified", download.LastModified)
+	differences = compareHeader(differences, resp, "Content-Type", download.ContentType)
+	differences = compareHeader(differences, resp, "Content-Encoding", download.ContentEncoding)
+	return differences
+}
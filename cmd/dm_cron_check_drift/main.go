@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/credentials"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/upstream"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+)
+
+func recordDriftCheck(db *gorm.DB, driftCheck *schema.DriftCheck, status string, details string, name string) {
+	driftCheck.CheckedAt = time.Now()
+	driftCheck.Status = status
+	if details != "" {
+		driftCheck.Details = &details
+	}
+	if status != schema.DriftStatusUnchanged {
+		log.Printf("%s: %s: %s", name, status, details)
+	}
+	if r := db.Create(driftCheck); r.Error != nil {
+		log.Printf("Failed to create drift check entry in database: %s", r.Error)
+	}
+}
+
+func main() {
+	var (
+		credentialsDockerConfig      = flag.String("credentials.docker-config", "", "Path of a Docker config.json file holding container registry credentials")
+		credentialsEncryptionKeyFile = flag.String("credentials.encryption-key-file", "", "Path of a file holding the hex encoded AES-256 key used to encrypt container registry credentials stored in the database")
+		credentialsFileCredentials   = flag.String("credentials.file-credentials", "", "Path of a JSON file holding credentials, request headers and TLS client certificates to use for upstream servers")
+		credentialsNetrc             = flag.String("credentials.netrc", "", "Path of a netrc file holding credentials to use for upstream servers")
+
+		dbAddress = flag.String("db.address", "", "Database server address.")
+
+		driftAlwaysFetch = flag.Bool("drift.always-fetch", false, "Always fetch and hash files, instead of trusting identical ETag and Last-Modified headers")
+		driftTimeout     = flag.Duration("drift.timeout", time.Hour, "Maximum duration of checking a single artifact")
+
+		upstreamFlags = upstream.RegisterFlags()
+	)
+	flag.Parse()
+
+	db, err := gorm.Open("postgres", *dbAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	destinationPolicy, err := upstreamFlags.NewDestinationPolicy()
+	if err != nil {
+		log.Fatal(err)
+	}
+	transportFactory, err := upstreamFlags.NewTransportFactory(destinationPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Files and container images are accessed with the same
+	// credentials as used by the downloaders.
+	fileCredentials, err := credentials.LoadFileCredentials(*credentialsFileCredentials, *credentialsNetrc)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fileChecker := newFileDriftChecker(
+		&http.Client{
+			Transport: fileCredentials.RoundTripper(transportFactory.NewTransport),
+		},
+		*driftAlwaysFetch)
+	containerChecker := newContainerDriftChecker(transportFactory.NewTransport(nil))
+
+	var dockerConfig *credentials.DockerConfig
+	if *credentialsDockerConfig != "" {
+		dockerConfig, err = credentials.LoadDockerConfigFile(*credentialsDockerConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var credentialsCipher *credentials.Cipher
+	if *credentialsEncryptionKeyFile != "" {
+		credentialsCipher, err = credentials.NewCipherFromKeyFile(*credentialsEncryptionKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+
+	// Check files.
+	var files []schema.File
+	if r := db.Where("present = true").Find(&files); r.Error != nil {
+		log.Fatal(r.Error)
+	}
+	for _, file := range files {
+		log.Printf("Checking %s", file.Uri)
+
+		// Compare against the last time the file was actually
+		// fetched from the upstream server.
+		var download *schema.FileDownload
+		var lastDownload schema.FileDownload
+		if r := db.Where("file_id = ? AND final_uri IS NOT NULL", file.Id).Order("downloaded_at DESC").Take(&lastDownload); r.Error == nil {
+			download = &lastDownload
+		} else if !r.RecordNotFound() {
+			log.Printf("Failed to get file download of %s: %s", file.Uri, r.Error)
+			continue
+		}
+
+		fileId := file.Id
+		ctx, cancel := context.WithTimeout(ctx, *driftTimeout)
+		status, details := fileChecker.check(ctx, &file, download)
+		cancel()
+		recordDriftCheck(db, &schema.DriftCheck{FileId: &fileId}, status, details, file.Uri)
+	}
+
+	// Check container images.
+	var containerImages []schema.ContainerImage
+	if r := db.Where("manifest IS NOT NULL").Find(&containerImages); r.Error != nil {
+		log.Fatal(r.Error)
+	}
+	for _, containerImage := range containerImages {
+		var containerRepository schema.ContainerRepository
+		if r := db.Where("id = ?", containerImage.RepositoryId).Take(&containerRepository); r.Error != nil {
+			log.Printf("Failed to get container repository %s: %s", containerImage.RepositoryId, r.Error)
+			continue
+		}
+		var containerRegistry schema.ContainerRegistry
+		if r := db.Where("id = ?", containerRepository.RegistryId).Take(&containerRegistry); r.Error != nil {
+			log.Printf("Failed to get container registry %s: %s", containerRepository.RegistryId, r.Error)
+			continue
+		}
+		creds, err := credentials.NewRegistryCredentialStore(db, credentialsCipher, dockerConfig, &containerRegistry)
+		if err != nil {
+			log.Printf("Failed to get credentials for container registry %s: %s", containerRegistry.Uri, err)
+			continue
+		}
+		name := containerRegistry.Uri + " " + containerRepository.RepositoryName + " " + containerImage.Digest
+		log.Printf("Checking %s", name)
+
+		containerImageId := containerImage.Id
+		ctx, cancel := context.WithTimeout(ctx, *driftTimeout)
+		status, details := containerChecker.check(ctx, containerRegistry.Uri, containerRepository.RepositoryName, containerImage.Digest, creds)
+		cancel()
+		recordDriftCheck(db, &schema.DriftCheck{ContainerImageId: &containerImageId}, status, details, name)
+	}
+}
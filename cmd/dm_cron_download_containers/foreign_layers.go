@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/jinzhu/gorm"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// foreignLayerMediatypes contains the media types of layers that
+// aren't distributed through registries, but through the URLs listed
+// in their descriptors.
+var foreignLayerMediatypes = map[string]bool{
+	schema2.MediaTypeForeignLayer:              true,
+	v1.MediaTypeImageLayerNonDistributable:     true,
+	v1.MediaTypeImageLayerNonDistributableGzip: true,
+	// Introduced by version 1.1 of the OCI image specification.
+	"application/vnd.oci.image.layer.nondistributable.v1.tar+zstd": true,
+}
+
+// isForeignLayer returns whether a descriptor refers to a foreign layer
+// (e.g., the base layers of Windows images).
+func isForeignLayer(descriptor distribution.Descriptor) bool {
+	return foreignLayerMediatypes[descriptor.MediaType] && len(descriptor.URLs) > 0
+}
+
+// foreignLayerDownloader downloads foreign layers from the URLs listed
+// in their descriptors. Registries tend not to serve these layers
+// themselves.
+type foreignLayerDownloader struct {
+	database   *gorm.DB
+	httpClient *http.Client
+}
+
+// open downloads a foreign layer from the first of its URLs that can
+// be fetched, returning the URL that was used.
+func (fd *foreignLayerDownloader) open(ctx context.Context, descriptor distribution.Descriptor) (io.ReadCloser, string, error) {
+	for _, url := range descriptor.URLs {
+		log.Printf("Downloading foreign layer %s from %s", descriptor.Digest, url)
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		resp, err := fd.httpClient.Do(req.WithContext(ctx))
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			log.Printf("Server returned %s", resp.Status)
+			continue
+		}
+		return resp.Body, url, nil
+	}
+	return nil, "", errors.New("None of the URLs of the foreign layer could be downloaded")
+}
+
+// record stores the URL from which a foreign layer was downloaded and
+// verified, so that the proxy can serve the layer to clients that
+// download it from its original location. URLs are never associated
+// with another layer afterwards.
+func (fd *foreignLayerDownloader) record(url string, descriptor distribution.Descriptor) error {
+	var foreignLayer schema.ContainerForeignLayer
+	if r := fd.database.Where("url = ?", url).Attrs(schema.ContainerForeignLayer{
+		Url:    url,
+		Digest: string(descriptor.Digest),
+	}).FirstOrCreate(&foreignLayer); r.Error != nil {
+		return fmt.Errorf("Failed to record URL %s of foreign layer %s: %s", url, descriptor.Digest, r.Error)
+	}
+	if foreignLayer.Digest != string(descriptor.Digest) {
+		return fmt.Errorf("URL %s of foreign layer %s was recorded for layer %s before", url, descriptor.Digest, foreignLayer.Digest)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/layers"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/manifests"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/util"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/docker/distribution"
+	"github.com/jinzhu/gorm"
+)
+
+// indexImageConfig stores the labels contained in the config blob of
+// a downloaded container image in the database, so that images can be
+// searched by label.
+func indexImageConfig(ctx context.Context, db *gorm.DB, s3Client *s3.S3, containerImage *schema.ContainerImage) error {
+	manifest, _, err := distribution.UnmarshalManifest(*containerImage.ManifestMediatype, *containerImage.Manifest)
+	if err != nil {
+		return err
+	}
+	descriptor, ok := manifests.GetConfigDescriptor(manifest)
+	if !ok {
+		return nil
+	}
+	var labels map[string]string
+	if manifests.IsImageConfig(descriptor) {
+		payload, err := util.GetObjectContents(ctx, s3Client, "container-blobs", string(descriptor.Digest))
+		if err != nil {
+			return err
+		}
+		if actualDigest := descriptor.Digest.Algorithm().FromBytes(payload); actualDigest != descriptor.Digest {
+			return fmt.Errorf("Config blob %s has digest %s", descriptor.Digest, actualDigest)
+		}
+		config, err := manifests.ParseImageConfig(payload)
+		if err != nil {
+			return err
+		}
+		labels = config.Config.Labels
+	}
+
+	tx := db.Begin()
+	if r := tx.Where("container_image_id = ?", containerImage.Id).Delete(&schema.ContainerImageLabel{}); r.Error != nil {
+		tx.Rollback()
+		return r.Error
+	}
+	for key, value := range labels {
+		if r := tx.Create(&schema.ContainerImageLabel{
+			ContainerImageId: containerImage.Id,
+			Key:              key,
+			Value:            value,
+		}); r.Error != nil {
+			tx.Rollback()
+			return r.Error
+		}
+	}
+	if r := tx.Model(&schema.ContainerImage{}).Where("id = ?", containerImage.Id).Update("config_digest", string(descriptor.Digest)); r.Error != nil {
+		tx.Rollback()
+		return r.Error
+	}
+	return tx.Commit().Error
+}
+
+// indexImageLayers stores the entries of the layers of a downloaded
+// container image in the database, so that its filesystem can be
+// browsed.
+func indexImageLayers(ctx context.Context, db *gorm.DB, s3Client *s3.S3, containerImage *schema.ContainerImage) error {
+	manifest, _, err := distribution.UnmarshalManifest(*containerImage.ManifestMediatype, *containerImage.Manifest)
+	if err != nil {
+		return err
+	}
+	return layers.IndexLayers(ctx, db, s3Client, layers.GetFilesystemLayers(manifest))
+}
@@ -2,90 +2,65 @@ package main
 
 import (
 	"context"
-	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"net/url"
 	"time"
 
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/cosign"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/credentials"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/manifests"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/platforms"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/registryclient"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/sbom"
 	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/upstream"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/util"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
+	aws_credentials "github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/docker/distribution"
 	"github.com/docker/distribution/manifest/manifestlist"
-	_ "github.com/docker/distribution/manifest/schema1"
+	_ "github.com/docker/distribution/manifest/ocischema"
+	"github.com/docker/distribution/manifest/schema1"
 	_ "github.com/docker/distribution/manifest/schema2"
-	"github.com/docker/distribution/reference"
-	"github.com/docker/distribution/registry/client"
-	"github.com/docker/distribution/registry/client/auth"
-	"github.com/docker/distribution/registry/client/transport"
-	"github.com/docker/docker/registry"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 	oci_digest "github.com/opencontainers/go-digest"
 )
 
-type anonymousCredentialStore struct {
-}
-
-func (cs *anonymousCredentialStore) Basic(*url.URL) (string, string) {
-	return "", ""
-}
-
-func (cs *anonymousCredentialStore) RefreshToken(u *url.URL, service string) string {
-	return ""
-}
-
-func (cs *anonymousCredentialStore) SetRefreshToken(u *url.URL, service string, token string) {
-}
-
-func downloadAndStoreContainerImage(ctx context.Context, registryUrl string, repositoryName string, digest string, uploader *s3manager.Uploader) (string, []byte, error) {
-	// Send ping to registry to obtain OAuth2 bearer token.
-	parsedRegistryUrl, err := url.Parse(registryUrl)
-	if err != nil {
-		return "", nil, err
-	}
-	challengeManager, confirmedV2, err := registry.PingV2Registry(parsedRegistryUrl, http.DefaultTransport)
+func downloadAndStoreContainerImage(ctx context.Context, repository distribution.Repository, digest string, s3Client *s3.S3, uploader *s3manager.Uploader, foreignLayers *foreignLayerDownloader) (string, []byte, error) {
+	// Obtain manifest of digest.
+	manifestService, err := repository.Manifests(ctx)
 	if err != nil {
 		return "", nil, err
 	}
-	if !confirmedV2 {
-		return "", nil, errors.New("Unsupported registry version")
-	}
-
-	// Access repository.
-	repositoryRef, err := reference.WithName(repositoryName)
+	parsedDigest, err := oci_digest.Parse(digest)
 	if err != nil {
 		return "", nil, err
 	}
-	creds := &anonymousCredentialStore{}
-	repository, err := client.NewRepository(
-		repositoryRef,
-		registryUrl,
-		transport.NewTransport(
-			http.DefaultTransport,
-			auth.NewAuthorizer(
-				challengeManager,
-				auth.NewTokenHandler(
-					http.DefaultTransport,
-					creds,
-					repositoryName,
-					"pull"),
-				auth.NewBasicHandler(creds))))
+	manifest, err := manifestService.Get(ctx, parsedDigest)
 	if err != nil {
 		return "", nil, err
 	}
 
-	// Obtain manifest of digest.
-	manifestService, err := repository.Manifests(ctx)
+	// Validate that the registry returned the manifest that was
+	// requested. The digest of a schema 1 manifest is computed over
+	// its contents without the signatures.
+	manifestMediatype, manifestPayload, err := manifest.Payload()
 	if err != nil {
 		return "", nil, err
 	}
-	manifest, err := manifestService.Get(ctx, oci_digest.Digest(digest))
-	if err != nil {
-		return "", nil, err
+	verifiedPayload := manifestPayload
+	if signedManifest, ok := manifest.(*schema1.SignedManifest); ok {
+		verifiedPayload = signedManifest.Canonical
+	}
+	if actualDigest := parsedDigest.Algorithm().FromBytes(verifiedPayload); actualDigest != parsedDigest {
+		return "", nil, fmt.Errorf("Registry returned manifest with digest %s, whereas %s was requested", actualDigest, parsedDigest)
 	}
 
 	// Copy blobs into S3. Don't do this for manifest lists. Those
@@ -101,35 +76,121 @@ func downloadAndStoreContainerImage(ctx context.Context, registryUrl string, rep
 			return "", nil, err
 		}
 		for _, descriptor := range manifest.References() {
-			// TODO(edsch): Skip downloading if blob already present in the cache.
-			log.Printf("Downloading blob %s", descriptor.Digest)
-			r, err := blobsService.Open(ctx, descriptor.Digest)
+			// Skip blobs that are already present. Base layers
+			// tend to be shared by many images.
+			if present, err := util.ObjectExists(ctx, s3Client, "container-blobs", string(descriptor.Digest)); err != nil {
+				return "", nil, err
+			} else if present {
+				log.Printf("Blob %s already present", descriptor.Digest)
+				continue
+			}
+
+			// Foreign layers are downloaded from the URLs
+			// listed in the manifest, falling back to the
+			// registry in case it serves them regardless.
+			var r io.ReadCloser
+			foreignLayerUrl := ""
+			if foreignLayers != nil && isForeignLayer(descriptor) {
+				r, foreignLayerUrl, err = foreignLayers.open(ctx, descriptor)
+				if err != nil {
+					log.Print(err)
+				}
+			}
+			if r == nil {
+				log.Printf("Downloading blob %s", descriptor.Digest)
+				r, err = blobsService.Open(ctx, descriptor.Digest)
+				if err != nil {
+					return "", nil, err
+				}
+			}
+			body, err := util.NewVerifyingReader(r, descriptor.Digest, descriptor.Size)
 			if err != nil {
+				r.Close()
 				return "", nil, err
 			}
 			_, err = uploader.UploadWithContext(ctx, &s3manager.UploadInput{
 				Bucket: aws.String("container-blobs"),
 				Key:    aws.String(string(descriptor.Digest)),
-				Body:   r,
+				Body:   body,
 			})
 			r.Close()
 			if err != nil {
 				return "", nil, err
 			}
+			if foreignLayerUrl != "" {
+				if err := foreignLayers.record(foreignLayerUrl, descriptor); err != nil {
+					log.Print(err)
+				}
+			}
 		}
 	}
-	return manifest.Payload()
+	return manifestMediatype, manifestPayload, nil
+}
+
+func getRepositoryAndRegistry(db *gorm.DB, containerImage *schema.ContainerImage) (*schema.ContainerRepository, *schema.ContainerRegistry, error) {
+	var containerRepository schema.ContainerRepository
+	if r := db.Where("id = ?", containerImage.RepositoryId).Take(&containerRepository); r.Error != nil {
+		return nil, nil, fmt.Errorf("Failed to get container repository %s: %s", containerImage.RepositoryId, r.Error)
+	}
+	var containerRegistry schema.ContainerRegistry
+	if r := db.Where("id = ?", containerRepository.RegistryId).Take(&containerRegistry); r.Error != nil {
+		return nil, nil, fmt.Errorf("Failed to get container registry %s: %s", containerRepository.RegistryId, r.Error)
+	}
+	return &containerRepository, &containerRegistry, nil
+}
+
+// enqueuePlatformChildren creates entries for the manifests referenced
+// by a manifest list that match the platform policy of the image or
+// its registry. Entries that still need to be downloaded are returned.
+func enqueuePlatformChildren(db *gorm.DB, containerImage *schema.ContainerImage) ([]schema.ContainerImage, error) {
+	if containerImage.ManifestMediatype == nil || !manifests.IsManifestList(*containerImage.ManifestMediatype) {
+		return nil, nil
+	}
+	_, containerRegistry, err := getRepositoryAndRegistry(db, containerImage)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := platforms.GetEffectivePolicy(containerImage, containerRegistry)
+	if err != nil || len(policy) == 0 {
+		return nil, err
+	}
+	manifest, _, err := distribution.UnmarshalManifest(*containerImage.ManifestMediatype, *containerImage.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	manifestList, ok := manifest.(*manifestlist.DeserializedManifestList)
+	if !ok {
+		return nil, nil
+	}
+	return platforms.EnqueueChildren(db, containerImage, manifestList, policy)
 }
 
 func main() {
 	var (
 		dbAddress = flag.String("db.address", "", "Database server address.")
 
+		downloadTimeout = flag.Duration("download.timeout", 10*time.Minute, "Maximum duration of downloading a single container image, including its signatures")
+
+		layersIndex        = flag.Bool("layers.index", false, "Index the files contained in the layers of downloaded container images, so that their filesystems can be browsed through the web UI")
+		layersIndexTimeout = flag.Duration("layers.index-timeout", 10*time.Minute, "Maximum duration of indexing the config and layers, and extracting the packages of a single container image")
+
+		layersDownloadForeign = flag.Bool("layers.download-foreign", true, "Download foreign layers (e.g., the base layers of Windows images) from the URLs listed in manifests, so that images containing them can be used without access to these URLs")
+
+		packagesExtract = flag.Bool("packages.extract", true, "Extract the packages installed in downloaded container images from their package databases and lockfiles")
+
+		cosignFulcioCertificates = flag.String("cosign.fulcio-certificates", "", "Path of a PEM file holding the Fulcio root and intermediate certificates used to verify keyless signatures")
+		cosignRekorPublicKeys    = flag.String("cosign.rekor-public-keys", "", "Path of a PEM file holding the Rekor public keys used to verify keyless signatures")
+
+		credentialsDockerConfig      = flag.String("credentials.docker-config", "", "Path of a Docker config.json file holding container registry credentials")
+		credentialsEncryptionKeyFile = flag.String("credentials.encryption-key-file", "", "Path of a file holding the hex encoded AES-256 key used to encrypt container registry credentials stored in the database")
+
 		s3AccessKeyId     = flag.String("s3.access-key-id", "", "Access key of the S3 bucket holding distfiles")
 		s3DisableSsl      = flag.Bool("s3.disable-ssl", false, "Whether SSL should be disabled for the S3 bucket holding distfiles")
 		s3Endpoint        = flag.String("s3.endpoint", "", "Endpoint URL of the S3 bucket holding distfiles")
 		s3Region          = flag.String("s3.region", "", "Region of the S3 bucket holding distfiles")
 		s3SecretAccessKey = flag.String("s3.secret-access-key", "", "Secret access key of the S3 bucket holding distfiles")
+
+		upstreamFlags = upstream.RegisterFlags()
 	)
 	flag.Parse()
 
@@ -138,38 +199,152 @@ func main() {
 		log.Fatal(err)
 	}
 
+	destinationPolicy, err := upstreamFlags.NewDestinationPolicy()
+	if err != nil {
+		log.Fatal(err)
+	}
+	transportFactory, err := upstreamFlags.NewTransportFactory(destinationPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	upstreamTransport := transportFactory.NewTransport(nil)
+	var foreignLayers *foreignLayerDownloader
+	if *layersDownloadForeign {
+		foreignLayers = &foreignLayerDownloader{
+			database: db,
+			httpClient: &http.Client{
+				Transport: upstreamTransport,
+			},
+		}
+	}
+
+	var dockerConfig *credentials.DockerConfig
+	if *credentialsDockerConfig != "" {
+		dockerConfig, err = credentials.LoadDockerConfigFile(*credentialsDockerConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var credentialsCipher *credentials.Cipher
+	if *credentialsEncryptionKeyFile != "" {
+		credentialsCipher, err = credentials.NewCipherFromKeyFile(*credentialsEncryptionKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	verifier := signatureVerifier{database: db}
+	if *cosignFulcioCertificates != "" || *cosignRekorPublicKeys != "" {
+		verifier.trustRoot, err = cosign.LoadTrustRoot(*cosignFulcioCertificates, *cosignRekorPublicKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	s3Session := session.New(&aws.Config{
-		Credentials:      credentials.NewStaticCredentials(*s3AccessKeyId, *s3SecretAccessKey, ""),
+		Credentials:      aws_credentials.NewStaticCredentials(*s3AccessKeyId, *s3SecretAccessKey, ""),
 		Endpoint:         s3Endpoint,
 		Region:           s3Region,
 		DisableSSL:       s3DisableSsl,
 		S3ForcePathStyle: aws.Bool(true),
 	})
-	s3Uploader := s3manager.NewUploader(s3Session)
+	s3Client := s3.New(s3Session)
+	s3Uploader := s3manager.NewUploaderWithClient(s3Client)
+
+	// Enqueue the manifests of manifest lists that match the
+	// platform policy. This is done for manifest lists that have
+	// been downloaded before as well, as policies may have changed.
+	var manifestLists []schema.ContainerImage
+	if r := db.Where("manifest_mediatype IN (?)", manifests.ManifestListMediatypes).Find(&manifestLists); r.Error != nil {
+		log.Fatal(r.Error)
+	}
+	for _, manifestList := range manifestLists {
+		if _, err := enqueuePlatformChildren(db, &manifestList); err != nil {
+			log.Printf("Failed to enqueue manifests of manifest list %s: %s", manifestList.Digest, err)
+		}
+	}
+
+	// Index the labels of images that were downloaded before
+	// labels were indexed. Only manifests having config blobs
+	// obtain a config digest, so don't attempt to index others
+	// (e.g., schema 1 manifests) over and over again.
+	var unindexedImages []schema.ContainerImage
+	if r := db.Where("manifest IS NOT NULL AND config_digest IS NULL AND manifest_mediatype IN (?)", manifests.ConfigManifestMediatypes).Find(&unindexedImages); r.Error != nil {
+		log.Fatal(r.Error)
+	}
+	for _, unindexedImage := range unindexedImages {
+		if err := indexImageConfig(context.Background(), db, s3Client, &unindexedImage); err != nil {
+			log.Printf("Failed to index config of %s: %s", unindexedImage.Digest, err)
+		}
+	}
+
+	// Extract the packages of images that were downloaded before
+	// packages were extracted, or that were imported or pushed
+	// instead of being downloaded.
+	if *packagesExtract {
+		var unextractedImages []schema.ContainerImage
+		if r := db.Where("manifest IS NOT NULL AND packages_extracted_at IS NULL AND manifest_mediatype NOT IN (?)", manifests.ManifestListMediatypes).Find(&unextractedImages); r.Error != nil {
+			log.Fatal(r.Error)
+		}
+		for _, unextractedImage := range unextractedImages {
+			extractCtx, cancel := context.WithTimeout(context.Background(), *layersIndexTimeout)
+			if err := sbom.ExtractPackages(extractCtx, db, s3Client, &unextractedImage); err != nil {
+				log.Printf("Failed to extract packages of %s: %s", unextractedImage.Digest, err)
+			}
+			cancel()
+		}
+	}
 
 	var containerImages []schema.ContainerImage
-	if r := db.Where("manifest IS NULL").Find(&containerImages); r.Error != nil {
+	if r := db.Where("manifest IS NULL AND pending_manifest IS NULL").Find(&containerImages); r.Error != nil {
 		log.Fatal(r.Error)
 	}
+	queued := map[string]bool{}
+	for _, containerImage := range containerImages {
+		queued[containerImage.Id] = true
+	}
 
 	ctx := context.Background()
-	for _, containerImage := range containerImages {
+	for i := 0; i < len(containerImages); i++ {
+		containerImage := containerImages[i]
+
 		// Obtain full information for container image to download.
-		var containerRepository schema.ContainerRepository
-		if r := db.Where("id = ?", containerImage.RepositoryId).Take(&containerRepository); r.Error != nil {
-			log.Printf("Failed to get container repository %s: %s", containerImage.RepositoryId, r.Error)
+		containerRepository, containerRegistry, err := getRepositoryAndRegistry(db, &containerImage)
+		if err != nil {
+			log.Print(err)
 			continue
 		}
-		var containerRegistry schema.ContainerRegistry
-		if r := db.Where("id = ?", containerRepository.RegistryId).Take(&containerRegistry); r.Error != nil {
-			log.Printf("Failed to get container registry %s: %s", containerRepository.RegistryId, r.Error)
+		creds, err := credentials.NewRegistryCredentialStore(db, credentialsCipher, dockerConfig, containerRegistry)
+		if err != nil {
+			log.Printf("Failed to get credentials for container registry %s: %s", containerRegistry.Uri, err)
 			continue
 		}
 		log.Printf("Downloading %s %s %s", containerRegistry.Uri, containerRepository.RepositoryName, containerImage.Digest)
 
-		// TODO(edsch): Make timeout configurable.
-		ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
-		manifestMediatype, manifest, err := downloadAndStoreContainerImage(ctx, containerRegistry.Uri, containerRepository.RepositoryName, containerImage.Digest, s3Uploader)
+		ctx, cancel := context.WithTimeout(ctx, *downloadTimeout)
+
+		// Refuse to mirror images that are not signed in
+		// accordance with the signature policy of their
+		// repository. Mirror the signatures as part of this run,
+		// so that clients can verify them against the mirror.
+		repository, err := registryclient.NewRepository(containerRegistry.Uri, containerRepository.RepositoryName, upstreamTransport, creds)
+		if err != nil {
+			cancel()
+			log.Printf("Failed to create repository client: %s", err)
+			continue
+		}
+		signatureImage, err := verifier.verify(ctx, repository, &containerImage)
+		if err != nil {
+			cancel()
+			log.Printf("Failed to verify signatures: %s", err)
+			continue
+		}
+		if signatureImage != nil && signatureImage.Manifest == nil && !queued[signatureImage.Id] {
+			queued[signatureImage.Id] = true
+			containerImages = append(containerImages, *signatureImage)
+		}
+
+		manifestMediatype, manifest, err := downloadAndStoreContainerImage(ctx, repository, containerImage.Digest, s3Client, s3Uploader, foreignLayers)
 		cancel()
 		if err != nil {
 			log.Printf("Failed to download and store: %s", err)
@@ -177,12 +352,59 @@ func main() {
 		}
 
 		// Update database entry to prevent successive download.
-		if r := db.Model(&schema.ContainerImage{}).Where("id = ?", containerImage.Id).Updates(schema.ContainerImage{
+		// Store which manifest this manifest is attached to, so
+		// that it can be returned through the referrers API.
+		metadata, err := manifests.ParseMetadata(manifest)
+		if err != nil {
+			log.Printf("Failed to parse manifest: %s", err)
+			continue
+		}
+		updates := schema.ContainerImage{
 			ManifestMediatype: &manifestMediatype,
 			Manifest:          &manifest,
-		}); r.Error != nil {
+			SubjectDigest:     metadata.SubjectDigest,
+		}
+		if metadata.ArtifactType != "" {
+			updates.ArtifactType = &metadata.ArtifactType
+		}
+		if r := db.Model(&schema.ContainerImage{}).Where("id = ?", containerImage.Id).Updates(updates); r.Error != nil {
 			log.Printf("Failed to update container image entry in database: %s", err)
 			continue
 		}
+
+		// Index the labels, the packages and optionally the layer
+		// contents of the image. Failing to do so doesn't prevent
+		// the image from being served.
+		containerImage.ManifestMediatype = &manifestMediatype
+		containerImage.Manifest = &manifest
+		indexCtx, cancel := context.WithTimeout(context.Background(), *layersIndexTimeout)
+		if err := indexImageConfig(indexCtx, db, s3Client, &containerImage); err != nil {
+			log.Printf("Failed to index config: %s", err)
+		}
+		if *packagesExtract {
+			if err := sbom.ExtractPackages(indexCtx, db, s3Client, &containerImage); err != nil {
+				log.Printf("Failed to extract packages: %s", err)
+			}
+		}
+		if *layersIndex {
+			if err := indexImageLayers(indexCtx, db, s3Client, &containerImage); err != nil {
+				log.Printf("Failed to index layers: %s", err)
+			}
+		}
+		cancel()
+
+		// Download the manifests of a manifest list that match
+		// the platform policy as part of this run.
+		children, err := enqueuePlatformChildren(db, &containerImage)
+		if err != nil {
+			log.Printf("Failed to enqueue manifests of manifest list %s: %s", containerImage.Digest, err)
+			continue
+		}
+		for _, child := range children {
+			if !queued[child.Id] {
+				queued[child.Id] = true
+				containerImages = append(containerImages, child)
+			}
+		}
 	}
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/cosign"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/docker/distribution"
+	"github.com/jinzhu/gorm"
+	oci_digest "github.com/opencontainers/go-digest"
+)
+
+// signatureVerifier checks whether container images are signed in
+// accordance with the signature policy of their repository before
+// they are mirrored. Only signatures stored under cosign's
+// "sha256-*.sig" tags are supported.
+type signatureVerifier struct {
+	database  *gorm.DB
+	trustRoot *cosign.TrustRoot
+}
+
+// fetchSignatures obtains the signature manifest of an image from the
+// registry, returning its digest and the signatures stored in it.
+func fetchSignatures(ctx context.Context, repository distribution.Repository, digest string) (string, []*cosign.Signature, error) {
+	manifestService, err := repository.Manifests(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	tag := strings.Replace(digest, ":", "-", 1) + ".sig"
+	manifest, err := manifestService.Get(ctx, "", distribution.WithTag(tag))
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to obtain signature manifest %s: %s", tag, err)
+	}
+	_, manifestPayload, err := manifest.Payload()
+	if err != nil {
+		return "", nil, err
+	}
+
+	var signatures []*cosign.Signature
+	blobsService := repository.Blobs(ctx)
+	for _, descriptor := range manifest.References() {
+		if descriptor.MediaType != cosign.SimpleSigningMediaType {
+			continue
+		}
+		if descriptor.Size > cosign.MaximumPayloadSize {
+			return "", nil, fmt.Errorf("Signature payload %s is too large", descriptor.Digest)
+		}
+		r, err := blobsService.Open(ctx, descriptor.Digest)
+		if err != nil {
+			return "", nil, err
+		}
+		payload, err := ioutil.ReadAll(io.LimitReader(r, cosign.MaximumPayloadSize+1))
+		r.Close()
+		if err != nil {
+			return "", nil, err
+		}
+		if len(payload) > cosign.MaximumPayloadSize {
+			return "", nil, fmt.Errorf("Signature payload %s is too large", descriptor.Digest)
+		}
+		if actualDigest := descriptor.Digest.Algorithm().FromBytes(payload); actualDigest != descriptor.Digest {
+			return "", nil, fmt.Errorf("Registry returned signature payload with digest %s, whereas %s was requested", actualDigest, descriptor.Digest)
+		}
+		signatures = append(signatures, cosign.NewSignature(payload, descriptor.Annotations))
+	}
+	return oci_digest.FromBytes(manifestPayload).String(), signatures, nil
+}
+
+// verify checks whether an image may be mirrored. If the image needs
+// to be signed and its signatures are accepted, an entry for the
+// signature manifest is returned, so that it can be mirrored as well.
+func (sv *signatureVerifier) verify(ctx context.Context, repository distribution.Repository, containerImage *schema.ContainerImage) (*schema.ContainerImage, error) {
+	if containerImage.SignedDigest != nil {
+		// Signature manifests themselves are not signed.
+		return nil, nil
+	}
+	policy, err := cosign.GetRepositoryPolicy(sv.database, containerImage.RepositoryId)
+	if err != nil || policy == nil {
+		return nil, err
+	}
+	if covered, err := cosign.IsCoveredByManifestList(sv.database, containerImage.RepositoryId, containerImage.Digest); err != nil || covered {
+		return nil, err
+	}
+
+	signatureDigest, signatures, err := fetchSignatures(ctx, repository, containerImage.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if err := policy.Verify(sv.trustRoot, signatures, containerImage.Digest); err != nil {
+		return nil, err
+	}
+
+	signatureImage := schema.ContainerImage{
+		RepositoryId: containerImage.RepositoryId,
+		Digest:       signatureDigest,
+	}
+	if r := sv.database.Where(signatureImage).Assign(schema.ContainerImage{SignedDigest: &containerImage.Digest}).FirstOrCreate(&signatureImage); r.Error != nil {
+		return nil, r.Error
+	}
+	return &signatureImage, nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/util"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// fileDownloader downloads files from the Internet and stores them in
+// the "files" S3 bucket, keyed by checksum and size.
+type fileDownloader struct {
+	httpClient *http.Client
+	s3Client   *s3.S3
+	uploader   *s3manager.Uploader
+
+	// Parameters for downloading large files in chunks.
+	stateDirectory string
+	chunkSize      int64
+	parallelism    int
+}
+
+func newFileDownloader(httpClient *http.Client, s3Client *s3.S3, uploader *s3manager.Uploader, stateDirectory string, chunkSize int64, parallelism int) *fileDownloader {
+	return &fileDownloader{
+		httpClient: httpClient,
+		s3Client:   s3Client,
+		uploader:   uploader,
+
+		stateDirectory: stateDirectory,
+		chunkSize:      chunkSize,
+		parallelism:    parallelism,
+	}
+}
+
+// findStoredFile searches the S3 bucket for a file with a given
+// checksum. Objects are keyed by checksum and size, but the size is not
+// known up front. List objects by checksum prefix instead.
+func (fd *fileDownloader) findStoredFile(ctx context.Context, checksum string) (uint64, bool, error) {
+	prefix := checksum + "|"
+	output, err := fd.s3Client.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket:  aws.String("files"),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(1),
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	for _, object := range output.Contents {
+		fileSize, err := strconv.ParseUint(strings.TrimPrefix(*object.Key, prefix), 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("Malformed object key %#v: %s", *object.Key, err)
+		}
+		return fileSize, true, nil
+	}
+	return 0, false, nil
+}
+
+// getOptionalHeader returns the value of a response header, or nil if
+// the header is not present.
+func getOptionalHeader(resp *http.Response, name string) *string {
+	if value := resp.Header.Get(name); value != "" {
+		return &value
+	}
+	return nil
+}
+
+// newFileDownload extracts provenance information from the response
+// returned by an upstream server.
+func newFileDownload(resp *http.Response) *schema.FileDownload {
+	finalUri := resp.Request.URL.String()
+	download := &schema.FileDownload{
+		FinalUri:           &finalUri,
+		LastModified:       getOptionalHeader(resp, "Last-Modified"),
+		Etag:               getOptionalHeader(resp, "ETag"),
+		ContentType:        getOptionalHeader(resp, "Content-Type"),
+		ContentDisposition: getOptionalHeader(resp, "Content-Disposition"),
+		ContentEncoding:    getOptionalHeader(resp, "Content-Encoding"),
+	}
+
+	// Reconstruct the redirect chain by walking back from the final
+	// request to the redirect responses that caused it.
+	for req := resp.Request; req.Response != nil; req = req.Response.Request {
+		download.RedirectChain = append([]string{req.Response.Request.URL.String()}, download.RedirectChain...)
+	}
+
+	if resp.TLS != nil {
+		for _, certificate := range resp.TLS.PeerCertificates {
+			fingerprint := sha256.Sum256(certificate.Raw)
+			download.TlsCertificateFingerprints = append(download.TlsCertificateFingerprints, hex.EncodeToString(fingerprint[:]))
+		}
+	}
+	return download
+}
+
+// newRequest creates a HTTP request for an upstream server. Only the
+// identity encoding is accepted, which also prevents the HTTP client
+// from decoding responses transparently. Servers that still apply a
+// content encoding (e.g., for pre-gzipped files) have their responses
+// stored as returned, so that they can be replayed by the proxy.
+func newRequest(method string, uri string) (*http.Request, error) {
+	req, err := http.NewRequest(method, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+	return req, nil
+}
+
+// fetch downloads the contents of a URI into a local file. Large files
+// are downloaded in parallel chunks if the upstream server supports
+// it. The returned function must be called to release the local file.
+// When called with discard set, any state that would allow a successive
+// run to resume the download is removed as well.
+func (fd *fileDownloader) fetch(ctx context.Context, uri string) (*os.File, func(bool), *schema.FileDownload, error) {
+	// Probe whether the upstream server supports range requests.
+	// Fall back to a single request if this is not the case. Range
+	// requests also require a validator, as chunks could otherwise
+	// be obtained from different versions of the file.
+	req, err := newRequest("HEAD", uri)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	resp, err := fd.httpClient.Do(req.WithContext(ctx))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK &&
+			resp.Header.Get("Accept-Ranges") == "bytes" &&
+			resp.Header.Get("Content-Encoding") == "" &&
+			resp.ContentLength > fd.chunkSize &&
+			getRangeValidator(resp) != "" {
+			file, release, err := fd.fetchRanged(ctx, uri, resp.ContentLength, getRangeValidator(resp))
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			return file, release, newFileDownload(resp), nil
+		}
+	}
+	return fd.fetchPlain(ctx, uri)
+}
+
+// fetchPlain downloads the contents of a URI into a temporary file
+// using a single request.
+func (fd *fileDownloader) fetchPlain(ctx context.Context, uri string) (*os.File, func(bool), *schema.FileDownload, error) {
+	// Create a temporary file for storing the file to be downloaded.
+	tmpfile, err := ioutil.TempFile("", "download")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	release := func(discard bool) {
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
+	}
+
+	// Download and store the file into the temporary file.
+	// TODO(edsch): Place upperbound on the maximum file size.
+	req, err := newRequest("GET", uri)
+	if err != nil {
+		release(true)
+		return nil, nil, nil, err
+	}
+	resp, err := fd.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		release(true)
+		return nil, nil, nil, err
+	}
+	_, err = io.Copy(tmpfile, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		release(true)
+		return nil, nil, nil, err
+	}
+	return tmpfile, release, newFileDownload(resp), nil
+}
+
+// downloadAndStoreFile downloads a file and stores it in the S3 bucket.
+// It returns the checksum and size of the file, together with its
+// provenance.
+func (fd *fileDownloader) downloadAndStoreFile(ctx context.Context, uri string, desiredSha256 *string) (string, uint64, *schema.FileDownload, error) {
+	// Don't download the file if the desired contents are already
+	// present in storage, e.g. because another URI refers to them.
+	if desiredSha256 != nil {
+		fileSize, ok, err := fd.findStoredFile(ctx, *desiredSha256)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		if ok {
+			log.Printf("File with checksum %s already present", *desiredSha256)
+			return *desiredSha256, fileSize, &schema.FileDownload{
+				DownloadedAt:      time.Now(),
+				DownloaderVersion: util.Version,
+			}, nil
+		}
+	}
+
+	file, release, download, err := fd.fetch(ctx, uri)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	download.DownloaderVersion = util.Version
+
+	// Compute file checksum and validate it against what is expected.
+	hasher := sha256.New()
+	if _, err := file.Seek(0, 0); err != nil {
+		release(false)
+		return "", 0, nil, err
+	}
+	fileSize, err := io.Copy(hasher, file)
+	if err != nil {
+		release(false)
+		return "", 0, nil, err
+	}
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	if desiredSha256 != nil && *desiredSha256 != checksum {
+		release(true)
+		return "", 0, nil, fmt.Errorf("Downloaded copy of %s has checksum %s, whereas %s was expected", uri, checksum, *desiredSha256)
+	}
+
+	// Upload file into S3 bucket, unless identical contents have
+	// already been stored before. Retain the local copy if uploading
+	// fails, so that a successive run does not need to download the
+	// file once more.
+	key := fmt.Sprintf("%s|%d", checksum, fileSize)
+	if present, err := util.ObjectExists(ctx, fd.s3Client, "files", key); err != nil {
+		release(false)
+		return "", 0, nil, err
+	} else if present {
+		log.Printf("File with checksum %s already present", checksum)
+		release(true)
+		download.DownloadedAt = time.Now()
+		return checksum, uint64(fileSize), download, nil
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		release(false)
+		return "", 0, nil, err
+	}
+	if _, err := fd.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String("files"),
+		Key:    aws.String(key),
+		Body:   file,
+	}); err != nil {
+		release(false)
+		return "", 0, nil, err
+	}
+	release(true)
+	download.DownloadedAt = time.Now()
+	return checksum, uint64(fileSize), download, nil
+}
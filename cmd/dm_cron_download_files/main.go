@@ -2,85 +2,44 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"flag"
-	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"time"
 
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/credentials"
 	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/upstream"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
+	aws_credentials "github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 )
 
-func downloadAndStoreFile(ctx context.Context, uri string, desiredSha256 *string, uploader *s3manager.Uploader) (string, uint64, error) {
-	// Create a temporary file for storing the file to be downloaded.
-	tmpfile, err := ioutil.TempFile("", "download")
-	if err != nil {
-		return "", 0, err
-	}
-	defer tmpfile.Close()
-	defer os.Remove(tmpfile.Name())
-
-	// Download and store the file into the temporary file.
-	// TODO(edsch): Place upperbound on the maximum file size.
-	req, err := http.NewRequest("GET", uri, nil)
-	if err != nil {
-		return "", 0, err
-	}
-	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
-	if err != nil {
-		return "", 0, err
-	}
-	fileSize, err := io.Copy(tmpfile, resp.Body)
-	resp.Body.Close()
-	if err != nil {
-		return "", 0, err
-	}
-
-	// Compute file checksum and validate it against what is expected.
-	hasher := sha256.New()
-	if _, err := tmpfile.Seek(0, 0); err != nil {
-		return "", 0, err
-	}
-	if _, err := io.Copy(hasher, tmpfile); err != nil {
-		return "", 0, err
-	}
-	checksum := hex.EncodeToString(hasher.Sum(nil))
-	if desiredSha256 != nil && *desiredSha256 != checksum {
-		return "", 0, fmt.Errorf("Downloaded copy of %s has checksum %s, whereas %s was expected", uri, checksum, *desiredSha256)
-	}
-
-	// Upload file into S3 bucket.
-	if _, err := tmpfile.Seek(0, 0); err != nil {
-		return "", 0, err
-	}
-	_, err = uploader.UploadWithContext(ctx, &s3manager.UploadInput{
-		Bucket: aws.String("files"),
-		Key:    aws.String(fmt.Sprintf("%s|%d", checksum, fileSize)),
-		Body:   tmpfile,
-	})
-	return checksum, uint64(fileSize), err
-}
-
 func main() {
 	var (
+		credentialsFileCredentials = flag.String("credentials.file-credentials", "", "Path of a JSON file holding credentials, request headers and TLS client certificates to use for upstream servers")
+		credentialsNetrc           = flag.String("credentials.netrc", "", "Path of a netrc file holding credentials to use for upstream servers")
+
 		dbAddress = flag.String("db.address", "", "Database server address.")
 
+		downloadChunkSize      = flag.Int64("download.chunk-size", 64*1024*1024, "Size of the chunks in which large files are downloaded, in bytes")
+		downloadParallelism    = flag.Int("download.parallelism", 4, "Number of chunks of a single file that are downloaded in parallel")
+		downloadStateDirectory = flag.String("download.state-directory", filepath.Join(os.TempDir(), "dm_cron_download_files"), "Directory holding partially downloaded files, allowing downloads to be resumed by successive runs")
+		downloadTimeout        = flag.Duration("download.timeout", time.Hour, "Maximum duration of a single download, for files that have no timeout configured")
+
 		s3AccessKeyId     = flag.String("s3.access-key-id", "", "Access key of the S3 bucket holding distfiles")
 		s3DisableSsl      = flag.Bool("s3.disable-ssl", false, "Whether SSL should be disabled for the S3 bucket holding distfiles")
 		s3Endpoint        = flag.String("s3.endpoint", "", "Endpoint URL of the S3 bucket holding distfiles")
 		s3Region          = flag.String("s3.region", "", "Region of the S3 bucket holding distfiles")
 		s3SecretAccessKey = flag.String("s3.secret-access-key", "", "Secret access key of the S3 bucket holding distfiles")
+
+		upstreamFlags = upstream.RegisterFlags()
 	)
 	flag.Parse()
 
@@ -92,14 +51,34 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Add credentials to requests for upstream servers that
+	// require authentication.
+	destinationPolicy, err := upstreamFlags.NewDestinationPolicy()
+	if err != nil {
+		log.Fatal(err)
+	}
+	transportFactory, err := upstreamFlags.NewTransportFactory(destinationPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fileCredentials, err := credentials.LoadFileCredentials(*credentialsFileCredentials, *credentialsNetrc)
+	if err != nil {
+		log.Fatal(err)
+	}
+	httpClient := &http.Client{
+		Transport: fileCredentials.RoundTripper(transportFactory.NewTransport),
+	}
+
 	s3Session := session.New(&aws.Config{
-		Credentials:      credentials.NewStaticCredentials(*s3AccessKeyId, *s3SecretAccessKey, ""),
+		Credentials:      aws_credentials.NewStaticCredentials(*s3AccessKeyId, *s3SecretAccessKey, ""),
 		Endpoint:         s3Endpoint,
 		Region:           s3Region,
 		DisableSSL:       s3DisableSsl,
 		S3ForcePathStyle: aws.Bool(true),
 	})
-	s3Uploader := s3manager.NewUploader(s3Session)
+	s3Client := s3.New(s3Session)
+	s3Uploader := s3manager.NewUploaderWithClient(s3Client)
+	downloader := newFileDownloader(httpClient, s3Client, s3Uploader, *downloadStateDirectory, *downloadChunkSize, *downloadParallelism)
 
 	var files []schema.File
 	if r := db.Where("present = false").Find(&files); r.Error != nil {
@@ -110,23 +89,48 @@ func main() {
 	for _, file := range files {
 		log.Printf("Downloading %s", file.Uri)
 
-		// TODO(edsch): Make timeout configurable.
-		ctx, cancel := context.WithTimeout(ctx, time.Hour)
-		checksum, fileSize, err := downloadAndStoreFile(ctx, file.Uri, file.Sha256, s3Uploader)
+		timeout := *downloadTimeout
+		if file.DownloadTimeoutSeconds != nil {
+			timeout = time.Duration(*file.DownloadTimeoutSeconds) * time.Second
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		checksum, fileSize, download, err := downloader.downloadAndStoreFile(ctx, file.Uri, file.Sha256)
 		cancel()
 		if err != nil {
 			log.Printf("Failed to download and store: %s", err)
 			continue
 		}
 
-		// Update database entry to prevent successive download.
-		if r := db.Model(&schema.File{}).Where("id = ?", file.Id).Updates(schema.File{
-			Sha256:  &checksum,
-			Size:    &fileSize,
-			Present: true,
-		}); r.Error != nil {
+		// Record the provenance of the file and update database
+		// entry to prevent successive download.
+		download.FileId = file.Id
+		tx := db.Begin()
+		if r := tx.Create(download); r.Error != nil {
+			tx.Rollback()
+			log.Printf("Failed to create file download entry in database: %s", r.Error)
+			continue
+		}
+		attributes := map[string]interface{}{
+			"sha256":  checksum,
+			"size":    fileSize,
+			"present": true,
+		}
+		if download.FinalUri != nil {
+			// Only replace the response headers that are
+			// replayed by the proxy if the file was actually
+			// downloaded.
+			attributes["content_type"] = download.ContentType
+			attributes["content_disposition"] = download.ContentDisposition
+			attributes["content_encoding"] = download.ContentEncoding
+		}
+		if r := tx.Model(&schema.File{}).Where("id = ?", file.Id).Updates(attributes); r.Error != nil {
+			tx.Rollback()
 			log.Printf("Failed to update file entry in database: %s", r.Error)
 			continue
 		}
+		if r := tx.Commit(); r.Error != nil {
+			log.Printf("Failed to commit file entry in database: %s", r.Error)
+			continue
+		}
 	}
 }
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of times the download of a single chunk is attempted
+	// before giving up on the file for the current run.
+	chunkAttempts = 3
+)
+
+// errUpstreamChanged is returned when the upstream server no longer
+// serves the version of the file whose chunks were downloaded before.
+var errUpstreamChanged = errors.New("Upstream file changed while being downloaded")
+
+// rangedDownloadState is stored next to a file that is downloaded in
+// chunks using HTTP range requests. It records which chunks have been
+// downloaded, so that an interrupted download can be resumed by a
+// successive run.
+type rangedDownloadState struct {
+	Uri             string `json:"uri"`
+	Size            int64  `json:"size"`
+	Validator       string `json:"validator"`
+	ChunkSize       int64  `json:"chunk_size"`
+	CompletedChunks []bool `json:"completed_chunks"`
+}
+
+// getRangeValidator returns a value that may be provided to an
+// If-Range header to ensure that byte ranges are only returned if the
+// file is identical to the one described by a response. Only strong
+// entity tags may be used for this purpose.
+func getRangeValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// parseContentRange parses the value of a Content-Range header of a
+// 206 response, returning the first and last byte of the range and the
+// size of the file.
+func parseContentRange(contentRange string) (int64, int64, int64, error) {
+	invalid := fmt.Errorf("Invalid Content-Range %#v", contentRange)
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		return 0, 0, 0, invalid
+	}
+	byteRange := strings.TrimPrefix(contentRange, "bytes ")
+	slash := strings.IndexByte(byteRange, '/')
+	if slash < 0 {
+		return 0, 0, 0, invalid
+	}
+	dash := strings.IndexByte(byteRange[:slash], '-')
+	if dash < 0 {
+		return 0, 0, 0, invalid
+	}
+	var values [3]int64
+	for i, field := range []string{byteRange[:dash], byteRange[dash+1 : slash], byteRange[slash+1:]} {
+		value, err := strconv.ParseUint(field, 10, 63)
+		if err != nil {
+			return 0, 0, 0, invalid
+		}
+		values[i] = int64(value)
+	}
+	if values[0] > values[1] || values[1] >= values[2] {
+		return 0, 0, 0, invalid
+	}
+	return values[0], values[1], values[2], nil
+}
+
+// offsetWriter is an io.Writer that writes into a file at a given
+// offset, so that chunks can be written into the file concurrently.
+type offsetWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+// fetchChunk downloads a single byte range of a file. The range
+// returned by the server must match the one requested, and must be part
+// of a file of the expected size.
+func (fd *fileDownloader) fetchChunk(ctx context.Context, uri string, size int64, validator string, file *os.File, offset int64, length int64) error {
+	req, err := newRequest("GET", uri)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	if validator != "" {
+		req.Header.Set("If-Range", validator)
+	}
+	resp, err := fd.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		// The server ignored the byte range, meaning that the
+		// If-Range condition no longer holds.
+		return errUpstreamChanged
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("Byte range %d-%d returned %s", offset, offset+length-1, resp.Status)
+	}
+	first, last, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return fmt.Errorf("Byte range %d-%d: %s", offset, offset+length-1, err)
+	}
+	if first != offset || last != offset+length-1 || total != size {
+		return fmt.Errorf("Byte range %d-%d of a file of %d bytes returned byte range %d-%d of a file of %d bytes", offset, offset+length-1, size, first, last, total)
+	}
+	copiedSize, err := io.Copy(&offsetWriter{file: file, offset: offset}, io.LimitReader(resp.Body, length))
+	if err != nil {
+		return err
+	}
+	if copiedSize != length {
+		return fmt.Errorf("Byte range %d-%d returned %d bytes, whereas %d were expected", offset, offset+length-1, copiedSize, length)
+	}
+	return file.Sync()
+}
+
+// fetchChunkWithRetries downloads a single byte range of a file,
+// retrying it if transient errors occur.
+func (fd *fileDownloader) fetchChunkWithRetries(ctx context.Context, uri string, size int64, validator string, file *os.File, offset int64, length int64) error {
+	var err error
+	for attempt := 1; attempt <= chunkAttempts; attempt++ {
+		err = fd.fetchChunk(ctx, uri, size, validator, file, offset, length)
+		if err == nil || err == errUpstreamChanged || ctx.Err() != nil {
+			return err
+		}
+		log.Printf("Attempt %d to download byte range %d-%d of %s failed: %s", attempt, offset, offset+length-1, uri, err)
+		select {
+		case <-time.After(time.Duration(attempt) * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// fetchRanged downloads the contents of a URI into a file in the state
+// directory, using parallel HTTP range requests. Chunks that have been
+// downloaded successfully are recorded, so that they don't need to be
+// downloaded again if the download gets interrupted.
+func (fd *fileDownloader) fetchRanged(ctx context.Context, uri string, size int64, validator string) (*os.File, func(bool), error) {
+	if err := os.MkdirAll(fd.stateDirectory, 0777); err != nil {
+		return nil, nil, err
+	}
+	name := filepath.Join(fd.stateDirectory, fmt.Sprintf("%x", sha256.Sum256([]byte(uri))))
+	dataPath, statePath := name+".data", name+".json"
+	file, err := os.OpenFile(dataPath, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+	release := func(discard bool) {
+		file.Close()
+		if discard {
+			os.Remove(dataPath)
+			os.Remove(statePath)
+		}
+	}
+
+	// Resume a previous download, but only if it is known that the
+	// upstream file has not changed in the meantime.
+	state := rangedDownloadState{
+		Uri:             uri,
+		Size:            size,
+		Validator:       validator,
+		ChunkSize:       fd.chunkSize,
+		CompletedChunks: make([]bool, (size+fd.chunkSize-1)/fd.chunkSize),
+	}
+	if contents, err := ioutil.ReadFile(statePath); err == nil && validator != "" {
+		var previousState rangedDownloadState
+		if err := json.Unmarshal(contents, &previousState); err == nil &&
+			previousState.Uri == state.Uri &&
+			previousState.Size == state.Size &&
+			previousState.Validator == state.Validator &&
+			previousState.ChunkSize == state.ChunkSize &&
+			len(previousState.CompletedChunks) == len(state.CompletedChunks) {
+			log.Printf("Resuming previous download of %s", uri)
+			state = previousState
+		}
+	}
+	if err := file.Truncate(size); err != nil {
+		release(true)
+		return nil, nil, err
+	}
+
+	// Download all missing chunks in parallel. Persist the state
+	// after every chunk. Write it into a temporary file first, so
+	// that it never gets corrupted when interrupted.
+	var stateLock sync.Mutex
+	saveState := func() error {
+		contents, err := json.Marshal(&state)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(statePath+".tmp", contents, 0666); err != nil {
+			return err
+		}
+		return os.Rename(statePath+".tmp", statePath)
+	}
+
+	workerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	chunks := make(chan int)
+	errs := make(chan error, fd.parallelism)
+	var wg sync.WaitGroup
+	for i := 0; i < fd.parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range chunks {
+				offset := int64(chunk) * fd.chunkSize
+				length := fd.chunkSize
+				if offset+length > size {
+					length = size - offset
+				}
+				err := fd.fetchChunkWithRetries(workerCtx, uri, size, validator, file, offset, length)
+				if err == nil {
+					stateLock.Lock()
+					state.CompletedChunks[chunk] = true
+					err = saveState()
+					stateLock.Unlock()
+				}
+				if err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+ScheduleChunks:
+	for chunk, completed := range state.CompletedChunks {
+		if !completed {
+			select {
+			case chunks <- chunk:
+			case <-workerCtx.Done():
+				break ScheduleChunks
+			}
+		}
+	}
+	close(chunks)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		release(err == errUpstreamChanged)
+		return nil, nil, err
+	default:
+	}
+	if err := ctx.Err(); err != nil {
+		release(false)
+		return nil, nil, err
+	}
+	return file, release, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseContentRange(t *testing.T) {
+	first, last, total, err := parseContentRange("bytes 1048576-2097151/5000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != 1048576 || last != 2097151 || total != 5000000 {
+		t.Errorf("Got range %d-%d/%d", first, last, total)
+	}
+
+	for _, contentRange := range []string{
+		"",
+		"bytes",
+		"bytes 0-99",
+		"bytes 0-99/*",
+		"bytes */100",
+		"bytes 0/99-100",
+		"bytes -0-99/100",
+		"bytes 0--99/100",
+		"bytes +0-99/100",
+		"bytes 0-99/100/100",
+		"bytes 99-0/100",
+		"bytes 0-100/100",
+		"bytes 0-99/99999999999999999999",
+		"items 0-99/100",
+	} {
+		t.Run(contentRange, func(t *testing.T) {
+			if _, _, _, err := parseContentRange(contentRange); err == nil {
+				t.Error("Invalid Content-Range was accepted")
+			}
+		})
+	}
+}
+
+func testFetch(t *testing.T, handler http.Handler) ([]byte, error) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	stateDirectory, err := ioutil.TempDir("", "ranged_download_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDirectory)
+
+	fd := newFileDownloader(server.Client(), nil, nil, stateDirectory, 1000, 2)
+	file, release, _, err := fd.fetch(context.Background(), server.URL+"/file")
+	if err != nil {
+		return nil, err
+	}
+	defer release(true)
+	if _, err := file.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents, nil
+}
+
+func TestFetchRanged(t *testing.T) {
+	expected := bytes.Repeat([]byte("0123456789"), 550)
+	var rangeRequests int32
+	contents, err := testFetch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt32(&rangeRequests, 1)
+		}
+		http.ServeContent(w, r, "file", time.Unix(1600000000, 0), bytes.NewReader(expected))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(contents, expected) {
+		t.Error("Downloaded file has different contents")
+	}
+	if rangeRequests != 6 {
+		t.Errorf("Got %d range requests, expected 6", rangeRequests)
+	}
+}
+
+func TestFetchWithoutValidator(t *testing.T) {
+	// Files without an entity tag or modification time are
+	// downloaded using a single request.
+	expected := bytes.Repeat([]byte("0123456789"), 550)
+	contents, err := testFetch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			t.Error("Range request was performed")
+		}
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(expected))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(contents, expected) {
+		t.Error("Downloaded file has different contents")
+	}
+}
+
+func TestFetchRangedContentRangeMismatch(t *testing.T) {
+	// Servers returning a different byte range than requested
+	// cause the download to fail.
+	for name, getContentRange := range map[string]func(requested string) string{
+		"WrongOffset": func(requested string) string { return "bytes 0-999/5500" },
+		"WrongSize":   func(requested string) string { return "bytes " + requested + "/6000" },
+		"Missing":     func(requested string) string { return "" },
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := testFetch(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Accept-Ranges", "bytes")
+				w.Header().Set("ETag", "\"v1\"")
+				byteRange := r.Header.Get("Range")
+				if byteRange == "" {
+					w.Header().Set("Content-Length", "5500")
+					return
+				}
+				if contentRange := getContentRange(strings.TrimPrefix(byteRange, "bytes=")); contentRange != "" {
+					w.Header().Set("Content-Range", contentRange)
+				}
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(make([]byte, 1000))
+			}))
+			if err == nil {
+				t.Error("Mismatching byte range was accepted")
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/credentials"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/registryclient"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/tagwatch"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/upstream"
+	"github.com/docker/distribution"
+	_ "github.com/docker/distribution/manifest/manifestlist"
+	_ "github.com/docker/distribution/manifest/ocischema"
+	_ "github.com/docker/distribution/manifest/schema1"
+	_ "github.com/docker/distribution/manifest/schema2"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+)
+
+// watchRepository lists the tags of a repository and creates proposals
+// for the images referred to by tags matching any of the rules that
+// are neither mirrored nor proposed yet.
+func watchRepository(ctx context.Context, db *gorm.DB, repository distribution.Repository, containerRepository *schema.ContainerRepository, rules []*tagwatch.Rule) error {
+	tagService := repository.Tags(ctx)
+	tags, err := tagService.All(ctx)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		matched := false
+		for _, rule := range rules {
+			if rule.Matches(tag) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		// Obtain the digest through a HEAD request, as that
+		// doesn't count towards the rate limits of some
+		// registries. The digest is validated by the downloader
+		// once the proposal is approved.
+		descriptor, err := tagService.Get(ctx, tag)
+		if err != nil {
+			log.Printf("Failed to resolve tag %s: %s", tag, err)
+			continue
+		}
+		if descriptor.Digest == "" {
+			log.Printf("Registry did not return a digest for tag %s", tag)
+			continue
+		}
+		digest := string(descriptor.Digest)
+
+		var count int
+		if r := db.Model(&schema.ContainerImage{}).Where("repository_id = ? AND digest = ?", containerRepository.Id, digest).Count(&count); r.Error != nil {
+			return r.Error
+		}
+		if count > 0 {
+			continue
+		}
+		proposal := schema.ContainerImageProposal{
+			RepositoryId: containerRepository.Id,
+			Tag:          tag,
+			Digest:       digest,
+		}
+		if r := db.Where(proposal).Attrs(schema.ContainerImageProposal{DiscoveredAt: time.Now()}).FirstOrCreate(&proposal); r.Error != nil {
+			return r.Error
+		}
+		if !proposal.Dismissed {
+			log.Printf("Tag %s refers to %s, which is not mirrored", tag, digest)
+		}
+	}
+	return nil
+}
+
+func main() {
+	var (
+		credentialsDockerConfig      = flag.String("credentials.docker-config", "", "Path of a Docker config.json file holding container registry credentials")
+		credentialsEncryptionKeyFile = flag.String("credentials.encryption-key-file", "", "Path of a file holding the hex encoded AES-256 key used to encrypt container registry credentials stored in the database")
+
+		dbAddress = flag.String("db.address", "", "Database server address.")
+
+		upstreamFlags = upstream.RegisterFlags()
+
+		watchTimeout = flag.Duration("watch.timeout", 10*time.Minute, "Maximum duration of watching the tags of a single repository")
+	)
+	flag.Parse()
+
+	db, err := gorm.Open("postgres", *dbAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	destinationPolicy, err := upstreamFlags.NewDestinationPolicy()
+	if err != nil {
+		log.Fatal(err)
+	}
+	transportFactory, err := upstreamFlags.NewTransportFactory(destinationPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	upstreamTransport := transportFactory.NewTransport(nil)
+
+	var dockerConfig *credentials.DockerConfig
+	if *credentialsDockerConfig != "" {
+		dockerConfig, err = credentials.LoadDockerConfigFile(*credentialsDockerConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var credentialsCipher *credentials.Cipher
+	if *credentialsEncryptionKeyFile != "" {
+		credentialsCipher, err = credentials.NewCipherFromKeyFile(*credentialsEncryptionKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Group watch rules by repository, so that the tags of every
+	// repository only need to be listed once.
+	var watchRules []schema.ContainerWatchRule
+	if r := db.Find(&watchRules); r.Error != nil {
+		log.Fatal(r.Error)
+	}
+	rulesByRepository := map[string][]*tagwatch.Rule{}
+	for _, watchRule := range watchRules {
+		rule, err := tagwatch.NewRule(&watchRule)
+		if err != nil {
+			log.Printf("Invalid watch rule %s: %s", watchRule.Id, err)
+			continue
+		}
+		rulesByRepository[watchRule.RepositoryId] = append(rulesByRepository[watchRule.RepositoryId], rule)
+	}
+
+	ctx := context.Background()
+	for repositoryId, rules := range rulesByRepository {
+		var containerRepository schema.ContainerRepository
+		if r := db.Where("id = ?", repositoryId).Take(&containerRepository); r.Error != nil {
+			log.Printf("Failed to get container repository %s: %s", repositoryId, r.Error)
+			continue
+		}
+		var containerRegistry schema.ContainerRegistry
+		if r := db.Where("id = ?", containerRepository.RegistryId).Take(&containerRegistry); r.Error != nil {
+			log.Printf("Failed to get container registry %s: %s", containerRepository.RegistryId, r.Error)
+			continue
+		}
+		creds, err := credentials.NewRegistryCredentialStore(db, credentialsCipher, dockerConfig, &containerRegistry)
+		if err != nil {
+			log.Printf("Failed to get credentials for container registry %s: %s", containerRegistry.Uri, err)
+			continue
+		}
+		log.Printf("Watching %s %s", containerRegistry.Uri, containerRepository.RepositoryName)
+
+		repository, err := registryclient.NewRepository(containerRegistry.Uri, containerRepository.RepositoryName, upstreamTransport, creds)
+		if err != nil {
+			log.Printf("Failed to create repository client: %s", err)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(ctx, *watchTimeout)
+		err = watchRepository(ctx, db, repository, &containerRepository, rules)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to watch tags: %s", err)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/references"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/docker/distribution"
+	"github.com/jinzhu/gorm"
+)
+
+// markFunc computes the set of keys of objects in a bucket that are
+// referenced by the database. It returns a function that can be used
+// to test whether a key is referenced.
+type markFunc func(database *gorm.DB) (func(key string) bool, error)
+
+// markFiles computes the set of objects in the "files" bucket that are
+// referenced. Next to the objects of files that are present, objects
+// whose checksum matches the one desired by a file that is not yet
+// downloaded are retained. The downloader reuses these objects without
+// downloading them again.
+func markFiles(database *gorm.DB) (func(key string) bool, error) {
+	fileReferences, err := references.GetFileReferences(database)
+	if err != nil {
+		return nil, err
+	}
+	var files []schema.File
+	if r := database.Where("present = false AND sha256 IS NOT NULL").Find(&files); r.Error != nil {
+		return nil, r.Error
+	}
+	desiredChecksums := map[string]bool{}
+	for _, file := range files {
+		desiredChecksums[*file.Sha256] = true
+	}
+	return func(key string) bool {
+		if _, ok := fileReferences[key]; ok {
+			return true
+		}
+		checksum := strings.SplitN(key, "|", 2)[0]
+		return desiredChecksums[checksum]
+	}, nil
+}
+
+// markContainerBlobs computes the set of objects in the
+// "container-blobs" bucket that are referenced by the manifests of
+// container images. This includes pushed manifests that are held back
+// until they are signed.
+func markContainerBlobs(database *gorm.DB) (func(key string) bool, error) {
+	containerBlobReferences, err := references.GetContainerBlobReferences(database)
+	if err != nil {
+		return nil, err
+	}
+	var pendingImages []schema.ContainerImage
+	if r := database.Where("pending_manifest IS NOT NULL").Find(&pendingImages); r.Error != nil {
+		return nil, r.Error
+	}
+	pendingReferences := map[string]bool{}
+	for _, image := range pendingImages {
+		manifest, _, err := distribution.UnmarshalManifest(*image.PendingManifestMediatype, *image.PendingManifest)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse pending manifest of container image %s: %s", image.Digest, err)
+		}
+		for _, descriptor := range manifest.References() {
+			pendingReferences[string(descriptor.Digest)] = true
+		}
+	}
+	return func(key string) bool {
+		_, ok := containerBlobReferences[key]
+		return ok || pendingReferences[key]
+	}, nil
+}
+
+// markContainerUploads computes the set of objects in the
+// "container-uploads" bucket that hold chunks of uploads that are
+// still in progress.
+func markContainerUploads(database *gorm.DB) (func(key string) bool, error) {
+	var uploads []schema.ContainerBlobUpload
+	if r := database.Select("id").Find(&uploads); r.Error != nil {
+		return nil, r.Error
+	}
+	uploadIds := map[string]bool{}
+	for _, upload := range uploads {
+		uploadIds[upload.Id] = true
+	}
+	return func(key string) bool {
+		return uploadIds[strings.SplitN(key, "/", 2)[0]]
+	}, nil
+}
+
+// garbageCollector removes objects from storage that are no longer
+// referenced by the database, using mark and sweep.
+type garbageCollector struct {
+	database    *gorm.DB
+	s3Client    *s3.S3
+	gracePeriod time.Duration
+	dryRun      bool
+}
+
+func newGarbageCollector(database *gorm.DB, s3Client *s3.S3, gracePeriod time.Duration, dryRun bool) *garbageCollector {
+	return &garbageCollector{
+		database:    database,
+		s3Client:    s3Client,
+		gracePeriod: gracePeriod,
+		dryRun:      dryRun,
+	}
+}
+
+// collectBucket removes all unreferenced objects from a bucket.
+//
+// Objects that have been modified during the grace period are never
+// removed, as they may have been uploaded by a downloader that has not
+// yet stored the corresponding entry in the database. The set of
+// referenced objects is computed once more right before removal, so
+// that objects that have become referenced while listing the bucket
+// are retained.
+func (gc *garbageCollector) collectBucket(ctx context.Context, bucket string, mark markFunc) error {
+	isReferenced, err := mark(gc.database)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-gc.gracePeriod)
+	var candidates []*s3.Object
+	if err := gc.s3Client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+	}, func(output *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range output.Contents {
+			if !isReferenced(*object.Key) && object.LastModified.Before(cutoff) {
+				candidates = append(candidates, object)
+			}
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+
+	isReferenced, err = mark(gc.database)
+	if err != nil {
+		return err
+	}
+	var count, size int64
+	for _, object := range candidates {
+		if isReferenced(*object.Key) {
+			continue
+		}
+		if gc.dryRun {
+			log.Printf("Would remove %s %s (%d bytes, last modified %s)", bucket, *object.Key, *object.Size, object.LastModified.UTC())
+		} else {
+			log.Printf("Removing %s %s (%d bytes, last modified %s)", bucket, *object.Key, *object.Size, object.LastModified.UTC())
+			if _, err := gc.s3Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    object.Key,
+			}); err != nil {
+				return err
+			}
+		}
+		count++
+		size += *object.Size
+	}
+	if gc.dryRun {
+		log.Printf("Would remove %d unreferenced objects from %s, totalling %d bytes", count, bucket, size)
+	} else {
+		log.Printf("Removed %d unreferenced objects from %s, totalling %d bytes", count, bucket, size)
+	}
+	return nil
+}
+
+// collectPendingImages removes images that were pushed into a
+// repository with a signature policy before the grace period, but
+// for which no accepted signatures were pushed.
+func (gc *garbageCollector) collectPendingImages() error {
+	cutoff := time.Now().Add(-gc.gracePeriod)
+	if gc.dryRun {
+		var count int64
+		if r := gc.database.Model(&schema.ContainerImage{}).Where("pending_manifest IS NOT NULL AND pushed_at < ?", cutoff).Count(&count); r.Error != nil {
+			return r.Error
+		}
+		log.Printf("Would remove %d unsigned pushed container images", count)
+		return nil
+	}
+
+	// Rows referring to the images need to be removed first, as
+	// their foreign keys don't cascade.
+	tx := gc.database.Begin()
+	for _, dependent := range []interface{}{
+		&schema.ContainerImageLabel{},
+		&schema.ContainerImagePackage{},
+		&schema.DriftCheck{},
+	} {
+		if r := tx.Where("container_image_id IN (SELECT id FROM container_images WHERE pending_manifest IS NOT NULL AND pushed_at < ?)", cutoff).Delete(dependent); r.Error != nil {
+			tx.Rollback()
+			return r.Error
+		}
+	}
+	r := tx.Where("pending_manifest IS NOT NULL AND pushed_at < ?", cutoff).Delete(&schema.ContainerImage{})
+	if r.Error != nil {
+		tx.Rollback()
+		return r.Error
+	}
+	if r := tx.Commit(); r.Error != nil {
+		return r.Error
+	}
+	log.Printf("Removed %d unsigned pushed container images", r.RowsAffected)
+	return nil
+}
+
+// collectUploads removes uploads of container image blobs that were
+// started before the grace period, as clients have likely abandoned
+// them. Their chunks are removed by collecting the "container-uploads"
+// bucket afterwards.
+func (gc *garbageCollector) collectUploads() error {
+	cutoff := time.Now().Add(-gc.gracePeriod)
+	if gc.dryRun {
+		var count int64
+		if r := gc.database.Model(&schema.ContainerBlobUpload{}).Where("started_at < ?", cutoff).Count(&count); r.Error != nil {
+			return r.Error
+		}
+		log.Printf("Would remove %d abandoned container blob uploads", count)
+		return nil
+	}
+	r := gc.database.Where("started_at < ?", cutoff).Delete(&schema.ContainerBlobUpload{})
+	if r.Error != nil {
+		return r.Error
+	}
+	log.Printf("Removed %d abandoned container blob uploads", r.RowsAffected)
+	return nil
+}
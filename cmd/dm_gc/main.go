@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	aws_credentials "github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+)
+
+func main() {
+	var (
+		dbAddress = flag.String("db.address", "", "Database server address.")
+
+		gcDryRun      = flag.Bool("gc.dry-run", false, "Only report which objects would be removed")
+		gcGracePeriod = flag.Duration("gc.grace-period", 24*time.Hour, "Minimum age of objects that may be removed. Should exceed the duration of the longest download")
+
+		s3AccessKeyId     = flag.String("s3.access-key-id", "", "Access key of the S3 bucket holding distfiles")
+		s3DisableSsl      = flag.Bool("s3.disable-ssl", false, "Whether SSL should be disabled for the S3 bucket holding distfiles")
+		s3Endpoint        = flag.String("s3.endpoint", "", "Endpoint URL of the S3 bucket holding distfiles")
+		s3Region          = flag.String("s3.region", "", "Region of the S3 bucket holding distfiles")
+		s3SecretAccessKey = flag.String("s3.secret-access-key", "", "Secret access key of the S3 bucket holding distfiles")
+	)
+	flag.Parse()
+
+	db, err := gorm.Open("postgres", *dbAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s3Session := session.New(&aws.Config{
+		Credentials:      aws_credentials.NewStaticCredentials(*s3AccessKeyId, *s3SecretAccessKey, ""),
+		Endpoint:         s3Endpoint,
+		Region:           s3Region,
+		DisableSSL:       s3DisableSsl,
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	s3Client := s3.New(s3Session)
+
+	gc := newGarbageCollector(db, s3Client, *gcGracePeriod, *gcDryRun)
+	ctx := context.Background()
+	if err := gc.collectBucket(ctx, "files", markFiles); err != nil {
+		log.Fatal(err)
+	}
+	if err := gc.collectPendingImages(); err != nil {
+		log.Fatal(err)
+	}
+	if err := gc.collectBucket(ctx, "container-blobs", markContainerBlobs); err != nil {
+		log.Fatal(err)
+	}
+	if err := gc.collectUploads(); err != nil {
+		log.Fatal(err)
+	}
+	if err := gc.collectBucket(ctx, "container-uploads", markContainerUploads); err != nil {
+		log.Fatal(err)
+	}
+}
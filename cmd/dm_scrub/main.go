@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/credentials"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/references"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/upstream"
+	"github.com/aws/aws-sdk-go/aws"
+	aws_credentials "github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+)
+
+func main() {
+	var (
+		credentialsDockerConfig      = flag.String("credentials.docker-config", "", "Path of a Docker config.json file holding container registry credentials")
+		credentialsEncryptionKeyFile = flag.String("credentials.encryption-key-file", "", "Path of a file holding the hex encoded AES-256 key used to encrypt container registry credentials stored in the database")
+		credentialsFileCredentials   = flag.String("credentials.file-credentials", "", "Path of a JSON file holding credentials, request headers and TLS client certificates to use for upstream servers")
+		credentialsNetrc             = flag.String("credentials.netrc", "", "Path of a netrc file holding credentials to use for upstream servers")
+
+		dbAddress = flag.String("db.address", "", "Database server address.")
+
+		s3AccessKeyId     = flag.String("s3.access-key-id", "", "Access key of the S3 bucket holding distfiles")
+		s3DisableSsl      = flag.Bool("s3.disable-ssl", false, "Whether SSL should be disabled for the S3 bucket holding distfiles")
+		s3Endpoint        = flag.String("s3.endpoint", "", "Endpoint URL of the S3 bucket holding distfiles")
+		s3Region          = flag.String("s3.region", "", "Region of the S3 bucket holding distfiles")
+		s3SecretAccessKey = flag.String("s3.secret-access-key", "", "Secret access key of the S3 bucket holding distfiles")
+
+		scrubRepair        = flag.Bool("scrub.repair", false, "Restore missing and corrupt objects, if the upstream server still serves identical contents")
+		scrubRepairTimeout = flag.Duration("scrub.repair-timeout", time.Hour, "Maximum duration of restoring a single object")
+
+		upstreamFlags = upstream.RegisterFlags()
+	)
+	flag.Parse()
+
+	// The container image lacks a functioning temporary directory by default.
+	os.Mkdir("/tmp", 0777)
+
+	db, err := gorm.Open("postgres", *dbAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s3Session := session.New(&aws.Config{
+		Credentials:      aws_credentials.NewStaticCredentials(*s3AccessKeyId, *s3SecretAccessKey, ""),
+		Endpoint:         s3Endpoint,
+		Region:           s3Region,
+		DisableSSL:       s3DisableSsl,
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	s3Client := s3.New(s3Session)
+
+	var blobRepairer *repairer
+	if *scrubRepair {
+		destinationPolicy, err := upstreamFlags.NewDestinationPolicy()
+		if err != nil {
+			log.Fatal(err)
+		}
+		transportFactory, err := upstreamFlags.NewTransportFactory(destinationPolicy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileCredentials, err := credentials.LoadFileCredentials(*credentialsFileCredentials, *credentialsNetrc)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var dockerConfig *credentials.DockerConfig
+		if *credentialsDockerConfig != "" {
+			dockerConfig, err = credentials.LoadDockerConfigFile(*credentialsDockerConfig)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		var credentialsCipher *credentials.Cipher
+		if *credentialsEncryptionKeyFile != "" {
+			credentialsCipher, err = credentials.NewCipherFromKeyFile(*credentialsEncryptionKeyFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		blobRepairer = newRepairer(
+			db,
+			s3manager.NewUploaderWithClient(s3Client),
+			&http.Client{
+				Transport: fileCredentials.RoundTripper(transportFactory.NewTransport),
+			},
+			transportFactory.NewTransport(nil),
+			credentialsCipher,
+			dockerConfig)
+	}
+
+	blobScrubber, err := newScrubber(db, s3Client)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// Scrub files.
+	fileReferences, err := references.GetFileReferences(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	referencedKeys := map[string]bool{}
+	for key := range fileReferences {
+		referencedKeys[key] = true
+	}
+	damagedKeys, err := blobScrubber.scrubBucket(ctx, "files", referencedKeys, verifyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if blobRepairer != nil {
+		for _, key := range damagedKeys {
+			if files, ok := fileReferences[key]; ok {
+				ctx, cancel := context.WithTimeout(ctx, *scrubRepairTimeout)
+				err := blobRepairer.repairFile(ctx, key, files)
+				cancel()
+				if err != nil {
+					log.Printf("Failed to restore files %s: %s", key, err)
+					continue
+				}
+				blobScrubber.clearFinding("files", key)
+			}
+		}
+	}
+
+	// Scrub container blobs.
+	containerBlobReferences, err := references.GetContainerBlobReferences(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	referencedKeys = map[string]bool{}
+	for key := range containerBlobReferences {
+		referencedKeys[key] = true
+	}
+	damagedKeys, err = blobScrubber.scrubBucket(ctx, "container-blobs", referencedKeys, verifyContainerBlob)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if blobRepairer != nil {
+		for _, key := range damagedKeys {
+			if images, ok := containerBlobReferences[key]; ok {
+				ctx, cancel := context.WithTimeout(ctx, *scrubRepairTimeout)
+				err := blobRepairer.repairContainerBlob(ctx, key, images)
+				cancel()
+				if err != nil {
+					log.Printf("Failed to restore container-blobs %s: %s", key, err)
+					continue
+				}
+				blobScrubber.clearFinding("container-blobs", key)
+			}
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/credentials"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/registryclient"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/jinzhu/gorm"
+	oci_digest "github.com/opencontainers/go-digest"
+)
+
+// repairer restores objects that are missing or corrupt by downloading
+// them from upstream once more. Objects are only restored if the
+// upstream server still serves contents that match the object's key.
+type repairer struct {
+	database *gorm.DB
+	uploader *s3manager.Uploader
+
+	httpClient        *http.Client
+	upstreamTransport http.RoundTripper
+	credentialsCipher *credentials.Cipher
+	dockerConfig      *credentials.DockerConfig
+}
+
+func newRepairer(database *gorm.DB, uploader *s3manager.Uploader, httpClient *http.Client, upstreamTransport http.RoundTripper, credentialsCipher *credentials.Cipher, dockerConfig *credentials.DockerConfig) *repairer {
+	return &repairer{
+		database: database,
+		uploader: uploader,
+
+		httpClient:        httpClient,
+		upstreamTransport: upstreamTransport,
+		credentialsCipher: credentialsCipher,
+		dockerConfig:      dockerConfig,
+	}
+}
+
+// storeVerified stores data obtained from upstream in a bucket. The
+// data is written into a temporary file first, so that it can be
+// verified before it replaces the object in storage.
+func (br *repairer) storeVerified(ctx context.Context, bucket string, key string, body io.Reader, verify verifyFunc) error {
+	tmpfile, err := ioutil.TempFile("", "repair")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+	defer tmpfile.Close()
+
+	if _, err := io.Copy(tmpfile, body); err != nil {
+		return err
+	}
+	if _, err := tmpfile.Seek(0, 0); err != nil {
+		return err
+	}
+	if details, err := verify(key, tmpfile); err != nil {
+		return err
+	} else if details != "" {
+		return fmt.Errorf("Upstream contents differ: %s", details)
+	}
+	if _, err := tmpfile.Seek(0, 0); err != nil {
+		return err
+	}
+	_, err = br.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   tmpfile,
+	})
+	return err
+}
+
+// repairFile restores an object in the "files" bucket by downloading
+// any of the files referencing it.
+func (br *repairer) repairFile(ctx context.Context, key string, files []schema.File) error {
+	for _, file := range files {
+		log.Printf("Attempting to restore %s from %s", key, file.Uri)
+		req, err := http.NewRequest(http.MethodGet, file.Uri, nil)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		// Objects are stored as returned by the upstream
+		// server. Don't let the HTTP client decode them.
+		req.Header.Set("Accept-Encoding", "identity")
+		resp, err := br.httpClient.Do(req.WithContext(ctx))
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			log.Printf("Upstream server returned %s", resp.Status)
+			continue
+		}
+		err = br.storeVerified(ctx, "files", key, resp.Body, verifyFile)
+		resp.Body.Close()
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		return nil
+	}
+	return errors.New("No upstream server provided identical contents")
+}
+
+// repairContainerBlob restores an object in the "container-blobs"
+// bucket by downloading it from the repository of any of the container
+// images referencing it.
+func (br *repairer) repairContainerBlob(ctx context.Context, key string, images []schema.ContainerImage) error {
+	for _, image := range images {
+		var repository schema.ContainerRepository
+		if r := br.database.Where("id = ?", image.RepositoryId).Take(&repository); r.Error != nil {
+			return r.Error
+		}
+		var registry schema.ContainerRegistry
+		if r := br.database.Where("id = ?", repository.RegistryId).Take(&registry); r.Error != nil {
+			return r.Error
+		}
+		log.Printf("Attempting to restore %s from %s %s", key, registry.Uri, repository.RepositoryName)
+		if err := br.repairContainerBlobFromRepository(ctx, key, &registry, &repository); err != nil {
+			log.Print(err)
+			continue
+		}
+		return nil
+	}
+	return errors.New("No upstream registry provided identical contents")
+}
+
+func (br *repairer) repairContainerBlobFromRepository(ctx context.Context, key string, registry *schema.ContainerRegistry, repository *schema.ContainerRepository) error {
+	creds, err := credentials.NewRegistryCredentialStore(br.database, br.credentialsCipher, br.dockerConfig, registry)
+	if err != nil {
+		return err
+	}
+	upstreamRepository, err := registryclient.NewRepository(registry.Uri, repository.RepositoryName, br.upstreamTransport, creds)
+	if err != nil {
+		return err
+	}
+	blob, err := upstreamRepository.Blobs(ctx).Open(ctx, oci_digest.Digest(key))
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	return br.storeVerified(ctx, "container-blobs", key, blob, verifyContainerBlob)
+}
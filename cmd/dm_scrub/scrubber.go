@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/jinzhu/gorm"
+	oci_digest "github.com/opencontainers/go-digest"
+)
+
+// verifyFunc verifies the contents of an object in storage against its
+// key. It returns a description of the problem if the contents are
+// corrupt.
+type verifyFunc func(key string, body io.Reader) (string, error)
+
+// verifyFile verifies an object in the "files" bucket. These objects
+// are keyed by SHA-256 checksum and size.
+func verifyFile(key string, body io.Reader) (string, error) {
+	fields := strings.Split(key, "|")
+	if len(fields) != 2 {
+		return "Malformed object key", nil
+	}
+	expectedSize, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "Malformed object key", nil
+	}
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, body)
+	if err != nil {
+		return "", err
+	}
+	if checksum := hex.EncodeToString(hasher.Sum(nil)); checksum != fields[0] || size != expectedSize {
+		return fmt.Sprintf("Object contains %d bytes with checksum %s", size, checksum), nil
+	}
+	return "", nil
+}
+
+// verifyContainerBlob verifies an object in the "container-blobs"
+// bucket. These objects are keyed by digest.
+func verifyContainerBlob(key string, body io.Reader) (string, error) {
+	digest, err := oci_digest.Parse(key)
+	if err != nil {
+		return fmt.Sprintf("Malformed object key: %s", err), nil
+	}
+	verifier := digest.Verifier()
+	size, err := io.Copy(verifier, body)
+	if err != nil {
+		return "", err
+	}
+	if !verifier.Verified() {
+		return fmt.Sprintf("Object of %d bytes does not match its digest", size), nil
+	}
+	return "", nil
+}
+
+type findingKey struct {
+	bucket string
+	key    string
+}
+
+// scrubber streams all objects in storage, verifies their contents
+// against their keys and records the problems found in the database.
+type scrubber struct {
+	database *gorm.DB
+	s3Client *s3.S3
+
+	// Findings present in the database, which are to be removed
+	// once the object verifies successfully.
+	recordedFindings map[findingKey]bool
+}
+
+func newScrubber(database *gorm.DB, s3Client *s3.S3) (*scrubber, error) {
+	var findings []schema.ScrubFinding
+	if r := database.Find(&findings); r.Error != nil {
+		return nil, r.Error
+	}
+	s := &scrubber{
+		database:         database,
+		s3Client:         s3Client,
+		recordedFindings: map[findingKey]bool{},
+	}
+	for _, finding := range findings {
+		s.recordedFindings[findingKey{bucket: finding.Bucket, key: finding.Key}] = true
+	}
+	return s, nil
+}
+
+func (s *scrubber) recordFinding(bucket string, key string, status string, details string) {
+	log.Printf("%s %s: %s: %s", bucket, key, status, details)
+	if r := s.database.Where(schema.ScrubFinding{Bucket: bucket, Key: key}).Assign(schema.ScrubFinding{
+		Status:     status,
+		Details:    &details,
+		DetectedAt: time.Now(),
+	}).FirstOrCreate(&schema.ScrubFinding{}); r.Error != nil {
+		log.Printf("Failed to record scrub finding in database: %s", r.Error)
+		return
+	}
+	s.recordedFindings[findingKey{bucket: bucket, key: key}] = true
+}
+
+func (s *scrubber) clearFinding(bucket string, key string) {
+	finding := findingKey{bucket: bucket, key: key}
+	if !s.recordedFindings[finding] {
+		return
+	}
+	log.Printf("%s %s: no longer has any problems", bucket, key)
+	if r := s.database.Where("bucket = ? AND key = ?", bucket, key).Delete(&schema.ScrubFinding{}); r.Error != nil {
+		log.Printf("Failed to remove scrub finding from database: %s", r.Error)
+		return
+	}
+	delete(s.recordedFindings, finding)
+}
+
+// verifyObject downloads a single object and verifies its contents.
+func (s *scrubber) verifyObject(ctx context.Context, bucket string, key string, verify verifyFunc) (string, error) {
+	object, err := s.s3Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer object.Body.Close()
+	return verify(key, object.Body)
+}
+
+// scrubBucket verifies all objects in a bucket. Objects that are
+// referenced by the database, but are not present in the bucket are
+// reported as missing. Keys of objects that need to be repaired are
+// returned.
+func (s *scrubber) scrubBucket(ctx context.Context, bucket string, referencedKeys map[string]bool, verify verifyFunc) ([]string, error) {
+	var damagedKeys []string
+	seenKeys := map[string]bool{}
+	if err := s.s3Client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+	}, func(output *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range output.Contents {
+			key := *object.Key
+			seenKeys[key] = true
+			details, err := s.verifyObject(ctx, bucket, key, verify)
+			if err != nil {
+				// Don't flag objects as corrupt if they
+				// could not be read at all.
+				log.Printf("Failed to verify %s %s: %s", bucket, key, err)
+			} else if details != "" {
+				s.recordFinding(bucket, key, schema.ScrubStatusCorrupt, details)
+				damagedKeys = append(damagedKeys, key)
+			} else {
+				s.clearFinding(bucket, key)
+			}
+		}
+		return ctx.Err() == nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for key := range referencedKeys {
+		if !seenKeys[key] {
+			s.recordFinding(bucket, key, schema.ScrubStatusMissing, "Object is referenced, but not present in storage")
+			damagedKeys = append(damagedKeys, key)
+		}
+	}
+
+	// Objects that were missing before, but are no longer
+	// referenced, are no longer a problem.
+	for finding := range s.recordedFindings {
+		if finding.bucket == bucket && !seenKeys[finding.key] && !referencedKeys[finding.key] {
+			s.clearFinding(bucket, finding.key)
+		}
+	}
+	return damagedKeys, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/archive"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// Formats in which container images can be exported.
+var archiveFormats = map[string]func(context.Context, *gorm.DB, *s3.S3, *archive.Image) (*archive.Archive, error){
+	"oci-layout":     archive.NewOCILayout,
+	"docker-archive": archive.NewDockerArchive,
+}
+
+// ContainerArchiveService allows downloading mirrored container images
+// as tarballs, so that they can be transferred to systems that cannot
+// access the mirror (e.g., "docker load", "skopeo copy oci-archive:").
+// Images are identified by the same parameters as used to create them,
+// so that the endpoint can be used by scripts.
+type ContainerArchiveService struct {
+	database  *gorm.DB
+	templates *template.Template
+	s3Client  *s3.S3
+}
+
+func NewContainerArchiveService(database *gorm.DB, templates *template.Template, router *mux.Router, s3Client *s3.S3) *ContainerArchiveService {
+	as := &ContainerArchiveService{
+		database:  database,
+		templates: templates,
+		s3Client:  s3Client,
+	}
+	router.HandleFunc("/containers/export", as.handleExport)
+	return as
+}
+
+func (as *ContainerArchiveService) handleErrorPage(w http.ResponseWriter, req *http.Request, message string, code int) {
+	renderErrorPage(as.templates, w, message, code)
+}
+
+// getImageName returns the name under which an image stored in a
+// registry is imported. Docker Hub's registry is not served under its
+// canonical name.
+func getImageName(registryUri string, repositoryName string) (string, error) {
+	parsedRegistryUri, err := url.Parse(registryUri)
+	if err != nil {
+		return "", err
+	}
+	host := parsedRegistryUri.Host
+	if host == "registry-1.docker.io" || host == "index.docker.io" {
+		host = "docker.io"
+	}
+	return host + "/" + repositoryName, nil
+}
+
+func (as *ContainerArchiveService) handleExport(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	newArchive, ok := archiveFormats[query.Get("format")]
+	if !ok {
+		as.handleErrorPage(w, req, "Format must be \"oci-layout\" or \"docker-archive\"", http.StatusBadRequest)
+		return
+	}
+
+	var registry schema.ContainerRegistry
+	if r := as.database.Where("uri = ?", query.Get("registry")).Take(&registry); r.Error != nil {
+		if r.RecordNotFound() {
+			as.handleErrorPage(w, req, "Registry not found", http.StatusNotFound)
+			return
+		}
+		as.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	var repository schema.ContainerRepository
+	if r := as.database.Where("registry_id = ? AND repository_name = ?", registry.Id, query.Get("repository")).Take(&repository); r.Error != nil {
+		if r.RecordNotFound() {
+			as.handleErrorPage(w, req, "Repository not found", http.StatusNotFound)
+			return
+		}
+		as.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	var image schema.ContainerImage
+	if r := as.database.Where("repository_id = ? AND digest = ? AND manifest IS NOT NULL", repository.Id, query.Get("digest")).Take(&image); r.Error != nil {
+		if r.RecordNotFound() {
+			as.handleErrorPage(w, req, "Container image not found or not downloaded yet", http.StatusNotFound)
+			return
+		}
+		as.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	imageName, err := getImageName(registry.Uri, repository.RepositoryName)
+	if err != nil {
+		as.handleErrorPage(w, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	archiveImage := archive.Image{
+		Name:           imageName,
+		ContainerImage: &image,
+	}
+	if image.Tag != nil {
+		archiveImage.Tag = *image.Tag
+	}
+	a, err := newArchive(req.Context(), as.database, as.s3Client, &archiveImage)
+	if err != nil {
+		as.handleErrorPage(w, req, "Failed to export container image: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Errors can no longer be reported once streaming has started.
+	// The tarball is left unterminated in that case.
+	filename := path.Base(repository.RepositoryName) + "-" + strings.Replace(image.Digest, ":", "-", -1) + "." + query.Get("format") + ".tar"
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(filename))
+	if err := a.Write(req.Context(), w); err != nil {
+		log.Printf("Failed to write archive of %s: %s", image.Digest, err)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/layers"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/docker/distribution"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// ContainerFilesystemService allows browsing the filesystems of
+// mirrored container images, using the index of the entries of their
+// layers.
+type ContainerFilesystemService struct {
+	database  *gorm.DB
+	templates *template.Template
+	s3Client  *s3.S3
+}
+
+func NewContainerFilesystemService(database *gorm.DB, templates *template.Template, router *mux.Router, s3Client *s3.S3) *ContainerFilesystemService {
+	fs := &ContainerFilesystemService{
+		database:  database,
+		templates: templates,
+		s3Client:  s3Client,
+	}
+	router.HandleFunc("/containers/images/{image_id:"+uuidRegex+"}/files", fs.handleFiles)
+	router.HandleFunc("/containers/images/{image_id:"+uuidRegex+"}/files/index", fs.handleIndex).Methods("POST")
+	router.HandleFunc("/containers/images/{image_id:"+uuidRegex+"}/files/raw", fs.handleRaw)
+	return fs
+}
+
+func (fs *ContainerFilesystemService) handleErrorPage(w http.ResponseWriter, req *http.Request, message string, code int) {
+	renderErrorPage(fs.templates, w, message, code)
+}
+
+// getLayers returns the image with a given ID and the layers of which
+// its filesystem consists.
+func (fs *ContainerFilesystemService) getLayers(imageId string) (*schema.ContainerImage, []distribution.Descriptor, error) {
+	var image schema.ContainerImage
+	if r := fs.database.Where("id = ? AND manifest IS NOT NULL", imageId).Take(&image); r.Error != nil {
+		return nil, nil, r.Error
+	}
+	manifest, _, err := distribution.UnmarshalManifest(*image.ManifestMediatype, *image.Manifest)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &image, layers.GetFilesystemLayers(manifest), nil
+}
+
+func getLayerDigests(descriptors []distribution.Descriptor) []string {
+	var layerDigests []string
+	for _, descriptor := range descriptors {
+		layerDigests = append(layerDigests, string(descriptor.Digest))
+	}
+	return layerDigests
+}
+
+// getUniqueLayerDigests returns the layer digests of an image with
+// duplicates removed.
+func getUniqueLayerDigests(layerDigests []string) []string {
+	seen := map[string]bool{}
+	var uniqueLayerDigests []string
+	for _, layerDigest := range layerDigests {
+		if !seen[layerDigest] {
+			seen[layerDigest] = true
+			uniqueLayerDigests = append(uniqueLayerDigests, layerDigest)
+		}
+	}
+	return uniqueLayerDigests
+}
+
+func (fs *ContainerFilesystemService) handleFiles(w http.ResponseWriter, req *http.Request) {
+	image, imageLayers, err := fs.getLayers(mux.Vars(req)["image_id"])
+	if err != nil {
+		fs.handleErrorPage(w, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	directory := path.Clean("/" + req.URL.Query().Get("path"))
+
+	// Only display the filesystem once all layers are indexed. An
+	// image may contain the same layer multiple times, while it is
+	// only indexed once.
+	layerDigests := getLayerDigests(imageLayers)
+	uniqueLayerDigests := getUniqueLayerDigests(layerDigests)
+	var indexedCount int
+	if r := fs.database.Model(&schema.ContainerLayerIndex{}).Where("layer_digest IN (?)", uniqueLayerDigests).Count(&indexedCount); r.Error != nil {
+		fs.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	type fileInfo struct {
+		schema.ContainerLayerEntry
+		Name  string
+		Mode  string
+		Layer int
+		Query string
+	}
+	var files []fileInfo
+	if len(uniqueLayerDigests) > 0 && indexedCount == len(uniqueLayerDigests) {
+		filesystem, err := layers.NewFilesystem(fs.database, layerDigests)
+		if err != nil {
+			fs.handleErrorPage(w, req, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		layerNumbers := map[string]int{}
+		for i, layerDigest := range layerDigests {
+			layerNumbers[layerDigest] = i + 1
+		}
+		for _, entry := range filesystem.List(directory) {
+			mode := os.FileMode(entry.Mode)
+			switch entry.Type {
+			case schema.LayerEntryTypeDirectory:
+				mode |= os.ModeDir
+			case schema.LayerEntryTypeSymlink:
+				mode |= os.ModeSymlink
+			}
+			files = append(files, fileInfo{
+				ContainerLayerEntry: entry,
+				Name:                path.Base(entry.Path),
+				Mode:                mode.String(),
+				Layer:               layerNumbers[entry.LayerDigest],
+				Query:               url.Values{"path": []string{entry.Path}}.Encode(),
+			})
+		}
+	}
+
+	// Allow navigating to any of the parent directories.
+	type pathComponent struct {
+		Name  string
+		Query string
+	}
+	breadcrumbs := []pathComponent{{Name: "/", Query: "path=%2F"}}
+	if directory != "/" {
+		components := strings.Split(strings.TrimPrefix(directory, "/"), "/")
+		for i, component := range components {
+			breadcrumbs = append(breadcrumbs, pathComponent{
+				Name:  component,
+				Query: url.Values{"path": []string{"/" + strings.Join(components[:i+1], "/")}}.Encode(),
+			})
+		}
+	}
+
+	if err := fs.templates.ExecuteTemplate(w, "containers_image_files.html", struct {
+		Image       *schema.ContainerImage
+		Directory   string
+		Breadcrumbs []pathComponent
+		LayerCount  int
+		Indexed     int
+		Files       []fileInfo
+	}{
+		Image:       image,
+		Directory:   directory,
+		Breadcrumbs: breadcrumbs,
+		LayerCount:  len(uniqueLayerDigests),
+		Indexed:     indexedCount,
+		Files:       files,
+	}); err != nil {
+		log.Print(err)
+	}
+}
+
+func (fs *ContainerFilesystemService) handleIndex(w http.ResponseWriter, req *http.Request) {
+	image, imageLayers, err := fs.getLayers(mux.Vars(req)["image_id"])
+	if err != nil {
+		fs.handleErrorPage(w, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := layers.IndexLayers(req.Context(), fs.database, fs.s3Client, imageLayers); err != nil {
+		fs.handleErrorPage(w, req, "Failed to index layers: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, "/containers/images/"+image.Id+"/files", http.StatusSeeOther)
+}
+
+func (fs *ContainerFilesystemService) handleRaw(w http.ResponseWriter, req *http.Request) {
+	_, imageLayers, err := fs.getLayers(mux.Vars(req)["image_id"])
+	if err != nil {
+		fs.handleErrorPage(w, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	filesystem, err := layers.NewFilesystem(fs.database, getLayerDigests(imageLayers))
+	if err != nil {
+		fs.handleErrorPage(w, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entry, ok := filesystem.Lookup(req.URL.Query().Get("path"))
+	if !ok {
+		fs.handleErrorPage(w, req, "File not found", http.StatusNotFound)
+		return
+	}
+
+	// The contents of hard links are stored under the path of the
+	// target within the same layer.
+	filePath := entry.Path
+	if entry.Type == schema.LayerEntryTypeHardlink {
+		filePath = *entry.LinkTarget
+	} else if entry.Type != schema.LayerEntryTypeFile {
+		fs.handleErrorPage(w, req, "Not a regular file", http.StatusBadRequest)
+		return
+	}
+	f, err := layers.OpenFile(req.Context(), fs.s3Client, entry.LayerDigest, filePath)
+	if err != nil {
+		fs.handleErrorPage(w, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	// Never let the browser interpret files from container images
+	// as content of the web UI.
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(path.Base(entry.Path)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if _, err := io.Copy(w, f); err != nil {
+		log.Printf("Failed to write body: %s", err)
+	}
+}
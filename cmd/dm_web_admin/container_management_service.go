@@ -1,58 +1,115 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/cosign"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/credentials"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/manifests"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/platforms"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/registryclient"
 	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/tagwatch"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/upstream"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/util"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/manifest/manifestlist"
+	_ "github.com/docker/distribution/manifest/ocischema"
 	_ "github.com/docker/distribution/manifest/schema1"
 	_ "github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/distribution/reference"
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 type ContainerManagementService struct {
-	database  *gorm.DB
-	templates *template.Template
+	database          *gorm.DB
+	templates         *template.Template
+	credentialsCipher *credentials.Cipher
+	dockerConfig      *credentials.DockerConfig
+	destinationPolicy *upstream.DestinationPolicy
+	upstreamTransport http.RoundTripper
+	s3Client          *s3.S3
 }
 
-func NewContainerManagementService(database *gorm.DB, templates *template.Template, router *mux.Router) *ContainerManagementService {
+func NewContainerManagementService(database *gorm.DB, templates *template.Template, router *mux.Router, credentialsCipher *credentials.Cipher, dockerConfig *credentials.DockerConfig, destinationPolicy *upstream.DestinationPolicy, upstreamTransport http.RoundTripper, s3Client *s3.S3) *ContainerManagementService {
 	ms := &ContainerManagementService{
-		database:  database,
-		templates: templates,
+		database:          database,
+		templates:         templates,
+		credentialsCipher: credentialsCipher,
+		dockerConfig:      dockerConfig,
+		destinationPolicy: destinationPolicy,
+		upstreamTransport: upstreamTransport,
+		s3Client:          s3Client,
 	}
 	router.HandleFunc("/containers/", ms.handleRegistriesList)
 	router.HandleFunc("/containers/create", ms.handleCreate)
+	router.HandleFunc("/containers/resolve", ms.handleResolve)
 	router.HandleFunc("/containers/registries/{registry_id:"+uuidRegex+"}", ms.handleRegistryInfo)
+	router.HandleFunc("/containers/registries/{registry_id:"+uuidRegex+"}/credentials", ms.handleRegistryCredentials).Methods("POST")
+	router.HandleFunc("/containers/registries/{registry_id:"+uuidRegex+"}/platforms", ms.handleRegistryPlatforms).Methods("POST")
 	router.HandleFunc("/containers/repositories/{repository_id:"+uuidRegex+"}", ms.handleRepositoryInfo)
+	router.HandleFunc("/containers/repositories/{repository_id:"+uuidRegex+"}/signature-policy", ms.handleRepositorySignaturePolicy).Methods("POST")
+	router.HandleFunc("/containers/repositories/{repository_id:"+uuidRegex+"}/watch-rules", ms.handleWatchRuleCreate).Methods("POST")
+	router.HandleFunc("/containers/watch-rules/{watch_rule_id:"+uuidRegex+"}/delete", ms.handleWatchRuleDelete).Methods("POST")
+	router.HandleFunc("/containers/proposals/{proposal_id:"+uuidRegex+"}/approve", ms.handleProposalApprove).Methods("POST")
+	router.HandleFunc("/containers/proposals/{proposal_id:"+uuidRegex+"}/dismiss", ms.handleProposalDismiss).Methods("POST")
 	router.HandleFunc("/containers/images/{image_id:"+uuidRegex+"}", ms.handleImageInfo)
+	router.HandleFunc("/containers/labels", ms.handleLabelSearch)
+	router.HandleFunc("/containers/images/{image_id:"+uuidRegex+"}/platforms", ms.handleImagePlatforms).Methods("POST")
 	return ms
 }
 
 func (ms *ContainerManagementService) handleErrorPage(w http.ResponseWriter, req *http.Request, message string, code int) {
-	log.Print(message)
-	w.WriteHeader(code)
-	if err := ms.templates.ExecuteTemplate(w, "error.html", struct {
-		Message string
-	}{
-		Message: message,
-	}); err != nil {
-		log.Print(err)
+	renderErrorPage(ms.templates, w, message, code)
+}
+
+// parsePlatforms validates a platform policy provided through a form.
+// An empty policy is converted to nil.
+func parsePlatforms(policy string) (*string, error) {
+	policy = strings.TrimSpace(policy)
+	if policy == "" {
+		return nil, nil
+	}
+	if _, err := platforms.ParsePolicy(policy); err != nil {
+		return nil, err
 	}
+	return &policy, nil
 }
 
 func (ms *ContainerManagementService) handleCreate(w http.ResponseWriter, req *http.Request) {
 	if req.Method == "POST" {
 		req.ParseForm()
+		imagePlatforms, err := parsePlatforms(req.Form.Get("platforms"))
+		if err != nil {
+			ms.handleErrorPage(w, req, err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		// Create registry, repository and image if not yet present.
 		// TODO(edsch): Store metadata: who creates the image and for what reason.
+		registryUri := req.Form.Get("registry")
+		parsedRegistryUri, err := url.Parse(registryUri)
+		if err != nil {
+			ms.handleErrorPage(w, req, "Invalid registry URI: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := ms.destinationPolicy.CheckUrl(parsedRegistryUri); err != nil {
+			ms.handleErrorPage(w, req, "Registry may not be accessed: "+err.Error(), http.StatusBadRequest)
+			return
+		}
 		var registry schema.ContainerRegistry
 		if r := ms.database.FirstOrCreate(&registry, schema.ContainerRegistry{
-			Uri: req.Form.Get("registry"),
+			Uri: registryUri,
 		}); r.Error != nil {
 			ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
 			return
@@ -73,15 +130,29 @@ func (ms *ContainerManagementService) handleCreate(w http.ResponseWriter, req *h
 			ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
 			return
 		}
+		if imagePlatforms != nil {
+			if r := ms.database.Model(&image).Update("platforms", imagePlatforms); r.Error != nil {
+				ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if tag := req.Form.Get("tag"); tag != "" {
+			if r := ms.database.Model(&image).Update("tag", tag); r.Error != nil {
+				ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
 
 		http.Redirect(w, req, "/containers/images/"+image.Id, http.StatusSeeOther)
 	} else {
 		// Present creation form.
 		query := req.URL.Query()
 		if err := ms.templates.ExecuteTemplate(w, "containers_create.html", struct {
-			Registry   string
-			Repository string
-			Digest     string
+			Registry    string
+			Repository  string
+			Digest      string
+			Tag         string
+			ResolvedTag *registryclient.ResolvedTag
 		}{
 			Registry:   query.Get("registry"),
 			Repository: query.Get("repository"),
@@ -92,6 +163,96 @@ func (ms *ContainerManagementService) handleCreate(w http.ResponseWriter, req *h
 	}
 }
 
+// parseImageReference converts an image reference of the form used by
+// the Docker CLI (e.g., "debian:bookworm",
+// "quay.io/prometheus/prometheus:latest") to a registry URI,
+// repository name and tag.
+func parseImageReference(imageReference string) (string, string, string, error) {
+	named, err := reference.ParseNormalizedNamed(strings.TrimSpace(imageReference))
+	if err != nil {
+		return "", "", "", err
+	}
+	named = reference.TagNameOnly(named)
+	tagged, ok := named.(reference.Tagged)
+	if !ok {
+		return "", "", "", errors.New("Image reference does not contain a tag")
+	}
+	// Docker Hub's registry is not served under its canonical name.
+	domain := reference.Domain(named)
+	if domain == "docker.io" {
+		domain = "registry-1.docker.io"
+	}
+	return "https://" + domain + "/", reference.Path(named), tagged.Tag(), nil
+}
+
+func (ms *ContainerManagementService) handleResolve(w http.ResponseWriter, req *http.Request) {
+	registryUri, repositoryName, tag, err := parseImageReference(req.URL.Query().Get("reference"))
+	if err != nil {
+		ms.handleErrorPage(w, req, "Invalid image reference: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	parsedRegistryUri, err := url.Parse(registryUri)
+	if err != nil {
+		ms.handleErrorPage(w, req, "Invalid registry URI: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := ms.destinationPolicy.CheckUrl(parsedRegistryUri); err != nil {
+		ms.handleErrorPage(w, req, "Registry may not be accessed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Use the credentials stored for the registry if it is known
+	// already. Don't create an entry for it, as the user may decide
+	// not to mirror the image.
+	registry := schema.ContainerRegistry{
+		Uri: registryUri,
+	}
+	credentialsCipher := ms.credentialsCipher
+	if r := ms.database.Where("uri = ?", registryUri).Take(&registry); r.Error != nil {
+		if !r.RecordNotFound() {
+			ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+			return
+		}
+		credentialsCipher = nil
+	}
+	creds, err := credentials.NewRegistryCredentialStore(ms.database, credentialsCipher, ms.dockerConfig, &registry)
+	if err != nil {
+		ms.handleErrorPage(w, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), time.Minute)
+	defer cancel()
+	repository, err := registryclient.NewRepository(registryUri, repositoryName, ms.upstreamTransport, creds)
+	if err != nil {
+		ms.handleErrorPage(w, req, "Failed to access repository: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	resolvedTag, err := registryclient.ResolveTag(ctx, repository, tag)
+	if err != nil {
+		ms.handleErrorPage(w, req, "Failed to resolve tag: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	// Present the creation form, so that the user can confirm
+	// that the digest should be mirrored.
+	if err := ms.templates.ExecuteTemplate(w, "containers_create.html", struct {
+		Registry    string
+		Repository  string
+		Digest      string
+		Tag         string
+		ResolvedTag *registryclient.ResolvedTag
+	}{
+		Registry:    registryUri,
+		Repository:  repositoryName,
+		Digest:      resolvedTag.Digest.String(),
+		Tag:         tag,
+		ResolvedTag: resolvedTag,
+	}); err != nil {
+		log.Print(err)
+	}
+}
+
 func (ms *ContainerManagementService) handleRegistriesList(w http.ResponseWriter, req *http.Request) {
 	var registries []schema.ContainerRegistry
 	if r := ms.database.Order("uri").Find(&registries); r.Error != nil {
@@ -124,17 +285,69 @@ func (ms *ContainerManagementService) handleRegistryInfo(w http.ResponseWriter,
 		return
 	}
 
+	// Obtain the username used to access the registry. Never
+	// display any secrets.
+	var username *string
+	var credential schema.ContainerRegistryCredential
+	if r := ms.database.Where("registry_id = ?", registry.Id).Take(&credential); r.Error == nil {
+		username = credential.Username
+	} else if !r.RecordNotFound() {
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	if err := ms.templates.ExecuteTemplate(w, "containers_registry_info.html", struct {
-		Registry     *schema.ContainerRegistry
-		Repositories []schema.ContainerRepository
+		Registry                *schema.ContainerRegistry
+		Repositories            []schema.ContainerRepository
+		Username                *string
+		CanConfigureCredentials bool
 	}{
-		Registry:     &registry,
-		Repositories: repositories,
+		Registry:                &registry,
+		Repositories:            repositories,
+		Username:                username,
+		CanConfigureCredentials: ms.credentialsCipher != nil,
 	}); err != nil {
 		log.Print(err)
 	}
 }
 
+func (ms *ContainerManagementService) handleRegistryCredentials(w http.ResponseWriter, req *http.Request) {
+	if ms.credentialsCipher == nil {
+		ms.handleErrorPage(w, req, "No encryption key for credentials has been configured", http.StatusNotImplemented)
+		return
+	}
+	req.ParseForm()
+
+	registryId := mux.Vars(req)["registry_id"]
+	if username := req.Form.Get("username"); username != "" {
+		if err := credentials.SetRegistryCredentials(ms.database, ms.credentialsCipher, registryId, username, req.Form.Get("password")); err != nil {
+			ms.handleErrorPage(w, req, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		if err := credentials.DeleteRegistryCredentials(ms.database, registryId); err != nil {
+			ms.handleErrorPage(w, req, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	http.Redirect(w, req, "/containers/registries/"+registryId, http.StatusSeeOther)
+}
+
+func (ms *ContainerManagementService) handleRegistryPlatforms(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	registryPlatforms, err := parsePlatforms(req.Form.Get("platforms"))
+	if err != nil {
+		ms.handleErrorPage(w, req, err.Error(), http.StatusBadRequest)
+		return
+	}
+	registryId := mux.Vars(req)["registry_id"]
+	if r := ms.database.Model(&schema.ContainerRegistry{}).Where("id = ?", registryId).Update("platforms", registryPlatforms); r.Error != nil {
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, "/containers/registries/"+registryId, http.StatusSeeOther)
+}
+
 func (ms *ContainerManagementService) handleRepositoryInfo(w http.ResponseWriter, req *http.Request) {
 	// Obtain repository information.
 	var repository schema.ContainerRepository
@@ -149,6 +362,15 @@ func (ms *ContainerManagementService) handleRepositoryInfo(w http.ResponseWriter
 		return
 	}
 
+	var signaturePolicy *schema.ContainerSignaturePolicy
+	var storedSignaturePolicy schema.ContainerSignaturePolicy
+	if r := ms.database.Where("repository_id = ?", repository.Id).Take(&storedSignaturePolicy); r.Error == nil {
+		signaturePolicy = &storedSignaturePolicy
+	} else if !r.RecordNotFound() {
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Obtain images in repository.
 	// TODO(edsch): Derive image type from ManifestMediatype.
 	var images []schema.ContainerImage
@@ -157,14 +379,226 @@ func (ms *ContainerManagementService) handleRepositoryInfo(w http.ResponseWriter
 		return
 	}
 
+	// Obtain the tags that are watched, and the images to which
+	// they refer that are not mirrored yet.
+	var watchRules []schema.ContainerWatchRule
+	if r := ms.database.Where("repository_id = ?", repository.Id).Find(&watchRules); r.Error != nil {
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	var proposals []schema.ContainerImageProposal
+	if r := ms.database.Where("repository_id = ? AND NOT dismissed", repository.Id).Order("discovered_at DESC, tag").Find(&proposals); r.Error != nil {
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	if err := ms.templates.ExecuteTemplate(w, "containers_repository_info.html", struct {
-		Registry   *schema.ContainerRegistry
-		Repository *schema.ContainerRepository
-		Images     []schema.ContainerImage
+		Registry        *schema.ContainerRegistry
+		Repository      *schema.ContainerRepository
+		SignaturePolicy *schema.ContainerSignaturePolicy
+		Images          []schema.ContainerImage
+		WatchRules      []schema.ContainerWatchRule
+		Proposals       []schema.ContainerImageProposal
+	}{
+		Registry:        &registry,
+		Repository:      &repository,
+		SignaturePolicy: signaturePolicy,
+		Images:          images,
+		WatchRules:      watchRules,
+		Proposals:       proposals,
+	}); err != nil {
+		log.Print(err)
+	}
+}
+
+func (ms *ContainerManagementService) handleRepositorySignaturePolicy(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	repositoryId := mux.Vars(req)["repository_id"]
+	signaturePolicy := schema.ContainerSignaturePolicy{
+		RepositoryId: repositoryId,
+	}
+	if publicKeys := strings.TrimSpace(req.Form.Get("public_keys")); publicKeys != "" {
+		if _, err := cosign.ParsePublicKeys(publicKeys); err != nil {
+			ms.handleErrorPage(w, req, err.Error(), http.StatusBadRequest)
+			return
+		}
+		signaturePolicy.PublicKeys = &publicKeys
+	}
+	identity := strings.TrimSpace(req.Form.Get("identity"))
+	issuer := strings.TrimSpace(req.Form.Get("issuer"))
+	if (identity == "") != (issuer == "") {
+		ms.handleErrorPage(w, req, "Keyless signatures require both an identity and an issuer", http.StatusBadRequest)
+		return
+	}
+	if identity != "" {
+		signaturePolicy.Identity = &identity
+		signaturePolicy.Issuer = &issuer
+	}
+
+	// Leaving all fields empty removes the policy, permitting
+	// unsigned images to be mirrored.
+	tx := ms.database.Begin()
+	if r := tx.Where("repository_id = ?", repositoryId).Delete(&schema.ContainerSignaturePolicy{}); r.Error != nil {
+		tx.Rollback()
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	if signaturePolicy.PublicKeys != nil || signaturePolicy.Identity != nil {
+		if r := tx.Create(&signaturePolicy); r.Error != nil {
+			tx.Rollback()
+			ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if r := tx.Commit(); r.Error != nil {
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, "/containers/repositories/"+repositoryId, http.StatusSeeOther)
+}
+
+func (ms *ContainerManagementService) handleWatchRuleCreate(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	repositoryId := mux.Vars(req)["repository_id"]
+	watchRule := schema.ContainerWatchRule{
+		RepositoryId: repositoryId,
+	}
+	if tagPattern := strings.TrimSpace(req.Form.Get("tag_pattern")); tagPattern != "" {
+		watchRule.TagPattern = &tagPattern
+	}
+	if semverRange := strings.TrimSpace(req.Form.Get("semver_range")); semverRange != "" {
+		watchRule.SemverRange = &semverRange
+	}
+	if _, err := tagwatch.NewRule(&watchRule); err != nil {
+		ms.handleErrorPage(w, req, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r := ms.database.Create(&watchRule); r.Error != nil {
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, "/containers/repositories/"+repositoryId, http.StatusSeeOther)
+}
+
+func (ms *ContainerManagementService) handleWatchRuleDelete(w http.ResponseWriter, req *http.Request) {
+	var watchRule schema.ContainerWatchRule
+	if r := ms.database.Where("id = ?", mux.Vars(req)["watch_rule_id"]).Take(&watchRule); r.Error != nil {
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r := ms.database.Delete(&watchRule); r.Error != nil {
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, "/containers/repositories/"+watchRule.RepositoryId, http.StatusSeeOther)
+}
+
+func (ms *ContainerManagementService) handleProposalApprove(w http.ResponseWriter, req *http.Request) {
+	var proposal schema.ContainerImageProposal
+	if r := ms.database.Where("id = ?", mux.Vars(req)["proposal_id"]).Take(&proposal); r.Error != nil {
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Create the image and discard all proposals for it, as the
+	// same image may be referred to by multiple tags.
+	tx := ms.database.Begin()
+	var image schema.ContainerImage
+	if r := tx.Where(schema.ContainerImage{
+		RepositoryId: proposal.RepositoryId,
+		Digest:       proposal.Digest,
+	}).Attrs(schema.ContainerImage{
+		Tag: &proposal.Tag,
+	}).FirstOrCreate(&image); r.Error != nil {
+		tx.Rollback()
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r := tx.Where("repository_id = ? AND digest = ?", proposal.RepositoryId, proposal.Digest).Delete(&schema.ContainerImageProposal{}); r.Error != nil {
+		tx.Rollback()
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r := tx.Commit(); r.Error != nil {
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, "/containers/images/"+image.Id, http.StatusSeeOther)
+}
+
+func (ms *ContainerManagementService) handleProposalDismiss(w http.ResponseWriter, req *http.Request) {
+	var proposal schema.ContainerImageProposal
+	if r := ms.database.Where("id = ?", mux.Vars(req)["proposal_id"]).Take(&proposal); r.Error != nil {
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r := ms.database.Model(&proposal).Update("dismissed", true); r.Error != nil {
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, "/containers/repositories/"+proposal.RepositoryId, http.StatusSeeOther)
+}
+
+// getImageConfig reads the config blob of a container image from
+// storage, if it has one.
+func (ms *ContainerManagementService) getImageConfig(ctx context.Context, manifest distribution.Manifest) (*v1.Image, error) {
+	descriptor, ok := manifests.GetConfigDescriptor(manifest)
+	if !ok || !manifests.IsImageConfig(descriptor) {
+		return nil, nil
+	}
+	payload, err := util.GetObjectContents(ctx, ms.s3Client, "container-blobs", string(descriptor.Digest))
+	if err != nil {
+		return nil, err
+	}
+	return manifests.ParseImageConfig(payload)
+}
+
+// likePatternEscaper escapes the wildcard characters of LIKE patterns,
+// so that strings provided by users are matched literally.
+var likePatternEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (ms *ContainerManagementService) handleLabelSearch(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	key := strings.TrimSpace(query.Get("key"))
+	value := strings.TrimSpace(query.Get("value"))
+
+	type labelMatch struct {
+		ImageId        string
+		Digest         string
+		RegistryUri    string
+		RepositoryName string
+		Key            string
+		Value          string
+	}
+	var labelMatches []labelMatch
+	if key != "" || value != "" {
+		// Keys are matched exactly, as they tend to be
+		// namespaced. Values are matched by substring.
+		search := ms.database.Table("container_image_labels").
+			Select("container_images.id AS image_id, container_images.digest, container_registries.uri AS registry_uri, container_repositories.repository_name, container_image_labels.key, container_image_labels.value").
+			Joins("JOIN container_images ON container_images.id = container_image_labels.container_image_id").
+			Joins("JOIN container_repositories ON container_repositories.id = container_images.repository_id").
+			Joins("JOIN container_registries ON container_registries.id = container_repositories.registry_id")
+		if key != "" {
+			search = search.Where("container_image_labels.key = ?", key)
+		}
+		if value != "" {
+			search = search.Where("container_image_labels.value ILIKE ?", "%"+likePatternEscaper.Replace(value)+"%")
+		}
+		if r := search.Order("container_registries.uri, container_repositories.repository_name, container_images.digest").Limit(1000).Scan(&labelMatches); r.Error != nil {
+			ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := ms.templates.ExecuteTemplate(w, "containers_labels.html", struct {
+		Key     string
+		Value   string
+		Matches []labelMatch
 	}{
-		Registry:   &registry,
-		Repository: &repository,
-		Images:     images,
+		Key:     key,
+		Value:   value,
+		Matches: labelMatches,
 	}); err != nil {
 		log.Print(err)
 	}
@@ -189,6 +623,76 @@ func (ms *ContainerManagementService) handleImageInfo(w http.ResponseWriter, req
 		return
 	}
 
+	// Obtain the most recent comparison against upstream.
+	var driftCheck *schema.DriftCheck
+	var lastDriftCheck schema.DriftCheck
+	if r := ms.database.Where("container_image_id = ?", image.Id).Order("checked_at DESC").Take(&lastDriftCheck); r.Error == nil {
+		driftCheck = &lastDriftCheck
+	} else if !r.RecordNotFound() {
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Obtain the manifest this image is attached to, and the
+	// artifacts attached to this image (e.g., signatures).
+	var subject *schema.ContainerImage
+	if image.SubjectDigest != nil {
+		var subjectImage schema.ContainerImage
+		if r := ms.database.Where("repository_id = ? AND digest = ?", image.RepositoryId, *image.SubjectDigest).Take(&subjectImage); r.Error == nil {
+			subject = &subjectImage
+		} else if !r.RecordNotFound() {
+			ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	var referrers []schema.ContainerImage
+	if r := ms.database.Where("repository_id = ? AND subject_digest = ?", image.RepositoryId, image.Digest).Order("digest").Find(&referrers); r.Error != nil {
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Obtain the mirrored cosign signatures of this image, or the
+	// image whose signatures are stored in this image.
+	var signatures *schema.ContainerImage
+	var signaturesImage schema.ContainerImage
+	if r := ms.database.Where("repository_id = ? AND signed_digest = ?", image.RepositoryId, image.Digest).Order("manifest IS NULL, pushed_at IS NULL, pushed_at DESC, digest").Take(&signaturesImage); r.Error == nil {
+		signatures = &signaturesImage
+	} else if !r.RecordNotFound() {
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	var signed *schema.ContainerImage
+	if image.SignedDigest != nil {
+		var signedImage schema.ContainerImage
+		if r := ms.database.Where("repository_id = ? AND digest = ?", image.RepositoryId, *image.SignedDigest).Take(&signedImage); r.Error == nil {
+			signed = &signedImage
+		} else if !r.RecordNotFound() {
+			ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Obtain the packages installed in the image, if extracted.
+	var packages []schema.ContainerImagePackage
+	if image.PackagesExtractedAt != nil {
+		if r := ms.database.Where("container_image_id = ?", image.Id).Order("location, name, version").Find(&packages); r.Error != nil {
+			ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Obtain the annotations of the manifest (e.g., the source
+	// repository and revision from which the image was built).
+	var annotations map[string]string
+	if image.Manifest != nil {
+		metadata, err := manifests.ParseMetadata(*image.Manifest)
+		if err != nil {
+			ms.handleErrorPage(w, req, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		annotations = metadata.Annotations
+	}
+
 	// Extract information from manifest if downloaded. A container
 	// image either has layers that allows it to be run directly, or
 	// it is a manifest list. When it is a manifest list, it refers
@@ -197,8 +701,10 @@ func (ms *ContainerManagementService) handleImageInfo(w http.ResponseWriter, req
 		manifestlist.ManifestDescriptor
 		ImageId *string
 	}
-	var manifests []manifestInfo
+	var manifestInfos []manifestInfo
 	var layers []distribution.Descriptor
+	var config *v1.Image
+	var configError string
 	if image.Manifest != nil {
 		manifest, _, err := distribution.UnmarshalManifest(*image.ManifestMediatype, *image.Manifest)
 		if err != nil {
@@ -226,30 +732,70 @@ func (ms *ContainerManagementService) handleImageInfo(w http.ResponseWriter, req
 				if val, ok := imageIds[string(manifestDescriptor.Digest)]; ok {
 					imageId = &val
 				}
-				manifests = append(manifests, manifestInfo{
+				manifestInfos = append(manifestInfos, manifestInfo{
 					ManifestDescriptor: manifestDescriptor,
 					ImageId:            imageId,
 				})
 			}
 		} else {
-			// Plain container image with layers.
+			// Plain container image with layers. Don't fail
+			// if its config can't be read from storage, as the
+			// manifest is still worth displaying.
 			layers = manifest.References()
+			config, err = ms.getImageConfig(req.Context(), manifest)
+			if err != nil {
+				log.Printf("Failed to read config of %s: %s", image.Digest, err)
+				configError = err.Error()
+			}
 		}
 	}
 
 	if err := ms.templates.ExecuteTemplate(w, "containers_image_info.html", struct {
-		Registry   *schema.ContainerRegistry
-		Repository *schema.ContainerRepository
-		Image      *schema.ContainerImage
-		Manifests  []manifestInfo
-		Layers     []distribution.Descriptor
+		Registry    *schema.ContainerRegistry
+		Repository  *schema.ContainerRepository
+		Image       *schema.ContainerImage
+		Manifests   []manifestInfo
+		Layers      []distribution.Descriptor
+		DriftCheck  *schema.DriftCheck
+		Subject     *schema.ContainerImage
+		Referrers   []schema.ContainerImage
+		Signatures  *schema.ContainerImage
+		Signed      *schema.ContainerImage
+		Config      *v1.Image
+		ConfigError string
+		Annotations map[string]string
+		Packages    []schema.ContainerImagePackage
 	}{
-		Registry:   &registry,
-		Repository: &repository,
-		Image:      &image,
-		Manifests:  manifests,
-		Layers:     layers,
+		Registry:    &registry,
+		Repository:  &repository,
+		Image:       &image,
+		Manifests:   manifestInfos,
+		Layers:      layers,
+		DriftCheck:  driftCheck,
+		Subject:     subject,
+		Referrers:   referrers,
+		Signatures:  signatures,
+		Signed:      signed,
+		Config:      config,
+		ConfigError: configError,
+		Annotations: annotations,
+		Packages:    packages,
 	}); err != nil {
 		log.Print(err)
 	}
 }
+
+func (ms *ContainerManagementService) handleImagePlatforms(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	imagePlatforms, err := parsePlatforms(req.Form.Get("platforms"))
+	if err != nil {
+		ms.handleErrorPage(w, req, err.Error(), http.StatusBadRequest)
+		return
+	}
+	imageId := mux.Vars(req)["image_id"]
+	if r := ms.database.Model(&schema.ContainerImage{}).Where("id = ?", imageId).Update("platforms", imagePlatforms); r.Error != nil {
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, "/containers/images/"+imageId, http.StatusSeeOther)
+}
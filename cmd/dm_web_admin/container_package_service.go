@@ -0,0 +1,109 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/sbom"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// ContainerPackageService allows extracting the packages installed in
+// mirrored container images, and exporting them as software bills of
+// materials.
+type ContainerPackageService struct {
+	database  *gorm.DB
+	templates *template.Template
+	s3Client  *s3.S3
+}
+
+func NewContainerPackageService(database *gorm.DB, templates *template.Template, router *mux.Router, s3Client *s3.S3) *ContainerPackageService {
+	ps := &ContainerPackageService{
+		database:  database,
+		templates: templates,
+		s3Client:  s3Client,
+	}
+	router.HandleFunc("/containers/images/{image_id:"+uuidRegex+"}/packages/extract", ps.handleExtract).Methods("POST")
+	router.HandleFunc("/containers/images/{image_id:"+uuidRegex+"}/sbom.spdx.json", ps.handleExportSPDX)
+	router.HandleFunc("/containers/images/{image_id:"+uuidRegex+"}/sbom.cdx.json", ps.handleExportCycloneDX)
+	return ps
+}
+
+func (ps *ContainerPackageService) handleErrorPage(w http.ResponseWriter, req *http.Request, message string, code int) {
+	renderErrorPage(ps.templates, w, message, code)
+}
+
+func (ps *ContainerPackageService) handleExtract(w http.ResponseWriter, req *http.Request) {
+	var image schema.ContainerImage
+	if r := ps.database.Where("id = ? AND manifest IS NOT NULL", mux.Vars(req)["image_id"]).Take(&image); r.Error != nil {
+		ps.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := sbom.ExtractPackages(req.Context(), ps.database, ps.s3Client, &image); err != nil {
+		ps.handleErrorPage(w, req, "Failed to extract packages: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, "/containers/images/"+image.Id, http.StatusSeeOther)
+}
+
+// handleExport writes the extracted packages of a container image as
+// a software bill of materials in a given format.
+func (ps *ContainerPackageService) handleExport(w http.ResponseWriter, req *http.Request, mediaType string, extension string, write func(io.Writer, *sbom.Image, []schema.ContainerImagePackage, time.Time) error) {
+	var image schema.ContainerImage
+	if r := ps.database.Where("id = ? AND packages_extracted_at IS NOT NULL", mux.Vars(req)["image_id"]).Take(&image); r.Error != nil {
+		if r.RecordNotFound() {
+			ps.handleErrorPage(w, req, "The packages of this container image have not been extracted", http.StatusNotFound)
+			return
+		}
+		ps.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	var repository schema.ContainerRepository
+	if r := ps.database.Where("id = ?", image.RepositoryId).Take(&repository); r.Error != nil {
+		ps.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	var registry schema.ContainerRegistry
+	if r := ps.database.Where("id = ?", repository.RegistryId).Take(&registry); r.Error != nil {
+		ps.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	registryUrl, err := url.Parse(registry.Uri)
+	if err != nil {
+		ps.handleErrorPage(w, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var packages []schema.ContainerImagePackage
+	if r := ps.database.Where("container_image_id = ?", image.Id).Order("location, name, version").Find(&packages); r.Error != nil {
+		ps.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	filename := path.Base(repository.RepositoryName) + "-" + strings.Replace(image.Digest, ":", "-", -1) + extension
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(filename))
+	if err := write(w, &sbom.Image{
+		Registry:   registryUrl.Host,
+		Repository: repository.RepositoryName,
+		Digest:     image.Digest,
+	}, packages, *image.PackagesExtractedAt); err != nil {
+		log.Printf("Failed to write body: %s", err)
+	}
+}
+
+func (ps *ContainerPackageService) handleExportSPDX(w http.ResponseWriter, req *http.Request) {
+	ps.handleExport(w, req, sbom.SPDXMediaType, ".spdx.json", sbom.WriteSPDX)
+}
+
+func (ps *ContainerPackageService) handleExportCycloneDX(w http.ResponseWriter, req *http.Request) {
+	ps.handleExport(w, req, sbom.CycloneDXMediaType, ".cdx.json", sbom.WriteCycloneDX)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Query that yields the most recent drift check of every
+	// artifact.
+	latestDriftChecksQuery = "SELECT DISTINCT ON (file_id, container_image_id) * FROM drift_checks ORDER BY file_id, container_image_id, checked_at DESC"
+)
+
+// DriftService displays the outcome of the drift checks performed by
+// dm_cron_check_drift, both as a web page and as Prometheus metrics.
+type DriftService struct {
+	database  *gorm.DB
+	templates *template.Template
+
+	artifactsDesc     *prometheus.Desc
+	lastCheckTimeDesc *prometheus.Desc
+}
+
+func NewDriftService(database *gorm.DB, templates *template.Template, router *mux.Router) *DriftService {
+	ds := &DriftService{
+		database:  database,
+		templates: templates,
+
+		artifactsDesc: prometheus.NewDesc(
+			"distfile_mirror_drift_artifacts",
+			"Number of artifacts, by the outcome of their most recent drift check.",
+			[]string{"kind", "status"},
+			nil),
+		lastCheckTimeDesc: prometheus.NewDesc(
+			"distfile_mirror_drift_last_check_timestamp_seconds",
+			"Time at which the most recent drift check was performed.",
+			nil,
+			nil),
+	}
+	router.HandleFunc("/drift/", ds.handleDriftList)
+	prometheus.MustRegister(ds)
+	return ds
+}
+
+func (ds *DriftService) handleErrorPage(w http.ResponseWriter, req *http.Request, message string, code int) {
+	renderErrorPage(ds.templates, w, message, code)
+}
+
+func (ds *DriftService) getLatestDriftChecks() ([]schema.DriftCheck, error) {
+	var driftChecks []schema.DriftCheck
+	if r := ds.database.Raw(latestDriftChecksQuery).Scan(&driftChecks); r.Error != nil {
+		return nil, r.Error
+	}
+	return driftChecks, nil
+}
+
+func (ds *DriftService) handleDriftList(w http.ResponseWriter, req *http.Request) {
+	driftChecks, err := ds.getLatestDriftChecks()
+	if err != nil {
+		ds.handleErrorPage(w, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Only list artifacts that have drifted, but count all of them.
+	type driftInfo struct {
+		Name       string
+		Link       string
+		DriftCheck schema.DriftCheck
+	}
+	var drifted []driftInfo
+	counts := map[string]int{}
+	var fileIds, containerImageIds []string
+	for _, driftCheck := range driftChecks {
+		counts[driftCheck.Status]++
+		if driftCheck.Status != schema.DriftStatusUnchanged {
+			if driftCheck.FileId != nil {
+				fileIds = append(fileIds, *driftCheck.FileId)
+			} else {
+				containerImageIds = append(containerImageIds, *driftCheck.ContainerImageId)
+			}
+		}
+	}
+
+	// Obtain names of the artifacts that have drifted.
+	var files []schema.File
+	if r := ds.database.Where("id IN (?)", fileIds).Find(&files); r.Error != nil {
+		ds.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	fileUris := map[string]string{}
+	for _, file := range files {
+		fileUris[file.Id] = file.Uri
+	}
+	var images []schema.ContainerImage
+	if r := ds.database.Where("id IN (?)", containerImageIds).Find(&images); r.Error != nil {
+		ds.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	imageNames := map[string]string{}
+	for _, image := range images {
+		var repository schema.ContainerRepository
+		if r := ds.database.Where("id = ?", image.RepositoryId).Take(&repository); r.Error != nil {
+			ds.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+			return
+		}
+		var registry schema.ContainerRegistry
+		if r := ds.database.Where("id = ?", repository.RegistryId).Take(&registry); r.Error != nil {
+			ds.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+			return
+		}
+		imageNames[image.Id] = registry.Uri + " " + repository.RepositoryName + " " + image.Digest
+	}
+
+	for _, driftCheck := range driftChecks {
+		if driftCheck.Status == schema.DriftStatusUnchanged {
+			continue
+		}
+		if driftCheck.FileId != nil {
+			drifted = append(drifted, driftInfo{
+				Name:       fileUris[*driftCheck.FileId],
+				Link:       "/files/" + *driftCheck.FileId,
+				DriftCheck: driftCheck,
+			})
+		} else {
+			drifted = append(drifted, driftInfo{
+				Name:       imageNames[*driftCheck.ContainerImageId],
+				Link:       "/containers/images/" + *driftCheck.ContainerImageId,
+				DriftCheck: driftCheck,
+			})
+		}
+	}
+
+	if err := ds.templates.ExecuteTemplate(w, "drift_list.html", struct {
+		Counts  map[string]int
+		Drifted []driftInfo
+	}{
+		Counts:  counts,
+		Drifted: drifted,
+	}); err != nil {
+		log.Print(err)
+	}
+}
+
+// Describe is part of the prometheus.Collector interface.
+func (ds *DriftService) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ds.artifactsDesc
+	ch <- ds.lastCheckTimeDesc
+}
+
+// Collect is part of the prometheus.Collector interface. Metrics are
+// computed from the database on every scrape, as the checks are
+// performed by a separate process.
+func (ds *DriftService) Collect(ch chan<- prometheus.Metric) {
+	driftChecks, err := ds.getLatestDriftChecks()
+	if err != nil {
+		log.Printf("Failed to obtain drift checks: %s", err)
+		return
+	}
+	type countKey struct {
+		kind   string
+		status string
+	}
+	counts := map[countKey]int{}
+	var lastCheckTime time.Time
+	for _, driftCheck := range driftChecks {
+		key := countKey{kind: "container_image", status: driftCheck.Status}
+		if driftCheck.FileId != nil {
+			key.kind = "file"
+		}
+		counts[key]++
+		if driftCheck.CheckedAt.After(lastCheckTime) {
+			lastCheckTime = driftCheck.CheckedAt
+		}
+	}
+	for key, count := range counts {
+		ch <- prometheus.MustNewConstMetric(ds.artifactsDesc, prometheus.GaugeValue, float64(count), key.kind, key.status)
+	}
+	if !lastCheckTime.IsZero() {
+		ch <- prometheus.MustNewConstMetric(ds.lastCheckTimeDesc, prometheus.GaugeValue, float64(lastCheckTime.Unix()))
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// renderErrorPage logs an error message and displays it to the user.
+// It is shared by all services of the admin interface.
+func renderErrorPage(templates *template.Template, w http.ResponseWriter, message string, code int) {
+	log.Print(message)
+	w.WriteHeader(code)
+	if err := templates.ExecuteTemplate(w, "error.html", struct {
+		Message string
+	}{
+		Message: message,
+	}); err != nil {
+		log.Print(err)
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/upstream"
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
 )
@@ -14,30 +18,26 @@ type FileManagementService struct {
 	database           *gorm.DB
 	templates          *template.Template
 	proxyPublicAddress string
+	destinationPolicy  *upstream.DestinationPolicy
 }
 
-func NewFileManagementService(database *gorm.DB, templates *template.Template, router *mux.Router, proxyPublicAddress string) *FileManagementService {
+func NewFileManagementService(database *gorm.DB, templates *template.Template, router *mux.Router, proxyPublicAddress string, destinationPolicy *upstream.DestinationPolicy) *FileManagementService {
 	ms := &FileManagementService{
 		database:           database,
 		templates:          templates,
 		proxyPublicAddress: proxyPublicAddress,
+		destinationPolicy:  destinationPolicy,
 	}
 	router.HandleFunc("/files/", ms.handleFilesList)
 	router.HandleFunc("/files/create", ms.handleCreate)
+	router.HandleFunc("/files/provenance.json", ms.handleProvenanceExport)
 	router.HandleFunc("/files/{file_id:"+uuidRegex+"}", ms.handleFileInfo)
+	router.HandleFunc("/files/{file_id:"+uuidRegex+"}/provenance.json", ms.handleFileProvenanceExport)
 	return ms
 }
 
 func (ms *FileManagementService) handleErrorPage(w http.ResponseWriter, req *http.Request, message string, code int) {
-	log.Print(message)
-	w.WriteHeader(code)
-	if err := ms.templates.ExecuteTemplate(w, "error.html", struct {
-		Message string
-	}{
-		Message: message,
-	}); err != nil {
-		log.Print(err)
-	}
+	renderErrorPage(ms.templates, w, message, code)
 }
 
 func (ms *FileManagementService) handleCreate(w http.ResponseWriter, req *http.Request) {
@@ -47,10 +47,30 @@ func (ms *FileManagementService) handleCreate(w http.ResponseWriter, req *http.R
 		// Create file if not yet present.
 		// TODO(edsch): Store metadata: who creates the image and for what reason.
 		// TODO(edsch): Allow the user to provide a desired SHA-256 sum.
+		uri := req.Form.Get("uri")
+		parsedUri, err := url.Parse(uri)
+		if err != nil {
+			ms.handleErrorPage(w, req, "Invalid URI: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := ms.destinationPolicy.CheckUrl(parsedUri); err != nil {
+			ms.handleErrorPage(w, req, "URI may not be downloaded: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var attributes schema.File
+		if timeout := req.Form.Get("download_timeout"); timeout != "" {
+			duration, err := time.ParseDuration(timeout)
+			if err != nil || duration < time.Second {
+				ms.handleErrorPage(w, req, "Invalid download timeout: "+timeout, http.StatusBadRequest)
+				return
+			}
+			seconds := uint64(duration / time.Second)
+			attributes.DownloadTimeoutSeconds = &seconds
+		}
 		var file schema.File
-		if r := ms.database.FirstOrCreate(&file, schema.File{
-			Uri: req.Form.Get("uri"),
-		}); r.Error != nil {
+		if r := ms.database.Where(schema.File{
+			Uri: uri,
+		}).Assign(attributes).FirstOrCreate(&file); r.Error != nil {
 			ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -88,13 +108,90 @@ func (ms *FileManagementService) handleFileInfo(w http.ResponseWriter, req *http
 		return
 	}
 
+	// Obtain the provenance of the file.
+	var downloads []schema.FileDownload
+	if r := ms.database.Where("file_id = ?", file.Id).Order("downloaded_at").Find(&downloads); r.Error != nil {
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Obtain the most recent comparison against upstream.
+	var driftCheck *schema.DriftCheck
+	var lastDriftCheck schema.DriftCheck
+	if r := ms.database.Where("file_id = ?", file.Id).Order("checked_at DESC").Take(&lastDriftCheck); r.Error == nil {
+		driftCheck = &lastDriftCheck
+	} else if !r.RecordNotFound() {
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	if err := ms.templates.ExecuteTemplate(w, "file_info.html", struct {
 		File               *schema.File
+		Downloads          []schema.FileDownload
+		DriftCheck         *schema.DriftCheck
 		ProxyPublicAddress string
 	}{
 		File:               &file,
+		Downloads:          downloads,
+		DriftCheck:         driftCheck,
 		ProxyPublicAddress: ms.proxyPublicAddress,
 	}); err != nil {
 		log.Print(err)
 	}
 }
+
+// fileProvenance is the format in which the provenance of files is
+// exported.
+type fileProvenance struct {
+	File      schema.File
+	Downloads []schema.FileDownload
+}
+
+func (ms *FileManagementService) writeProvenance(w http.ResponseWriter, req *http.Request, files []schema.File) {
+	var fileIds []string
+	for _, file := range files {
+		fileIds = append(fileIds, file.Id)
+	}
+	var downloads []schema.FileDownload
+	if r := ms.database.Where("file_id IN (?)", fileIds).Order("downloaded_at").Find(&downloads); r.Error != nil {
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	downloadsByFile := map[string][]schema.FileDownload{}
+	for _, download := range downloads {
+		downloadsByFile[download.FileId] = append(downloadsByFile[download.FileId], download)
+	}
+
+	provenance := []fileProvenance{}
+	for _, file := range files {
+		provenance = append(provenance, fileProvenance{
+			File:      file,
+			Downloads: downloadsByFile[file.Id],
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(provenance); err != nil {
+		log.Print(err)
+	}
+}
+
+func (ms *FileManagementService) handleProvenanceExport(w http.ResponseWriter, req *http.Request) {
+	var files []schema.File
+	if r := ms.database.Order("uri").Find(&files); r.Error != nil {
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	ms.writeProvenance(w, req, files)
+}
+
+func (ms *FileManagementService) handleFileProvenanceExport(w http.ResponseWriter, req *http.Request) {
+	var file schema.File
+	if r := ms.database.Where("id = ?", mux.Vars(req)["file_id"]).Take(&file); r.Error != nil {
+		// TODO(edsch): Error code.
+		ms.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	ms.writeProvenance(w, req, []schema.File{file})
+}
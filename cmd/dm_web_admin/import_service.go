@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/archive"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/util"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// Maximum size of a form value that is uploaded along with a file.
+const maximumFormValueSize = 64 * 1024
+
+var sha256Regex = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// ImportService allows registering container images and files that
+// were obtained through other means than downloading them from their
+// upstream (e.g., "docker save" tarballs provided by vendors). Uploads
+// are stored as if they were downloaded, while their provenance
+// records that they were imported manually.
+type ImportService struct {
+	database       *gorm.DB
+	templates      *template.Template
+	s3Client       *s3.S3
+	uploader       *s3manager.Uploader
+	spoolDirectory string
+}
+
+func NewImportService(database *gorm.DB, templates *template.Template, router *mux.Router, s3Client *s3.S3, spoolDirectory string) *ImportService {
+	is := &ImportService{
+		database:       database,
+		templates:      templates,
+		s3Client:       s3Client,
+		uploader:       s3manager.NewUploaderWithClient(s3Client),
+		spoolDirectory: spoolDirectory,
+	}
+	router.HandleFunc("/containers/import", is.handleContainerImport)
+	router.HandleFunc("/files/import", is.handleFileImport)
+	return is
+}
+
+func (is *ImportService) handleErrorPage(w http.ResponseWriter, req *http.Request, message string, code int) {
+	renderErrorPage(is.templates, w, message, code)
+}
+
+// spoolUpload reads a multipart form containing a single file, writing
+// the file to the spool directory. The caller must close and remove
+// the file.
+func (is *ImportService) spoolUpload(req *http.Request, fileField string) (url.Values, *os.File, string, error) {
+	reader, err := req.MultipartReader()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	values := url.Values{}
+	var upload *os.File
+	var filename string
+	cleanup := func() {
+		if upload != nil {
+			upload.Close()
+			os.Remove(upload.Name())
+		}
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			cleanup()
+			return nil, nil, "", err
+		}
+		if part.FormName() == fileField && part.FileName() != "" {
+			if upload != nil {
+				cleanup()
+				return nil, nil, "", fmt.Errorf("Multiple files provided for %s", fileField)
+			}
+			upload, err = ioutil.TempFile(is.spoolDirectory, "upload")
+			if err != nil {
+				return nil, nil, "", err
+			}
+			filename = part.FileName()
+			if _, err := io.Copy(upload, part); err != nil {
+				cleanup()
+				return nil, nil, "", err
+			}
+		} else {
+			value, err := ioutil.ReadAll(io.LimitReader(part, maximumFormValueSize+1))
+			if err != nil {
+				cleanup()
+				return nil, nil, "", err
+			}
+			if len(value) > maximumFormValueSize {
+				cleanup()
+				return nil, nil, "", fmt.Errorf("Value of %s is too large", part.FormName())
+			}
+			values.Add(part.FormName(), string(value))
+		}
+	}
+	if upload == nil {
+		return nil, nil, "", fmt.Errorf("No file provided for %s", fileField)
+	}
+	if _, err := upload.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, nil, "", err
+	}
+	return values, upload, filename, nil
+}
+
+func (is *ImportService) handleContainerImport(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		// Present import form.
+		if err := is.templates.ExecuteTemplate(w, "containers_import.html", nil); err != nil {
+			log.Print(err)
+		}
+		return
+	}
+
+	form, upload, _, err := is.spoolUpload(req, "archive")
+	if err != nil {
+		is.handleErrorPage(w, req, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer os.Remove(upload.Name())
+	defer upload.Close()
+
+	// Images are imported into the repository from which they
+	// originate, so that they are served under their original name.
+	registryUri := form.Get("registry")
+	if parsedRegistryUri, err := url.Parse(registryUri); err != nil || !parsedRegistryUri.IsAbs() {
+		is.handleErrorPage(w, req, "Invalid registry URI", http.StatusBadRequest)
+		return
+	}
+	repositoryName := form.Get("repository")
+	if repositoryName == "" {
+		is.handleErrorPage(w, req, "No repository provided", http.StatusBadRequest)
+		return
+	}
+	var registry schema.ContainerRegistry
+	if r := is.database.FirstOrCreate(&registry, schema.ContainerRegistry{
+		Uri: registryUri,
+	}); r.Error != nil {
+		is.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	var repository schema.ContainerRepository
+	if r := is.database.FirstOrCreate(&repository, schema.ContainerRepository{
+		RegistryId:     registry.Id,
+		RepositoryName: repositoryName,
+	}); r.Error != nil {
+		is.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	images, err := archive.ImportImages(req.Context(), is.database, is.s3Client, is.uploader, upload, &repository)
+	if err != nil {
+		is.handleErrorPage(w, req, "Failed to import archive: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(images) == 1 {
+		http.Redirect(w, req, "/containers/images/"+images[0].Id, http.StatusSeeOther)
+	} else {
+		http.Redirect(w, req, "/containers/repositories/"+repository.Id, http.StatusSeeOther)
+	}
+}
+
+func (is *ImportService) handleFileImport(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		// Present import form.
+		if err := is.templates.ExecuteTemplate(w, "files_import.html", nil); err != nil {
+			log.Print(err)
+		}
+		return
+	}
+
+	form, upload, uploadedFilename, err := is.spoolUpload(req, "file")
+	if err != nil {
+		is.handleErrorPage(w, req, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer os.Remove(upload.Name())
+	defer upload.Close()
+
+	// The URI under which the file is served by the proxy needs to
+	// be declared, as it cannot be derived from the upload.
+	uri := form.Get("uri")
+	if parsedUri, err := url.Parse(uri); err != nil || !parsedUri.IsAbs() {
+		is.handleErrorPage(w, req, "Invalid URI", http.StatusBadRequest)
+		return
+	}
+	var desiredSha256 *string
+	if checksum := strings.ToLower(strings.TrimSpace(form.Get("sha256"))); checksum != "" {
+		if !sha256Regex.MatchString(checksum) {
+			is.handleErrorPage(w, req, "Invalid SHA-256 checksum", http.StatusBadRequest)
+			return
+		}
+		desiredSha256 = &checksum
+	}
+
+	hasher := sha256.New()
+	fileSize, err := io.Copy(hasher, upload)
+	if err != nil {
+		is.handleErrorPage(w, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	if desiredSha256 != nil && *desiredSha256 != checksum {
+		is.handleErrorPage(w, req, fmt.Sprintf("Uploaded file has checksum %s, whereas %s was declared", checksum, *desiredSha256), http.StatusBadRequest)
+		return
+	}
+
+	// Refuse to replace the contents of a file that is already
+	// mirrored, or that is expected to have other contents.
+	var file schema.File
+	if r := is.database.Where("uri = ?", uri).Take(&file); r.Error == nil {
+		if file.Sha256 != nil && *file.Sha256 != checksum {
+			is.handleErrorPage(w, req, fmt.Sprintf("File is already registered with checksum %s", *file.Sha256), http.StatusConflict)
+			return
+		}
+	} else if !r.RecordNotFound() {
+		is.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Store the file in the same way as the downloader.
+	key := fmt.Sprintf("%s|%d", checksum, fileSize)
+	if present, err := util.ObjectExists(req.Context(), is.s3Client, "files", key); err != nil {
+		is.handleErrorPage(w, req, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !present {
+		if _, err := upload.Seek(0, io.SeekStart); err != nil {
+			is.handleErrorPage(w, req, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if _, err := is.uploader.UploadWithContext(req.Context(), &s3manager.UploadInput{
+			Bucket: aws.String("files"),
+			Key:    aws.String(key),
+			Body:   upload,
+		}); err != nil {
+			is.handleErrorPage(w, req, "Failed to store file: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Record the provenance of the file and mark it as present.
+	tx := is.database.Begin()
+	if r := tx.FirstOrCreate(&file, schema.File{
+		Uri: uri,
+	}); r.Error != nil {
+		tx.Rollback()
+		is.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r := tx.Create(&schema.FileDownload{
+		FileId:            file.Id,
+		DownloadedAt:      time.Now(),
+		DownloaderVersion: util.Version,
+		ManuallyImported:  true,
+		UploadedFilename:  &uploadedFilename,
+	}); r.Error != nil {
+		tx.Rollback()
+		is.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	attributes := map[string]interface{}{
+		"sha256":  checksum,
+		"size":    fileSize,
+		"present": true,
+	}
+	if contentType := form.Get("content_type"); contentType != "" {
+		attributes["content_type"] = contentType
+	}
+	if r := tx.Model(&schema.File{}).Where("id = ?", file.Id).Updates(attributes); r.Error != nil {
+		tx.Rollback()
+		is.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r := tx.Commit(); r.Error != nil {
+		is.handleErrorPage(w, req, r.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, "/files/"+file.Id, http.StatusSeeOther)
+}
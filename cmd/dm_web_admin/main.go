@@ -5,8 +5,15 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"os"
 
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/credentials"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/upstream"
 	"github.com/ProdriveTechnologies/distfile-mirror/pkg/util"
+	"github.com/aws/aws-sdk-go/aws"
+	aws_credentials "github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
@@ -20,16 +27,70 @@ const (
 
 func main() {
 	var (
-		dbAddress          = flag.String("db.address", "", "Database server address.")
-		proxyPublicAddress = flag.String("proxy.public-address", "", "Public address at which the proxy can be contacted.")
+		credentialsDockerConfig      = flag.String("credentials.docker-config", "", "Path of a Docker config.json file holding container registry credentials")
+		credentialsEncryptionKeyFile = flag.String("credentials.encryption-key-file", "", "Path of a file holding the hex encoded AES-256 key used to encrypt container registry credentials stored in the database")
+		dbAddress                    = flag.String("db.address", "", "Database server address.")
+		importSpoolDirectory         = flag.String("import.spool-directory", os.TempDir(), "Directory in which uploaded archives and files are stored while they are imported")
+		proxyPublicAddress           = flag.String("proxy.public-address", "", "Public address at which the proxy can be contacted.")
+
+		s3AccessKeyId     = flag.String("s3.access-key-id", "", "Access key of the S3 bucket holding distfiles")
+		s3DisableSsl      = flag.Bool("s3.disable-ssl", false, "Whether SSL should be disabled for the S3 bucket holding distfiles")
+		s3Endpoint        = flag.String("s3.endpoint", "", "Endpoint URL of the S3 bucket holding distfiles")
+		s3Region          = flag.String("s3.region", "", "Region of the S3 bucket holding distfiles")
+		s3SecretAccessKey = flag.String("s3.secret-access-key", "", "Secret access key of the S3 bucket holding distfiles")
+
+		upstreamFlags = upstream.RegisterFlags()
 	)
 	flag.Parse()
 
+	// Reject artifacts that the downloaders are not permitted to
+	// fetch right away. This should use the same policy as the
+	// downloaders.
+	destinationPolicy, err := upstreamFlags.NewDestinationPolicy()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Tags of container images are resolved against the registry
+	// directly, using the same transport and credentials as the
+	// downloaders.
+	transportFactory, err := upstreamFlags.NewTransportFactory(destinationPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var dockerConfig *credentials.DockerConfig
+	if *credentialsDockerConfig != "" {
+		dockerConfig, err = credentials.LoadDockerConfigFile(*credentialsDockerConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var credentialsCipher *credentials.Cipher
+	if *credentialsEncryptionKeyFile != "" {
+		credentialsCipher, err = credentials.NewCipherFromKeyFile(*credentialsEncryptionKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	db, err := gorm.Open("postgres", *dbAddress)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Container image configs, layers and the files contained
+	// within are read from storage to display and export them.
+	// Imported container images and files are written to it.
+	s3Session := session.New(&aws.Config{
+		Credentials:      aws_credentials.NewStaticCredentials(*s3AccessKeyId, *s3SecretAccessKey, ""),
+		Endpoint:         s3Endpoint,
+		Region:           s3Region,
+		DisableSSL:       s3DisableSsl,
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	s3Client := s3.New(s3Session)
+
 	templates, err := template.ParseGlob("templates/*")
 	if err != nil {
 		log.Fatal(err)
@@ -40,7 +101,12 @@ func main() {
 	util.RegisterHealthPage(db, router)
 	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static/"))))
 	NewFrontpageService(templates, router, *proxyPublicAddress)
-	NewContainerManagementService(db, templates, router)
-	NewFileManagementService(db, templates, router, *proxyPublicAddress)
+	NewContainerManagementService(db, templates, router, credentialsCipher, dockerConfig, destinationPolicy, transportFactory.NewTransport(nil), s3Client)
+	NewContainerArchiveService(db, templates, router, s3Client)
+	NewContainerFilesystemService(db, templates, router, s3Client)
+	NewContainerPackageService(db, templates, router, s3Client)
+	NewFileManagementService(db, templates, router, *proxyPublicAddress, destinationPolicy)
+	NewImportService(db, templates, router, s3Client, *importSpoolDirectory)
+	NewDriftService(db, templates, router)
 	log.Fatal(http.ListenAndServe(":80", router))
 }
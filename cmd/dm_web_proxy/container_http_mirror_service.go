@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"io"
 	"log"
 	"net/http"
@@ -8,31 +9,60 @@ import (
 	"regexp"
 	"strconv"
 
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/cosign"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/manifests"
 	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/util"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/jinzhu/gorm"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 var (
 	containerPingPattern      = regexp.MustCompile("(.*/)v2/$")
 	containerManifestsPattern = regexp.MustCompile("(.*/)v2/(.*)/manifests/(.*)")
 	containerBlobsPattern     = regexp.MustCompile("(.*/)v2/(.*)/blobs/(.*)")
+	containerReferrersPattern = regexp.MustCompile("(.*/)v2/(.*)/referrers/(.*)")
+
+	// Tag under which cosign stores the signatures of a manifest.
+	cosignSignatureTagPattern = regexp.MustCompile("^(sha256)-([0-9a-f]{64})\\.sig$")
 )
 
+// referrerDescriptor is an entry in the image index returned by the OCI
+// referrers API.
+type referrerDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
 type containerHttpMirrorService struct {
-	scheme   string
-	database *gorm.DB
-	s3       *s3.S3
-	fallback http.Handler
+	scheme            string
+	database          *gorm.DB
+	s3                *s3.S3
+	uploader          *s3manager.Uploader
+	pushAuthenticator *pushAuthenticator
+	trustRoot         *cosign.TrustRoot
+	fallback          http.Handler
 }
 
-func NewContainerHttpMirrorService(scheme string, database *gorm.DB, s3 *s3.S3, fallback http.Handler) http.Handler {
+// NewContainerHttpMirrorService creates a HTTP handler that serves
+// mirrored container images. Images may also be pushed if a
+// pushAuthenticator is provided, in which case keyless signatures of
+// pushed images are verified against trustRoot.
+func NewContainerHttpMirrorService(scheme string, database *gorm.DB, s3 *s3.S3, uploader *s3manager.Uploader, pushAuthenticator *pushAuthenticator, trustRoot *cosign.TrustRoot, fallback http.Handler) http.Handler {
 	return &containerHttpMirrorService{
-		scheme:   scheme,
-		database: database,
-		s3:       s3,
-		fallback: fallback,
+		scheme:            scheme,
+		database:          database,
+		s3:                s3,
+		uploader:          uploader,
+		pushAuthenticator: pushAuthenticator,
+		trustRoot:         trustRoot,
+		fallback:          fallback,
 	}
 }
 
@@ -68,6 +98,10 @@ func (ms *containerHttpMirrorService) getRepository(host string, path string, re
 }
 
 func (ms *containerHttpMirrorService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if ms.pushAuthenticator != nil && ms.servePush(w, req) {
+		return
+	}
+
 	if matches := containerPingPattern.FindStringSubmatch(req.URL.Path); matches != nil {
 		// Serve a HTTP 200 response for ping requests for existing repositories.
 		registry, err := ms.getRegistry(req.Host, matches[1])
@@ -92,8 +126,30 @@ func (ms *containerHttpMirrorService) ServeHTTP(w http.ResponseWriter, req *http
 			goto NoMatch
 		}
 
+		// Only digests and the tags of mirrored signatures can
+		// be resolved. Images that are held back until they are
+		// signed are only served to users that may push, as
+		// cosign needs to obtain them for signing.
+		query := ms.database.Where("repository_id = ? AND manifest IS NOT NULL", repository.Id)
+		if ms.pushAuthenticator != nil {
+			if username, ok := ms.pushAuthenticator.authenticate(req, ms.scheme == "https"); ok && username != "" {
+				query = ms.database.Where("repository_id = ? AND (manifest IS NOT NULL OR pending_manifest IS NOT NULL)", repository.Id)
+			}
+		}
+		if tagMatches := cosignSignatureTagPattern.FindStringSubmatch(matches[3]); tagMatches != nil {
+			// Multiple signature manifests may exist for
+			// the same image (e.g., when signatures were
+			// pushed after mirroring). Prefer the ones that
+			// are present, followed by the most recently
+			// pushed one, as cosign appends signatures to
+			// existing ones.
+			query = query.Where("signed_digest = ?", tagMatches[1]+":"+tagMatches[2]).
+				Order("manifest IS NULL, pushed_at IS NULL, pushed_at DESC, digest")
+		} else {
+			query = query.Where("digest = ?", matches[3])
+		}
 		var image schema.ContainerImage
-		if r := ms.database.Where("repository_id = ? AND digest = ? AND manifest IS NOT NULL", repository.Id, matches[3]).Take(&image); r.Error != nil {
+		if r := query.Take(&image); r.Error != nil {
 			if r.RecordNotFound() {
 				goto NoMatch
 			}
@@ -101,9 +157,70 @@ func (ms *containerHttpMirrorService) ServeHTTP(w http.ResponseWriter, req *http
 			return
 		}
 
-		w.Header().Set("Content-Length", strconv.FormatInt(int64(len(*image.Manifest)), 10))
-		w.Header().Set("Content-Type", *image.ManifestMediatype)
-		w.Write(*image.Manifest)
+		manifestMediatype, manifest := image.ManifestMediatype, image.Manifest
+		if manifest == nil {
+			manifestMediatype, manifest = image.PendingManifestMediatype, image.PendingManifest
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(int64(len(*manifest)), 10))
+		w.Header().Set("Content-Type", *manifestMediatype)
+		w.Header().Set("Docker-Content-Digest", image.Digest)
+		w.Write(*manifest)
+		return
+	} else if matches := containerReferrersPattern.FindStringSubmatch(req.URL.Path); matches != nil {
+		// Serve the list of mirrored manifests that are
+		// attached to a manifest as an OCI image index.
+		repository, err := ms.getRepository(req.Host, matches[1], matches[2])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if repository == nil {
+			goto NoMatch
+		}
+
+		var images []schema.ContainerImage
+		query := ms.database.Where("repository_id = ? AND subject_digest = ? AND manifest IS NOT NULL", repository.Id, matches[3])
+		artifactType := req.URL.Query().Get("artifactType")
+		if artifactType != "" {
+			query = query.Where("artifact_type = ?", artifactType)
+			w.Header().Set("OCI-Filters-Applied", "artifactType")
+		}
+		if r := query.Order("digest").Find(&images); r.Error != nil {
+			http.Error(w, r.Error.Error(), http.StatusInternalServerError)
+			return
+		}
+		descriptors := []referrerDescriptor{}
+		for _, image := range images {
+			metadata, err := manifests.ParseMetadata(*image.Manifest)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			descriptors = append(descriptors, referrerDescriptor{
+				MediaType:    *image.ManifestMediatype,
+				Digest:       image.Digest,
+				Size:         int64(len(*image.Manifest)),
+				ArtifactType: metadata.ArtifactType,
+				Annotations:  metadata.Annotations,
+			})
+		}
+		index, err := json.Marshal(struct {
+			SchemaVersion int                  `json:"schemaVersion"`
+			MediaType     string               `json:"mediaType"`
+			Manifests     []referrerDescriptor `json:"manifests"`
+		}{
+			SchemaVersion: 2,
+			MediaType:     v1.MediaTypeImageIndex,
+			Manifests:     descriptors,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Length", strconv.FormatInt(int64(len(index)), 10))
+		w.Header().Set("Content-Type", v1.MediaTypeImageIndex)
+		w.Write(index)
 		return
 	} else if matches := containerBlobsPattern.FindStringSubmatch(req.URL.Path); matches != nil {
 		// Serve blob from S3. Don't care whether the blob
@@ -118,30 +235,77 @@ func (ms *containerHttpMirrorService) ServeHTTP(w http.ResponseWriter, req *http
 			goto NoMatch
 		}
 
-		blob, err := ms.s3.GetObjectWithContext(req.Context(), &s3.GetObjectInput{
+		ms.serveBlob(w, req, matches[3])
+		return
+	}
+
+NoMatch:
+	// Foreign layers that have been mirrored are served at the
+	// URLs from which they were downloaded, as clients fetch them
+	// from there instead of from the registry.
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		url := *req.URL
+		url.Scheme = ms.scheme
+		url.Host = req.Host
+		var foreignLayer schema.ContainerForeignLayer
+		if r := ms.database.Where("url = ?", url.String()).Take(&foreignLayer); r.Error == nil {
+			ms.serveBlob(w, req, foreignLayer.Digest)
+			return
+		} else if !r.RecordNotFound() {
+			http.Error(w, r.Error.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	ms.fallback.ServeHTTP(w, req)
+}
+
+// serveBlob serves a blob from S3.
+func (ms *containerHttpMirrorService) serveBlob(w http.ResponseWriter, req *http.Request, blobDigest string) {
+	// Clients that push images check for the existence of blobs,
+	// so HEAD requests and missing blobs need to be handled
+	// properly.
+	if req.Method == http.MethodHead {
+		blob, err := ms.s3.HeadObjectWithContext(req.Context(), &s3.HeadObjectInput{
 			Bucket: aws.String("container-blobs"),
-			Key:    aws.String(matches[3]),
+			Key:    aws.String(blobDigest),
 		})
 		if err != nil {
-			// TODO(edsch): Return 404 where applicable.
+			if util.IsNotFound(err) {
+				writeRegistryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "Blob not found")
+				return
+			}
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-
-		// Copy blob to HTTP response.
 		if blob.ContentLength != nil {
 			w.Header().Set("Content-Length", strconv.FormatInt(*blob.ContentLength, 10))
 		}
 		w.Header().Set("Content-Type", "application/octet-stream")
-		_, err = io.Copy(w, blob.Body)
-		blob.Body.Close()
-		if err != nil {
-			log.Printf("Failed to write body: %s", err)
+		w.Header().Set("Docker-Content-Digest", blobDigest)
+		return
+	}
+	blob, err := ms.s3.GetObjectWithContext(req.Context(), &s3.GetObjectInput{
+		Bucket: aws.String("container-blobs"),
+		Key:    aws.String(blobDigest),
+	})
+	if err != nil {
+		if util.IsNotFound(err) {
+			writeRegistryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "Blob not found")
 			return
 		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-NoMatch:
-	ms.fallback.ServeHTTP(w, req)
+	// Copy blob to HTTP response.
+	if blob.ContentLength != nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(*blob.ContentLength, 10))
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", blobDigest)
+	_, err = io.Copy(w, blob.Body)
+	blob.Body.Close()
+	if err != nil {
+		log.Printf("Failed to write body: %s", err)
+	}
 }
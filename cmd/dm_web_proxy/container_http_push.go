@@ -0,0 +1,743 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/cosign"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/manifests"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/util"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	_ "github.com/docker/distribution/manifest/ocischema"
+	"github.com/docker/distribution/manifest/schema1"
+	_ "github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// Maximum size of a manifest that may be pushed.
+const maximumManifestSize = 4 * 1024 * 1024
+
+var (
+	containerTokenPattern   = regexp.MustCompile("(.*/)v2/token$")
+	containerUploadsPattern = regexp.MustCompile("(.*/)v2/(.*)/blobs/uploads/(.*)")
+
+	repositoryNamePattern = regexp.MustCompile("^" + reference.NameRegexp.String() + "$")
+	tagPattern            = regexp.MustCompile("^" + reference.TagRegexp.String() + "$")
+	uploadIdPattern       = regexp.MustCompile("^[a-f0-9]{8}-[a-f0-9]{4}-[1-5][a-f0-9]{3}-[a-f0-9]{4}-[a-f0-9]{12}$")
+)
+
+// writeRegistryError writes an error response in the format of the OCI
+// distribution specification, so that clients can display it.
+func writeRegistryError(w http.ResponseWriter, code int, errorCode string, message string) {
+	body, err := json.Marshal(struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}{
+		Errors: []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}{{Code: errorCode, Message: message}},
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.FormatInt(int64(len(body)), 10))
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// writeChallenge requests the client to authenticate by obtaining a
+// bearer token.
+func (ms *containerHttpMirrorService) writeChallenge(w http.ResponseWriter, req *http.Request, registryPath string, scope string) {
+	realm := url.URL{
+		Scheme: ms.scheme,
+		Host:   req.Host,
+		Path:   registryPath + "v2/token",
+	}
+	challenge := fmt.Sprintf("Bearer realm=%q,service=%q", realm.String(), req.Host)
+	if scope != "" {
+		challenge += fmt.Sprintf(",scope=%q", scope)
+	}
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	w.Header().Set("WWW-Authenticate", challenge)
+	writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Authentication required")
+}
+
+// getOrCreateRepository returns the repository to which an image is
+// pushed. Registries and repositories are created on demand, so that
+// images of registries that have not been mirrored before can be
+// pushed.
+func (ms *containerHttpMirrorService) getOrCreateRepository(host string, path string, repositoryName string) (*schema.ContainerRepository, error) {
+	registryUrl := url.URL{
+		Scheme: ms.scheme,
+		Host:   host,
+		Path:   path,
+	}
+	var registry schema.ContainerRegistry
+	if r := ms.database.FirstOrCreate(&registry, schema.ContainerRegistry{
+		Uri: registryUrl.String(),
+	}); r.Error != nil {
+		return nil, r.Error
+	}
+	var repository schema.ContainerRepository
+	if r := ms.database.FirstOrCreate(&repository, schema.ContainerRepository{
+		RegistryId:     registry.Id,
+		RepositoryName: repositoryName,
+	}); r.Error != nil {
+		return nil, r.Error
+	}
+	return &repository, nil
+}
+
+// servePush handles the requests needed to push container images,
+// namely obtaining tokens, uploading blobs and storing manifests. It
+// returns false for requests that are served as if the mirror is
+// read-only.
+func (ms *containerHttpMirrorService) servePush(w http.ResponseWriter, req *http.Request) bool {
+	if containerTokenPattern.MatchString(req.URL.Path) {
+		ms.handleToken(w, req)
+		return true
+	}
+
+	username, authenticated := ms.pushAuthenticator.authenticate(req, ms.scheme == "https")
+	if matches := containerPingPattern.FindStringSubmatch(req.URL.Path); matches != nil {
+		// Clients only send credentials if requested to do so
+		// when pinging.
+		if !authenticated || req.Header.Get("Authorization") == "" {
+			ms.writeChallenge(w, req, matches[1], "")
+			return true
+		}
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		return true
+	}
+
+	isUpload := true
+	matches := containerUploadsPattern.FindStringSubmatch(req.URL.Path)
+	if matches == nil {
+		isUpload = false
+		matches = containerManifestsPattern.FindStringSubmatch(req.URL.Path)
+		if matches == nil || req.Method != http.MethodPut {
+			return false
+		}
+	}
+	if !authenticated || username == "" {
+		ms.writeChallenge(w, req, matches[1], "repository:"+matches[2]+":pull,push")
+		return true
+	}
+	if !repositoryNamePattern.MatchString(matches[2]) {
+		writeRegistryError(w, http.StatusBadRequest, "NAME_INVALID", "Invalid repository name")
+		return true
+	}
+	if !ms.pushAuthenticator.mayPush(req.Host + matches[1] + matches[2]) {
+		writeRegistryError(w, http.StatusForbidden, "DENIED", "Images may not be pushed into this repository")
+		return true
+	}
+	repository, err := ms.getOrCreateRepository(req.Host, matches[1], matches[2])
+	if err != nil {
+		writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return true
+	}
+	if isUpload {
+		ms.handleUpload(w, req, matches[1]+"v2/"+matches[2]+"/blobs/", repository, matches[3])
+	} else {
+		ms.handleManifestPut(w, req, matches[1]+"v2/"+matches[2]+"/manifests/", repository, matches[3], username)
+	}
+	return true
+}
+
+// handleToken issues bearer tokens. Clients that provide valid
+// credentials obtain tokens that permit pushing.
+func (ms *containerHttpMirrorService) handleToken(w http.ResponseWriter, req *http.Request) {
+	username := ""
+	if user, password, ok := req.BasicAuth(); ok {
+		if ms.scheme != "https" {
+			writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Credentials may only be provided over HTTPS")
+			return
+		}
+		if !ms.pushAuthenticator.checkPassword(user, password) {
+			writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid username or password")
+			return
+		}
+		username = user
+	}
+	now := time.Now()
+	token := ms.pushAuthenticator.issueToken(username, now)
+	body, err := json.Marshal(struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+		IssuedAt    string `json:"issued_at"`
+	}{
+		Token:       token,
+		AccessToken: token,
+		ExpiresIn:   int64(ms.pushAuthenticator.tokenLifetime / time.Second),
+		IssuedAt:    now.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func writeBlobCreated(w http.ResponseWriter, blobsPath string, blobDigest digest.Digest) {
+	w.Header().Set("Location", blobsPath+string(blobDigest))
+	w.Header().Set("Docker-Content-Digest", string(blobDigest))
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func writeUploadStatus(w http.ResponseWriter, blobsPath string, upload *schema.ContainerBlobUpload, code int) {
+	end := upload.Size
+	if end > 0 {
+		end--
+	}
+	w.Header().Set("Location", blobsPath+"uploads/"+upload.Id)
+	w.Header().Set("Docker-Upload-UUID", upload.Id)
+	w.Header().Set("Range", fmt.Sprintf("0-%d", end))
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(code)
+}
+
+// getChunkKey returns the key of the object in the "container-uploads"
+// bucket that holds a chunk of an upload. Offsets are padded, so that
+// chunks are listed in order.
+func getChunkKey(upload *schema.ContainerBlobUpload, offset int64) string {
+	return fmt.Sprintf("%s/%020d", upload.Id, offset)
+}
+
+func (ms *containerHttpMirrorService) handleUpload(w http.ResponseWriter, req *http.Request, blobsPath string, repository *schema.ContainerRepository, uploadId string) {
+	if uploadId == "" {
+		if req.Method != http.MethodPost {
+			writeRegistryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "Uploads must be started using POST")
+			return
+		}
+		ms.handleUploadStart(w, req, blobsPath, repository)
+		return
+	}
+
+	var upload schema.ContainerBlobUpload
+	if !uploadIdPattern.MatchString(uploadId) {
+		writeRegistryError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "Upload not found")
+		return
+	}
+	if r := ms.database.Where("id = ? AND repository_id = ?", uploadId, repository.Id).Take(&upload); r.Error != nil {
+		if r.RecordNotFound() {
+			writeRegistryError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "Upload not found")
+			return
+		}
+		writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", r.Error.Error())
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		writeUploadStatus(w, blobsPath, &upload, http.StatusNoContent)
+	case http.MethodPatch:
+		if ms.storeChunk(w, req, &upload) {
+			writeUploadStatus(w, blobsPath, &upload, http.StatusAccepted)
+		}
+	case http.MethodPut:
+		// The final chunk may be provided when completing
+		// the upload.
+		if ms.storeChunk(w, req, &upload) {
+			ms.handleUploadFinish(w, req, blobsPath, &upload)
+		}
+	case http.MethodDelete:
+		if err := ms.deleteUpload(req.Context(), &upload); err != nil {
+			writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeRegistryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "Unsupported method")
+	}
+}
+
+// handleUploadStart starts the upload of a blob. Blobs may also be
+// uploaded in a single request, or be mounted from another repository.
+func (ms *containerHttpMirrorService) handleUploadStart(w http.ResponseWriter, req *http.Request, blobsPath string, repository *schema.ContainerRepository) {
+	query := req.URL.Query()
+
+	// All repositories share the same blob storage, meaning that
+	// any blob that is present can be mounted.
+	if mountDigest, err := digest.Parse(query.Get("mount")); err == nil {
+		if present, err := util.ObjectExists(req.Context(), ms.s3, "container-blobs", string(mountDigest)); err != nil {
+			writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+			return
+		} else if present {
+			writeBlobCreated(w, blobsPath, mountDigest)
+			return
+		}
+	}
+
+	if query.Get("digest") != "" {
+		blobDigest, err := digest.Parse(query.Get("digest"))
+		if err != nil {
+			writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+			return
+		}
+		if present, err := util.ObjectExists(req.Context(), ms.s3, "container-blobs", string(blobDigest)); err != nil {
+			writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+			return
+		} else if !present {
+			body, err := util.NewVerifyingReader(req.Body, blobDigest, req.ContentLength)
+			if err != nil {
+				writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+				return
+			}
+			if _, err := ms.uploader.UploadWithContext(req.Context(), &s3manager.UploadInput{
+				Bucket: aws.String("container-blobs"),
+				Key:    aws.String(string(blobDigest)),
+				Body:   body,
+			}); err != nil {
+				writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+				return
+			}
+		}
+		writeBlobCreated(w, blobsPath, blobDigest)
+		return
+	}
+
+	upload := schema.ContainerBlobUpload{
+		RepositoryId: repository.Id,
+		StartedAt:    time.Now(),
+	}
+	if r := ms.database.Create(&upload); r.Error != nil {
+		writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", r.Error.Error())
+		return
+	}
+	writeUploadStatus(w, blobsPath, &upload, http.StatusAccepted)
+}
+
+// countingReader counts the number of bytes read.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// storeChunk stores the body of a request as the next chunk of an
+// upload. It returns false if an error response has been written.
+func (ms *containerHttpMirrorService) storeChunk(w http.ResponseWriter, req *http.Request, upload *schema.ContainerBlobUpload) bool {
+	if contentRange := req.Header.Get("Content-Range"); contentRange != "" {
+		var start, end int64
+		if _, err := fmt.Sscanf(contentRange, "%d-%d", &start, &end); err != nil || start != upload.Size || end < start {
+			writeRegistryError(w, http.StatusRequestedRangeNotSatisfiable, "BLOB_UPLOAD_INVALID", fmt.Sprintf("Chunk must start at offset %d", upload.Size))
+			return false
+		}
+	}
+	body := bufio.NewReader(req.Body)
+	if _, err := body.Peek(1); err == io.EOF {
+		return true
+	}
+	counter := countingReader{r: body}
+	if _, err := ms.uploader.UploadWithContext(req.Context(), &s3manager.UploadInput{
+		Bucket: aws.String("container-uploads"),
+		Key:    aws.String(getChunkKey(upload, upload.Size)),
+		Body:   &counter,
+	}); err != nil {
+		writeRegistryError(w, http.StatusInternalServerError, "BLOB_UPLOAD_INVALID", err.Error())
+		return false
+	}
+
+	// Chunks of the same upload may be sent concurrently.
+	// Only accept the first one stored at a given offset.
+	r := ms.database.Model(&schema.ContainerBlobUpload{}).Where("id = ? AND size = ?", upload.Id, upload.Size).Update("size", upload.Size+counter.n)
+	if r.Error != nil {
+		writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", r.Error.Error())
+		return false
+	}
+	if r.RowsAffected != 1 {
+		writeRegistryError(w, http.StatusRequestedRangeNotSatisfiable, "BLOB_UPLOAD_INVALID", "Upload was modified concurrently")
+		return false
+	}
+	upload.Size += counter.n
+	return true
+}
+
+// chunkReader concatenates the chunks of an upload.
+type chunkReader struct {
+	ctx  context.Context
+	s3   *s3.S3
+	keys []string
+	body io.ReadCloser
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if cr.body == nil {
+			if len(cr.keys) == 0 {
+				return 0, io.EOF
+			}
+			object, err := cr.s3.GetObjectWithContext(cr.ctx, &s3.GetObjectInput{
+				Bucket: aws.String("container-uploads"),
+				Key:    aws.String(cr.keys[0]),
+			})
+			if err != nil {
+				return 0, err
+			}
+			cr.keys = cr.keys[1:]
+			cr.body = object.Body
+		}
+		n, err := cr.body.Read(p)
+		if err == io.EOF {
+			cr.body.Close()
+			cr.body = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (cr *chunkReader) Close() {
+	if cr.body != nil {
+		cr.body.Close()
+	}
+}
+
+// getChunkKeys returns the keys of the chunks of an upload in order.
+func (ms *containerHttpMirrorService) getChunkKeys(ctx context.Context, upload *schema.ContainerBlobUpload) ([]string, error) {
+	var keys []string
+	if err := ms.s3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String("container-uploads"),
+		Prefix: aws.String(upload.Id + "/"),
+	}, func(output *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range output.Contents {
+			keys = append(keys, *object.Key)
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// deleteUpload removes the chunks of an upload and the upload itself.
+func (ms *containerHttpMirrorService) deleteUpload(ctx context.Context, upload *schema.ContainerBlobUpload) error {
+	keys, err := ms.getChunkKeys(ctx, upload)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, err := ms.s3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String("container-uploads"),
+			Key:    aws.String(key),
+		}); err != nil {
+			return err
+		}
+	}
+	return ms.database.Where("id = ?", upload.Id).Delete(&schema.ContainerBlobUpload{}).Error
+}
+
+// handleUploadFinish completes an upload by concatenating its chunks
+// into a blob, whose digest is validated before it is stored.
+func (ms *containerHttpMirrorService) handleUploadFinish(w http.ResponseWriter, req *http.Request, blobsPath string, upload *schema.ContainerBlobUpload) {
+	blobDigest, err := digest.Parse(req.URL.Query().Get("digest"))
+	if err != nil {
+		writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+	if present, err := util.ObjectExists(req.Context(), ms.s3, "container-blobs", string(blobDigest)); err != nil {
+		writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	} else if !present {
+		keys, err := ms.getChunkKeys(req.Context(), upload)
+		if err != nil {
+			writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+			return
+		}
+		chunks := &chunkReader{
+			ctx:  req.Context(),
+			s3:   ms.s3,
+			keys: keys,
+		}
+		defer chunks.Close()
+		body, err := util.NewVerifyingReader(chunks, blobDigest, upload.Size)
+		if err != nil {
+			writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+			return
+		}
+		if _, err := ms.uploader.UploadWithContext(req.Context(), &s3manager.UploadInput{
+			Bucket: aws.String("container-blobs"),
+			Key:    aws.String(string(blobDigest)),
+			Body:   body,
+		}); err != nil {
+			writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+			return
+		}
+	}
+	if err := ms.deleteUpload(req.Context(), upload); err != nil {
+		// The blob has been stored successfully. Leftovers
+		// are removed by the garbage collector.
+		log.Printf("Failed to remove upload %s: %s", upload.Id, err)
+	}
+	writeBlobCreated(w, blobsPath, blobDigest)
+}
+
+// handleManifestPut stores a manifest that is pushed by digest or by
+// tag. The blobs referenced by the manifest must be present, including
+// foreign layers. Manifest lists may be pushed without pushing all of
+// the manifests they reference, just like the mirror may only mirror
+// some platforms.
+func (ms *containerHttpMirrorService) handleManifestPut(w http.ResponseWriter, req *http.Request, manifestsPath string, repository *schema.ContainerRepository, manifestReference string, username string) {
+	payload, err := ioutil.ReadAll(io.LimitReader(req.Body, maximumManifestSize+1))
+	if err != nil {
+		writeRegistryError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+		return
+	}
+	if len(payload) > maximumManifestSize {
+		writeRegistryError(w, http.StatusRequestEntityTooLarge, "MANIFEST_INVALID", "Manifest is too large")
+		return
+	}
+	manifestMediatype := req.Header.Get("Content-Type")
+	manifest, _, err := distribution.UnmarshalManifest(manifestMediatype, payload)
+	if err != nil {
+		writeRegistryError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+		return
+	}
+	if _, ok := manifest.(*schema1.SignedManifest); ok {
+		writeRegistryError(w, http.StatusBadRequest, "MANIFEST_INVALID", "Schema 1 manifests cannot be pushed")
+		return
+	}
+
+	manifestDigest := digest.FromBytes(payload)
+	var tag *string
+	if strings.Contains(manifestReference, ":") {
+		if manifestReference != string(manifestDigest) {
+			writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", fmt.Sprintf("Manifest has digest %s", manifestDigest))
+			return
+		}
+	} else if tagPattern.MatchString(manifestReference) {
+		tag = &manifestReference
+	} else {
+		writeRegistryError(w, http.StatusBadRequest, "TAG_INVALID", "Invalid tag")
+		return
+	}
+
+	if _, ok := manifest.(*manifestlist.DeserializedManifestList); !ok {
+		for _, descriptor := range manifest.References() {
+			if present, err := util.ObjectExists(req.Context(), ms.s3, "container-blobs", string(descriptor.Digest)); err != nil {
+				writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+				return
+			} else if !present {
+				// Docker only pushes foreign layers if
+				// configured to do so.
+				message := fmt.Sprintf("Blob %s has not been pushed", descriptor.Digest)
+				if len(descriptor.URLs) > 0 {
+					message += ", which is a foreign layer that Docker only pushes if \"allow-nondistributable-artifacts\" is configured"
+				}
+				writeRegistryError(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", message)
+				return
+			}
+		}
+	}
+
+	metadata, err := manifests.ParseMetadata(payload)
+	if err != nil {
+		writeRegistryError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+		return
+	}
+
+	// Signature manifests are stored under cosign's tags, so that
+	// the proxy can serve them.
+	var signedDigest *string
+	if tag != nil {
+		if tagMatches := cosignSignatureTagPattern.FindStringSubmatch(*tag); tagMatches != nil {
+			d := tagMatches[1] + ":" + tagMatches[2]
+			signedDigest = &d
+		}
+	}
+
+	// Apply the signature policy of the repository, just like the
+	// downloader does. As images are signed after they have been
+	// pushed, unsigned images are held back until signatures that
+	// are accepted by the policy are pushed.
+	policy, err := cosign.GetRepositoryPolicy(ms.database, repository.Id)
+	if err != nil {
+		writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	pending := false
+	if policy != nil {
+		if signedDigest != nil {
+			if err := ms.verifyPushedSignatures(req.Context(), policy, manifest, *signedDigest); err != nil {
+				writeRegistryError(w, http.StatusForbidden, "DENIED", "Signatures are not accepted by the signature policy of the repository: "+err.Error())
+				return
+			}
+		} else if signed, err := ms.isSigned(repository.Id, string(manifestDigest)); err != nil {
+			writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+			return
+		} else {
+			pending = !signed
+		}
+	}
+
+	var image schema.ContainerImage
+	if r := ms.database.FirstOrCreate(&image, schema.ContainerImage{
+		RepositoryId: repository.Id,
+		Digest:       string(manifestDigest),
+	}); r.Error != nil {
+		writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", r.Error.Error())
+		return
+	}
+	if image.Manifest == nil && image.PendingManifest == nil {
+		pushedAt := time.Now()
+		updates := schema.ContainerImage{
+			SubjectDigest: metadata.SubjectDigest,
+			SignedDigest:  signedDigest,
+			Tag:           tag,
+			PushedAt:      &pushedAt,
+			PushedBy:      &username,
+		}
+		if pending {
+			updates.PendingManifestMediatype = &manifestMediatype
+			updates.PendingManifest = &payload
+		} else {
+			updates.ManifestMediatype = &manifestMediatype
+			updates.Manifest = &payload
+		}
+		if metadata.ArtifactType != "" {
+			updates.ArtifactType = &metadata.ArtifactType
+		}
+		if r := ms.database.Model(&schema.ContainerImage{}).Where("id = ?", image.Id).Updates(updates); r.Error != nil {
+			writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", r.Error.Error())
+			return
+		}
+	} else if tag != nil {
+		// An existing image is pushed under another tag.
+		if r := ms.database.Model(&image).Update("tag", *tag); r.Error != nil {
+			writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", r.Error.Error())
+			return
+		}
+	}
+	if policy != nil && signedDigest != nil {
+		if err := ms.releasePendingManifest(repository.Id, *signedDigest); err != nil {
+			writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Location", manifestsPath+string(manifestDigest))
+	w.Header().Set("Docker-Content-Digest", string(manifestDigest))
+	if metadata.SubjectDigest != nil {
+		w.Header().Set("OCI-Subject", *metadata.SubjectDigest)
+	}
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// verifyPushedSignatures checks whether a pushed signature manifest
+// contains a signature over an image that is accepted by a signature
+// policy. The payloads of the signatures need to be pushed first.
+func (ms *containerHttpMirrorService) verifyPushedSignatures(ctx context.Context, policy *cosign.Policy, manifest distribution.Manifest, signedDigest string) error {
+	var signatures []*cosign.Signature
+	for _, descriptor := range manifest.References() {
+		if descriptor.MediaType != cosign.SimpleSigningMediaType {
+			continue
+		}
+		if descriptor.Size > cosign.MaximumPayloadSize {
+			return fmt.Errorf("Signature payload %s is too large", descriptor.Digest)
+		}
+		object, err := ms.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String("container-blobs"),
+			Key:    aws.String(string(descriptor.Digest)),
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to obtain signature payload %s: %s", descriptor.Digest, err)
+		}
+		payload, err := ioutil.ReadAll(io.LimitReader(object.Body, cosign.MaximumPayloadSize+1))
+		object.Body.Close()
+		if err != nil {
+			return err
+		}
+		if len(payload) > cosign.MaximumPayloadSize {
+			return fmt.Errorf("Signature payload %s is too large", descriptor.Digest)
+		}
+		signatures = append(signatures, cosign.NewSignature(payload, descriptor.Annotations))
+	}
+	return policy.Verify(ms.trustRoot, signatures, signedDigest)
+}
+
+// isSigned returns whether an image pushed into a repository with a
+// signature policy may be served immediately, because signatures that
+// are accepted by the policy have already been pushed for it or for a
+// manifest list referencing it.
+func (ms *containerHttpMirrorService) isSigned(repositoryId string, digest string) (bool, error) {
+	var count int
+	if r := ms.database.Model(&schema.ContainerImage{}).Where("repository_id = ? AND signed_digest = ? AND manifest IS NOT NULL", repositoryId, digest).Count(&count); r.Error != nil {
+		return false, r.Error
+	}
+	if count > 0 {
+		return true, nil
+	}
+	return cosign.IsCoveredByManifestList(ms.database, repositoryId, digest)
+}
+
+// releasePendingManifest starts serving an image that was held back
+// until it was signed. The manifests referenced by a manifest list are
+// covered by its signatures, meaning that they are released as well.
+func (ms *containerHttpMirrorService) releasePendingManifest(repositoryId string, digest string) error {
+	var image schema.ContainerImage
+	if r := ms.database.Where("repository_id = ? AND digest = ? AND pending_manifest IS NOT NULL", repositoryId, digest).Take(&image); r.Error != nil {
+		if r.RecordNotFound() {
+			return nil
+		}
+		return r.Error
+	}
+	if r := ms.database.Model(&schema.ContainerImage{}).Where("id = ?", image.Id).Updates(map[string]interface{}{
+		"manifest_mediatype":         *image.PendingManifestMediatype,
+		"manifest":                   *image.PendingManifest,
+		"pending_manifest_mediatype": nil,
+		"pending_manifest":           nil,
+	}); r.Error != nil {
+		return r.Error
+	}
+
+	if !manifests.IsManifestList(*image.PendingManifestMediatype) {
+		return nil
+	}
+	manifest, _, err := distribution.UnmarshalManifest(*image.PendingManifestMediatype, *image.PendingManifest)
+	if err != nil {
+		return err
+	}
+	if _, ok := manifest.(*manifestlist.DeserializedManifestList); !ok {
+		return nil
+	}
+	for _, descriptor := range manifest.References() {
+		if err := ms.releasePendingManifest(repositoryId, string(descriptor.Digest)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -62,7 +62,21 @@ func (ms *fileHttpMirrorService) ServeHTTP(w http.ResponseWriter, req *http.Requ
 
 	// Copy blob to HTTP response.
 	w.Header().Set("Content-Length", strconv.FormatUint(*file.Size, 10))
-	w.Header().Set("Content-Type", "application/octet-stream")
+	// Replay the response headers returned by the upstream server.
+	// The blob is stored with its content encoding still applied,
+	// so that clients decode it exactly once.
+	if file.ContentType != nil {
+		w.Header().Set("Content-Type", *file.ContentType)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	if file.ContentDisposition != nil {
+		w.Header().Set("Content-Disposition", *file.ContentDisposition)
+	}
+	if file.ContentEncoding != nil {
+		w.Header().Set("Content-Encoding", *file.ContentEncoding)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 	copiedSize, err := io.Copy(w, blob.Body)
 	blob.Body.Close()
 	if err != nil {
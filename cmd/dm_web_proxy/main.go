@@ -6,11 +6,14 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"time"
 
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/cosign"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 )
@@ -19,6 +22,21 @@ func main() {
 	var (
 		dbAddress = flag.String("db.address", "", "Database server address.")
 
+		proxyInterceptTls = flag.Bool("proxy.intercept-tls", true, "Whether HTTPS connections made through the proxy should be intercepted, using the CA certificate and private key stored in /ca. CONNECT requests are rejected if disabled")
+
+		registryMirrorDefaultRegistry = flag.String("registry-mirror.default-registry", "docker.io", "Registry from which images are served by the registry mirror if clients don't provide the \"ns\" query parameter")
+		registryMirrorListenAddress   = flag.String("registry-mirror.listen-address", "", "Address on which to serve container images to clients that are configured to use the proxy as a registry mirror. Disabled if not set")
+		registryMirrorTlsCertificate  = flag.String("registry-mirror.tls-certificate", "", "Path of the PEM file holding the TLS certificate of the registry mirror")
+		registryMirrorTlsPrivateKey   = flag.String("registry-mirror.tls-private-key", "", "Path of the PEM file holding the TLS private key of the registry mirror")
+
+		cosignFulcioCertificates = flag.String("cosign.fulcio-certificates", "", "Path of a PEM file holding the Fulcio root and intermediate certificates used to verify keyless signatures of pushed images")
+		cosignRekorPublicKeys    = flag.String("cosign.rekor-public-keys", "", "Path of a PEM file holding the Rekor public keys used to verify keyless signatures of pushed images")
+
+		pushAllowedRepositories = flag.String("push.allowed-repositories", "", "Comma separated list of repositories, including the hostname of their registry, into which images may be pushed. Entries match repositories they are a prefix of (e.g., registry.example.com/partners)")
+		pushHtpasswdFile        = flag.String("push.htpasswd-file", "", "Path of an htpasswd file with bcrypt hashed passwords of users that may push container images. Pushing is disabled if not set")
+		pushTokenKeyFile        = flag.String("push.token-key-file", "", "Path of a file holding the hex encoded key of at least 32 bytes used to sign bearer tokens. A random key is generated if not set, meaning that tokens are only accepted by the replica that issued them")
+		pushTokenLifetime       = flag.Duration("push.token-lifetime", time.Hour, "Amount of time for which bearer tokens issued to clients remain valid")
+
 		s3AccessKeyId     = flag.String("s3.access-key-id", "", "Access key of the S3 bucket holding distfiles")
 		s3DisableSsl      = flag.Bool("s3.disable-ssl", false, "Whether SSL should be disabled for the S3 bucket holding distfiles")
 		s3Endpoint        = flag.String("s3.endpoint", "", "Endpoint URL of the S3 bucket holding distfiles")
@@ -40,33 +58,68 @@ func main() {
 		S3ForcePathStyle: aws.Bool(true),
 	})
 	s3 := s3.New(s3Session)
+	uploader := s3manager.NewUploaderWithClient(s3)
 
-	// Certificate authority used for generating SSL certificates on
-	// the fly to 'man in the middle' incoming connections.
-	// TODO(edsch): Should we add an adapter to cache certificates?
-	caCertificate, err := ioutil.ReadFile("/ca/tls.crt")
-	if err != nil {
-		log.Fatalf("Failed to load CA certificate: %s", err)
+	var trustRoot *cosign.TrustRoot
+	if *cosignFulcioCertificates != "" || *cosignRekorPublicKeys != "" {
+		trustRoot, err = cosign.LoadTrustRoot(*cosignFulcioCertificates, *cosignRekorPublicKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-	caPrivateKey, err := ioutil.ReadFile("/ca/tls.key")
-	if err != nil {
-		log.Fatalf("Failed to load CA private key: %s", err)
+
+	var pushAuthenticator *pushAuthenticator
+	if *pushHtpasswdFile != "" {
+		pushAuthenticator, err = newPushAuthenticator(*pushHtpasswdFile, *pushTokenKeyFile, *pushTokenLifetime, *pushAllowedRepositories)
+		if err != nil {
+			log.Fatalf("Failed to create push authenticator: %s", err)
+		}
 	}
-	certificateGenerator, err := NewCertificateGenerator(caCertificate, caPrivateKey)
-	if err != nil {
-		log.Fatal(err)
+
+	// Registry mirror service. Images can only be pulled, as
+	// clients push to the registry itself.
+	if *registryMirrorListenAddress != "" {
+		go func() {
+			log.Fatal(http.ListenAndServeTLS(
+				*registryMirrorListenAddress,
+				*registryMirrorTlsCertificate,
+				*registryMirrorTlsPrivateKey,
+				NewRegistryMirrorHandler(*registryMirrorDefaultRegistry,
+					NewContainerHttpMirrorService("https", db, s3, uploader, nil, nil, http.NotFoundHandler()))))
+		}()
 	}
 
-	// HTTPS service.
-	httpsListener := NewProxyConnectionListener()
-	go func() {
-		log.Fatal(http.Serve(
-			tls.NewListener(httpsListener, &tls.Config{
-				GetCertificate: certificateGenerator.GetCertificate,
-			}),
-			NewFileHttpMirrorService("https", db, s3,
-				NewContainerHttpMirrorService("https", db, s3, http.NotFoundHandler()))))
-	}()
+	// HTTPS service, only needed when intercepting connections.
+	var connectionHandler ProxyConnectionHandler
+	if *proxyInterceptTls {
+		// Certificate authority used for generating SSL
+		// certificates on the fly to 'man in the middle'
+		// incoming connections.
+		// TODO(edsch): Should we add an adapter to cache certificates?
+		caCertificate, err := ioutil.ReadFile("/ca/tls.crt")
+		if err != nil {
+			log.Fatalf("Failed to load CA certificate: %s", err)
+		}
+		caPrivateKey, err := ioutil.ReadFile("/ca/tls.key")
+		if err != nil {
+			log.Fatalf("Failed to load CA private key: %s", err)
+		}
+		certificateGenerator, err := NewCertificateGenerator(caCertificate, caPrivateKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		httpsListener := NewProxyConnectionListener()
+		go func() {
+			log.Fatal(http.Serve(
+				tls.NewListener(httpsListener, &tls.Config{
+					GetCertificate: certificateGenerator.GetCertificate,
+				}),
+				NewFileHttpMirrorService("https", db, s3,
+					NewContainerHttpMirrorService("https", db, s3, uploader, pushAuthenticator, trustRoot, http.NotFoundHandler()))))
+		}()
+		connectionHandler = httpsListener
+	}
 
 	// HTTP proxy frontend.
 	// TODO(edsch): Demultiplex connections to the appropriate service
@@ -74,7 +127,7 @@ func main() {
 	log.Fatal(http.ListenAndServe(
 		":80",
 		NewProxyConnectionHijacker(
-			httpsListener,
+			connectionHandler,
 			NewFileHttpMirrorService("http", db, s3,
-				NewContainerHttpMirrorService("http", db, s3, http.NotFoundHandler())))))
+				NewContainerHttpMirrorService("http", db, s3, uploader, pushAuthenticator, trustRoot, http.NotFoundHandler())))))
 }
@@ -7,7 +7,8 @@ import (
 // proxyConnectionHijacker implements a http.Handler that filters out
 // HTTP CONNECT requests and extracts the associated TCP connections to
 // a ProxyConnectionHandler. Plain non-CONNECT HTTP requests are
-// forwarded to another http.Handler.
+// forwarded to another http.Handler. CONNECT requests are rejected if
+// no ProxyConnectionHandler is provided.
 type proxyConnectionHijacker struct {
 	connectionHandler ProxyConnectionHandler
 	requestHandler    http.Handler
@@ -22,6 +23,10 @@ func NewProxyConnectionHijacker(connectionHandler ProxyConnectionHandler, reques
 
 func (sch *proxyConnectionHijacker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodConnect {
+		if sch.connectionHandler == nil {
+			http.Error(w, "Interception of HTTPS connections is disabled", http.StatusMethodNotAllowed)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		hijacker, ok := w.(http.Hijacker)
 		if !ok {
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// pushAuthenticator authenticates users that push container images to
+// the mirror. Users are listed in an htpasswd file with bcrypt hashed
+// passwords.
+//
+// Docker only sends credentials to registries that request them when
+// pinged, after which it refuses to pull anonymously if the registry
+// asks for HTTP basic authentication. Bearer tokens are therefore
+// issued instead. Anonymous clients obtain tokens as well, which don't
+// permit pushing.
+type pushAuthenticator struct {
+	passwordHashes      map[string][]byte
+	tokenKey            []byte
+	tokenLifetime       time.Duration
+	allowedRepositories []string
+}
+
+// loadTokenKey loads the hex encoded key with which bearer tokens are
+// signed. Sharing the key between replicas of the proxy allows them to
+// accept each other's tokens. A random key is generated if no path is
+// provided, meaning that tokens are only accepted by the replica that
+// issued them.
+func loadTokenKey(path string) ([]byte, error) {
+	if path == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode key: %s", err)
+	}
+	if len(key) < 32 {
+		return nil, fmt.Errorf("Key is %d bytes in size, whereas at least 32 bytes are required", len(key))
+	}
+	return key, nil
+}
+
+func newPushAuthenticator(htpasswdPath string, tokenKeyPath string, tokenLifetime time.Duration, allowedRepositories string) (*pushAuthenticator, error) {
+	var allowedPrefixes []string
+	for _, prefix := range strings.Split(allowedRepositories, ",") {
+		if prefix = strings.Trim(strings.ToLower(strings.TrimSpace(prefix)), "/"); prefix != "" {
+			allowedPrefixes = append(allowedPrefixes, prefix)
+		}
+	}
+	if len(allowedPrefixes) == 0 {
+		return nil, errors.New("No repositories to which images may be pushed provided")
+	}
+
+	tokenKey, err := loadTokenKey(tokenKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(htpasswdPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	passwordHashes := map[string][]byte{}
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: Expected a username and password hash separated by a colon", htpasswdPath, lineNumber)
+		}
+		if _, err := bcrypt.Cost([]byte(fields[1])); err != nil {
+			return nil, fmt.Errorf("%s:%d: Password hash of user %#v is not a bcrypt hash", htpasswdPath, lineNumber, fields[0])
+		}
+		passwordHashes[fields[0]] = []byte(fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &pushAuthenticator{
+		passwordHashes:      passwordHashes,
+		tokenKey:            tokenKey,
+		tokenLifetime:       tokenLifetime,
+		allowedRepositories: allowedPrefixes,
+	}, nil
+}
+
+// mayPush returns whether images may be pushed into a repository,
+// identified by the hostname and path of its registry followed by its
+// name (e.g., "registry.example.com/partners/app"). Pushes are limited
+// to configured prefixes, so that images mirrored from upstream
+// registries can't be replaced.
+func (pa *pushAuthenticator) mayPush(repository string) bool {
+	repository = strings.ToLower(repository)
+	for _, prefix := range pa.allowedRepositories {
+		if repository == prefix || strings.HasPrefix(repository, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPassword returns whether a username and password are valid.
+func (pa *pushAuthenticator) checkPassword(username string, password string) bool {
+	passwordHash, ok := pa.passwordHashes[username]
+	return ok && bcrypt.CompareHashAndPassword(passwordHash, []byte(password)) == nil
+}
+
+func (pa *pushAuthenticator) getTokenSignature(payload string) string {
+	mac := hmac.New(sha256.New, pa.tokenKey)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// issueToken creates a bearer token for a user. Anonymous users are
+// represented by an empty username.
+func (pa *pushAuthenticator) issueToken(username string, now time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(username)) + "." + strconv.FormatInt(now.Add(pa.tokenLifetime).Unix(), 10)
+	return payload + "." + pa.getTokenSignature(payload)
+}
+
+// checkToken returns the name of the user for which a bearer token was
+// issued, if the token is valid and has not expired.
+func (pa *pushAuthenticator) checkToken(token string, now time.Time) (string, bool) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return "", false
+	}
+	payload, signature := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(pa.getTokenSignature(payload))) {
+		return "", false
+	}
+	fields := strings.Split(payload, ".")
+	if len(fields) != 2 {
+		return "", false
+	}
+	username, err := base64.RawURLEncoding.DecodeString(fields[0])
+	if err != nil {
+		return "", false
+	}
+	expiry, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || now.Unix() >= expiry {
+		return "", false
+	}
+	return string(username), true
+}
+
+// authenticate returns the name of the user that performs a request,
+// using either a bearer token or HTTP basic authentication. An empty
+// username is returned for anonymous requests. HTTP basic
+// authentication should only be permitted over HTTPS, as passwords
+// would otherwise be sent in cleartext.
+func (pa *pushAuthenticator) authenticate(req *http.Request, allowBasic bool) (string, bool) {
+	authorization := req.Header.Get("Authorization")
+	if authorization == "" {
+		return "", true
+	}
+	if strings.HasPrefix(authorization, "Bearer ") {
+		return pa.checkToken(strings.TrimPrefix(authorization, "Bearer "), time.Now())
+	}
+	if username, password, ok := req.BasicAuth(); ok && allowBasic && pa.checkPassword(username, password) {
+		return username, true
+	}
+	return "", false
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeTestFiles writes files into a temporary directory, returning
+// the path of the directory.
+func writeTestFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	directory, err := ioutil.TempDir("", "push_authenticator_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(directory, name), []byte(contents), 0600); err != nil {
+			os.RemoveAll(directory)
+			t.Fatal(err)
+		}
+	}
+	return directory
+}
+
+func newTestPushAuthenticator(t *testing.T) *pushAuthenticator {
+	t.Helper()
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	directory := writeTestFiles(t, map[string]string{
+		"htpasswd": "# Comment\n\nalice:" + string(passwordHash) + "\n",
+	})
+	defer os.RemoveAll(directory)
+	pa, err := newPushAuthenticator(filepath.Join(directory, "htpasswd"), "", time.Hour, " registry.example.com/Partners/ ,,mirror.example.com/internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pa
+}
+
+func TestLoadTokenKey(t *testing.T) {
+	key, err := loadTokenKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 32 {
+		t.Errorf("Generated key is %d bytes in size, expected 32", len(key))
+	}
+
+	directory := writeTestFiles(t, map[string]string{
+		"valid":   strings.Repeat("ab", 32) + "\n",
+		"short":   strings.Repeat("ab", 31),
+		"invalid": strings.Repeat("xy", 32),
+	})
+	defer os.RemoveAll(directory)
+	key, err = loadTokenKey(filepath.Join(directory, "valid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 32 || key[0] != 0xab {
+		t.Errorf("Loaded key %x", key)
+	}
+	for _, name := range []string{"short", "invalid", "nonexistent"} {
+		if _, err := loadTokenKey(filepath.Join(directory, name)); err == nil {
+			t.Errorf("Key %s was accepted", name)
+		}
+	}
+}
+
+func TestNewPushAuthenticatorInvalid(t *testing.T) {
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	directory := writeTestFiles(t, map[string]string{
+		"valid":      "alice:" + string(passwordHash) + "\n",
+		"no_colon":   "alice\n",
+		"not_bcrypt": "alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n",
+	})
+	defer os.RemoveAll(directory)
+	for _, testCase := range []struct {
+		name                string
+		htpasswd            string
+		allowedRepositories string
+	}{
+		{"NoRepositories", "valid", " , /"},
+		{"MissingFile", "nonexistent", "registry.example.com"},
+		{"NoColon", "no_colon", "registry.example.com"},
+		{"NotBcrypt", "not_bcrypt", "registry.example.com"},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			if _, err := newPushAuthenticator(filepath.Join(directory, testCase.htpasswd), "", time.Hour, testCase.allowedRepositories); err == nil {
+				t.Error("Invalid configuration was accepted")
+			}
+		})
+	}
+}
+
+func TestPushAuthenticatorMayPush(t *testing.T) {
+	pa := newTestPushAuthenticator(t)
+	for _, testCase := range []struct {
+		repository string
+		allowed    bool
+	}{
+		{"registry.example.com/partners", true},
+		{"registry.example.com/partners/app", true},
+		{"REGISTRY.example.com/Partners/App", true},
+		{"registry.example.com/partnersx/app", false},
+		{"registry.example.com/app", false},
+		{"registry.example.com", false},
+		{"mirror.example.com/internal/tools/app", true},
+		{"other.example.com/partners/app", false},
+		{"registry-1.docker.io/library/debian", false},
+	} {
+		t.Run(testCase.repository, func(t *testing.T) {
+			if allowed := pa.mayPush(testCase.repository); allowed != testCase.allowed {
+				t.Errorf("Got %v, expected %v", allowed, testCase.allowed)
+			}
+		})
+	}
+}
+
+func TestPushAuthenticatorCheckToken(t *testing.T) {
+	pa := newTestPushAuthenticator(t)
+	now := time.Unix(1600000000, 0)
+	token := pa.issueToken("alice", now)
+
+	if username, ok := pa.checkToken(token, now); !ok || username != "alice" {
+		t.Errorf("Got %#v, %v for valid token", username, ok)
+	}
+	if username, ok := pa.checkToken(pa.issueToken("", now), now); !ok || username != "" {
+		t.Errorf("Got %#v, %v for anonymous token", username, ok)
+	}
+
+	i := strings.LastIndexByte(token, '.')
+	payload, signature := token[:i], token[i+1:]
+	other := newTestPushAuthenticator(t)
+	for _, testCase := range []struct {
+		name  string
+		token string
+		now   time.Time
+	}{
+		{"Expired", token, now.Add(time.Hour)},
+		{"Empty", "", now},
+		{"NoSignature", payload, now},
+		{"InvalidSignature", payload + "." + strings.Repeat("0", len(signature)), now},
+		{"OtherKey", other.issueToken("alice", now), now},
+		{"ChangedUsername", "Ym9i" + token[strings.IndexByte(token, '.'):], now},
+		{"ChangedExpiry", payload + "0." + signature, now},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			if username, ok := pa.checkToken(testCase.token, testCase.now); ok {
+				t.Errorf("Token was accepted for user %#v", username)
+			}
+		})
+	}
+}
+
+func TestPushAuthenticatorAuthenticate(t *testing.T) {
+	pa := newTestPushAuthenticator(t)
+	for _, testCase := range []struct {
+		name          string
+		authorization string
+		allowBasic    bool
+		username      string
+		ok            bool
+	}{
+		{"Anonymous", "", false, "", true},
+		{"Bearer", "Bearer " + pa.issueToken("alice", time.Now()), false, "alice", true},
+		{"ExpiredBearer", "Bearer " + pa.issueToken("alice", time.Now().Add(-2*time.Hour)), false, "", false},
+		{"InvalidBearer", "Bearer invalid", true, "", false},
+		{"Basic", "Basic YWxpY2U6c2VjcmV0", true, "alice", true},
+		{"BasicNotAllowed", "Basic YWxpY2U6c2VjcmV0", false, "", false},
+		{"BasicWrongPassword", "Basic YWxpY2U6d3Jvbmc=", true, "", false},
+		{"BasicUnknownUser", "Basic Ym9iOnNlY3JldA==", true, "", false},
+		{"UnsupportedScheme", "Digest username=\"alice\"", true, "", false},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "https://registry.example.com/v2/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if testCase.authorization != "" {
+				req.Header.Set("Authorization", testCase.authorization)
+			}
+			if username, ok := pa.authenticate(req, testCase.allowBasic); username != testCase.username || ok != testCase.ok {
+				t.Errorf("Got %#v, %v, expected %#v, %v", username, ok, testCase.username, testCase.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/docker/distribution/reference"
+)
+
+var (
+	registryMirrorRepositoryPattern = regexp.MustCompile("^/v2/(.*)/(manifests|blobs|referrers)/([^/]*)$")
+	registryMirrorDomainPattern     = regexp.MustCompile("^" + reference.DomainRegexp.String() + "$")
+)
+
+type registryMirrorHandler struct {
+	defaultRegistry string
+	mirror          http.Handler
+}
+
+// NewRegistryMirrorHandler creates a HTTP handler that allows the
+// mirror to be configured as a registry mirror of Docker
+// ("registry-mirrors") or containerd ("hosts.toml"), meaning that no
+// TLS interception is needed. These clients contact the mirror
+// directly, providing the name of the upstream registry through the
+// "ns" query parameter. Requests are rewritten as if they were sent to
+// the upstream registry, so that the same images are served.
+func NewRegistryMirrorHandler(defaultRegistry string, mirror http.Handler) http.Handler {
+	return &registryMirrorHandler{
+		defaultRegistry: defaultRegistry,
+		mirror:          mirror,
+	}
+}
+
+// getRegistryHost returns the hostname under which the images of a
+// registry are stored. Docker Hub's registry is not served under its
+// canonical name.
+func getRegistryHost(domain string) string {
+	if domain == "docker.io" || domain == "index.docker.io" {
+		return "registry-1.docker.io"
+	}
+	return domain
+}
+
+func (rh *registryMirrorHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// Clients stop using a registry mirror if it can't be pinged,
+	// regardless of whether it mirrors any images of the registry.
+	if req.URL.Path == "/v2/" {
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		return
+	}
+
+	// Docker only uses registry mirrors for Docker Hub, and doesn't
+	// provide the "ns" query parameter.
+	domain := req.URL.Query().Get("ns")
+	if domain == "" {
+		domain = rh.defaultRegistry
+	}
+
+	path := req.URL.Path
+	if matches := registryMirrorRepositoryPattern.FindStringSubmatch(path); matches != nil {
+		// Apply the same normalisation as the Docker CLI,
+		// so that "debian" refers to "library/debian" on
+		// Docker Hub.
+		named, err := reference.ParseNormalizedNamed(domain + "/" + matches[1])
+		if err != nil || !reference.IsNameOnly(named) {
+			writeRegistryError(w, http.StatusBadRequest, "NAME_INVALID", "Invalid repository name")
+			return
+		}
+		domain = reference.Domain(named)
+		path = "/v2/" + reference.Path(named) + "/" + matches[2] + "/" + matches[3]
+	} else if !registryMirrorDomainPattern.MatchString(domain) {
+		writeRegistryError(w, http.StatusBadRequest, "NAME_INVALID", "Invalid registry name")
+		return
+	}
+
+	upstreamReq := *req
+	upstreamUrl := *req.URL
+	upstreamUrl.Path = path
+	upstreamUrl.RawPath = ""
+	upstreamReq.URL = &upstreamUrl
+	upstreamReq.Host = getRegistryHost(domain)
+	rh.mirror.ServeHTTP(w, &upstreamReq)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistryMirrorHandler(t *testing.T) {
+	var upstreamReq *http.Request
+	handler := NewRegistryMirrorHandler("docker.io", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstreamReq = req
+	}))
+	for _, testCase := range []struct {
+		url    string
+		status int
+		host   string
+		path   string
+	}{
+		// Docker Hub's official images are stored under "library/".
+		{"/v2/debian/manifests/latest", http.StatusOK, "registry-1.docker.io", "/v2/library/debian/manifests/latest"},
+		{"/v2/library/debian/manifests/latest", http.StatusOK, "registry-1.docker.io", "/v2/library/debian/manifests/latest"},
+		{"/v2/bitnami/redis/blobs/sha256:0123", http.StatusOK, "registry-1.docker.io", "/v2/bitnami/redis/blobs/sha256:0123"},
+		{"/v2/debian/manifests/latest?ns=docker.io", http.StatusOK, "registry-1.docker.io", "/v2/library/debian/manifests/latest"},
+		{"/v2/debian/manifests/latest?ns=index.docker.io", http.StatusOK, "registry-1.docker.io", "/v2/library/debian/manifests/latest"},
+		{"/v2/debian/referrers/sha256:0123", http.StatusOK, "registry-1.docker.io", "/v2/library/debian/referrers/sha256:0123"},
+
+		// Other registries don't have a default namespace.
+		{"/v2/debian/manifests/latest?ns=ghcr.io", http.StatusOK, "ghcr.io", "/v2/debian/manifests/latest"},
+		{"/v2/coreos/etcd/manifests/v3.5.0?ns=quay.io", http.StatusOK, "quay.io", "/v2/coreos/etcd/manifests/v3.5.0"},
+		{"/v2/app/blobs/sha256:0123?ns=localhost:5000", http.StatusOK, "localhost:5000", "/v2/app/blobs/sha256:0123"},
+		{"/v2/_catalog?ns=quay.io", http.StatusOK, "quay.io", "/v2/_catalog"},
+
+		// Invalid names are rejected.
+		{"/v2/Debian/manifests/latest", http.StatusBadRequest, "", ""},
+		{"/v2/debian:latest/manifests/latest", http.StatusBadRequest, "", ""},
+		{"/v2/debian/manifests/latest?ns=bad%20host", http.StatusBadRequest, "", ""},
+		{"/v2/_catalog?ns=bad%20host", http.StatusBadRequest, "", ""},
+	} {
+		t.Run(testCase.url, func(t *testing.T) {
+			upstreamReq = nil
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://mirror.example.com"+testCase.url, nil))
+			if w.Code != testCase.status {
+				t.Fatalf("Got status %d, expected %d", w.Code, testCase.status)
+			}
+			if testCase.host == "" {
+				if upstreamReq != nil {
+					t.Error("Request was forwarded to the mirror")
+				}
+				return
+			}
+			if upstreamReq == nil {
+				t.Fatal("Request was not forwarded to the mirror")
+			}
+			if upstreamReq.Host != testCase.host || upstreamReq.URL.Path != testCase.path {
+				t.Errorf("Got request for %s%s, expected %s%s", upstreamReq.Host, upstreamReq.URL.Path, testCase.host, testCase.path)
+			}
+		})
+	}
+}
+
+func TestRegistryMirrorHandlerPing(t *testing.T) {
+	handler := NewRegistryMirrorHandler("docker.io", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Error("Ping was forwarded to the mirror")
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://mirror.example.com/v2/?ns=quay.io", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Docker-Distribution-API-Version") != "registry/2.0" {
+		t.Errorf("Got status %d and headers %v", w.Code, w.Header())
+	}
+}
@@ -1,9 +1,24 @@
 CREATE TABLE container_registries (
 	id UUID NOT NULL DEFAULT gen_random_uuid(),
 	uri STRING NOT NULL,
+	platforms STRING NULL,
 	CONSTRAINT "primary" PRIMARY KEY (id ASC),
 	UNIQUE INDEX container_registries_uri_key (uri ASC),
-	FAMILY "primary" (id, uri)
+	FAMILY "primary" (id, uri, platforms)
+);
+
+CREATE TABLE container_registry_credentials (
+	registry_id UUID NOT NULL,
+	username STRING NULL,
+	encrypted_password BYTES NULL,
+	refresh_token_service STRING NULL,
+	encrypted_refresh_token BYTES NULL,
+	encrypted_refresh_token_credentials BYTES NULL,
+	CONSTRAINT "primary" PRIMARY KEY (registry_id ASC),
+	CONSTRAINT fk_registry_id_ref_container_registries FOREIGN KEY (registry_id) REFERENCES container_registries (id),
+	FAMILY "primary" (registry_id, username, encrypted_password, refresh_token_service, encrypted_refresh_token, encrypted_refresh_token_credentials),
+	CONSTRAINT check_username_encrypted_password CHECK ((username IS NULL) = (encrypted_password IS NULL)),
+	CONSTRAINT check_refresh_token_service_encrypted_refresh_token CHECK ((refresh_token_service IS NULL) = (encrypted_refresh_token IS NULL))
 );
 
 CREATE TABLE container_repositories (
@@ -22,11 +37,127 @@ CREATE TABLE container_images (
 	digest STRING NOT NULL,
 	manifest_mediatype STRING NULL,
 	manifest BYTES NULL,
+	platforms STRING NULL,
+	artifact_type STRING NULL,
+	subject_digest STRING NULL,
+	signed_digest STRING NULL,
+	tag STRING NULL,
+	config_digest STRING NULL,
+	packages_extracted_at TIMESTAMP NULL,
+	imported_at TIMESTAMP NULL,
+	pushed_at TIMESTAMP NULL,
+	pushed_by STRING NULL,
+	pending_manifest_mediatype STRING NULL,
+	pending_manifest BYTES NULL,
 	CONSTRAINT "primary" PRIMARY KEY (id ASC),
 	CONSTRAINT fk_repository_id_ref_container_repositories FOREIGN KEY (repository_id) REFERENCES container_repositories (id),
 	UNIQUE INDEX container_images_repository_id_digest_key (repository_id ASC, digest ASC),
-	FAMILY "primary" (id, repository_id, digest, manifest_mediatype, manifest),
-	CONSTRAINT check_manifest_manifest_mediatype CHECK ((manifest IS NULL) = (manifest_mediatype IS NULL))
+	INDEX container_images_repository_id_subject_digest_idx (repository_id ASC, subject_digest ASC),
+	INDEX container_images_repository_id_signed_digest_idx (repository_id ASC, signed_digest ASC),
+	FAMILY "primary" (id, repository_id, digest, manifest_mediatype, manifest, platforms, artifact_type, subject_digest, signed_digest, tag, config_digest, packages_extracted_at, imported_at, pushed_at, pushed_by, pending_manifest_mediatype, pending_manifest),
+	CONSTRAINT check_manifest_manifest_mediatype CHECK ((manifest IS NULL) = (manifest_mediatype IS NULL)),
+	CONSTRAINT check_pending_manifest_pending_manifest_mediatype CHECK ((pending_manifest IS NULL) = (pending_manifest_mediatype IS NULL))
+);
+
+CREATE TABLE container_blob_uploads (
+	id UUID NOT NULL DEFAULT gen_random_uuid(),
+	repository_id UUID NOT NULL,
+	started_at TIMESTAMP NOT NULL,
+	size INTEGER NOT NULL DEFAULT 0,
+	CONSTRAINT "primary" PRIMARY KEY (id ASC),
+	CONSTRAINT fk_repository_id_ref_container_repositories FOREIGN KEY (repository_id) REFERENCES container_repositories (id),
+	FAMILY "primary" (id, repository_id, started_at, size),
+	CONSTRAINT check_size CHECK (size >= 0)
+);
+
+CREATE TABLE container_foreign_layers (
+	url STRING NOT NULL,
+	digest STRING NOT NULL,
+	CONSTRAINT "primary" PRIMARY KEY (url ASC),
+	FAMILY "primary" (url, digest)
+);
+
+CREATE TABLE container_image_labels (
+	container_image_id UUID NOT NULL,
+	key STRING NOT NULL,
+	value STRING NOT NULL,
+	CONSTRAINT "primary" PRIMARY KEY (container_image_id ASC, key ASC),
+	CONSTRAINT fk_container_image_id_ref_container_images FOREIGN KEY (container_image_id) REFERENCES container_images (id),
+	INDEX container_image_labels_key_value_idx (key ASC, value ASC),
+	FAMILY "primary" (container_image_id, key, value)
+);
+
+CREATE TABLE container_image_packages (
+	container_image_id UUID NOT NULL,
+	location STRING NOT NULL,
+	type STRING NOT NULL,
+	name STRING NOT NULL,
+	version STRING NOT NULL,
+	license STRING NULL,
+	purl STRING NOT NULL,
+	CONSTRAINT "primary" PRIMARY KEY (container_image_id ASC, location ASC, type ASC, name ASC, version ASC),
+	CONSTRAINT fk_container_image_id_ref_container_images FOREIGN KEY (container_image_id) REFERENCES container_images (id),
+	INDEX container_image_packages_name_version_idx (name ASC, version ASC),
+	FAMILY "primary" (container_image_id, location, type, name, version, license, purl),
+	CONSTRAINT check_type CHECK (type IN ('apk', 'cargo', 'composer', 'deb', 'gem', 'npm', 'pypi', 'rpm'))
+);
+
+CREATE TABLE container_layer_indexes (
+	layer_digest STRING NOT NULL,
+	indexed_at TIMESTAMP NOT NULL,
+	entry_count INTEGER NOT NULL,
+	CONSTRAINT "primary" PRIMARY KEY (layer_digest ASC),
+	FAMILY "primary" (layer_digest, indexed_at, entry_count)
+);
+
+CREATE TABLE container_layer_entries (
+	layer_digest STRING NOT NULL,
+	path STRING NOT NULL,
+	type STRING NOT NULL,
+	mode INTEGER NOT NULL,
+	size INTEGER NOT NULL,
+	link_target STRING NULL,
+	CONSTRAINT "primary" PRIMARY KEY (layer_digest ASC, path ASC),
+	FAMILY "primary" (layer_digest, path, type, mode, size, link_target),
+	CONSTRAINT check_type CHECK (type IN ('file', 'directory', 'symlink', 'hardlink', 'whiteout', 'opaque_whiteout', 'other')),
+	CONSTRAINT check_link_target CHECK ((link_target IS NOT NULL) = (type IN ('symlink', 'hardlink')))
+);
+
+CREATE TABLE container_signature_policies (
+	repository_id UUID NOT NULL,
+	public_keys STRING NULL,
+	identity STRING NULL,
+	issuer STRING NULL,
+	CONSTRAINT "primary" PRIMARY KEY (repository_id ASC),
+	CONSTRAINT fk_repository_id_ref_container_repositories FOREIGN KEY (repository_id) REFERENCES container_repositories (id),
+	FAMILY "primary" (repository_id, public_keys, identity, issuer),
+	CONSTRAINT check_identity_issuer CHECK ((identity IS NULL) = (issuer IS NULL)),
+	CONSTRAINT check_public_keys_identity CHECK ((public_keys IS NOT NULL) OR (identity IS NOT NULL))
+);
+
+CREATE TABLE container_watch_rules (
+	id UUID NOT NULL DEFAULT gen_random_uuid(),
+	repository_id UUID NOT NULL,
+	tag_pattern STRING NULL,
+	semver_range STRING NULL,
+	CONSTRAINT "primary" PRIMARY KEY (id ASC),
+	CONSTRAINT fk_repository_id_ref_container_repositories FOREIGN KEY (repository_id) REFERENCES container_repositories (id),
+	INDEX container_watch_rules_repository_id_idx (repository_id ASC),
+	FAMILY "primary" (id, repository_id, tag_pattern, semver_range),
+	CONSTRAINT check_tag_pattern_semver_range CHECK ((tag_pattern IS NOT NULL) OR (semver_range IS NOT NULL))
+);
+
+CREATE TABLE container_image_proposals (
+	id UUID NOT NULL DEFAULT gen_random_uuid(),
+	repository_id UUID NOT NULL,
+	tag STRING NOT NULL,
+	digest STRING NOT NULL,
+	discovered_at TIMESTAMP NOT NULL,
+	dismissed BOOL NOT NULL DEFAULT false,
+	CONSTRAINT "primary" PRIMARY KEY (id ASC),
+	CONSTRAINT fk_repository_id_ref_container_repositories FOREIGN KEY (repository_id) REFERENCES container_repositories (id),
+	UNIQUE INDEX container_image_proposals_repository_id_tag_digest_key (repository_id ASC, tag ASC, digest ASC),
+	FAMILY "primary" (id, repository_id, tag, digest, discovered_at, dismissed)
 );
 
 CREATE TABLE files (
@@ -35,10 +166,64 @@ CREATE TABLE files (
 	sha256 STRING NULL,
 	size INTEGER NULL,
 	present BOOL NOT NULL DEFAULT false,
+	download_timeout_seconds INTEGER NULL,
+	content_type STRING NULL,
+	content_disposition STRING NULL,
+	content_encoding STRING NULL,
 	CONSTRAINT "primary" PRIMARY KEY (id ASC),
 	UNIQUE INDEX files_uri_key (uri ASC),
-	FAMILY "primary" (id, uri, sha256, size, present),
+	FAMILY "primary" (id, uri, sha256, size, present, download_timeout_seconds, content_type, content_disposition, content_encoding),
 	CONSTRAINT check_sha256 CHECK (sha256 ~ '^[0-9a-f]{64}$'),
 	CONSTRAINT check_present_sha256 CHECK ((NOT present) OR (sha256 IS NOT NULL)),
-	CONSTRAINT check_present_size CHECK ((NOT present) OR (size IS NOT NULL))
+	CONSTRAINT check_present_size CHECK ((NOT present) OR (size IS NOT NULL)),
+	CONSTRAINT check_download_timeout_seconds CHECK (download_timeout_seconds > 0)
+);
+
+CREATE TABLE file_downloads (
+	id UUID NOT NULL DEFAULT gen_random_uuid(),
+	file_id UUID NOT NULL,
+	downloaded_at TIMESTAMP NOT NULL,
+	downloader_version STRING NOT NULL,
+	manually_imported BOOL NOT NULL DEFAULT false,
+	uploaded_filename STRING NULL,
+	final_uri STRING NULL,
+	redirect_chain STRING[] NULL,
+	last_modified STRING NULL,
+	etag STRING NULL,
+	content_type STRING NULL,
+	content_disposition STRING NULL,
+	content_encoding STRING NULL,
+	tls_certificate_fingerprints STRING[] NULL,
+	CONSTRAINT "primary" PRIMARY KEY (id ASC),
+	CONSTRAINT fk_file_id_ref_files FOREIGN KEY (file_id) REFERENCES files (id),
+	INDEX file_downloads_file_id_downloaded_at_idx (file_id ASC, downloaded_at ASC),
+	FAMILY "primary" (id, file_id, downloaded_at, downloader_version, manually_imported, uploaded_filename, final_uri, redirect_chain, last_modified, etag, content_type, content_disposition, content_encoding, tls_certificate_fingerprints)
+);
+
+CREATE TABLE drift_checks (
+	id UUID NOT NULL DEFAULT gen_random_uuid(),
+	file_id UUID NULL,
+	container_image_id UUID NULL,
+	checked_at TIMESTAMP NOT NULL,
+	status STRING NOT NULL,
+	details STRING NULL,
+	CONSTRAINT "primary" PRIMARY KEY (id ASC),
+	CONSTRAINT fk_file_id_ref_files FOREIGN KEY (file_id) REFERENCES files (id),
+	CONSTRAINT fk_container_image_id_ref_container_images FOREIGN KEY (container_image_id) REFERENCES container_images (id),
+	INDEX drift_checks_file_id_checked_at_idx (file_id ASC, checked_at DESC),
+	INDEX drift_checks_container_image_id_checked_at_idx (container_image_id ASC, checked_at DESC),
+	FAMILY "primary" (id, file_id, container_image_id, checked_at, status, details),
+	CONSTRAINT check_artifact CHECK ((file_id IS NULL) != (container_image_id IS NULL)),
+	CONSTRAINT check_status CHECK (status IN ('unchanged', 'changed', 'missing', 'headers_changed', 'error'))
+);
+
+CREATE TABLE scrub_findings (
+	bucket STRING NOT NULL,
+	key STRING NOT NULL,
+	status STRING NOT NULL,
+	details STRING NULL,
+	detected_at TIMESTAMP NOT NULL,
+	CONSTRAINT "primary" PRIMARY KEY (bucket ASC, key ASC),
+	FAMILY "primary" (bucket, key, status, details, detected_at),
+	CONSTRAINT check_status CHECK (status IN ('missing', 'corrupt'))
 );
@@ -0,0 +1,319 @@
+package archive
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/manifests"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/util"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/jinzhu/gorm"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Annotation used by containerd to store the name of an image in the
+// index of an OCI image layout.
+const containerdImageNameAnnotation = "io.containerd.image.name"
+
+// Image is a mirrored container image that is written to an archive,
+// together with the name under which it should be imported.
+type Image struct {
+	// Name of the image (e.g., "docker.io/library/debian").
+	Name string
+	// Tag of the image, if any.
+	Tag string
+
+	ContainerImage *schema.ContainerImage
+}
+
+// getReference returns the reference under which the image should be
+// imported.
+func (i *Image) getReference() string {
+	if i.Tag != "" {
+		return i.Name + ":" + i.Tag
+	}
+	return i.Name + "@" + i.ContainerImage.Digest
+}
+
+// blob is a blob that is written to an archive. Manifests are obtained
+// from the database, while all other blobs are read from storage.
+type blob struct {
+	descriptor distribution.Descriptor
+	contents   []byte
+}
+
+func getBlobPath(d digest.Digest) string {
+	return "blobs/" + d.Algorithm().String() + "/" + d.Hex()
+}
+
+// Archive is a tarball containing a container image that is written on
+// the fly. The blobs that are part of the image are determined when the
+// archive is created, so that errors can be reported before any data
+// is written.
+type Archive struct {
+	s3Client *s3.S3
+	blobs    []blob
+	seen     map[digest.Digest]bool
+	files    map[string][]byte
+}
+
+func newArchive(ctx context.Context, db *gorm.DB, s3Client *s3.S3, image *Image, includeChildren bool) (*Archive, distribution.Manifest, error) {
+	containerImage := image.ContainerImage
+	if containerImage.Manifest == nil {
+		return nil, nil, errors.New("Container image has not been downloaded")
+	}
+	a := &Archive{
+		s3Client: s3Client,
+		seen:     map[digest.Digest]bool{},
+		files:    map[string][]byte{},
+	}
+	manifest, err := a.addManifest(ctx, db, containerImage, includeChildren)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The index of the image layout refers to the image.
+	annotations := map[string]string{
+		containerdImageNameAnnotation: image.getReference(),
+	}
+	if image.Tag != "" {
+		annotations[v1.AnnotationRefName] = image.Tag
+	}
+	index, err := json.Marshal(struct {
+		SchemaVersion int             `json:"schemaVersion"`
+		MediaType     string          `json:"mediaType"`
+		Manifests     []v1.Descriptor `json:"manifests"`
+	}{
+		SchemaVersion: 2,
+		MediaType:     v1.MediaTypeImageIndex,
+		Manifests: []v1.Descriptor{{
+			MediaType:   *containerImage.ManifestMediatype,
+			Digest:      digest.Digest(containerImage.Digest),
+			Size:        int64(len(*containerImage.Manifest)),
+			Annotations: annotations,
+		}},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	a.files["index.json"] = index
+	a.files[v1.ImageLayoutFile] = []byte(`{"imageLayoutVersion":"` + v1.ImageLayoutVersion + `"}`)
+	return a, manifest, nil
+}
+
+// addManifest adds a manifest and the blobs it references to the
+// archive. The manifests referenced by a manifest list are only added
+// if they have been mirrored.
+func (a *Archive) addManifest(ctx context.Context, db *gorm.DB, containerImage *schema.ContainerImage, includeChildren bool) (distribution.Manifest, error) {
+	manifest, _, err := distribution.UnmarshalManifest(*containerImage.ManifestMediatype, *containerImage.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := manifest.(*schema1.SignedManifest); ok {
+		return nil, errors.New("Schema 1 manifests cannot be exported")
+	}
+	manifestDigest := digest.Digest(containerImage.Digest)
+	if a.seen[manifestDigest] {
+		return manifest, nil
+	}
+	a.seen[manifestDigest] = true
+	a.blobs = append(a.blobs, blob{
+		descriptor: distribution.Descriptor{
+			MediaType: *containerImage.ManifestMediatype,
+			Digest:    manifestDigest,
+			Size:      int64(len(*containerImage.Manifest)),
+		},
+		contents: *containerImage.Manifest,
+	})
+
+	if manifestList, ok := manifest.(*manifestlist.DeserializedManifestList); ok {
+		if !includeChildren {
+			return manifest, nil
+		}
+		var childDigests []string
+		for _, descriptor := range manifestList.Manifests {
+			childDigests = append(childDigests, string(descriptor.Digest))
+		}
+		var children []schema.ContainerImage
+		if r := db.Where("repository_id = ? AND digest IN (?) AND manifest IS NOT NULL", containerImage.RepositoryId, childDigests).Order("digest").Find(&children); r.Error != nil {
+			return nil, r.Error
+		}
+		for _, child := range children {
+			if _, err := a.addManifest(ctx, db, &child, includeChildren); err != nil {
+				return nil, err
+			}
+		}
+		return manifest, nil
+	}
+
+	for _, descriptor := range manifest.References() {
+		if a.seen[descriptor.Digest] {
+			continue
+		}
+		if present, err := util.ObjectExists(ctx, a.s3Client, "container-blobs", string(descriptor.Digest)); err != nil {
+			return nil, err
+		} else if !present {
+			return nil, fmt.Errorf("Blob %s is not present in storage", descriptor.Digest)
+		}
+		a.seen[descriptor.Digest] = true
+		a.blobs = append(a.blobs, blob{descriptor: descriptor})
+	}
+	return manifest, nil
+}
+
+// NewOCILayout creates an archive containing a container image in the
+// OCI image layout format. Manifest lists are exported together with
+// the manifests referenced by them that have been mirrored.
+func NewOCILayout(ctx context.Context, db *gorm.DB, s3Client *s3.S3, image *Image) (*Archive, error) {
+	a, _, err := newArchive(ctx, db, s3Client, image, true)
+	return a, err
+}
+
+// NewDockerArchive creates an archive containing a container image in
+// the format written by "docker save". Like recent versions of Docker,
+// the archive is also a valid OCI image layout. Docker archives can
+// only hold images for a single platform.
+func NewDockerArchive(ctx context.Context, db *gorm.DB, s3Client *s3.S3, image *Image) (*Archive, error) {
+	a, manifest, err := newArchive(ctx, db, s3Client, image, false)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := manifest.(*manifestlist.DeserializedManifestList); ok {
+		return nil, errors.New("Manifest lists cannot be exported as Docker archives. Export one of the images referenced by it instead")
+	}
+	config, ok := manifests.GetConfigDescriptor(manifest)
+	if !ok || !manifests.IsImageConfig(config) {
+		return nil, errors.New("Only container images can be exported as Docker archives")
+	}
+
+	var layers []string
+	for _, descriptor := range manifest.References() {
+		if descriptor.Digest != config.Digest {
+			layers = append(layers, getBlobPath(descriptor.Digest))
+		}
+	}
+	var repoTags []string
+	if image.Tag != "" {
+		repoTags = append(repoTags, image.getReference())
+	}
+	dockerManifest, err := json.Marshal([]struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}{{
+		Config:   getBlobPath(config.Digest),
+		RepoTags: repoTags,
+		Layers:   layers,
+	}})
+	if err != nil {
+		return nil, err
+	}
+	a.files["manifest.json"] = dockerManifest
+	return a, nil
+}
+
+func getTarHeader(name string, size int64) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Unix(0, 0),
+	}
+}
+
+// Write the archive. As blobs are streamed from storage, the digests
+// of blobs are validated while writing. When a blob turns out to be
+// corrupt, an error is returned without finalizing the tarball.
+func (a *Archive) Write(ctx context.Context, w io.Writer) error {
+	tarWriter := tar.NewWriter(w)
+
+	// Emit the directories holding blobs first.
+	algorithms := map[string]bool{}
+	for _, blob := range a.blobs {
+		algorithms[blob.descriptor.Digest.Algorithm().String()] = true
+	}
+	directories := []string{"blobs/"}
+	for algorithm := range algorithms {
+		directories = append(directories, "blobs/"+algorithm+"/")
+	}
+	sort.Strings(directories)
+	for _, directory := range directories {
+		if err := tarWriter.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     directory,
+			Mode:     0755,
+			ModTime:  time.Unix(0, 0),
+		}); err != nil {
+			return err
+		}
+	}
+
+	for _, blob := range a.blobs {
+		if err := a.writeBlob(ctx, tarWriter, blob); err != nil {
+			return err
+		}
+	}
+
+	var names []string
+	for name := range a.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		contents := a.files[name]
+		if err := tarWriter.WriteHeader(getTarHeader(name, int64(len(contents)))); err != nil {
+			return err
+		}
+		if _, err := tarWriter.Write(contents); err != nil {
+			return err
+		}
+	}
+	return tarWriter.Close()
+}
+
+func (a *Archive) writeBlob(ctx context.Context, tarWriter *tar.Writer, blob blob) error {
+	header := getTarHeader(getBlobPath(blob.descriptor.Digest), blob.descriptor.Size)
+	if blob.contents != nil {
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := tarWriter.Write(blob.contents)
+		return err
+	}
+
+	object, err := a.s3Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String("container-blobs"),
+		Key:    aws.String(string(blob.descriptor.Digest)),
+	})
+	if err != nil {
+		return err
+	}
+	defer object.Body.Close()
+	if object.ContentLength != nil && *object.ContentLength != blob.descriptor.Size {
+		return fmt.Errorf("Blob %s has size %d, while %d was expected", blob.descriptor.Digest, *object.ContentLength, blob.descriptor.Size)
+	}
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	verifier := blob.descriptor.Digest.Verifier()
+	if _, err := io.CopyN(tarWriter, io.TeeReader(object.Body, verifier), blob.descriptor.Size); err != nil {
+		return fmt.Errorf("Failed to copy blob %s: %s", blob.descriptor.Digest, err)
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("Blob %s is corrupt", blob.descriptor.Digest)
+	}
+	return nil
+}
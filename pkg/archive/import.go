@@ -0,0 +1,586 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/manifests"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/util"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/distribution/reference"
+	"github.com/jinzhu/gorm"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Maximum size of a manifest or config contained in an uploaded
+// archive. Files up to this size are read into memory, so that they
+// can be parsed.
+const maximumMetadataSize = 4 * 1024 * 1024
+
+// entry is a regular file contained in an uploaded archive.
+type entry struct {
+	// Name of the entry holding the contents of the file. This
+	// differs from the file's name for links.
+	name string
+
+	digest digest.Digest
+	size   int64
+
+	// Contents of the file. Only retained for small files.
+	contents []byte
+
+	// Whether the contents of the file are compressed using gzip.
+	gzipped bool
+}
+
+func getEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// readEntries computes the digests of all regular files contained in
+// an archive. Links are resolved to the files they refer to, as "docker
+// save" uses them to deduplicate layers shared by multiple images.
+func readEntries(r io.Reader) (map[string]*entry, error) {
+	entries := map[string]*entry{}
+	links := map[string]string{}
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		name := getEntryName(header.Name)
+		if _, ok := entries[name]; ok {
+			return nil, fmt.Errorf("Archive contains multiple files named %#v", name)
+		}
+		if _, ok := links[name]; ok {
+			return nil, fmt.Errorf("Archive contains multiple files named %#v", name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			digester := digest.SHA256.Digester()
+			body := bufio.NewReader(io.TeeReader(tarReader, digester.Hash()))
+			magic, _ := body.Peek(2)
+			e := &entry{
+				name:    name,
+				size:    header.Size,
+				gzipped: bytes.Equal(magic, []byte{0x1f, 0x8b}),
+			}
+			if header.Size <= maximumMetadataSize {
+				if e.contents, err = ioutil.ReadAll(body); err != nil {
+					return nil, err
+				}
+			} else if _, err := io.Copy(ioutil.Discard, body); err != nil {
+				return nil, err
+			}
+			e.digest = digester.Digest()
+			entries[name] = e
+		case tar.TypeSymlink:
+			links[name] = getEntryName(path.Join(path.Dir(name), header.Linkname))
+		case tar.TypeLink:
+			links[name] = getEntryName(header.Linkname)
+		}
+	}
+
+	for name, target := range links {
+		// Follow chains of links, while preventing cycles.
+		for i := 0; i < len(links); i++ {
+			if next, ok := links[target]; ok {
+				target = next
+			}
+		}
+		if e, ok := entries[target]; ok {
+			entries[name] = e
+		}
+	}
+	return entries, nil
+}
+
+// importedImage is a container image that is contained in an uploaded
+// archive.
+type importedImage struct {
+	digest            digest.Digest
+	manifestMediatype string
+	manifest          []byte
+
+	// Tag under which the image was stored in the archive, if any.
+	tag string
+	// Whether the image is referenced by the archive directly, as
+	// opposed to through a manifest list.
+	topLevel bool
+}
+
+// importer collects the container images and blobs contained in an
+// uploaded archive.
+type importer struct {
+	s3Client *s3.S3
+	entries  map[string]*entry
+
+	images   []importedImage
+	imported map[digest.Digest]bool
+	// Blobs referenced by the images that are contained in the
+	// archive, together with the name of the entry holding them.
+	blobs map[digest.Digest]string
+	// Digests that the entries holding gzip compressed layers of
+	// Docker archives must have after decompression.
+	diffIds map[string]digest.Digest
+}
+
+// getTag extracts the tag from the name of an image stored in an
+// archive. OCI image layouts may either store the full reference or
+// just the tag.
+func getTag(name string) string {
+	if tag := reference.TagRegexp.FindString(name); tag == name {
+		return tag
+	}
+	if named, err := reference.ParseNormalizedNamed(name); err == nil {
+		if tagged, ok := named.(reference.Tagged); ok {
+			return tagged.Tag()
+		}
+	}
+	return ""
+}
+
+// getEntry returns the file contained in the archive that holds a blob
+// with a given digest and size, if any.
+func (i *importer) getEntry(descriptor distribution.Descriptor) (*entry, error) {
+	if err := descriptor.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	if descriptor.Digest.Algorithm() != digest.SHA256 {
+		return nil, fmt.Errorf("Blob %s does not use SHA-256", descriptor.Digest)
+	}
+	e, ok := i.entries[getBlobPath(descriptor.Digest)]
+	if !ok {
+		return nil, nil
+	}
+	if e.digest != descriptor.Digest {
+		return nil, fmt.Errorf("Blob %s has digest %s", descriptor.Digest, e.digest)
+	}
+	if e.size != descriptor.Size {
+		return nil, fmt.Errorf("Blob %s has size %d, while %d was expected", descriptor.Digest, e.size, descriptor.Size)
+	}
+	return e, nil
+}
+
+// addBlob records that a blob referenced by a manifest needs to be
+// stored. Blobs that are not contained in the archive are permitted if
+// they are already present in storage.
+func (i *importer) addBlob(ctx context.Context, descriptor distribution.Descriptor) error {
+	e, err := i.getEntry(descriptor)
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		if present, err := util.ObjectExists(ctx, i.s3Client, "container-blobs", string(descriptor.Digest)); err != nil {
+			return err
+		} else if !present {
+			return fmt.Errorf("Blob %s is not contained in the archive, nor present in storage", descriptor.Digest)
+		}
+		return nil
+	}
+	i.blobs[descriptor.Digest] = e.name
+	return nil
+}
+
+// addManifest adds a manifest contained in an OCI image layout and the
+// blobs it references. Manifests referenced by a manifest list are only
+// added if they are contained in the archive, as "docker save" only
+// stores the images for some platforms.
+func (i *importer) addManifest(ctx context.Context, descriptor distribution.Descriptor, tag string, topLevel bool) error {
+	if i.imported[descriptor.Digest] {
+		return nil
+	}
+	e, err := i.getEntry(descriptor)
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		return fmt.Errorf("Manifest %s is not contained in the archive", descriptor.Digest)
+	}
+	if e.contents == nil {
+		return fmt.Errorf("Manifest %s is too large", descriptor.Digest)
+	}
+
+	// Descriptors in OCI image layouts may omit the media type,
+	// in which case it is stored in the manifest itself.
+	mediaType := descriptor.MediaType
+	if mediaType == "" {
+		var versioned struct {
+			MediaType string `json:"mediaType"`
+		}
+		if err := json.Unmarshal(e.contents, &versioned); err != nil {
+			return err
+		}
+		mediaType = versioned.MediaType
+	}
+	manifest, _, err := distribution.UnmarshalManifest(mediaType, e.contents)
+	if err != nil {
+		return fmt.Errorf("Failed to parse manifest %s: %s", descriptor.Digest, err)
+	}
+	if _, ok := manifest.(*schema1.SignedManifest); ok {
+		return errors.New("Schema 1 manifests cannot be imported")
+	}
+	i.imported[descriptor.Digest] = true
+	i.images = append(i.images, importedImage{
+		digest:            descriptor.Digest,
+		manifestMediatype: mediaType,
+		manifest:          e.contents,
+		tag:               tag,
+		topLevel:          topLevel,
+	})
+
+	if manifestList, ok := manifest.(*manifestlist.DeserializedManifestList); ok {
+		for _, child := range manifestList.Manifests {
+			if _, ok := i.entries[getBlobPath(child.Digest)]; ok {
+				if err := i.addManifest(ctx, child.Descriptor, "", false); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	for _, referenced := range manifest.References() {
+		if err := i.addBlob(ctx, referenced); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addOCILayout adds the images referenced by the index of an OCI image
+// layout. Since version 25, "docker save" writes these as well.
+func (i *importer) addOCILayout(ctx context.Context, index *entry) error {
+	if index.contents == nil {
+		return errors.New("Index of the OCI image layout is too large")
+	}
+	var parsedIndex v1.Index
+	if err := json.Unmarshal(index.contents, &parsedIndex); err != nil {
+		return fmt.Errorf("Failed to parse index of the OCI image layout: %s", err)
+	}
+	for _, descriptor := range parsedIndex.Manifests {
+		name := descriptor.Annotations[v1.AnnotationRefName]
+		if containerdName, ok := descriptor.Annotations[containerdImageNameAnnotation]; ok {
+			name = containerdName
+		}
+		if err := i.addManifest(ctx, distribution.Descriptor{
+			MediaType: descriptor.MediaType,
+			Digest:    descriptor.Digest,
+			Size:      descriptor.Size,
+		}, getTag(name), true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addDockerArchive adds the images contained in an archive written by
+// versions of "docker save" prior to 25. These archives don't contain
+// manifests. Schema 2 manifests are constructed instead, meaning that
+// the digests of the images differ from the ones in their original
+// registry.
+func (i *importer) addDockerArchive(ctx context.Context, dockerManifest *entry) error {
+	if dockerManifest.contents == nil {
+		return errors.New("Manifest of the Docker archive is too large")
+	}
+	var images []struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	if err := json.Unmarshal(dockerManifest.contents, &images); err != nil {
+		return fmt.Errorf("Failed to parse manifest of the Docker archive: %s", err)
+	}
+	for _, image := range images {
+		configEntry, ok := i.entries[getEntryName(image.Config)]
+		if !ok {
+			return fmt.Errorf("Config %#v is not contained in the archive", image.Config)
+		}
+		if configEntry.contents == nil {
+			return fmt.Errorf("Config %#v is too large", image.Config)
+		}
+		config, err := manifests.ParseImageConfig(configEntry.contents)
+		if err != nil {
+			return fmt.Errorf("Failed to parse config %#v: %s", image.Config, err)
+		}
+		if len(config.RootFS.DiffIDs) != len(image.Layers) {
+			return fmt.Errorf("Config %#v refers to %d layers, while the archive contains %d", image.Config, len(config.RootFS.DiffIDs), len(image.Layers))
+		}
+		i.blobs[configEntry.digest] = configEntry.name
+
+		// Layers are typically stored uncompressed, meaning that
+		// their digests must match the ones in the config. The
+		// same holds for compressed layers after decompression.
+		m := schema2.Manifest{
+			Versioned: schema2.SchemaVersion,
+			Config: distribution.Descriptor{
+				MediaType: schema2.MediaTypeImageConfig,
+				Digest:    configEntry.digest,
+				Size:      configEntry.size,
+			},
+		}
+		for j, layer := range image.Layers {
+			layerEntry, ok := i.entries[getEntryName(layer)]
+			if !ok {
+				return fmt.Errorf("Layer %#v is not contained in the archive", layer)
+			}
+			mediaType := schema2.MediaTypeLayer
+			if layerEntry.gzipped {
+				// Compressed layers are decompressed and
+				// validated once all images are added.
+				if diffId, ok := i.diffIds[layerEntry.name]; ok && diffId != config.RootFS.DiffIDs[j] {
+					return fmt.Errorf("Layer %#v is expected to have digests %s and %s", layer, diffId, config.RootFS.DiffIDs[j])
+				}
+				i.diffIds[layerEntry.name] = config.RootFS.DiffIDs[j]
+			} else {
+				if layerEntry.digest != config.RootFS.DiffIDs[j] {
+					return fmt.Errorf("Layer %#v has digest %s, while the config expects %s", layer, layerEntry.digest, config.RootFS.DiffIDs[j])
+				}
+				mediaType = schema2.MediaTypeUncompressedLayer
+			}
+			m.Layers = append(m.Layers, distribution.Descriptor{
+				MediaType: mediaType,
+				Digest:    layerEntry.digest,
+				Size:      layerEntry.size,
+			})
+			i.blobs[layerEntry.digest] = layerEntry.name
+		}
+		manifest, err := schema2.FromStruct(m)
+		if err != nil {
+			return err
+		}
+		_, payload, err := manifest.Payload()
+		if err != nil {
+			return err
+		}
+
+		manifestDigest := digest.FromBytes(payload)
+		if i.imported[manifestDigest] {
+			continue
+		}
+		i.imported[manifestDigest] = true
+		newImage := importedImage{
+			digest:            manifestDigest,
+			manifestMediatype: schema2.MediaTypeManifest,
+			manifest:          payload,
+			topLevel:          true,
+		}
+		if len(image.RepoTags) > 0 {
+			newImage.tag = getTag(image.RepoTags[0])
+		}
+		i.images = append(i.images, newImage)
+	}
+	return nil
+}
+
+// verifyDiffIds decompresses the gzip compressed layers of Docker
+// archives, validating their digests against the ones in the configs of
+// the images.
+func (i *importer) verifyDiffIds(r io.Reader) error {
+	pending := map[string]digest.Digest{}
+	for name, diffId := range i.diffIds {
+		if err := diffId.Validate(); err != nil {
+			return err
+		}
+		pending[name] = diffId
+	}
+
+	tarReader := tar.NewReader(r)
+	for len(pending) > 0 {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return errors.New("Archive was truncated while importing")
+		} else if err != nil {
+			return err
+		}
+		name := getEntryName(header.Name)
+		diffId, ok := pending[name]
+		if !ok || (header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA) {
+			continue
+		}
+		gzipReader, err := gzip.NewReader(tarReader)
+		if err != nil {
+			return fmt.Errorf("Failed to decompress layer %#v: %s", name, err)
+		}
+		verifier := diffId.Verifier()
+		if _, err := io.Copy(verifier, gzipReader); err != nil {
+			return fmt.Errorf("Failed to decompress layer %#v: %s", name, err)
+		}
+		if !verifier.Verified() {
+			return fmt.Errorf("Layer %#v does not have digest %s after decompression", name, diffId)
+		}
+		delete(pending, name)
+	}
+	return nil
+}
+
+// uploadBlobs copies the blobs contained in the archive that are not
+// present in storage yet.
+func (i *importer) uploadBlobs(ctx context.Context, uploader *s3manager.Uploader, r io.Reader) error {
+	pending := map[string]digest.Digest{}
+	for blobDigest, name := range i.blobs {
+		if present, err := util.ObjectExists(ctx, i.s3Client, "container-blobs", string(blobDigest)); err != nil {
+			return err
+		} else if !present {
+			pending[name] = blobDigest
+		}
+	}
+
+	tarReader := tar.NewReader(r)
+	for len(pending) > 0 {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return errors.New("Archive was truncated while importing")
+		} else if err != nil {
+			return err
+		}
+		name := getEntryName(header.Name)
+		blobDigest, ok := pending[name]
+		if !ok || (header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA) {
+			continue
+		}
+		log.Printf("Uploading blob %s", blobDigest)
+		verifier := blobDigest.Verifier()
+		if _, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+			Bucket: aws.String("container-blobs"),
+			Key:    aws.String(string(blobDigest)),
+			Body:   io.TeeReader(tarReader, verifier),
+		}); err != nil {
+			return err
+		}
+		if !verifier.Verified() {
+			// The archive was modified since its digests
+			// were computed. Don't leave a corrupt blob
+			// behind.
+			if _, err := i.s3Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String("container-blobs"),
+				Key:    aws.String(string(blobDigest)),
+			}); err != nil {
+				return err
+			}
+			return fmt.Errorf("Blob %s changed while importing", blobDigest)
+		}
+		delete(pending, name)
+	}
+	return nil
+}
+
+// ImportImages imports the container images contained in an archive
+// into a repository. Archives may either be in the OCI image layout
+// format or in the format written by "docker save". The digests of all
+// manifests and blobs are validated. Images that have already been
+// mirrored are left untouched. The images referenced by the archive
+// directly are returned.
+func ImportImages(ctx context.Context, db *gorm.DB, s3Client *s3.S3, uploader *s3manager.Uploader, r io.ReadSeeker, repository *schema.ContainerRepository) ([]schema.ContainerImage, error) {
+	entries, err := readEntries(r)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read archive: %s", err)
+	}
+	i := importer{
+		s3Client: s3Client,
+		entries:  entries,
+		imported: map[digest.Digest]bool{},
+		blobs:    map[digest.Digest]string{},
+		diffIds:  map[string]digest.Digest{},
+	}
+	if index, ok := entries["index.json"]; ok {
+		err = i.addOCILayout(ctx, index)
+	} else if dockerManifest, ok := entries["manifest.json"]; ok {
+		err = i.addDockerArchive(ctx, dockerManifest)
+	} else {
+		err = errors.New("Archive is neither an OCI image layout, nor a Docker archive")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(i.images) == 0 {
+		return nil, errors.New("Archive does not contain any container images")
+	}
+
+	if len(i.diffIds) > 0 {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if err := i.verifyDiffIds(r); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := i.uploadBlobs(ctx, uploader, r); err != nil {
+		return nil, err
+	}
+
+	// Register the images as present. Blobs have been stored at
+	// this point, meaning the images can be served right away.
+	importedAt := time.Now()
+	var topLevelImages []schema.ContainerImage
+	tx := db.Begin()
+	for _, image := range i.images {
+		var containerImage schema.ContainerImage
+		if r := tx.FirstOrCreate(&containerImage, schema.ContainerImage{
+			RepositoryId: repository.Id,
+			Digest:       string(image.digest),
+		}); r.Error != nil {
+			tx.Rollback()
+			return nil, r.Error
+		}
+		if containerImage.Manifest == nil {
+			metadata, err := manifests.ParseMetadata(image.manifest)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			updates := schema.ContainerImage{
+				ManifestMediatype: &image.manifestMediatype,
+				Manifest:          &image.manifest,
+				SubjectDigest:     metadata.SubjectDigest,
+				ImportedAt:        &importedAt,
+			}
+			if metadata.ArtifactType != "" {
+				updates.ArtifactType = &metadata.ArtifactType
+			}
+			if image.tag != "" {
+				updates.Tag = &image.tag
+			}
+			if r := tx.Model(&schema.ContainerImage{}).Where("id = ?", containerImage.Id).Updates(updates); r.Error != nil {
+				tx.Rollback()
+				return nil, r.Error
+			}
+		} else {
+			log.Printf("Container image %s is already present", image.digest)
+		}
+		if image.topLevel {
+			topLevelImages = append(topLevelImages, containerImage)
+		}
+	}
+	if r := tx.Commit(); r.Error != nil {
+		return nil, r.Error
+	}
+	return topLevelImages, nil
+}
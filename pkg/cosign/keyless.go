@@ -0,0 +1,236 @@
+package cosign
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// Certificate extensions in which Fulcio stores the URL of
+	// the OIDC issuer that authenticated the signer.
+	oidcIssuerV1OID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	oidcIssuerV2OID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// bundlePayload is the part of a Rekor bundle that is covered by the
+// signed entry timestamp. Fields are listed in lexicographical order,
+// so that marshaling it yields canonical JSON.
+type bundlePayload struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogID          string `json:"logID"`
+	LogIndex       int64  `json:"logIndex"`
+}
+
+type bundle struct {
+	SignedEntryTimestamp string
+	Payload              bundlePayload
+}
+
+// hashedRekordEntry is the body of a transparency log entry of kind
+// "hashedrekord".
+type hashedRekordEntry struct {
+	Kind string `json:"kind"`
+	Spec struct {
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+		Signature struct {
+			Content   string `json:"content"`
+			PublicKey struct {
+				Content string `json:"content"`
+			} `json:"publicKey"`
+		} `json:"signature"`
+	} `json:"spec"`
+}
+
+// verifyBundle checks whether a signature has been recorded in the
+// transparency log using a given certificate, returning the time at
+// which this happened.
+func (s *Signature) verifyBundle(trustRoot *TrustRoot, certificate *x509.Certificate) (time.Time, error) {
+	if s.Bundle == "" {
+		return time.Time{}, errors.New("Signature does not contain a transparency log bundle")
+	}
+	var b bundle
+	if err := json.Unmarshal([]byte(s.Bundle), &b); err != nil {
+		return time.Time{}, fmt.Errorf("Invalid transparency log bundle: %s", err)
+	}
+
+	// Validate the signed entry timestamp against the public keys
+	// of the transparency log.
+	signedEntryTimestamp, err := base64.StdEncoding.DecodeString(b.SignedEntryTimestamp)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid signed entry timestamp encoding: %s", err)
+	}
+	canonicalPayload, err := json.Marshal(b.Payload)
+	if err != nil {
+		return time.Time{}, err
+	}
+	verified := false
+	for _, publicKey := range trustRoot.rekorKeys {
+		if verifySHA256Signature(publicKey, canonicalPayload, signedEntryTimestamp) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return time.Time{}, errors.New("Signed entry timestamp is not signed by any of the trusted transparency logs")
+	}
+
+	// Ensure that the log entry actually corresponds to this
+	// signature.
+	body, err := base64.StdEncoding.DecodeString(b.Payload.Body)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid transparency log entry encoding: %s", err)
+	}
+	var entry hashedRekordEntry
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return time.Time{}, fmt.Errorf("Invalid transparency log entry: %s", err)
+	}
+	if entry.Kind != "hashedrekord" {
+		return time.Time{}, fmt.Errorf("Unsupported transparency log entry kind %#v", entry.Kind)
+	}
+	payloadHash := sha256.Sum256(s.Payload)
+	if entry.Spec.Data.Hash.Algorithm != "sha256" || entry.Spec.Data.Hash.Value != hex.EncodeToString(payloadHash[:]) {
+		return time.Time{}, errors.New("Transparency log entry does not correspond to the signature payload")
+	}
+	if entry.Spec.Signature.Content != s.Signature {
+		return time.Time{}, errors.New("Transparency log entry does not correspond to the signature")
+	}
+
+	// The log entry contains the PEM encoded certificate that was
+	// used to create the signature, or just its public key.
+	publicKey, err := base64.StdEncoding.DecodeString(entry.Spec.Signature.PublicKey.Content)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid transparency log entry public key encoding: %s", err)
+	}
+	matched := false
+	if block, _ := pem.Decode(publicKey); block != nil {
+		switch block.Type {
+		case "CERTIFICATE":
+			matched = bytes.Equal(block.Bytes, certificate.Raw)
+		case "PUBLIC KEY":
+			matched = bytes.Equal(block.Bytes, certificate.RawSubjectPublicKeyInfo)
+		}
+	}
+	if !matched {
+		return time.Time{}, errors.New("Transparency log entry does not correspond to the certificate")
+	}
+	return time.Unix(b.Payload.IntegratedTime, 0), nil
+}
+
+func parseCertificates(contents string) ([]*x509.Certificate, error) {
+	var certificates []*x509.Certificate
+	rest := []byte(contents)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+	return certificates, nil
+}
+
+// getOIDCIssuer returns the URL of the OIDC issuer stored in a
+// certificate issued by Fulcio.
+func getOIDCIssuer(certificate *x509.Certificate) string {
+	for _, extension := range certificate.Extensions {
+		if extension.Id.Equal(oidcIssuerV2OID) {
+			var issuer string
+			if _, err := asn1.Unmarshal(extension.Value, &issuer); err == nil {
+				return issuer
+			}
+		}
+	}
+	for _, extension := range certificate.Extensions {
+		if extension.Id.Equal(oidcIssuerV1OID) {
+			return string(extension.Value)
+		}
+	}
+	return ""
+}
+
+// getIdentities returns the email addresses and URIs stored in the
+// subject alternative name of a certificate.
+func getIdentities(certificate *x509.Certificate) []string {
+	identities := append([]string(nil), certificate.EmailAddresses...)
+	for _, uri := range certificate.URIs {
+		identities = append(identities, uri.String())
+	}
+	return identities
+}
+
+// verifyKeyless checks whether a signature was created using a
+// certificate issued by Fulcio to an expected identity. As these
+// certificates are short-lived, their validity is checked at the time
+// at which the signature was recorded in the transparency log.
+func (s *Signature) verifyKeyless(trustRoot *TrustRoot, identity string, issuer string) error {
+	if trustRoot == nil {
+		return errors.New("No trust root for keyless signatures configured")
+	}
+	certificates, err := parseCertificates(s.Certificate)
+	if err != nil {
+		return fmt.Errorf("Invalid certificate: %s", err)
+	}
+	if len(certificates) != 1 {
+		return errors.New("Signature does not contain exactly one certificate")
+	}
+	certificate := certificates[0]
+
+	integratedTime, err := s.verifyBundle(trustRoot, certificate)
+	if err != nil {
+		return err
+	}
+
+	chain, err := parseCertificates(s.Chain)
+	if err != nil {
+		return fmt.Errorf("Invalid certificate chain: %s", err)
+	}
+	intermediates := x509.NewCertPool()
+	for _, intermediate := range append(chain, trustRoot.intermediates...) {
+		intermediates.AddCert(intermediate)
+	}
+	if _, err := certificate.Verify(x509.VerifyOptions{
+		Roots:         trustRoot.roots,
+		Intermediates: intermediates,
+		CurrentTime:   integratedTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return fmt.Errorf("Certificate is not issued by a trusted certificate authority: %s", err)
+	}
+
+	if actualIssuer := getOIDCIssuer(certificate); actualIssuer != issuer {
+		return fmt.Errorf("Certificate is issued for OIDC issuer %#v, while %#v was expected", actualIssuer, issuer)
+	}
+	identities := getIdentities(certificate)
+	matched := false
+	for _, actualIdentity := range identities {
+		if actualIdentity == identity {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return fmt.Errorf("Certificate is issued for identities %#v, while %#v was expected", identities, identity)
+	}
+
+	return s.verifySignature(certificate.PublicKey)
+}
@@ -0,0 +1,87 @@
+package cosign
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+)
+
+// Policy describes which cosign signatures are accepted for the images
+// in a container repository.
+type Policy struct {
+	publicKeys []crypto.PublicKey
+	identity   string
+	issuer     string
+}
+
+// NewPolicy converts a signature policy stored in the database to a
+// Policy that can be used to verify signatures.
+func NewPolicy(policy *schema.ContainerSignaturePolicy) (*Policy, error) {
+	p := &Policy{}
+	if policy.PublicKeys != nil {
+		publicKeys, err := ParsePublicKeys(*policy.PublicKeys)
+		if err != nil {
+			return nil, err
+		}
+		p.publicKeys = publicKeys
+	}
+	if policy.Identity != nil && policy.Issuer != nil {
+		p.identity = *policy.Identity
+		p.issuer = *policy.Issuer
+	}
+	if len(p.publicKeys) == 0 && p.identity == "" {
+		return nil, errors.New("Policy does not contain any public keys or keyless identities")
+	}
+	return p, nil
+}
+
+// verify checks whether a single signature is accepted by the policy.
+func (p *Policy) verify(trustRoot *TrustRoot, signature *Signature, digest string) error {
+	signedDigest, err := signature.getSignedDigest()
+	if err != nil {
+		return err
+	}
+	if signedDigest != digest {
+		return fmt.Errorf("Signature is for digest %s", signedDigest)
+	}
+
+	var errs []string
+	for _, publicKey := range p.publicKeys {
+		err := signature.verifySignature(publicKey)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err.Error())
+	}
+	if p.identity != "" && signature.Certificate != "" {
+		err := signature.verifyKeyless(trustRoot, p.identity, p.issuer)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err.Error())
+	}
+	if len(errs) == 0 {
+		return errors.New("Signature does not match any of the public keys or keyless identities")
+	}
+	return errors.New(strings.Join(errs, ", "))
+}
+
+// Verify checks whether at least one of the signatures of a manifest
+// is accepted by the policy.
+func (p *Policy) Verify(trustRoot *TrustRoot, signatures []*Signature, digest string) error {
+	if len(signatures) == 0 {
+		return fmt.Errorf("No signatures found for %s", digest)
+	}
+	var errs []string
+	for i, signature := range signatures {
+		err := p.verify(trustRoot, signature, digest)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("signature %d: %s", i, err))
+	}
+	return fmt.Errorf("None of the signatures of %s are accepted: %s", digest, strings.Join(errs, "; "))
+}
@@ -0,0 +1,50 @@
+package cosign
+
+import (
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/manifests"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/jinzhu/gorm"
+)
+
+// GetRepositoryPolicy returns the signature policy of a repository, or
+// nil if images in the repository don't need to be signed.
+func GetRepositoryPolicy(database *gorm.DB, repositoryId string) (*Policy, error) {
+	var signaturePolicy schema.ContainerSignaturePolicy
+	if r := database.Where("repository_id = ?", repositoryId).Take(&signaturePolicy); r.Error != nil {
+		if r.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, r.Error
+	}
+	return NewPolicy(&signaturePolicy)
+}
+
+// IsCoveredByManifestList returns whether an image is referenced by a
+// manifest list whose signatures have been verified and mirrored. A
+// signature over a manifest list also covers the manifests that it
+// references, as they are referenced by digest.
+func IsCoveredByManifestList(database *gorm.DB, repositoryId string, digest string) (bool, error) {
+	var manifestLists []schema.ContainerImage
+	if r := database.Where(
+		"repository_id = ? AND manifest_mediatype IN (?) AND digest IN (SELECT signed_digest FROM container_images WHERE repository_id = ? AND manifest IS NOT NULL)",
+		repositoryId, manifests.ManifestListMediatypes, repositoryId).Find(&manifestLists); r.Error != nil {
+		return false, r.Error
+	}
+	for _, manifestList := range manifestLists {
+		manifest, _, err := distribution.UnmarshalManifest(*manifestList.ManifestMediatype, *manifestList.Manifest)
+		if err != nil {
+			return false, err
+		}
+		if _, ok := manifest.(*manifestlist.DeserializedManifestList); !ok {
+			continue
+		}
+		for _, descriptor := range manifest.References() {
+			if string(descriptor.Digest) == digest {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,104 @@
+package cosign
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+const (
+	// Maximum size of a simple signing payload that is read into
+	// memory.
+	MaximumPayloadSize = 1024 * 1024
+
+	// Media type of the layers of a signature manifest.
+	SimpleSigningMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+
+	// Annotations placed on the layers of a signature manifest.
+	SignatureAnnotation   = "dev.cosignproject.cosign/signature"
+	CertificateAnnotation = "dev.sigstore.cosign/certificate"
+	ChainAnnotation       = "dev.sigstore.cosign/chain"
+	BundleAnnotation      = "dev.sigstore.cosign/bundle"
+)
+
+// Signature is a single signature stored in a cosign signature
+// manifest. Each layer of such a manifest holds a payload in the
+// simple signing format, whereas the signature over this payload and
+// the material needed to verify it are stored in annotations.
+type Signature struct {
+	Payload     []byte
+	Signature   string
+	Certificate string
+	Chain       string
+	Bundle      string
+}
+
+// NewSignature creates a Signature from a layer of a cosign signature
+// manifest.
+func NewSignature(payload []byte, annotations map[string]string) *Signature {
+	return &Signature{
+		Payload:     payload,
+		Signature:   annotations[SignatureAnnotation],
+		Certificate: annotations[CertificateAnnotation],
+		Chain:       annotations[ChainAnnotation],
+		Bundle:      annotations[BundleAnnotation],
+	}
+}
+
+// getSignedDigest returns the digest of the manifest that is signed by
+// a simple signing payload.
+func (s *Signature) getSignedDigest() (string, error) {
+	var payload struct {
+		Critical struct {
+			Image struct {
+				DockerManifestDigest string `json:"docker-manifest-digest"`
+			} `json:"image"`
+			Type string `json:"type"`
+		} `json:"critical"`
+	}
+	if err := json.Unmarshal(s.Payload, &payload); err != nil {
+		return "", fmt.Errorf("Invalid signature payload: %s", err)
+	}
+	if payload.Critical.Type != "cosign container image signature" {
+		return "", fmt.Errorf("Unsupported signature payload type %#v", payload.Critical.Type)
+	}
+	return payload.Critical.Image.DockerManifestDigest, nil
+}
+
+// verifySignature checks whether the signature over the payload was
+// created with the private key corresponding to a public key.
+func (s *Signature) verifySignature(publicKey crypto.PublicKey) error {
+	signature, err := base64.StdEncoding.DecodeString(s.Signature)
+	if err != nil {
+		return fmt.Errorf("Invalid signature encoding: %s", err)
+	}
+	return verifySHA256Signature(publicKey, s.Payload, signature)
+}
+
+func verifySHA256Signature(publicKey crypto.PublicKey, data []byte, signature []byte) error {
+	hash := sha256.Sum256(data)
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		var ecdsaSignature struct {
+			R, S *big.Int
+		}
+		if _, err := asn1.Unmarshal(signature, &ecdsaSignature); err != nil {
+			return fmt.Errorf("Invalid ECDSA signature: %s", err)
+		}
+		if !ecdsa.Verify(key, hash[:], ecdsaSignature.R, ecdsaSignature.S) {
+			return errors.New("Invalid ECDSA signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature)
+	default:
+		return fmt.Errorf("Unsupported public key type %T", publicKey)
+	}
+}
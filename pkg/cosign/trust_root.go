@@ -0,0 +1,108 @@
+package cosign
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// TrustRoot holds the certificates of the certificate authority
+// (Fulcio) that issues the short-lived certificates used for keyless
+// signing, and the public keys of the transparency log (Rekor) in
+// which these signatures are recorded. They are supplied locally, as
+// opposed to obtained through TUF, so that the downloader does not
+// need to trust any online services.
+type TrustRoot struct {
+	roots         *x509.CertPool
+	intermediates []*x509.Certificate
+	rekorKeys     []crypto.PublicKey
+}
+
+func readPemBlocks(path string, blockType string) ([][]byte, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var blocks [][]byte
+	for {
+		var block *pem.Block
+		block, contents = pem.Decode(contents)
+		if block == nil {
+			break
+		}
+		if block.Type == blockType {
+			blocks = append(blocks, block.Bytes)
+		}
+	}
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("%s does not contain any PEM blocks of type %s", path, blockType)
+	}
+	return blocks, nil
+}
+
+// LoadTrustRoot loads a trust root from a PEM file containing the
+// Fulcio root and intermediate certificates, and a PEM file containing
+// the Rekor public keys.
+func LoadTrustRoot(fulcioCertificatesPath string, rekorPublicKeysPath string) (*TrustRoot, error) {
+	tr := &TrustRoot{
+		roots: x509.NewCertPool(),
+	}
+	certificates, err := readPemBlocks(fulcioCertificatesPath, "CERTIFICATE")
+	if err != nil {
+		return nil, err
+	}
+	for _, der := range certificates {
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid certificate in %s: %s", fulcioCertificatesPath, err)
+		}
+		// Self-signed certificates are roots. All others are
+		// intermediates.
+		if certificate.CheckSignatureFrom(certificate) == nil {
+			tr.roots.AddCert(certificate)
+		} else {
+			tr.intermediates = append(tr.intermediates, certificate)
+		}
+	}
+
+	publicKeys, err := readPemBlocks(rekorPublicKeysPath, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	for _, der := range publicKeys {
+		publicKey, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid public key in %s: %s", rekorPublicKeysPath, err)
+		}
+		tr.rekorKeys = append(tr.rekorKeys, publicKey)
+	}
+	return tr, nil
+}
+
+// ParsePublicKeys parses a list of PEM encoded public keys.
+func ParsePublicKeys(contents string) ([]crypto.PublicKey, error) {
+	var publicKeys []crypto.PublicKey
+	rest := []byte(contents)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("Unexpected PEM block of type %s", block.Type)
+		}
+		publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		publicKeys = append(publicKeys, publicKey)
+	}
+	if len(publicKeys) == 0 {
+		return nil, errors.New("No PEM encoded public keys found")
+	}
+	return publicKeys, nil
+}
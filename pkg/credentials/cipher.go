@@ -0,0 +1,63 @@
+package credentials
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Cipher encrypts secrets before they are stored in the database, so
+// that they are not exposed through database dumps and backups. It
+// uses AES-256 in GCM mode. Ciphertexts are prefixed with their nonce.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipherFromKeyFile creates a Cipher using a key stored in a file.
+// The file must contain 32 bytes of hex encoded key material.
+func NewCipherFromKeyFile(path string) (*Cipher, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode key: %s", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("Key is %d bytes in size, whereas 32 bytes were expected", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// Encrypt a secret.
+func (c *Cipher) Encrypt(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt a secret that was previously encrypted using Encrypt.
+func (c *Cipher) Decrypt(ciphertext []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, errors.New("Ciphertext is too short")
+	}
+	return c.aead.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], nil)
+}
@@ -0,0 +1,82 @@
+package credentials
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+// dockerConfigAuth corresponds to a single entry in the "auths" section
+// of a Docker config.json file.
+type dockerConfigAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// DockerConfig holds the container registry credentials stored in a
+// file that uses the same format as Docker's config.json.
+type DockerConfig struct {
+	auths map[string]dockerConfigAuth
+}
+
+// dockerConfigHost extracts the hostname from a key in the "auths"
+// section of a Docker config.json file. These keys may either be plain
+// hostnames or URLs.
+func dockerConfigHost(key string) string {
+	if strings.Contains(key, "://") {
+		if u, err := url.Parse(key); err == nil {
+			key = u.Host
+		}
+	}
+	key = strings.SplitN(key, "/", 2)[0]
+	// Docker Hub credentials are stored under the legacy index
+	// hostname, while images are fetched from another host.
+	if key == "index.docker.io" || key == "docker.io" {
+		return "registry-1.docker.io"
+	}
+	return key
+}
+
+// LoadDockerConfigFile loads container registry credentials from a file
+// that uses the same format as Docker's config.json.
+func LoadDockerConfigFile(path string) (*DockerConfig, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Auths map[string]dockerConfigAuth `json:"auths"`
+	}
+	if err := json.Unmarshal(contents, &config); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %s", path, err)
+	}
+
+	auths := map[string]dockerConfigAuth{}
+	for key, auth := range config.Auths {
+		// Credentials may be stored as a base64 encoded
+		// "username:password" pair.
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to decode credentials for %s: %s", key, err)
+			}
+			fields := strings.SplitN(string(decoded), ":", 2)
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("Credentials for %s are not of the form username:password", key)
+			}
+			auth.Username, auth.Password = fields[0], fields[1]
+		}
+		auths[dockerConfigHost(key)] = auth
+	}
+	return &DockerConfig{auths: auths}, nil
+}
+
+func (dc *DockerConfig) lookup(registryUrl *url.URL) (dockerConfigAuth, bool) {
+	auth, ok := dc.auths[dockerConfigHost(registryUrl.Host)]
+	return auth, ok
+}
@@ -0,0 +1,261 @@
+package credentials
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// fileCredentialRuleConfiguration is the on-disk representation of a
+// FileCredentials rule.
+type fileCredentialRuleConfiguration struct {
+	// The rule applies to HTTPS requests for this hostname,
+	// optionally followed by a port number. Plain HTTP requests,
+	// including those caused by redirects, are never matched, as that
+	// would expose the credentials.
+	Host string `json:"host"`
+
+	// The rule applies to requests for URLs with the same scheme and
+	// host as this prefix, whose path starts with the path of this
+	// prefix at a path segment boundary. Takes precedence over rules
+	// matching by hostname.
+	UrlPrefix string `json:"url_prefix"`
+
+	// Credentials for basic authentication.
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// Additional request headers. Values are templates that are
+	// evaluated for every request. They may call "env" and "file" to
+	// obtain the value of an environment variable or the contents of
+	// a file, respectively. This allows tokens to be rotated without
+	// restarting the downloader.
+	Headers map[string]string `json:"headers"`
+
+	// Paths of a PEM encoded TLS client certificate and its private
+	// key.
+	ClientCertificate string `json:"client_certificate"`
+	ClientPrivateKey  string `json:"client_private_key"`
+}
+
+type fileCredentialRule struct {
+	host      string
+	urlPrefix string
+
+	prefixScheme string
+	prefixHost   string
+	prefixPath   string
+
+	username string
+	password string
+	headers  map[string]*template.Template
+
+	clientCertificates []tls.Certificate
+}
+
+var headerTemplateFunctions = template.FuncMap{
+	"env": os.Getenv,
+	"file": func(path string) (string, error) {
+		contents, err := ioutil.ReadFile(path)
+		return strings.TrimSpace(string(contents)), err
+	},
+}
+
+// FileCredentials holds the credentials, request headers and TLS client
+// certificates that should be used when downloading files from upstream
+// servers. They are configured per hostname or URL prefix, and may be
+// supplemented by a netrc file. As these credentials are only available
+// to the downloader, they are never exposed through the web UI or the
+// proxy. Credentials matched by hostname, including those stored in
+// the netrc file, are only sent over HTTPS.
+type FileCredentials struct {
+	rules []*fileCredentialRule
+	netrc *netrc
+}
+
+// LoadFileCredentials loads file credentials from a JSON file
+// containing a list of rules and a netrc file. Both paths are optional.
+func LoadFileCredentials(configurationPath string, netrcPath string) (*FileCredentials, error) {
+	fc := &FileCredentials{}
+	if configurationPath != "" {
+		contents, err := ioutil.ReadFile(configurationPath)
+		if err != nil {
+			return nil, err
+		}
+		var configurations []fileCredentialRuleConfiguration
+		if err := json.Unmarshal(contents, &configurations); err != nil {
+			return nil, fmt.Errorf("Failed to parse %s: %s", configurationPath, err)
+		}
+		for i, configuration := range configurations {
+			rule, err := newFileCredentialRule(&configuration)
+			if err != nil {
+				return nil, fmt.Errorf("Rule %d in %s: %s", i, configurationPath, err)
+			}
+			fc.rules = append(fc.rules, rule)
+		}
+
+		// Let the most specific URL prefix match first, followed
+		// by rules matching by hostname.
+		sort.SliceStable(fc.rules, func(i, j int) bool {
+			return len(fc.rules[i].urlPrefix) > len(fc.rules[j].urlPrefix)
+		})
+	}
+	if netrcPath != "" {
+		n, err := loadNetrcFile(netrcPath)
+		if err != nil {
+			return nil, err
+		}
+		fc.netrc = n
+	}
+	return fc, nil
+}
+
+func newFileCredentialRule(configuration *fileCredentialRuleConfiguration) (*fileCredentialRule, error) {
+	if (configuration.Host == "") == (configuration.UrlPrefix == "") {
+		return nil, errors.New("Exactly one of host and url_prefix must be provided")
+	}
+	rule := &fileCredentialRule{
+		host:      configuration.Host,
+		urlPrefix: configuration.UrlPrefix,
+		username:  configuration.Username,
+		password:  configuration.Password,
+		headers:   map[string]*template.Template{},
+	}
+	if configuration.UrlPrefix != "" {
+		prefix, err := url.Parse(configuration.UrlPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid URL prefix: %s", err)
+		}
+		if prefix.Scheme == "" || prefix.Host == "" {
+			return nil, errors.New("URL prefix must contain a scheme and a host")
+		}
+		if prefix.RawQuery != "" || prefix.Fragment != "" {
+			return nil, errors.New("URL prefix may not contain a query or fragment")
+		}
+		rule.prefixScheme = strings.ToLower(prefix.Scheme)
+		rule.prefixHost = strings.ToLower(prefix.Host)
+		rule.prefixPath = prefix.EscapedPath()
+	}
+	for name, value := range configuration.Headers {
+		t, err := template.New(name).Funcs(headerTemplateFunctions).Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid template for header %s: %s", name, err)
+		}
+		rule.headers[http.CanonicalHeaderKey(name)] = t
+	}
+	if configuration.ClientCertificate != "" || configuration.ClientPrivateKey != "" {
+		certificate, err := tls.LoadX509KeyPair(configuration.ClientCertificate, configuration.ClientPrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate: %s", err)
+		}
+		rule.clientCertificates = []tls.Certificate{certificate}
+	}
+	return rule, nil
+}
+
+// matchesPrefix returns whether a URL has the same scheme and host as
+// the URL prefix of a rule, and whether its path is equal to or
+// contained in the path of the prefix.
+func (rule *fileCredentialRule) matchesPrefix(u *url.URL) bool {
+	if strings.ToLower(u.Scheme) != rule.prefixScheme || strings.ToLower(u.Host) != rule.prefixHost {
+		return false
+	}
+	path := u.EscapedPath()
+	if rule.prefixPath == "" || rule.prefixPath == "/" || path == rule.prefixPath {
+		return true
+	}
+	if strings.HasSuffix(rule.prefixPath, "/") {
+		return strings.HasPrefix(path, rule.prefixPath)
+	}
+	return strings.HasPrefix(path, rule.prefixPath+"/")
+}
+
+func (fc *FileCredentials) lookup(u *url.URL) *fileCredentialRule {
+	for _, rule := range fc.rules {
+		if rule.urlPrefix != "" {
+			if rule.matchesPrefix(u) {
+				return rule
+			}
+		} else if strings.EqualFold(u.Scheme, "https") && (strings.EqualFold(rule.host, u.Host) || strings.EqualFold(rule.host, u.Hostname())) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// RoundTripper returns a http.RoundTripper that adds credentials to
+// outgoing requests. As credentials are looked up for every request
+// individually, they are not forwarded when redirects to other hosts
+// are followed. The provided function is called to create transports
+// for rules that have a TLS client certificate. It is called with no
+// certificates to create the transport for all other requests.
+func (fc *FileCredentials) RoundTripper(newTransport func(clientCertificates []tls.Certificate) http.RoundTripper) http.RoundTripper {
+	rt := &fileCredentialsRoundTripper{
+		credentials:      fc,
+		defaultTransport: newTransport(nil),
+		ruleTransports:   map[*fileCredentialRule]http.RoundTripper{},
+	}
+	for _, rule := range fc.rules {
+		if len(rule.clientCertificates) > 0 {
+			rt.ruleTransports[rule] = newTransport(rule.clientCertificates)
+		}
+	}
+	return rt
+}
+
+type fileCredentialsRoundTripper struct {
+	credentials      *FileCredentials
+	defaultTransport http.RoundTripper
+	ruleTransports   map[*fileCredentialRule]http.RoundTripper
+}
+
+func (rt *fileCredentialsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rule := rt.credentials.lookup(req.URL)
+	var netrcEntry netrcEntry
+	hasNetrcEntry := false
+	if rule == nil && rt.credentials.netrc != nil && strings.EqualFold(req.URL.Scheme, "https") {
+		netrcEntry, hasNetrcEntry = rt.credentials.netrc.lookup(req.URL.Hostname())
+	}
+	if rule == nil && !hasNetrcEntry {
+		return rt.defaultTransport.RoundTrip(req)
+	}
+
+	// Round trippers should not modify the original request.
+	newReq := req.WithContext(req.Context())
+	newReq.Header = http.Header{}
+	for name, values := range req.Header {
+		newReq.Header[name] = append([]string(nil), values...)
+	}
+
+	if hasNetrcEntry {
+		newReq.SetBasicAuth(netrcEntry.login, netrcEntry.password)
+		return rt.defaultTransport.RoundTrip(newReq)
+	}
+
+	if rule.username != "" || rule.password != "" {
+		newReq.SetBasicAuth(rule.username, rule.password)
+	}
+	for name, t := range rule.headers {
+		var value bytes.Buffer
+		if err := t.Execute(&value, nil); err != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, fmt.Errorf("Failed to evaluate template for header %s: %s", name, err)
+		}
+		newReq.Header.Set(name, value.String())
+	}
+	if transport, ok := rt.ruleTransports[rule]; ok {
+		return transport.RoundTrip(newReq)
+	}
+	return rt.defaultTransport.RoundTrip(newReq)
+}
@@ -0,0 +1,159 @@
+package credentials
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestFileCredentials(t *testing.T, configuration string, netrc string) *FileCredentials {
+	t.Helper()
+	directory, err := ioutil.TempDir("", "file_credentials_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	configurationPath := filepath.Join(directory, "credentials.json")
+	if err := ioutil.WriteFile(configurationPath, []byte(configuration), 0600); err != nil {
+		t.Fatal(err)
+	}
+	netrcPath := ""
+	if netrc != "" {
+		netrcPath = filepath.Join(directory, "netrc")
+		if err := ioutil.WriteFile(netrcPath, []byte(netrc), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fc, err := LoadFileCredentials(configurationPath, netrcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fc
+}
+
+func TestFileCredentialsLookup(t *testing.T) {
+	fc := newTestFileCredentials(t, `[
+		{"host": "example.com:8443", "username": "host-port"},
+		{"host": "example.com", "username": "host"},
+		{"url_prefix": "https://example.com/private", "username": "prefix"},
+		{"url_prefix": "https://example.com/private/nested/", "username": "nested"},
+		{"url_prefix": "http://plain.example.com/", "username": "plain"}
+	]`, "")
+	for _, testCase := range []struct {
+		url      string
+		username string
+	}{
+		{"https://example.com/file", "host"},
+		{"https://EXAMPLE.com/file", "host"},
+		{"https://example.com:443/file", "host"},
+		{"https://example.com:8443/file", "host-port"},
+		{"https://example.com/private", "prefix"},
+		{"https://example.com/private/file", "prefix"},
+		{"https://example.com/privateer", "host"},
+		{"https://example.com/private/nested/file", "nested"},
+		{"https://example.com/private/nested", "prefix"},
+		{"http://plain.example.com/file", "plain"},
+		{"https://plain.example.com/file", ""},
+		{"https://other.example.com/file", ""},
+		// Host rules don't apply to plain HTTP, as that would
+		// expose the credentials.
+		{"http://example.com/file", ""},
+		{"http://example.com/private/file", ""},
+	} {
+		t.Run(testCase.url, func(t *testing.T) {
+			u, err := url.Parse(testCase.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			username := ""
+			if rule := fc.lookup(u); rule != nil {
+				username = rule.username
+			}
+			if username != testCase.username {
+				t.Errorf("Matched rule %#v, expected %#v", username, testCase.username)
+			}
+		})
+	}
+}
+
+func TestLoadFileCredentialsInvalid(t *testing.T) {
+	for _, configuration := range []string{
+		`[{}]`,
+		`[{"host": "example.com", "url_prefix": "https://example.com/"}]`,
+		`[{"url_prefix": "example.com/path"}]`,
+		`[{"url_prefix": "https://example.com/path?query"}]`,
+		`[{"host": "example.com", "headers": {"Authorization": "{{"}}]`,
+	} {
+		t.Run(configuration, func(t *testing.T) {
+			directory, err := ioutil.TempDir("", "file_credentials_test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(directory)
+			path := filepath.Join(directory, "credentials.json")
+			if err := ioutil.WriteFile(path, []byte(configuration), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadFileCredentials(path, ""); err == nil {
+				t.Error("Invalid configuration was accepted")
+			}
+		})
+	}
+}
+
+// redirectingTransport records the Authorization headers of requests.
+// Requests for HTTPS URLs are redirected to the same URL over HTTP.
+type redirectingTransport struct {
+	authorizations map[string]string
+}
+
+func (rt *redirectingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.authorizations[req.URL.String()] = req.Header.Get("Authorization")
+	response := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}
+	if req.URL.Scheme == "https" {
+		location := *req.URL
+		location.Scheme = "http"
+		response.StatusCode = http.StatusFound
+		response.Header.Set("Location", location.String())
+	}
+	return response, nil
+}
+
+func TestFileCredentialsRoundTripperRedirectToHTTP(t *testing.T) {
+	fc := newTestFileCredentials(t, `[
+		{"host": "example.com", "username": "user", "password": "secret"}
+	]`, "machine netrc.example.com login user password secret\n")
+	transport := &redirectingTransport{authorizations: map[string]string{}}
+	client := &http.Client{
+		Transport: fc.RoundTripper(func(clientCertificates []tls.Certificate) http.RoundTripper {
+			return transport
+		}),
+	}
+	for _, host := range []string{"example.com", "netrc.example.com"} {
+		t.Run(host, func(t *testing.T) {
+			response, err := client.Get("https://" + host + "/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			if transport.authorizations["https://"+host+"/file"] == "" {
+				t.Error("No credentials were sent over HTTPS")
+			}
+			if authorization, ok := transport.authorizations["http://"+host+"/file"]; !ok {
+				t.Error("Redirect was not followed")
+			} else if authorization != "" {
+				t.Error("Credentials were sent over HTTP")
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package credentials
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// netrcEntry holds the login and password of a single machine listed
+// in a netrc file.
+type netrcEntry struct {
+	login    string
+	password string
+}
+
+// netrc holds the contents of a netrc file, as used by tools like
+// curl and ftp to store credentials per host.
+type netrc struct {
+	machines map[string]netrcEntry
+}
+
+// loadNetrcFile parses a netrc file. Macro definitions are skipped, as
+// they have no meaning outside of ftp. The "default" entry is ignored,
+// as it would cause credentials to be sent to any host, including the
+// targets of redirects.
+func loadNetrcFile(path string) (*netrc, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &netrc{machines: map[string]netrcEntry{}}
+	var machine string
+	var entry *netrcEntry
+	flush := func() {
+		if entry == nil {
+			return
+		}
+		if machine != "" {
+			n.machines[machine] = *entry
+		}
+		entry = nil
+	}
+
+	lines := bufio.NewScanner(bytes.NewReader(contents))
+	inMacro := false
+	for lines.Scan() {
+		line := lines.Text()
+		if inMacro {
+			// Macro definitions are terminated by an empty line.
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			switch fields[i] {
+			case "machine":
+				if i+1 >= len(fields) {
+					return nil, fmt.Errorf("%s: machine keyword lacks a hostname", path)
+				}
+				flush()
+				i++
+				machine, entry = strings.ToLower(fields[i]), &netrcEntry{}
+			case "default":
+				flush()
+				machine, entry = "", &netrcEntry{}
+			case "login", "password", "account":
+				if i+1 >= len(fields) {
+					return nil, fmt.Errorf("%s: %s keyword lacks a value", path, fields[i])
+				}
+				if entry == nil {
+					return nil, fmt.Errorf("%s: %s keyword is not preceded by a machine", path, fields[i])
+				}
+				switch fields[i] {
+				case "login":
+					entry.login = fields[i+1]
+				case "password":
+					entry.password = fields[i+1]
+				}
+				i++
+			case "macdef":
+				inMacro = true
+				i = len(fields)
+			default:
+				if strings.HasPrefix(fields[i], "#") {
+					i = len(fields)
+				} else {
+					return nil, fmt.Errorf("%s: unknown keyword %#v", path, fields[i])
+				}
+			}
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return n, nil
+}
+
+func (n *netrc) lookup(hostname string) (netrcEntry, bool) {
+	entry, ok := n.machines[strings.ToLower(hostname)]
+	return entry, ok
+}
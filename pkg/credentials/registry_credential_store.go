@@ -0,0 +1,206 @@
+package credentials
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"log"
+	"net/url"
+	"sync"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/docker/distribution/registry/client/auth"
+	"github.com/jinzhu/gorm"
+)
+
+// registryCredentialStore implements auth.CredentialStore for a single
+// container registry. Refresh tokens handed out by the registry's token
+// server are persisted in the database, so that successive runs don't
+// need to authenticate using the username and password. They are only
+// used as long as the username and password remain unchanged, and are
+// discarded when rejected by the token server.
+type registryCredentialStore struct {
+	database   *gorm.DB
+	cipher     *Cipher
+	registryId string
+
+	username      string
+	password      string
+	identityToken string
+
+	lock                  sync.Mutex
+	refreshTokens         map[string]string
+	identityTokenRejected bool
+}
+
+// NewRegistryCredentialStore creates an auth.CredentialStore for a
+// container registry. Credentials stored in the database take
+// precedence over the ones in the Docker config file. Credentials are
+// only read from and written to the database if a Cipher is provided.
+// The Docker config file is optional as well. Anonymous access is used
+// if no credentials are available.
+func NewRegistryCredentialStore(database *gorm.DB, cipher *Cipher, dockerConfig *DockerConfig, registry *schema.ContainerRegistry) (auth.CredentialStore, error) {
+	cs := &registryCredentialStore{
+		database:      database,
+		cipher:        cipher,
+		registryId:    registry.Id,
+		refreshTokens: map[string]string{},
+	}
+
+	if dockerConfig != nil {
+		registryUrl, err := url.Parse(registry.Uri)
+		if err != nil {
+			return nil, err
+		}
+		if auth, ok := dockerConfig.lookup(registryUrl); ok {
+			cs.username = auth.Username
+			cs.password = auth.Password
+			cs.identityToken = auth.IdentityToken
+		}
+	}
+
+	if cipher != nil {
+		var credential schema.ContainerRegistryCredential
+		if r := database.Where("registry_id = ?", registry.Id).Take(&credential); r.Error != nil {
+			if !r.RecordNotFound() {
+				return nil, r.Error
+			}
+		} else if credential.Username != nil && credential.EncryptedPassword != nil {
+			password, err := cipher.Decrypt(*credential.EncryptedPassword)
+			if err != nil {
+				return nil, err
+			}
+			cs.username = *credential.Username
+			cs.password = string(password)
+		}
+		if credential.RefreshTokenService != nil && credential.EncryptedRefreshToken != nil && credential.EncryptedRefreshTokenCredentials != nil {
+			refreshTokenCredentials, err := cipher.Decrypt(*credential.EncryptedRefreshTokenCredentials)
+			if err != nil {
+				return nil, err
+			}
+			if bytes.Equal(refreshTokenCredentials, cs.getCredentialsDigest()) {
+				refreshToken, err := cipher.Decrypt(*credential.EncryptedRefreshToken)
+				if err != nil {
+					return nil, err
+				}
+				cs.refreshTokens[*credential.RefreshTokenService] = string(refreshToken)
+			}
+		}
+	}
+	return cs, nil
+}
+
+// getCredentialsDigest returns a digest of the credentials that are
+// used to obtain refresh tokens, so that it can be determined whether
+// a stored refresh token was obtained using the same credentials.
+func (cs *registryCredentialStore) getCredentialsDigest() []byte {
+	h := sha256.New()
+	for _, value := range []string{cs.username, cs.password, cs.identityToken} {
+		h.Write([]byte(value))
+		h.Write([]byte{0})
+	}
+	return h.Sum(nil)
+}
+
+func (cs *registryCredentialStore) Basic(*url.URL) (string, string) {
+	return cs.username, cs.password
+}
+
+func (cs *registryCredentialStore) RefreshToken(u *url.URL, service string) string {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	if refreshToken, ok := cs.refreshTokens[service]; ok {
+		return refreshToken
+	}
+	// Identity tokens stored in Docker config files are refresh
+	// tokens that may be used for any service.
+	if cs.identityTokenRejected {
+		return ""
+	}
+	return cs.identityToken
+}
+
+func (cs *registryCredentialStore) SetRefreshToken(u *url.URL, service string, token string) {
+	cs.lock.Lock()
+	cs.refreshTokens[service] = token
+	cs.lock.Unlock()
+
+	if cs.cipher == nil {
+		return
+	}
+	encryptedRefreshToken, err := cs.cipher.Encrypt([]byte(token))
+	if err != nil {
+		log.Printf("Failed to encrypt refresh token for %s: %s", service, err)
+		return
+	}
+	encryptedRefreshTokenCredentials, err := cs.cipher.Encrypt(cs.getCredentialsDigest())
+	if err != nil {
+		log.Printf("Failed to encrypt refresh token for %s: %s", service, err)
+		return
+	}
+	var credential schema.ContainerRegistryCredential
+	if r := cs.database.Where(schema.ContainerRegistryCredential{
+		RegistryId: cs.registryId,
+	}).Assign(schema.ContainerRegistryCredential{
+		RefreshTokenService:              &service,
+		EncryptedRefreshToken:            &encryptedRefreshToken,
+		EncryptedRefreshTokenCredentials: &encryptedRefreshTokenCredentials,
+	}).FirstOrCreate(&credential); r.Error != nil {
+		log.Printf("Failed to store refresh token for %s: %s", service, r.Error)
+	}
+}
+
+// InvalidateRefreshToken discards the refresh token for a service after
+// the token server rejected it, so that the next token is requested
+// using the username and password instead.
+func (cs *registryCredentialStore) InvalidateRefreshToken(service string) {
+	cs.lock.Lock()
+	if _, ok := cs.refreshTokens[service]; ok {
+		delete(cs.refreshTokens, service)
+	} else {
+		cs.identityTokenRejected = true
+	}
+	cs.lock.Unlock()
+
+	if cs.cipher == nil {
+		return
+	}
+	if r := cs.database.Model(&schema.ContainerRegistryCredential{}).Where(
+		"registry_id = ? AND refresh_token_service = ?", cs.registryId, service,
+	).Updates(map[string]interface{}{
+		"refresh_token_service":               nil,
+		"encrypted_refresh_token":             nil,
+		"encrypted_refresh_token_credentials": nil,
+	}); r.Error != nil {
+		log.Printf("Failed to discard refresh token for %s: %s", service, r.Error)
+	}
+}
+
+// SetRegistryCredentials stores the username and password that should
+// be used to access a container registry in the database. Any refresh
+// token obtained using previous credentials is discarded.
+func SetRegistryCredentials(database *gorm.DB, cipher *Cipher, registryId string, username string, password string) error {
+	encryptedPassword, err := cipher.Encrypt([]byte(password))
+	if err != nil {
+		return err
+	}
+	tx := database.Begin()
+	if r := tx.Where("registry_id = ?", registryId).Delete(&schema.ContainerRegistryCredential{}); r.Error != nil {
+		tx.Rollback()
+		return r.Error
+	}
+	if r := tx.Create(&schema.ContainerRegistryCredential{
+		RegistryId:        registryId,
+		Username:          &username,
+		EncryptedPassword: &encryptedPassword,
+	}); r.Error != nil {
+		tx.Rollback()
+		return r.Error
+	}
+	return tx.Commit().Error
+}
+
+// DeleteRegistryCredentials removes any credentials that should be
+// used to access a container registry from the database.
+func DeleteRegistryCredentials(database *gorm.DB, registryId string) error {
+	return database.Where("registry_id = ?", registryId).Delete(&schema.ContainerRegistryCredential{}).Error
+}
@@ -0,0 +1,91 @@
+package layers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/docker/distribution"
+)
+
+// isUnderneath returns whether a path is equal to or stored underneath
+// a directory.
+func isUnderneath(p string, directory string) bool {
+	return p == directory || strings.HasPrefix(p, strings.TrimSuffix(directory, "/")+"/")
+}
+
+// ReadFiles returns the contents of the regular files in the filesystem
+// of an image whose paths are accepted by a matcher, reading its layers
+// directly from storage. Files that are removed or replaced by higher
+// layers are omitted, as are files larger than a given size. An error
+// is returned if the total size of the files read exceeds a limit.
+func ReadFiles(ctx context.Context, s3Client *s3.S3, layers []distribution.Descriptor, match func(p string) bool, maximumSize int64, maximumTotalSize int64) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	var totalSize int64
+	for _, layer := range layers {
+		tarReader, closer, err := openLayer(ctx, s3Client, string(layer.Digest))
+		if err != nil {
+			return nil, err
+		}
+
+		// Entries only replace files in lower layers, so they
+		// are applied once the entire layer has been read.
+		var removedPaths []string
+		layerFiles := map[string][]byte{}
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				closer.Close()
+				return nil, fmt.Errorf("Failed to read layer %s: %s", layer.Digest, err)
+			}
+			p := normalizePath(header.Name)
+			switch getEntryType(header) {
+			case schema.LayerEntryTypeOpaqueWhiteout:
+				removedPaths = append(removedPaths, strings.TrimSuffix(path.Dir(p), "/")+"/")
+			case schema.LayerEntryTypeWhiteout:
+				removedPaths = append(removedPaths, path.Join(path.Dir(p), strings.TrimPrefix(path.Base(p), whiteoutPrefix)))
+			case schema.LayerEntryTypeFile:
+				removedPaths = append(removedPaths, p)
+				delete(layerFiles, p)
+				if match(p) && header.Size <= maximumSize {
+					totalSize += header.Size
+					if totalSize > maximumTotalSize {
+						closer.Close()
+						return nil, fmt.Errorf("Matching files are larger than %d bytes in total", maximumTotalSize)
+					}
+					contents, err := ioutil.ReadAll(tarReader)
+					if err != nil {
+						closer.Close()
+						return nil, fmt.Errorf("Failed to read %s from layer %s: %s", p, layer.Digest, err)
+					}
+					layerFiles[p] = contents
+				}
+			case schema.LayerEntryTypeDirectory:
+			default:
+				removedPaths = append(removedPaths, p)
+				delete(layerFiles, p)
+			}
+		}
+		closer.Close()
+
+		for filePath := range files {
+			for _, removedPath := range removedPaths {
+				if isUnderneath(filePath, removedPath) {
+					delete(files, filePath)
+					break
+				}
+			}
+		}
+		for filePath, contents := range layerFiles {
+			files[filePath] = contents
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,174 @@
+package layers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/jinzhu/gorm"
+)
+
+// Filesystem is the view of a container image's filesystem obtained by
+// applying its layers on top of each other.
+type Filesystem struct {
+	entries map[string]schema.ContainerLayerEntry
+}
+
+// removeTree removes a path and everything underneath it.
+func (fs *Filesystem) removeTree(p string) {
+	delete(fs.entries, p)
+	fs.removeChildren(p)
+}
+
+// removeChildren removes everything underneath a directory.
+func (fs *Filesystem) removeChildren(p string) {
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	for entryPath := range fs.entries {
+		if strings.HasPrefix(entryPath, prefix) {
+			delete(fs.entries, entryPath)
+		}
+	}
+}
+
+// applyLayer applies the entries of a layer on top of the filesystem.
+func (fs *Filesystem) applyLayer(entries []schema.ContainerLayerEntry) {
+	// Whiteouts only apply to lower layers, so they need to
+	// be processed before adding the layer's own entries.
+	for _, entry := range entries {
+		switch entry.Type {
+		case schema.LayerEntryTypeOpaqueWhiteout:
+			fs.removeChildren(path.Dir(entry.Path))
+		case schema.LayerEntryTypeWhiteout:
+			fs.removeTree(path.Join(path.Dir(entry.Path), strings.TrimPrefix(path.Base(entry.Path), whiteoutPrefix)))
+		}
+	}
+
+	// Replacing a directory by anything other than a directory
+	// discards its contents. The directory may only be implied by
+	// the paths of the lower layers' entries, so check the parents
+	// of all of them.
+	nonDirectories := map[string]bool{}
+	for _, entry := range entries {
+		if entry.Type != schema.LayerEntryTypeDirectory {
+			nonDirectories[entry.Path] = true
+		}
+	}
+	for entryPath := range fs.entries {
+		for parent := path.Dir(entryPath); parent != "/"; parent = path.Dir(parent) {
+			if nonDirectories[parent] {
+				delete(fs.entries, entryPath)
+				break
+			}
+		}
+	}
+
+	for _, entry := range entries {
+		if entry.Type != schema.LayerEntryTypeWhiteout && entry.Type != schema.LayerEntryTypeOpaqueWhiteout {
+			fs.entries[entry.Path] = entry
+		}
+	}
+}
+
+// NewFilesystem merges the indexed entries of a list of layers, ordered
+// from the bottom to the top.
+func NewFilesystem(db *gorm.DB, layerDigests []string) (*Filesystem, error) {
+	fs := &Filesystem{
+		entries: map[string]schema.ContainerLayerEntry{},
+	}
+	for _, layerDigest := range layerDigests {
+		var count int
+		if r := db.Model(&schema.ContainerLayerIndex{}).Where("layer_digest = ?", layerDigest).Count(&count); r.Error != nil {
+			return nil, r.Error
+		} else if count == 0 {
+			return nil, fmt.Errorf("Layer %s has not been indexed", layerDigest)
+		}
+		var entries []schema.ContainerLayerEntry
+		if r := db.Where("layer_digest = ?", layerDigest).Order("path").Find(&entries); r.Error != nil {
+			return nil, r.Error
+		}
+
+		fs.applyLayer(entries)
+	}
+	return fs, nil
+}
+
+// Lookup returns the entry stored at a path.
+func (fs *Filesystem) Lookup(p string) (schema.ContainerLayerEntry, bool) {
+	entry, ok := fs.entries[normalizePath(p)]
+	return entry, ok
+}
+
+// List returns the entries contained in a directory, sorted by path.
+// Layers don't necessarily contain entries for all parent directories
+// of the files stored within. Entries are synthesized for these.
+func (fs *Filesystem) List(directory string) []schema.ContainerLayerEntry {
+	prefix := strings.TrimSuffix(normalizePath(directory), "/") + "/"
+	children := map[string]schema.ContainerLayerEntry{}
+	for entryPath, entry := range fs.entries {
+		if !strings.HasPrefix(entryPath, prefix) {
+			continue
+		}
+		name := strings.TrimPrefix(entryPath, prefix)
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			childPath := prefix + name[:i]
+			if _, ok := children[childPath]; !ok {
+				if explicit, ok := fs.entries[childPath]; ok {
+					children[childPath] = explicit
+				} else {
+					children[childPath] = schema.ContainerLayerEntry{
+						Path: childPath,
+						Type: schema.LayerEntryTypeDirectory,
+						Mode: 0755,
+					}
+				}
+			}
+		} else {
+			children[entryPath] = entry
+		}
+	}
+	list := make([]schema.ContainerLayerEntry, 0, len(children))
+	for _, entry := range children {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Path < list[j].Path
+	})
+	return list
+}
+
+type layerFileReader struct {
+	io.Reader
+	io.Closer
+}
+
+// OpenFile opens a regular file stored in a layer blob. The layer is
+// read sequentially up to the file, as tarballs don't have an index.
+func OpenFile(ctx context.Context, s3Client *s3.S3, layerDigest string, p string) (io.ReadCloser, error) {
+	tarReader, closer, err := openLayer(ctx, s3Client, layerDigest)
+	if err != nil {
+		return nil, err
+	}
+	p = normalizePath(p)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			closer.Close()
+			return nil, fmt.Errorf("%s is not present in layer %s", p, layerDigest)
+		} else if err != nil {
+			closer.Close()
+			return nil, err
+		}
+		if normalizePath(header.Name) == p {
+			if getEntryType(header) != schema.LayerEntryTypeFile {
+				closer.Close()
+				return nil, fmt.Errorf("%s is not a regular file", p)
+			}
+			return layerFileReader{Reader: tarReader, Closer: closer}, nil
+		}
+	}
+}
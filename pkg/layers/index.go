@@ -0,0 +1,239 @@
+package layers
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/ocischema"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/jinzhu/gorm"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// Prefix of the names of files that mark files in lower layers
+	// as deleted, and the name of the file that marks the contents
+	// of a directory in lower layers as deleted.
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+
+	// Number of entries to insert into the database per statement.
+	insertBatchSize = 500
+)
+
+// filesystemLayerMediatypes contains the media types of layers that
+// hold tarballs of filesystem changes.
+var filesystemLayerMediatypes = map[string]bool{
+	schema2.MediaTypeLayer:                     true,
+	schema2.MediaTypeUncompressedLayer:         true,
+	schema2.MediaTypeForeignLayer:              true,
+	v1.MediaTypeImageLayer:                     true,
+	v1.MediaTypeImageLayerGzip:                 true,
+	v1.MediaTypeImageLayerNonDistributable:     true,
+	v1.MediaTypeImageLayerNonDistributableGzip: true,
+	// Introduced by version 1.1 of the OCI image specification.
+	"application/vnd.oci.image.layer.v1.tar+zstd": true,
+}
+
+// GetFilesystemLayers returns the descriptors of the layers of an image
+// manifest that contain filesystem changes, ordered from the bottom to
+// the top. Schema 1 manifests and the layers of other types of OCI
+// artifacts (e.g., Helm charts) are not supported.
+func GetFilesystemLayers(manifest distribution.Manifest) []distribution.Descriptor {
+	var descriptors []distribution.Descriptor
+	switch m := manifest.(type) {
+	case *schema2.DeserializedManifest:
+		descriptors = m.Layers
+	case *ocischema.DeserializedManifest:
+		descriptors = m.Layers
+	}
+	var layers []distribution.Descriptor
+	for _, descriptor := range descriptors {
+		if filesystemLayerMediatypes[descriptor.MediaType] {
+			layers = append(layers, descriptor)
+		}
+	}
+	return layers
+}
+
+// openLayer opens the tarball contained in a layer blob stored in S3.
+// Compression is detected based on the contents of the blob, as
+// opposed to the media type, as some registries label uncompressed
+// layers as compressed.
+func openLayer(ctx context.Context, s3Client *s3.S3, digest string) (*tar.Reader, io.Closer, error) {
+	blob, err := s3Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String("container-blobs"),
+		Key:    aws.String(digest),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	body := bufio.NewReader(blob.Body)
+	magic, err := body.Peek(4)
+	if err != nil && err != io.EOF {
+		blob.Body.Close()
+		return nil, nil, err
+	}
+	if len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(body)
+		if err != nil {
+			blob.Body.Close()
+			return nil, nil, err
+		}
+		return tar.NewReader(gzipReader), blob.Body, nil
+	}
+	if len(magic) == 4 && magic[0] == 0x28 && magic[1] == 0xb5 && magic[2] == 0x2f && magic[3] == 0xfd {
+		blob.Body.Close()
+		return nil, nil, errors.New("Zstandard compressed layers are not supported")
+	}
+	return tar.NewReader(body), blob.Body, nil
+}
+
+// normalizePath converts the name of an entry in a layer tarball
+// (e.g., "./usr/bin/", "usr/bin") to an absolute path ("/usr/bin").
+func normalizePath(name string) string {
+	return path.Clean("/" + name)
+}
+
+func getEntryType(header *tar.Header) string {
+	base := path.Base(normalizePath(header.Name))
+	if base == opaqueWhiteout {
+		return schema.LayerEntryTypeOpaqueWhiteout
+	}
+	if strings.HasPrefix(base, whiteoutPrefix) {
+		return schema.LayerEntryTypeWhiteout
+	}
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		return schema.LayerEntryTypeFile
+	case tar.TypeDir:
+		return schema.LayerEntryTypeDirectory
+	case tar.TypeSymlink:
+		return schema.LayerEntryTypeSymlink
+	case tar.TypeLink:
+		return schema.LayerEntryTypeHardlink
+	default:
+		return schema.LayerEntryTypeOther
+	}
+}
+
+// insertEntries stores the entries of a layer in the database using
+// multi-row statements, as layers may contain many thousands of files.
+func insertEntries(tx *gorm.DB, entries []schema.ContainerLayerEntry) error {
+	for start := 0; start < len(entries); start += insertBatchSize {
+		end := start + insertBatchSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+		var placeholders []string
+		var values []interface{}
+		for _, entry := range entries[start:end] {
+			placeholders = append(placeholders, "(?, ?, ?, ?, ?, ?)")
+			values = append(values, entry.LayerDigest, entry.Path, entry.Type, entry.Mode, entry.Size, entry.LinkTarget)
+		}
+		if r := tx.Exec("INSERT INTO container_layer_entries (layer_digest, path, type, mode, size, link_target) VALUES "+strings.Join(placeholders, ", "), values...); r.Error != nil {
+			return r.Error
+		}
+	}
+	return nil
+}
+
+// IndexLayer stores the entries of the tarball contained in a layer
+// in the database. Layers are identified by digest, meaning that layers
+// shared by multiple images only need to be indexed once.
+func IndexLayer(ctx context.Context, db *gorm.DB, s3Client *s3.S3, digest string) error {
+	tarReader, closer, err := openLayer(ctx, s3Client, digest)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	// Tarballs may contain the same path multiple times, in which
+	// case the last entry takes precedence.
+	entriesByPath := map[string]int{}
+	var entries []schema.ContainerLayerEntry
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Failed to read layer %s: %s", digest, err)
+		}
+		entry := schema.ContainerLayerEntry{
+			LayerDigest: digest,
+			Path:        normalizePath(header.Name),
+			Type:        getEntryType(header),
+			Mode:        header.Mode & 07777,
+			Size:        header.Size,
+		}
+		if entry.Path == "/" {
+			continue
+		}
+		if header.Typeflag == tar.TypeSymlink {
+			linkTarget := header.Linkname
+			entry.LinkTarget = &linkTarget
+		} else if header.Typeflag == tar.TypeLink {
+			linkTarget := normalizePath(header.Linkname)
+			entry.LinkTarget = &linkTarget
+		}
+		if i, ok := entriesByPath[entry.Path]; ok {
+			entries[i] = entry
+		} else {
+			entriesByPath[entry.Path] = len(entries)
+			entries = append(entries, entry)
+		}
+	}
+
+	tx := db.Begin()
+	if r := tx.Where("layer_digest = ?", digest).Delete(&schema.ContainerLayerEntry{}); r.Error != nil {
+		tx.Rollback()
+		return r.Error
+	}
+	if r := tx.Where("layer_digest = ?", digest).Delete(&schema.ContainerLayerIndex{}); r.Error != nil {
+		tx.Rollback()
+		return r.Error
+	}
+	if err := insertEntries(tx, entries); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if r := tx.Create(&schema.ContainerLayerIndex{
+		LayerDigest: digest,
+		IndexedAt:   time.Now(),
+		EntryCount:  int64(len(entries)),
+	}); r.Error != nil {
+		tx.Rollback()
+		return r.Error
+	}
+	return tx.Commit().Error
+}
+
+// IndexLayers indexes the layers of an image that have not been indexed
+// yet.
+func IndexLayers(ctx context.Context, db *gorm.DB, s3Client *s3.S3, layers []distribution.Descriptor) error {
+	for _, layer := range layers {
+		var count int
+		if r := db.Model(&schema.ContainerLayerIndex{}).Where("layer_digest = ?", string(layer.Digest)).Count(&count); r.Error != nil {
+			return r.Error
+		}
+		if count > 0 {
+			continue
+		}
+		if err := IndexLayer(ctx, db, s3Client, string(layer.Digest)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
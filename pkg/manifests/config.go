@@ -0,0 +1,48 @@
+package manifests
+
+import (
+	"encoding/json"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/ocischema"
+	"github.com/docker/distribution/manifest/schema2"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// GetConfigDescriptor returns the descriptor of the config blob of a
+// manifest, if it has one. Manifest lists and schema 1 manifests don't
+// have config blobs.
+func GetConfigDescriptor(manifest distribution.Manifest) (distribution.Descriptor, bool) {
+	switch m := manifest.(type) {
+	case *schema2.DeserializedManifest:
+		return m.Config, true
+	case *ocischema.DeserializedManifest:
+		return m.Config, true
+	default:
+		return distribution.Descriptor{}, false
+	}
+}
+
+// ConfigManifestMediatypes contains the media types of manifests that
+// have config blobs, as returned by GetConfigDescriptor.
+var ConfigManifestMediatypes = []string{
+	schema2.MediaTypeManifest,
+	v1.MediaTypeImageManifest,
+}
+
+// IsImageConfig returns whether a config blob contains the
+// configuration of a container image, as opposed to the configuration
+// of another type of OCI artifact.
+func IsImageConfig(descriptor distribution.Descriptor) bool {
+	return descriptor.MediaType == schema2.MediaTypeImageConfig || descriptor.MediaType == v1.MediaTypeImageConfig
+}
+
+// ParseImageConfig parses the config blob of a container image. Docker
+// and OCI image configs use the same format.
+func ParseImageConfig(payload []byte) (*v1.Image, error) {
+	var config v1.Image
+	if err := json.Unmarshal(payload, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
@@ -0,0 +1,70 @@
+package manifests
+
+import (
+	"encoding/json"
+
+	"github.com/docker/distribution/manifest/manifestlist"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ManifestListMediatypes contains the media types of manifests that
+// refer to other manifests, as opposed to blobs.
+var ManifestListMediatypes = []string{
+	manifestlist.MediaTypeManifestList,
+	v1.MediaTypeImageIndex,
+}
+
+// IsManifestList returns whether a media type corresponds to a Docker
+// manifest list or an OCI image index.
+func IsManifestList(mediatype string) bool {
+	for _, manifestListMediatype := range ManifestListMediatypes {
+		if mediatype == manifestListMediatype {
+			return true
+		}
+	}
+	return false
+}
+
+// Metadata contains the fields of an OCI manifest that are used to
+// attach artifacts (e.g., signatures, SBOMs) to other manifests. These
+// fields were introduced by version 1.1 of the OCI image specification,
+// which is not supported by the manifest types of docker/distribution.
+type Metadata struct {
+	// Type of the artifact. Equal to the media type of the config
+	// blob if not set explicitly.
+	ArtifactType string
+
+	// Digest of the manifest to which this manifest is attached.
+	SubjectDigest *string
+
+	Annotations map[string]string
+}
+
+// ParseMetadata extracts the fields used to attach artifacts to other
+// manifests from a manifest's payload.
+func ParseMetadata(payload []byte) (*Metadata, error) {
+	var manifest struct {
+		ArtifactType string `json:"artifactType"`
+		Config       *struct {
+			MediaType string `json:"mediaType"`
+		} `json:"config"`
+		Subject *struct {
+			Digest string `json:"digest"`
+		} `json:"subject"`
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(payload, &manifest); err != nil {
+		return nil, err
+	}
+	metadata := &Metadata{
+		ArtifactType: manifest.ArtifactType,
+		Annotations:  manifest.Annotations,
+	}
+	if metadata.ArtifactType == "" && manifest.Config != nil {
+		metadata.ArtifactType = manifest.Config.MediaType
+	}
+	if manifest.Subject != nil && manifest.Subject.Digest != "" {
+		metadata.SubjectDigest = &manifest.Subject.Digest
+	}
+	return metadata, nil
+}
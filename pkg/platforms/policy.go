@@ -0,0 +1,89 @@
+package platforms
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/jinzhu/gorm"
+)
+
+type platform struct {
+	os           string
+	architecture string
+	variant      string
+}
+
+// Policy describes which platforms of a manifest list should be
+// mirrored (e.g., "linux/amd64,linux/arm64/v8"). A platform without a
+// variant matches all variants of the architecture.
+type Policy []platform
+
+// ParsePolicy parses a comma separated list of platforms.
+func ParsePolicy(policy string) (Policy, error) {
+	var p Policy
+	for _, entry := range strings.Split(policy, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		fields := strings.Split(entry, "/")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("Invalid platform %#v: must be of the form os/architecture[/variant]", entry)
+		}
+		pl := platform{os: fields[0], architecture: fields[1]}
+		if len(fields) == 3 {
+			pl.variant = fields[2]
+		}
+		p = append(p, pl)
+	}
+	return p, nil
+}
+
+// Matches returns whether a manifest for a given platform should be
+// mirrored.
+func (p Policy) Matches(spec *manifestlist.PlatformSpec) bool {
+	for _, pl := range p {
+		if pl.os == spec.OS && pl.architecture == spec.Architecture && (pl.variant == "" || pl.variant == spec.Variant) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetEffectivePolicy returns the policy that applies to a container
+// image. A policy set on the image itself takes precedence over the
+// one of the registry.
+func GetEffectivePolicy(image *schema.ContainerImage, registry *schema.ContainerRegistry) (Policy, error) {
+	if image.Platforms != nil {
+		return ParsePolicy(*image.Platforms)
+	}
+	if registry.Platforms != nil {
+		return ParsePolicy(*registry.Platforms)
+	}
+	return nil, nil
+}
+
+// EnqueueChildren creates entries for the manifests referenced by a
+// manifest list that match a policy, so that they are downloaded. The
+// entries that still need to be downloaded are returned.
+func EnqueueChildren(database *gorm.DB, image *schema.ContainerImage, manifestList *manifestlist.DeserializedManifestList, policy Policy) ([]schema.ContainerImage, error) {
+	var pending []schema.ContainerImage
+	for _, descriptor := range manifestList.Manifests {
+		if !policy.Matches(&descriptor.Platform) {
+			continue
+		}
+		var child schema.ContainerImage
+		if r := database.FirstOrCreate(&child, schema.ContainerImage{
+			RepositoryId: image.RepositoryId,
+			Digest:       string(descriptor.Digest),
+		}); r.Error != nil {
+			return nil, r.Error
+		}
+		if child.Manifest == nil {
+			pending = append(pending, child)
+		}
+	}
+	return pending, nil
+}
@@ -0,0 +1,55 @@
+package references
+
+import (
+	"fmt"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	_ "github.com/docker/distribution/manifest/ocischema"
+	_ "github.com/docker/distribution/manifest/schema1"
+	_ "github.com/docker/distribution/manifest/schema2"
+	"github.com/jinzhu/gorm"
+)
+
+// GetFileReferences returns the keys of all objects in the "files"
+// bucket that are referenced by files that are present, together with
+// the files referencing them.
+func GetFileReferences(database *gorm.DB) (map[string][]schema.File, error) {
+	var files []schema.File
+	if r := database.Where("present = true").Find(&files); r.Error != nil {
+		return nil, r.Error
+	}
+	references := map[string][]schema.File{}
+	for _, file := range files {
+		key := fmt.Sprintf("%s|%d", *file.Sha256, *file.Size)
+		references[key] = append(references[key], file)
+	}
+	return references, nil
+}
+
+// GetContainerBlobReferences returns the keys of all objects in the
+// "container-blobs" bucket that are referenced by the manifests of
+// container images that are present, together with the container
+// images referencing them. Manifest lists don't reference any blobs.
+func GetContainerBlobReferences(database *gorm.DB) (map[string][]schema.ContainerImage, error) {
+	var images []schema.ContainerImage
+	if r := database.Where("manifest IS NOT NULL").Find(&images); r.Error != nil {
+		return nil, r.Error
+	}
+	references := map[string][]schema.ContainerImage{}
+	for _, image := range images {
+		manifest, _, err := distribution.UnmarshalManifest(*image.ManifestMediatype, *image.Manifest)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse manifest of container image %s: %s", image.Digest, err)
+		}
+		if _, ok := manifest.(*manifestlist.DeserializedManifestList); ok {
+			continue
+		}
+		for _, descriptor := range manifest.References() {
+			key := string(descriptor.Digest)
+			references[key] = append(references[key], image)
+		}
+	}
+	return references, nil
+}
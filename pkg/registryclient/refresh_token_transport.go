@@ -0,0 +1,47 @@
+package registryclient
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// RefreshTokenInvalidator is implemented by credential stores that are
+// capable of discarding refresh tokens that are no longer accepted by
+// a registry's token server.
+type RefreshTokenInvalidator interface {
+	InvalidateRefreshToken(service string)
+}
+
+// refreshTokenTransport inspects requests sent to a registry's token
+// server. When a token request using a refresh token is rejected, the
+// refresh token is discarded. Otherwise a stale refresh token would be
+// used indefinitely, taking precedence over the username and password.
+type refreshTokenTransport struct {
+	base        http.RoundTripper
+	invalidator RefreshTokenInvalidator
+}
+
+func (rt *refreshTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPost || req.Body == nil {
+		return rt.base.RoundTrip(req)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	newReq := req.WithContext(req.Context())
+	newReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	form, err := url.ParseQuery(string(body))
+	if err != nil || form.Get("grant_type") != "refresh_token" {
+		return rt.base.RoundTrip(newReq)
+	}
+
+	resp, err := rt.base.RoundTrip(newReq)
+	if err == nil && (resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized) {
+		rt.invalidator.InvalidateRefreshToken(form.Get("service"))
+	}
+	return resp, err
+}
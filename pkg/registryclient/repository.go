@@ -0,0 +1,69 @@
+package registryclient
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/client"
+	"github.com/docker/distribution/registry/client/auth"
+	"github.com/docker/distribution/registry/client/transport"
+	"github.com/docker/docker/registry"
+)
+
+// NewRepository creates a client for pulling from a repository stored
+// in an upstream container registry. The registry is pinged to
+// determine which authentication schemes it supports. OAuth2 bearer
+// tokens are requested with offline access, so that the credential
+// store may persist the refresh tokens handed out by the registry.
+// Credential stores implementing RefreshTokenInvalidator are notified
+// when refresh tokens are rejected.
+func NewRepository(registryUrl string, repositoryName string, upstreamTransport http.RoundTripper, creds auth.CredentialStore) (distribution.Repository, error) {
+	// Send ping to registry to obtain OAuth2 bearer token.
+	parsedRegistryUrl, err := url.Parse(registryUrl)
+	if err != nil {
+		return nil, err
+	}
+	challengeManager, confirmedV2, err := registry.PingV2Registry(parsedRegistryUrl, upstreamTransport)
+	if err != nil {
+		return nil, err
+	}
+	if !confirmedV2 {
+		return nil, errors.New("Unsupported registry version")
+	}
+
+	// Access repository.
+	repositoryRef, err := reference.WithName(repositoryName)
+	if err != nil {
+		return nil, err
+	}
+	tokenTransport := upstreamTransport
+	if invalidator, ok := creds.(RefreshTokenInvalidator); ok {
+		tokenTransport = &refreshTokenTransport{
+			base:        upstreamTransport,
+			invalidator: invalidator,
+		}
+	}
+	return client.NewRepository(
+		repositoryRef,
+		registryUrl,
+		transport.NewTransport(
+			upstreamTransport,
+			auth.NewAuthorizer(
+				challengeManager,
+				auth.NewTokenHandlerWithOptions(auth.TokenHandlerOptions{
+					Transport:     tokenTransport,
+					Credentials:   creds,
+					OfflineAccess: true,
+					ClientID:      "distfile-mirror",
+					Scopes: []auth.Scope{
+						auth.RepositoryScope{
+							Repository: repositoryName,
+							Actions:    []string{"pull"},
+						},
+					},
+				}),
+				auth.NewBasicHandler(creds))))
+}
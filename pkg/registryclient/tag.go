@@ -0,0 +1,56 @@
+package registryclient
+
+import (
+	"context"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema1"
+	oci_digest "github.com/opencontainers/go-digest"
+)
+
+// ResolvedTag describes the manifest to which a tag referred at the
+// time it was resolved.
+type ResolvedTag struct {
+	Digest    oci_digest.Digest
+	MediaType string
+
+	// Platforms of the manifests referenced by the manifest, if it
+	// is a manifest list.
+	Platforms []manifestlist.PlatformSpec
+}
+
+// ResolveTag fetches the manifest to which a tag in a repository
+// currently refers. The digest is computed locally, as opposed to
+// taken from the Docker-Content-Digest header returned by the
+// registry.
+func ResolveTag(ctx context.Context, repository distribution.Repository, tag string) (*ResolvedTag, error) {
+	manifestService, err := repository.Manifests(ctx)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := manifestService.Get(ctx, "", distribution.WithTag(tag))
+	if err != nil {
+		return nil, err
+	}
+	mediaType, payload, err := manifest.Payload()
+	if err != nil {
+		return nil, err
+	}
+
+	// The digest of a schema 1 manifest is computed over its
+	// contents without the signatures.
+	if signedManifest, ok := manifest.(*schema1.SignedManifest); ok {
+		payload = signedManifest.Canonical
+	}
+	resolvedTag := &ResolvedTag{
+		Digest:    oci_digest.FromBytes(payload),
+		MediaType: mediaType,
+	}
+	if manifestList, ok := manifest.(*manifestlist.DeserializedManifestList); ok {
+		for _, manifestDescriptor := range manifestList.Manifests {
+			resolvedTag.Platforms = append(resolvedTag.Platforms, manifestDescriptor.Platform)
+		}
+	}
+	return resolvedTag, nil
+}
@@ -0,0 +1,49 @@
+package sbom
+
+import (
+	"strings"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+)
+
+// parseApkInstalled extracts the installed packages from the database
+// of Alpine's package manager (/lib/apk/db/installed). It consists of
+// paragraphs of "K:value" pairs, where keys are single letters.
+func parseApkInstalled(contents []byte, release *osRelease) ([]schema.ContainerImagePackage, error) {
+	var packages []schema.ContainerImagePackage
+	fields := map[byte]string{}
+	flush := func() {
+		name, version := fields['P'], fields['V']
+		if name != "" && version != "" {
+			var license *string
+			if l := fields['L']; l != "" {
+				license = &l
+			}
+			packages = append(packages, schema.ContainerImagePackage{
+				Type:    schema.PackageTypeApk,
+				Name:    name,
+				Version: version,
+				License: license,
+				Purl: newPurl("apk", release.getNamespace("alpine"), name, version, map[string]string{
+					"arch":   fields['A'],
+					"distro": release.getDistroQualifier(),
+				}),
+			})
+		}
+		fields = map[byte]string{}
+	}
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			flush()
+		} else if len(line) >= 2 && line[1] == ':' {
+			// Keys such as "F" (directory) and "R" (file) may
+			// occur many times. Only keep the first occurrence.
+			if _, ok := fields[line[0]]; !ok {
+				fields[line[0]] = line[2:]
+			}
+		}
+	}
+	flush()
+	return packages, nil
+}
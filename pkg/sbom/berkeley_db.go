@@ -0,0 +1,137 @@
+package sbom
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Constants of the on-disk format of Berkeley DB hash databases.
+const (
+	berkeleyDBHashMagic        = 0x061561
+	berkeleyDBPageHeaderLength = 26
+
+	berkeleyDBPageTypeHashUnsorted = 2
+	berkeleyDBPageTypeOverflow     = 7
+	berkeleyDBPageTypeHash         = 13
+
+	berkeleyDBItemTypeKeyData = 1
+	berkeleyDBItemTypeOffPage = 3
+)
+
+// readBerkeleyDBHashValues returns all values stored in a Berkeley DB
+// hash database, in page order. Values are either stored inline in
+// hash pages, or in a chain of overflow pages if they are large.
+func readBerkeleyDBHashValues(contents []byte) ([][]byte, error) {
+	if len(contents) < 72 {
+		return nil, errors.New("Database is too short")
+	}
+	// The byte order of the database is that of the system that
+	// created it. Detect it from the magic number.
+	var byteOrder binary.ByteOrder = binary.LittleEndian
+	if byteOrder.Uint32(contents[12:]) != berkeleyDBHashMagic {
+		byteOrder = binary.BigEndian
+		if byteOrder.Uint32(contents[12:]) != berkeleyDBHashMagic {
+			return nil, errors.New("Database is not a Berkeley DB hash database")
+		}
+	}
+	if contents[24] != 0 {
+		return nil, errors.New("Encrypted databases are not supported")
+	}
+	pageSize := int(byteOrder.Uint32(contents[20:]))
+	lastPage := int(byteOrder.Uint32(contents[32:]))
+	// Validate the header before multiplying, as the page size and
+	// page count may be chosen such that their product overflows.
+	if pageSize < 512 || pageSize > len(contents) || lastPage >= len(contents)/pageSize {
+		return nil, errors.New("Database is truncated")
+	}
+	getPage := func(pageNumber uint32) ([]byte, error) {
+		if pageNumber == 0 || uint64(pageNumber) > uint64(lastPage) {
+			return nil, fmt.Errorf("Page number %d out of range", pageNumber)
+		}
+		start := int(pageNumber) * pageSize
+		if start > len(contents)-pageSize {
+			return nil, fmt.Errorf("Page number %d out of range", pageNumber)
+		}
+		return contents[start : start+pageSize], nil
+	}
+
+	// Values stored in overflow pages are copied. As these are
+	// stored in distinct pages, their total size can't exceed that
+	// of the database. This prevents corrupt lengths and cyclic
+	// overflow chains from exhausting memory.
+	remainingOverflowSize := len(contents)
+	var values [][]byte
+	for pageNumber := 1; pageNumber <= lastPage; pageNumber++ {
+		page, err := getPage(uint32(pageNumber))
+		if err != nil {
+			return nil, err
+		}
+		if pageType := page[25]; pageType != berkeleyDBPageTypeHash && pageType != berkeleyDBPageTypeHashUnsorted {
+			continue
+		}
+		entries := int(byteOrder.Uint16(page[20:]))
+		if berkeleyDBPageHeaderLength+2*entries > pageSize {
+			return nil, fmt.Errorf("Page %d has too many entries", pageNumber)
+		}
+		offsets := make([]int, entries)
+		for i := range offsets {
+			offsets[i] = int(byteOrder.Uint16(page[berkeleyDBPageHeaderLength+2*i:]))
+		}
+
+		// Entries alternate between keys and values. Items are
+		// stored from the end of the page to the front.
+		for i := 1; i < entries; i += 2 {
+			start, end := offsets[i], offsets[i-1]
+			if start < berkeleyDBPageHeaderLength+2*entries || start >= end || end > pageSize {
+				return nil, fmt.Errorf("Page %d contains an invalid item", pageNumber)
+			}
+			item := page[start:end]
+			switch item[0] {
+			case berkeleyDBItemTypeKeyData:
+				values = append(values, item[1:])
+			case berkeleyDBItemTypeOffPage:
+				if len(item) < 12 {
+					return nil, fmt.Errorf("Page %d contains an invalid item", pageNumber)
+				}
+				length := int(byteOrder.Uint32(item[8:]))
+				if length > remainingOverflowSize {
+					return nil, errors.New("Overflow values are larger than the database")
+				}
+				remainingOverflowSize -= length
+				value, err := readBerkeleyDBOverflow(getPage, byteOrder, byteOrder.Uint32(item[4:]), length)
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, value)
+			default:
+				return nil, fmt.Errorf("Page %d contains an item of unsupported type %d", pageNumber, item[0])
+			}
+		}
+	}
+	return values, nil
+}
+
+// readBerkeleyDBOverflow reads a value stored in a chain of overflow
+// pages.
+func readBerkeleyDBOverflow(getPage func(uint32) ([]byte, error), byteOrder binary.ByteOrder, pageNumber uint32, length int) ([]byte, error) {
+	value := make([]byte, 0, length)
+	for len(value) < length {
+		page, err := getPage(pageNumber)
+		if err != nil {
+			return nil, err
+		}
+		if page[25] != berkeleyDBPageTypeOverflow {
+			return nil, fmt.Errorf("Page %d is not an overflow page", pageNumber)
+		}
+		// The offset field of overflow pages holds the number
+		// of bytes stored in the page.
+		used := int(byteOrder.Uint16(page[22:]))
+		if berkeleyDBPageHeaderLength+used > len(page) || used == 0 {
+			return nil, fmt.Errorf("Overflow page %d is corrupt", pageNumber)
+		}
+		value = append(value, page[berkeleyDBPageHeaderLength:berkeleyDBPageHeaderLength+used]...)
+		pageNumber = byteOrder.Uint32(page[16:])
+	}
+	return value[:length], nil
+}
@@ -0,0 +1,224 @@
+package sbom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// berkeleyDBBuilder constructs Berkeley DB hash databases for testing.
+// Page 0 holds the metadata, while the other pages are provided by the
+// test.
+type berkeleyDBBuilder struct {
+	byteOrder binary.ByteOrder
+	pageSize  int
+	pages     [][]byte
+}
+
+func newBerkeleyDBBuilder(byteOrder binary.ByteOrder, pageSize int) *berkeleyDBBuilder {
+	return &berkeleyDBBuilder{
+		byteOrder: byteOrder,
+		pageSize:  pageSize,
+		pages:     [][]byte{make([]byte, pageSize)},
+	}
+}
+
+// addHashPage adds a hash page containing items that alternate between
+// keys and values. Items are stored from the end of the page to the
+// front.
+func (b *berkeleyDBBuilder) addHashPage(items ...[]byte) uint32 {
+	page := make([]byte, b.pageSize)
+	page[25] = berkeleyDBPageTypeHash
+	b.byteOrder.PutUint16(page[20:], uint16(len(items)))
+	end := b.pageSize
+	for i, item := range items {
+		start := end - len(item)
+		copy(page[start:], item)
+		b.byteOrder.PutUint16(page[berkeleyDBPageHeaderLength+2*i:], uint16(start))
+		end = start
+	}
+	b.pages = append(b.pages, page)
+	return uint32(len(b.pages) - 1)
+}
+
+// addOverflowPage adds an overflow page holding part of a value.
+func (b *berkeleyDBBuilder) addOverflowPage(next uint32, data []byte) uint32 {
+	page := make([]byte, b.pageSize)
+	page[25] = berkeleyDBPageTypeOverflow
+	b.byteOrder.PutUint32(page[16:], next)
+	b.byteOrder.PutUint16(page[22:], uint16(len(data)))
+	copy(page[berkeleyDBPageHeaderLength:], data)
+	b.pages = append(b.pages, page)
+	return uint32(len(b.pages) - 1)
+}
+
+func (b *berkeleyDBBuilder) keyData(data string) []byte {
+	return append([]byte{berkeleyDBItemTypeKeyData}, data...)
+}
+
+func (b *berkeleyDBBuilder) offPage(pageNumber uint32, length int) []byte {
+	item := make([]byte, 12)
+	item[0] = berkeleyDBItemTypeOffPage
+	b.byteOrder.PutUint32(item[4:], pageNumber)
+	b.byteOrder.PutUint32(item[8:], uint32(length))
+	return item
+}
+
+func (b *berkeleyDBBuilder) build() []byte {
+	meta := b.pages[0]
+	b.byteOrder.PutUint32(meta[12:], berkeleyDBHashMagic)
+	b.byteOrder.PutUint32(meta[20:], uint32(b.pageSize))
+	b.byteOrder.PutUint32(meta[32:], uint32(len(b.pages)-1))
+	return bytes.Join(b.pages, nil)
+}
+
+func TestReadBerkeleyDBHashValues(t *testing.T) {
+	for _, byteOrder := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		// A value that is stored in two overflow pages.
+		largeValue := bytes.Repeat([]byte("0123456789"), 60)
+		b := newBerkeleyDBBuilder(byteOrder, 512)
+		b.addHashPage(b.keyData("key1"), b.keyData("value1"), b.keyData("key2"), b.offPage(2, len(largeValue)))
+		b.addOverflowPage(3, largeValue[:400])
+		b.addOverflowPage(0, largeValue[400:])
+		b.addHashPage(b.keyData("key3"), b.keyData("value3"))
+
+		values, err := readBerkeleyDBHashValues(b.build())
+		if err != nil {
+			t.Fatalf("%s: %s", byteOrder, err)
+		}
+		expected := [][]byte{[]byte("value1"), largeValue, []byte("value3")}
+		if len(values) != len(expected) {
+			t.Fatalf("%s: got %d values, expected %d", byteOrder, len(values), len(expected))
+		}
+		for i := range expected {
+			if !bytes.Equal(values[i], expected[i]) {
+				t.Errorf("%s: value %d is %#v, expected %#v", byteOrder, i, string(values[i]), string(expected[i]))
+			}
+		}
+	}
+}
+
+func TestReadBerkeleyDBHashValuesInvalid(t *testing.T) {
+	valid := func() *berkeleyDBBuilder {
+		b := newBerkeleyDBBuilder(binary.LittleEndian, 512)
+		b.addHashPage(b.keyData("key"), b.keyData("value"))
+		return b
+	}
+	for _, testCase := range []struct {
+		name     string
+		contents func() []byte
+	}{
+		{"Empty", func() []byte { return nil }},
+		{"TruncatedHeader", func() []byte { return valid().build()[:71] }},
+		{"BadMagic", func() []byte {
+			contents := valid().build()
+			contents[12] = 0
+			return contents
+		}},
+		{"Encrypted", func() []byte {
+			contents := valid().build()
+			contents[24] = 1
+			return contents
+		}},
+		{"SmallPageSize", func() []byte {
+			contents := valid().build()
+			binary.LittleEndian.PutUint32(contents[20:], 256)
+			return contents
+		}},
+		{"TruncatedPages", func() []byte { return valid().build()[:1000] }},
+		{"LastPageOutOfRange", func() []byte {
+			contents := valid().build()
+			binary.LittleEndian.PutUint32(contents[32:], 2)
+			return contents
+		}},
+		{"OverflowingPageSizeAndLastPage", func() []byte {
+			// Regression test: the product of the page size
+			// and the number of pages used to overflow,
+			// causing out of range page accesses.
+			contents := valid().build()
+			binary.LittleEndian.PutUint32(contents[20:], 0xffffffff)
+			binary.LittleEndian.PutUint32(contents[32:], 0xffffffff)
+			return contents
+		}},
+		{"LargePageSize", func() []byte {
+			contents := valid().build()
+			binary.LittleEndian.PutUint32(contents[20:], 0x80000000)
+			binary.LittleEndian.PutUint32(contents[32:], 1)
+			return contents
+		}},
+		{"TooManyEntries", func() []byte {
+			contents := valid().build()
+			binary.LittleEndian.PutUint16(contents[512+20:], 0xffff)
+			return contents
+		}},
+		{"ItemOffsetOutOfRange", func() []byte {
+			contents := valid().build()
+			binary.LittleEndian.PutUint16(contents[512+berkeleyDBPageHeaderLength:], 0xffff)
+			return contents
+		}},
+		{"ItemOffsetInIndex", func() []byte {
+			contents := valid().build()
+			binary.LittleEndian.PutUint16(contents[512+berkeleyDBPageHeaderLength+2:], 0)
+			return contents
+		}},
+		{"UnsupportedItemType", func() []byte {
+			b := newBerkeleyDBBuilder(binary.LittleEndian, 512)
+			b.addHashPage(b.keyData("key"), []byte{5, 0})
+			return b.build()
+		}},
+		{"TruncatedOffPageItem", func() []byte {
+			b := newBerkeleyDBBuilder(binary.LittleEndian, 512)
+			b.addHashPage(b.keyData("key"), []byte{berkeleyDBItemTypeOffPage, 0, 0, 0})
+			return b.build()
+		}},
+		{"OverflowLengthExceedsDatabase", func() []byte {
+			b := newBerkeleyDBBuilder(binary.LittleEndian, 512)
+			b.addHashPage(b.keyData("key"), b.offPage(2, 1<<31))
+			b.addOverflowPage(0, []byte("value"))
+			return b.build()
+		}},
+		{"OverflowPageOutOfRange", func() []byte {
+			b := newBerkeleyDBBuilder(binary.LittleEndian, 512)
+			b.addHashPage(b.keyData("key"), b.offPage(0xffffffff, 10))
+			return b.build()
+		}},
+		{"OverflowChainEndsEarly", func() []byte {
+			b := newBerkeleyDBBuilder(binary.LittleEndian, 512)
+			b.addHashPage(b.keyData("key"), b.offPage(2, 10))
+			b.addOverflowPage(0, []byte("value"))
+			return b.build()
+		}},
+		{"OverflowChainNotOverflowPage", func() []byte {
+			b := newBerkeleyDBBuilder(binary.LittleEndian, 512)
+			b.addHashPage(b.keyData("key"), b.offPage(1, 10))
+			return b.build()
+		}},
+		{"EmptyOverflowPage", func() []byte {
+			b := newBerkeleyDBBuilder(binary.LittleEndian, 512)
+			b.addHashPage(b.keyData("key"), b.offPage(2, 10))
+			b.addOverflowPage(2, nil)
+			return b.build()
+		}},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			if _, err := readBerkeleyDBHashValues(testCase.contents()); err == nil {
+				t.Error("Invalid database was accepted")
+			}
+		})
+	}
+}
+
+func TestReadBerkeleyDBHashValuesCyclicOverflowChain(t *testing.T) {
+	// Cyclic overflow chains terminate once the length of the value
+	// has been read, as every overflow page contains data.
+	b := newBerkeleyDBBuilder(binary.LittleEndian, 512)
+	b.addHashPage(b.keyData("key"), b.offPage(2, 12))
+	b.addOverflowPage(2, []byte("abc"))
+	values, err := readBerkeleyDBHashValues(b.build())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || string(values[0]) != "abcabcabcabc" {
+		t.Errorf("Got values %#v", values)
+	}
+}
@@ -0,0 +1,106 @@
+package sbom
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+)
+
+// CycloneDXMediaType is the media type of CycloneDX documents in JSON
+// format.
+const CycloneDXMediaType = "application/vnd.cyclonedx+json"
+
+type cycloneDXProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cycloneDXLicense struct {
+	License struct {
+		Name string `json:"name"`
+	} `json:"license"`
+}
+
+type cycloneDXComponent struct {
+	BOMRef     string              `json:"bom-ref"`
+	Type       string              `json:"type"`
+	Name       string              `json:"name"`
+	Version    string              `json:"version"`
+	Purl       string              `json:"purl"`
+	Licenses   []cycloneDXLicense  `json:"licenses,omitempty"`
+	Properties []cycloneDXProperty `json:"properties,omitempty"`
+}
+
+// WriteCycloneDX writes a software bill of materials of a container
+// image in CycloneDX 1.5 JSON format.
+func WriteCycloneDX(w io.Writer, image *Image, packages []schema.ContainerImagePackage, created time.Time) error {
+	serialNumber, err := newUUIDURN()
+	if err != nil {
+		return err
+	}
+
+	components := []cycloneDXComponent{}
+	for i, p := range packages {
+		component := cycloneDXComponent{
+			BOMRef:  "package-" + strconv.Itoa(i+1),
+			Type:    "library",
+			Name:    p.Name,
+			Version: p.Version,
+			Purl:    p.Purl,
+			Properties: []cycloneDXProperty{{
+				Name:  "distfile-mirror:location",
+				Value: p.Location,
+			}},
+		}
+		if p.License != nil {
+			var license cycloneDXLicense
+			license.License.Name = *p.License
+			component.Licenses = []cycloneDXLicense{license}
+		}
+		components = append(components, component)
+	}
+
+	type tool struct {
+		Type string `json:"type"`
+		Name string `json:"name"`
+	}
+	type metadata struct {
+		Timestamp string `json:"timestamp"`
+		Tools     struct {
+			Components []tool `json:"components"`
+		} `json:"tools"`
+		Component cycloneDXComponent `json:"component"`
+	}
+	bomMetadata := metadata{
+		Timestamp: created.UTC().Format(time.RFC3339),
+		Component: cycloneDXComponent{
+			BOMRef:  "image",
+			Type:    "container",
+			Name:    image.getName(),
+			Version: image.Digest,
+			Purl:    image.getPurl(),
+		},
+	}
+	bomMetadata.Tools.Components = []tool{{Type: "application", Name: "distfile-mirror"}}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(struct {
+		BOMFormat    string               `json:"bomFormat"`
+		SpecVersion  string               `json:"specVersion"`
+		SerialNumber string               `json:"serialNumber"`
+		Version      int                  `json:"version"`
+		Metadata     metadata             `json:"metadata"`
+		Components   []cycloneDXComponent `json:"components"`
+	}{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: serialNumber,
+		Version:      1,
+		Metadata:     bomMetadata,
+		Components:   components,
+	})
+}
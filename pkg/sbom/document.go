@@ -0,0 +1,46 @@
+package sbom
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+)
+
+// Image identifies the container image that is described by a
+// software bill of materials.
+type Image struct {
+	// Hostname of the registry (e.g., "registry-1.docker.io").
+	Registry string
+	// Name of the repository (e.g., "library/debian").
+	Repository string
+	// Digest of the manifest of the image.
+	Digest string
+}
+
+// getName returns the name under which the image is pulled.
+func (i *Image) getName() string {
+	return i.Registry + "/" + i.Repository
+}
+
+// getPurl returns the package URL of the image.
+func (i *Image) getPurl() string {
+	name := i.Repository
+	if j := strings.LastIndexByte(name, '/'); j >= 0 {
+		name = name[j+1:]
+	}
+	return newPurl("oci", "", name, i.Digest, map[string]string{
+		"repository_url": i.getName(),
+	})
+}
+
+// newUUIDURN creates a random (version 4) UUID URN, used to identify
+// documents uniquely.
+func newUUIDURN() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,61 @@
+package sbom
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+)
+
+// parseDpkgParagraphs parses a file consisting of paragraphs of
+// "Field: value" pairs, as used by dpkg's status file. Continuation
+// lines of multi-line fields are discarded.
+func parseDpkgParagraphs(contents []byte) []map[string]string {
+	var paragraphs []map[string]string
+	paragraph := map[string]string{}
+	for _, line := range strings.Split(string(bytes.Replace(contents, []byte("\r\n"), []byte("\n"), -1)), "\n") {
+		if strings.TrimSpace(line) == "" {
+			if len(paragraph) > 0 {
+				paragraphs = append(paragraphs, paragraph)
+				paragraph = map[string]string{}
+			}
+		} else if line[0] != ' ' && line[0] != '\t' {
+			if i := strings.IndexByte(line, ':'); i > 0 {
+				paragraph[line[:i]] = strings.TrimSpace(line[i+1:])
+			}
+		}
+	}
+	if len(paragraph) > 0 {
+		paragraphs = append(paragraphs, paragraph)
+	}
+	return paragraphs
+}
+
+// parseDpkgStatus extracts the installed packages from dpkg's status
+// file (/var/lib/dpkg/status). Distroless images store a file per
+// package in /var/lib/dpkg/status.d instead, which lack the Status
+// field.
+func parseDpkgStatus(contents []byte, release *osRelease) ([]schema.ContainerImagePackage, error) {
+	var packages []schema.ContainerImagePackage
+	for _, paragraph := range parseDpkgParagraphs(contents) {
+		name, version := paragraph["Package"], paragraph["Version"]
+		if name == "" || version == "" {
+			continue
+		}
+		if status, ok := paragraph["Status"]; ok {
+			if fields := strings.Fields(status); len(fields) != 3 || fields[2] != "installed" {
+				continue
+			}
+		}
+		packages = append(packages, schema.ContainerImagePackage{
+			Type:    schema.PackageTypeDeb,
+			Name:    name,
+			Version: version,
+			Purl: newPurl("deb", release.getNamespace("debian"), name, version, map[string]string{
+				"arch":   paragraph["Architecture"],
+				"distro": release.getDistroQualifier(),
+			}),
+		})
+	}
+	return packages, nil
+}
@@ -0,0 +1,186 @@
+package sbom
+
+import (
+	"context"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/layers"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/manifests"
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/docker/distribution"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// Maximum size of package databases and lockfiles that are
+	// read from layers. RPM databases of large images may be
+	// hundreds of megabytes in size.
+	maximumFileSize = 256 * 1024 * 1024
+
+	// Maximum total size of the package databases and lockfiles
+	// read from a single image.
+	maximumTotalFileSize = 512 * 1024 * 1024
+
+	// Number of packages to insert into the database per statement.
+	insertBatchSize = 500
+)
+
+type parser func(contents []byte, release *osRelease) ([]schema.ContainerImagePackage, error)
+
+// Parsers of package databases of operating systems, by path.
+var packageDatabaseParsers = map[string]parser{
+	"/var/lib/dpkg/status":               parseDpkgStatus,
+	"/lib/apk/db/installed":              parseApkInstalled,
+	"/var/lib/rpm/Packages":              parseRpmBerkeleyDB,
+	"/var/lib/rpm/rpmdb.sqlite":          parseRpmSQLite,
+	"/usr/lib/sysimage/rpm/rpmdb.sqlite": parseRpmSQLite,
+}
+
+// Parsers of lockfiles of programming languages, by filename.
+var lockfileParsers = map[string]parser{
+	"Cargo.lock":        parseCargoLockfile,
+	"Gemfile.lock":      parseGemfileLockfile,
+	"Pipfile.lock":      parsePipfileLockfile,
+	"composer.lock":     parseComposerLockfile,
+	"package-lock.json": parseNpmLockfile,
+	"poetry.lock":       parsePoetryLockfile,
+	"yarn.lock":         parseYarnLockfile,
+}
+
+func getParser(p string) parser {
+	if parser, ok := packageDatabaseParsers[p]; ok {
+		return parser
+	}
+	// Distroless images store a dpkg status file per package.
+	if path.Dir(p) == "/var/lib/dpkg/status.d" {
+		return parseDpkgStatus
+	}
+	return lockfileParsers[path.Base(p)]
+}
+
+func isRelevantFile(p string) bool {
+	for _, osReleasePath := range osReleasePaths {
+		if p == osReleasePath {
+			return true
+		}
+	}
+	return getParser(p) != nil
+}
+
+// parseFiles extracts packages from the package databases and
+// lockfiles contained in a set of files, keyed by path. Files that
+// cannot be parsed are skipped, as a single corrupt lockfile should
+// not prevent the remainder of an image from being inventoried.
+func parseFiles(files map[string][]byte) []schema.ContainerImagePackage {
+	release := &osRelease{}
+	for _, osReleasePath := range osReleasePaths {
+		if contents, ok := files[osReleasePath]; ok {
+			release = parseOsRelease(contents)
+			break
+		}
+	}
+
+	// Packages are stored once per location, even if a lockfile
+	// lists them multiple times.
+	type packageKey struct {
+		location string
+		name     string
+		version  string
+	}
+	seen := map[packageKey]bool{}
+	var packages []schema.ContainerImagePackage
+	for p, contents := range files {
+		parser := getParser(p)
+		if parser == nil {
+			continue
+		}
+		filePackages, err := parser(contents, release)
+		if err != nil {
+			log.Printf("Failed to parse %s: %s", p, err)
+			continue
+		}
+		for _, filePackage := range filePackages {
+			key := packageKey{location: p, name: filePackage.Name, version: filePackage.Version}
+			if !seen[key] {
+				seen[key] = true
+				filePackage.Location = p
+				packages = append(packages, filePackage)
+			}
+		}
+	}
+	sort.Slice(packages, func(i, j int) bool {
+		if packages[i].Location != packages[j].Location {
+			return packages[i].Location < packages[j].Location
+		}
+		if packages[i].Name != packages[j].Name {
+			return packages[i].Name < packages[j].Name
+		}
+		return packages[i].Version < packages[j].Version
+	})
+	return packages
+}
+
+// insertPackages stores the packages of an image in the database
+// using multi-row statements, as images may contain thousands of
+// packages.
+func insertPackages(tx *gorm.DB, packages []schema.ContainerImagePackage) error {
+	for start := 0; start < len(packages); start += insertBatchSize {
+		end := start + insertBatchSize
+		if end > len(packages) {
+			end = len(packages)
+		}
+		var placeholders []string
+		var values []interface{}
+		for _, p := range packages[start:end] {
+			placeholders = append(placeholders, "(?, ?, ?, ?, ?, ?, ?)")
+			values = append(values, p.ContainerImageId, p.Location, p.Type, p.Name, p.Version, p.License, p.Purl)
+		}
+		if r := tx.Exec("INSERT INTO container_image_packages (container_image_id, location, type, name, version, license, purl) VALUES "+strings.Join(placeholders, ", "), values...); r.Error != nil {
+			return r.Error
+		}
+	}
+	return nil
+}
+
+// ExtractPackages stores the packages contained in a downloaded
+// container image in the database. Package databases and lockfiles
+// are read from its layers directly, meaning the layers don't need to
+// be indexed. Manifest lists are skipped, as they don't have layers of
+// their own.
+func ExtractPackages(ctx context.Context, db *gorm.DB, s3Client *s3.S3, containerImage *schema.ContainerImage) error {
+	if manifests.IsManifestList(*containerImage.ManifestMediatype) {
+		return nil
+	}
+	manifest, _, err := distribution.UnmarshalManifest(*containerImage.ManifestMediatype, *containerImage.Manifest)
+	if err != nil {
+		return err
+	}
+	files, err := layers.ReadFiles(ctx, s3Client, layers.GetFilesystemLayers(manifest), isRelevantFile, maximumFileSize, maximumTotalFileSize)
+	if err != nil {
+		return err
+	}
+	packages := parseFiles(files)
+	for i := range packages {
+		packages[i].ContainerImageId = containerImage.Id
+	}
+
+	tx := db.Begin()
+	if r := tx.Where("container_image_id = ?", containerImage.Id).Delete(&schema.ContainerImagePackage{}); r.Error != nil {
+		tx.Rollback()
+		return r.Error
+	}
+	if err := insertPackages(tx, packages); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if r := tx.Model(&schema.ContainerImage{}).Where("id = ?", containerImage.Id).Update("packages_extracted_at", time.Now()); r.Error != nil {
+		tx.Rollback()
+		return r.Error
+	}
+	return tx.Commit().Error
+}
@@ -0,0 +1,243 @@
+package sbom
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+)
+
+func newLanguagePackage(packageType string, name string, version string, license string) schema.ContainerImagePackage {
+	p := schema.ContainerImagePackage{
+		Type:    packageType,
+		Name:    name,
+		Version: version,
+		Purl:    newPurl(packageType, "", name, version, nil),
+	}
+	if license != "" {
+		p.License = &license
+	}
+	return p
+}
+
+// parseNpmLockfile extracts packages from an npm package-lock.json
+// file. Version 2 and later list packages by their path in
+// node_modules, while version 1 nests dependencies.
+func parseNpmLockfile(contents []byte, release *osRelease) ([]schema.ContainerImagePackage, error) {
+	type npmDependency struct {
+		Version      string                    `json:"version"`
+		Dev          bool                      `json:"dev"`
+		Dependencies map[string]*npmDependency `json:"dependencies"`
+	}
+	var lockfile struct {
+		Packages map[string]struct {
+			Name    string          `json:"name"`
+			Version string          `json:"version"`
+			License json.RawMessage `json:"license"`
+			Dev     bool            `json:"dev"`
+			Link    bool            `json:"link"`
+		} `json:"packages"`
+		Dependencies map[string]*npmDependency `json:"dependencies"`
+	}
+	if err := json.Unmarshal(contents, &lockfile); err != nil {
+		return nil, err
+	}
+
+	var packages []schema.ContainerImagePackage
+	if lockfile.Packages != nil {
+		for packagePath, p := range lockfile.Packages {
+			i := strings.LastIndex(packagePath, "node_modules/")
+			if i < 0 || p.Version == "" || p.Dev || p.Link {
+				continue
+			}
+			name := p.Name
+			if name == "" {
+				name = packagePath[i+len("node_modules/"):]
+			}
+			// Licenses are either a string or an object in
+			// older package.json files. Only use the former.
+			var license string
+			json.Unmarshal(p.License, &license)
+			packages = append(packages, newLanguagePackage(schema.PackageTypeNpm, name, p.Version, license))
+		}
+		return packages, nil
+	}
+
+	var walk func(dependencies map[string]*npmDependency)
+	walk = func(dependencies map[string]*npmDependency) {
+		for name, dependency := range dependencies {
+			if dependency == nil || dependency.Dev {
+				continue
+			}
+			if dependency.Version != "" {
+				packages = append(packages, newLanguagePackage(schema.PackageTypeNpm, name, dependency.Version, ""))
+			}
+			walk(dependency.Dependencies)
+		}
+	}
+	walk(lockfile.Dependencies)
+	return packages, nil
+}
+
+// parseYarnLockfile extracts packages from a yarn.lock file. Version
+// 1 lockfiles use a format of their own, while later versions use
+// YAML. In both cases, entries are unindented lists of specifiers
+// (e.g., "lodash@^4.17.0, lodash@^4.17.21:") followed by indented
+// fields, among which the version.
+func parseYarnLockfile(contents []byte, release *osRelease) ([]schema.ContainerImagePackage, error) {
+	var packages []schema.ContainerImagePackage
+	var name string
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line[0] != ' ' {
+			// Obtain the name from the first specifier.
+			specifier := strings.TrimSuffix(line, ":")
+			if i := strings.IndexByte(specifier, ','); i >= 0 {
+				specifier = specifier[:i]
+			}
+			specifier = strings.Trim(strings.TrimSpace(specifier), "\"")
+			name = ""
+			if i := strings.LastIndexByte(specifier, '@'); i > 0 && !strings.Contains(specifier[i:], "workspace:") {
+				name = specifier[:i]
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		if name != "" && len(fields) == 2 && (fields[0] == "version" || fields[0] == "version:") && strings.HasPrefix(line, "  ") && line[2] != ' ' {
+			version := fields[1]
+			if unquoted, err := strconv.Unquote(version); err == nil {
+				version = unquoted
+			}
+			packages = append(packages, newLanguagePackage(schema.PackageTypeNpm, name, version, ""))
+			name = ""
+		}
+	}
+	return packages, nil
+}
+
+// parsePipfileLockfile extracts packages from a Pipfile.lock file.
+// Development dependencies are not included.
+func parsePipfileLockfile(contents []byte, release *osRelease) ([]schema.ContainerImagePackage, error) {
+	var lockfile struct {
+		Default map[string]struct {
+			Version string `json:"version"`
+		} `json:"default"`
+	}
+	if err := json.Unmarshal(contents, &lockfile); err != nil {
+		return nil, err
+	}
+	var packages []schema.ContainerImagePackage
+	for name, p := range lockfile.Default {
+		// Packages installed from version control don't have
+		// a pinned version.
+		if version := strings.TrimPrefix(p.Version, "=="); version != "" {
+			packages = append(packages, newLanguagePackage(schema.PackageTypePypi, strings.ToLower(name), version, ""))
+		}
+	}
+	return packages, nil
+}
+
+// parseTomlPackages extracts the name and version fields of the
+// [[package]] tables in a TOML lockfile, as used by Cargo and Poetry.
+// Only the subset of TOML that these tools emit is supported.
+func parseTomlPackages(contents []byte, packageType string) []schema.ContainerImagePackage {
+	var packages []schema.ContainerImagePackage
+	var name, version string
+	inPackage := false
+	flush := func() {
+		if name != "" && version != "" {
+			packages = append(packages, newLanguagePackage(packageType, name, version, ""))
+		}
+		name, version = "", ""
+	}
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			// Subtables such as [package.dependencies]
+			// contain fields that aren't the package's.
+			flush()
+			inPackage = line == "[[package]]"
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if !inPackage || i < 0 {
+			continue
+		}
+		value, err := strconv.Unquote(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			continue
+		}
+		switch strings.TrimSpace(line[:i]) {
+		case "name":
+			name = value
+		case "version":
+			version = value
+		}
+	}
+	flush()
+	return packages
+}
+
+// parseCargoLockfile extracts packages from a Cargo.lock file.
+func parseCargoLockfile(contents []byte, release *osRelease) ([]schema.ContainerImagePackage, error) {
+	return parseTomlPackages(contents, schema.PackageTypeCargo), nil
+}
+
+// parsePoetryLockfile extracts packages from a poetry.lock file.
+func parsePoetryLockfile(contents []byte, release *osRelease) ([]schema.ContainerImagePackage, error) {
+	packages := parseTomlPackages(contents, schema.PackageTypePypi)
+	for i := range packages {
+		packages[i].Name = strings.ToLower(packages[i].Name)
+		packages[i].Purl = newPurl(schema.PackageTypePypi, "", packages[i].Name, packages[i].Version, nil)
+	}
+	return packages, nil
+}
+
+// parseGemfileLockfile extracts packages from a Gemfile.lock file.
+// Gems are listed underneath "specs:" with an indentation of four
+// spaces (e.g., "    rake (13.0.6)"), while their dependencies are
+// indented by six spaces.
+func parseGemfileLockfile(contents []byte, release *osRelease) ([]schema.ContainerImagePackage, error) {
+	var packages []schema.ContainerImagePackage
+	inSpecs := false
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" || line[0] != ' ' {
+			inSpecs = false
+		} else if line == "  specs:" {
+			inSpecs = true
+		} else if inSpecs && strings.HasPrefix(line, "    ") && line[4] != ' ' {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && strings.HasPrefix(fields[1], "(") && strings.HasSuffix(fields[1], ")") {
+				packages = append(packages, newLanguagePackage(schema.PackageTypeGem, fields[0], strings.Trim(fields[1], "()"), ""))
+			}
+		}
+	}
+	return packages, nil
+}
+
+// parseComposerLockfile extracts packages from a composer.lock file.
+// Development dependencies are not included.
+func parseComposerLockfile(contents []byte, release *osRelease) ([]schema.ContainerImagePackage, error) {
+	var lockfile struct {
+		Packages []struct {
+			Name    string   `json:"name"`
+			Version string   `json:"version"`
+			License []string `json:"license"`
+		} `json:"packages"`
+	}
+	if err := json.Unmarshal(contents, &lockfile); err != nil {
+		return nil, err
+	}
+	var packages []schema.ContainerImagePackage
+	for _, p := range lockfile.Packages {
+		if p.Name != "" && p.Version != "" {
+			packages = append(packages, newLanguagePackage(schema.PackageTypeComposer, p.Name, p.Version, strings.Join(p.License, " OR ")))
+		}
+	}
+	return packages, nil
+}
@@ -0,0 +1,67 @@
+package sbom
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// Paths at which os-release files may be stored, in order of preference.
+var osReleasePaths = []string{"/etc/os-release", "/usr/lib/os-release"}
+
+// osRelease contains the identification of the operating system
+// installed in a container image, used to qualify package URLs of
+// operating system packages.
+type osRelease struct {
+	// Name of the distribution (e.g., "debian").
+	Id string
+	// Version of the distribution (e.g., "12").
+	VersionId string
+}
+
+// parseOsRelease parses an os-release file, as described in
+// os-release(5).
+func parseOsRelease(contents []byte) *osRelease {
+	var release osRelease
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		i := strings.IndexByte(line, '=')
+		if i < 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		value := line[i+1:]
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else {
+			value = strings.Trim(value, "'")
+		}
+		switch line[:i] {
+		case "ID":
+			release.Id = value
+		case "VERSION_ID":
+			release.VersionId = value
+		}
+	}
+	return &release
+}
+
+// getDistroQualifier returns the value of the "distro" qualifier of
+// package URLs (e.g., "debian-12").
+func (r *osRelease) getDistroQualifier() string {
+	if r.Id == "" || r.VersionId == "" {
+		return ""
+	}
+	return r.Id + "-" + r.VersionId
+}
+
+// getNamespace returns the namespace of package URLs of operating
+// system packages, falling back to a given namespace if the
+// distribution is unknown.
+func (r *osRelease) getNamespace(fallback string) string {
+	if r.Id == "" {
+		return fallback
+	}
+	return r.Id
+}
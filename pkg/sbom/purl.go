@@ -0,0 +1,59 @@
+package sbom
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+func escapePurlComponent(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// newPurl creates a package URL (https://github.com/package-url/purl-spec).
+// Names containing slashes are split up in a namespace and a name,
+// which is how scoped npm packages and Composer packages are encoded.
+func newPurl(purlType string, namespace string, name string, version string, qualifiers map[string]string) string {
+	var purl strings.Builder
+	purl.WriteString("pkg:")
+	purl.WriteString(purlType)
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		if namespace != "" {
+			namespace += "/"
+		}
+		namespace += name[:i]
+		name = name[i+1:]
+	}
+	if namespace != "" {
+		for _, segment := range strings.Split(namespace, "/") {
+			purl.WriteString("/")
+			purl.WriteString(escapePurlComponent(segment))
+		}
+	}
+	purl.WriteString("/")
+	purl.WriteString(escapePurlComponent(name))
+	if version != "" {
+		purl.WriteString("@")
+		purl.WriteString(escapePurlComponent(version))
+	}
+
+	// Qualifiers need to be sorted by key. Empty values are omitted.
+	var keys []string
+	for key, value := range qualifiers {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		if i == 0 {
+			purl.WriteString("?")
+		} else {
+			purl.WriteString("&")
+		}
+		purl.WriteString(key)
+		purl.WriteString("=")
+		purl.WriteString(escapePurlComponent(qualifiers[key]))
+	}
+	return purl.String()
+}
@@ -0,0 +1,164 @@
+package sbom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+)
+
+// Tags and types of entries in RPM headers that are used to obtain the
+// identity of a package.
+const (
+	rpmTagName    = 1000
+	rpmTagVersion = 1001
+	rpmTagRelease = 1002
+	rpmTagEpoch   = 1003
+	rpmTagLicense = 1014
+	rpmTagArch    = 1022
+
+	rpmTypeInt32        = 4
+	rpmTypeString       = 6
+	rpmTypeI18NString   = 9
+	rpmIndexEntryLength = 16
+)
+
+// rpmHeader contains the fields of an RPM header blob, as stored in
+// the RPM database, that are used to identify a package.
+type rpmHeader struct {
+	Name    string
+	Version string
+	Release string
+	Epoch   *int32
+	License string
+	Arch    string
+}
+
+// parseRpmHeader parses an RPM header blob. Such blobs start with the
+// number of index entries and the size of the data store, followed by
+// the index entries and the data store.
+func parseRpmHeader(blob []byte) (*rpmHeader, error) {
+	if len(blob) < 8 {
+		return nil, errors.New("Header is too short")
+	}
+	indexCount := int(binary.BigEndian.Uint32(blob))
+	dataLength := int(binary.BigEndian.Uint32(blob[4:]))
+	dataStart := 8 + indexCount*rpmIndexEntryLength
+	if indexCount < 0 || dataLength < 0 || indexCount > len(blob)/rpmIndexEntryLength || dataStart+dataLength > len(blob) {
+		return nil, errors.New("Header is truncated")
+	}
+	data := blob[dataStart : dataStart+dataLength]
+
+	var header rpmHeader
+	for i := 0; i < indexCount; i++ {
+		entry := blob[8+i*rpmIndexEntryLength:]
+		tag := binary.BigEndian.Uint32(entry)
+		entryType := binary.BigEndian.Uint32(entry[4:])
+		offset := int(binary.BigEndian.Uint32(entry[8:]))
+		if offset < 0 || offset >= len(data) {
+			continue
+		}
+		var stringValue string
+		switch entryType {
+		case rpmTypeString, rpmTypeI18NString:
+			// Strings are NUL terminated. For
+			// internationalized strings, only use the first.
+			value := data[offset:]
+			if end := bytes.IndexByte(value, 0); end >= 0 {
+				value = value[:end]
+			}
+			stringValue = string(value)
+		case rpmTypeInt32:
+			if tag == rpmTagEpoch && offset+4 <= len(data) {
+				epoch := int32(binary.BigEndian.Uint32(data[offset:]))
+				header.Epoch = &epoch
+			}
+			continue
+		default:
+			continue
+		}
+		switch tag {
+		case rpmTagName:
+			header.Name = stringValue
+		case rpmTagVersion:
+			header.Version = stringValue
+		case rpmTagRelease:
+			header.Release = stringValue
+		case rpmTagLicense:
+			header.License = stringValue
+		case rpmTagArch:
+			header.Arch = stringValue
+		}
+	}
+	if header.Name == "" || header.Version == "" {
+		return nil, errors.New("Header does not contain a name and version")
+	}
+	return &header, nil
+}
+
+// parseRpmHeaders converts the header blobs stored in an RPM database
+// to packages.
+func parseRpmHeaders(blobs [][]byte, release *osRelease) ([]schema.ContainerImagePackage, error) {
+	var packages []schema.ContainerImagePackage
+	for _, blob := range blobs {
+		header, err := parseRpmHeader(blob)
+		if err != nil {
+			return nil, err
+		}
+		// Public keys imported into the RPM database are
+		// stored as pseudo-packages.
+		if header.Name == "gpg-pubkey" {
+			continue
+		}
+		version := header.Version
+		if header.Release != "" {
+			version += "-" + header.Release
+		}
+		// Package URLs store the epoch as a qualifier.
+		purlVersion := version
+		qualifiers := map[string]string{
+			"arch":   header.Arch,
+			"distro": release.getDistroQualifier(),
+		}
+		if header.Epoch != nil {
+			qualifiers["epoch"] = strconv.FormatInt(int64(*header.Epoch), 10)
+			version = fmt.Sprintf("%d:%s", *header.Epoch, version)
+		}
+		var license *string
+		if header.License != "" {
+			license = &header.License
+		}
+		packages = append(packages, schema.ContainerImagePackage{
+			Type:    schema.PackageTypeRpm,
+			Name:    header.Name,
+			Version: version,
+			License: license,
+			Purl:    newPurl("rpm", release.getNamespace(""), header.Name, purlVersion, qualifiers),
+		})
+	}
+	return packages, nil
+}
+
+// parseRpmBerkeleyDB extracts the installed packages from an RPM
+// database stored in Berkeley DB format (/var/lib/rpm/Packages), as
+// used by RHEL 8 and older.
+func parseRpmBerkeleyDB(contents []byte, release *osRelease) ([]schema.ContainerImagePackage, error) {
+	blobs, err := readBerkeleyDBHashValues(contents)
+	if err != nil {
+		return nil, err
+	}
+	return parseRpmHeaders(blobs, release)
+}
+
+// parseRpmSQLite extracts the installed packages from an RPM database
+// stored in SQLite format (rpmdb.sqlite), as used by RHEL 9 and Fedora.
+func parseRpmSQLite(contents []byte, release *osRelease) ([]schema.ContainerImagePackage, error) {
+	blobs, err := readSQLiteColumn(contents, "Packages", 1)
+	if err != nil {
+		return nil, err
+	}
+	return parseRpmHeaders(blobs, release)
+}
@@ -0,0 +1,223 @@
+package sbom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+)
+
+// rpmHeaderEntry is an entry of an RPM header blob constructed for
+// testing. Values are either strings or int32s.
+type rpmHeaderEntry struct {
+	tag   uint32
+	value interface{}
+}
+
+// newRpmHeader constructs an RPM header blob, as stored in the RPM
+// database.
+func newRpmHeader(entries ...rpmHeaderEntry) []byte {
+	var index, data bytes.Buffer
+	for _, entry := range entries {
+		var entryType uint32
+		switch value := entry.value.(type) {
+		case string:
+			entryType = rpmTypeString
+			binary.Write(&index, binary.BigEndian, []uint32{entry.tag, entryType, uint32(data.Len()), 1})
+			data.WriteString(value)
+			data.WriteByte(0)
+		case int32:
+			entryType = rpmTypeInt32
+			for data.Len()%4 != 0 {
+				data.WriteByte(0)
+			}
+			binary.Write(&index, binary.BigEndian, []uint32{entry.tag, entryType, uint32(data.Len()), 1})
+			binary.Write(&data, binary.BigEndian, value)
+		}
+	}
+	var blob bytes.Buffer
+	binary.Write(&blob, binary.BigEndian, []uint32{uint32(len(entries)), uint32(data.Len())})
+	blob.Write(index.Bytes())
+	blob.Write(data.Bytes())
+	return blob.Bytes()
+}
+
+func TestParseRpmHeader(t *testing.T) {
+	header, err := parseRpmHeader(newRpmHeader(
+		rpmHeaderEntry{rpmTagName, "openssl-libs"},
+		rpmHeaderEntry{rpmTagVersion, "3.0.7"},
+		rpmHeaderEntry{rpmTagRelease, "24.el9"},
+		rpmHeaderEntry{rpmTagEpoch, int32(1)},
+		rpmHeaderEntry{rpmTagLicense, "ASL 2.0"},
+		rpmHeaderEntry{rpmTagArch, "x86_64"},
+		// Unknown tags are ignored.
+		rpmHeaderEntry{1004, "Utilities from the general purpose cryptography library"},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Name != "openssl-libs" || header.Version != "3.0.7" || header.Release != "24.el9" || header.License != "ASL 2.0" || header.Arch != "x86_64" {
+		t.Errorf("Got header %#v", header)
+	}
+	if header.Epoch == nil || *header.Epoch != 1 {
+		t.Errorf("Got epoch %v, expected 1", header.Epoch)
+	}
+}
+
+func TestParseRpmHeaderInvalid(t *testing.T) {
+	valid := newRpmHeader(
+		rpmHeaderEntry{rpmTagName, "bash"},
+		rpmHeaderEntry{rpmTagVersion, "5.1.8"},
+	)
+	withUint32 := func(offset int, value uint32) []byte {
+		blob := append([]byte(nil), valid...)
+		binary.BigEndian.PutUint32(blob[offset:], value)
+		return blob
+	}
+	for _, testCase := range []struct {
+		name string
+		blob []byte
+	}{
+		{"Empty", nil},
+		{"TruncatedCounts", valid[:7]},
+		{"TruncatedIndex", valid[:8+rpmIndexEntryLength]},
+		{"TruncatedData", valid[:len(valid)-1]},
+		{"OverflowingIndexCount", withUint32(0, 0xffffffff)},
+		{"OverflowingDataLength", withUint32(4, 0xffffffff)},
+		{"LargeIndexCount", withUint32(0, 0x10000000)},
+		{"MissingName", newRpmHeader(rpmHeaderEntry{rpmTagVersion, "5.1.8"})},
+		{"MissingVersion", newRpmHeader(rpmHeaderEntry{rpmTagName, "bash"})},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			if _, err := parseRpmHeader(testCase.blob); err == nil {
+				t.Error("Invalid header was accepted")
+			}
+		})
+	}
+}
+
+func TestParseRpmHeaderOffsetsOutOfRange(t *testing.T) {
+	// Entries whose offsets point outside of the data store are
+	// ignored, as are integers that are truncated.
+	blob := newRpmHeader(
+		rpmHeaderEntry{rpmTagName, "bash"},
+		rpmHeaderEntry{rpmTagVersion, "5.1.8"},
+		rpmHeaderEntry{rpmTagLicense, "GPLv3+"},
+		rpmHeaderEntry{rpmTagEpoch, int32(2)},
+	)
+	binary.BigEndian.PutUint32(blob[8+2*rpmIndexEntryLength+8:], 0xffffffff)
+	binary.BigEndian.PutUint32(blob[8+3*rpmIndexEntryLength+8:], uint32(len(blob)-8-4*rpmIndexEntryLength-2))
+	header, err := parseRpmHeader(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.License != "" || header.Epoch != nil {
+		t.Errorf("Got header %#v", header)
+	}
+}
+
+func TestParseRpmHeaders(t *testing.T) {
+	packages, err := parseRpmHeaders([][]byte{
+		newRpmHeader(
+			rpmHeaderEntry{rpmTagName, "bash"},
+			rpmHeaderEntry{rpmTagVersion, "5.1.8"},
+			rpmHeaderEntry{rpmTagRelease, "6.el9"},
+			rpmHeaderEntry{rpmTagLicense, "GPLv3+"},
+			rpmHeaderEntry{rpmTagArch, "x86_64"},
+		),
+		newRpmHeader(
+			rpmHeaderEntry{rpmTagName, "openssl-libs"},
+			rpmHeaderEntry{rpmTagVersion, "3.0.7"},
+			rpmHeaderEntry{rpmTagRelease, "24.el9"},
+			rpmHeaderEntry{rpmTagEpoch, int32(1)},
+			rpmHeaderEntry{rpmTagArch, "x86_64"},
+		),
+		// Public keys are stored as pseudo-packages.
+		newRpmHeader(
+			rpmHeaderEntry{rpmTagName, "gpg-pubkey"},
+			rpmHeaderEntry{rpmTagVersion, "fd431d51"},
+		),
+	}, &osRelease{Id: "rhel", VersionId: "9.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPackages(t, packages, []schema.ContainerImagePackage{
+		{
+			Type:    schema.PackageTypeRpm,
+			Name:    "bash",
+			Version: "5.1.8-6.el9",
+			Purl:    "pkg:rpm/rhel/bash@5.1.8-6.el9?arch=x86_64&distro=rhel-9.2",
+		},
+		{
+			Type:    schema.PackageTypeRpm,
+			Name:    "openssl-libs",
+			Version: "1:3.0.7-24.el9",
+			Purl:    "pkg:rpm/rhel/openssl-libs@3.0.7-24.el9?arch=x86_64&distro=rhel-9.2&epoch=1",
+		},
+	})
+	if packages[0].License == nil || *packages[0].License != "GPLv3+" || packages[1].License != nil {
+		t.Error("Licenses were not extracted")
+	}
+}
+
+func TestParseRpmBerkeleyDB(t *testing.T) {
+	b := newBerkeleyDBBuilder(binary.LittleEndian, 512)
+	key := make([]byte, 4)
+	b.addHashPage(
+		b.keyData(string(key)),
+		append([]byte{berkeleyDBItemTypeKeyData}, newRpmHeader(
+			rpmHeaderEntry{rpmTagName, "bash"},
+			rpmHeaderEntry{rpmTagVersion, "4.4.20"},
+			rpmHeaderEntry{rpmTagRelease, "4.el8"},
+			rpmHeaderEntry{rpmTagArch, "x86_64"},
+		)...))
+	packages, err := parseRpmBerkeleyDB(b.build(), &osRelease{Id: "rhel", VersionId: "8.9"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPackages(t, packages, []schema.ContainerImagePackage{
+		{
+			Type:    schema.PackageTypeRpm,
+			Name:    "bash",
+			Version: "4.4.20-4.el8",
+			Purl:    "pkg:rpm/rhel/bash@4.4.20-4.el8?arch=x86_64&distro=rhel-8.9",
+		},
+	})
+}
+
+func TestParseRpmSQLite(t *testing.T) {
+	packages, err := parseRpmSQLite(readTestdata(t, "rpmdb.sqlite"), &osRelease{Id: "rhel", VersionId: "9.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPackages(t, packages, []schema.ContainerImagePackage{
+		{
+			Type:    schema.PackageTypeRpm,
+			Name:    "bash",
+			Version: "5.1.8-6.el9",
+			Purl:    "pkg:rpm/rhel/bash@5.1.8-6.el9?arch=x86_64&distro=rhel-9.2",
+		},
+		{
+			Type:    schema.PackageTypeRpm,
+			Name:    "openssl-libs",
+			Version: "1:3.0.7-24.el9",
+			Purl:    "pkg:rpm/rhel/openssl-libs@3.0.7-24.el9?arch=x86_64&distro=rhel-9.2&epoch=1",
+		},
+	})
+}
+
+// checkPackages compares the identity of packages, ignoring their
+// licenses.
+func checkPackages(t *testing.T, packages []schema.ContainerImagePackage, expected []schema.ContainerImagePackage) {
+	t.Helper()
+	if len(packages) != len(expected) {
+		t.Fatalf("Got %d packages, expected %d", len(packages), len(expected))
+	}
+	for i := range expected {
+		p := packages[i]
+		if p.Type != expected[i].Type || p.Name != expected[i].Name || p.Version != expected[i].Version || p.Purl != expected[i].Purl {
+			t.Errorf("Package %d is %s %s %s %s, expected %s %s %s %s", i, p.Type, p.Name, p.Version, p.Purl, expected[i].Type, expected[i].Name, expected[i].Version, expected[i].Purl)
+		}
+	}
+}
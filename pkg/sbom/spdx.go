@@ -0,0 +1,134 @@
+package sbom
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+)
+
+// SPDXMediaType is the media type of SPDX documents in JSON format.
+const SPDXMediaType = "application/spdx+json"
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxPackage struct {
+	SPDXID                string            `json:"SPDXID"`
+	Name                  string            `json:"name"`
+	VersionInfo           string            `json:"versionInfo"`
+	DownloadLocation      string            `json:"downloadLocation"`
+	FilesAnalyzed         bool              `json:"filesAnalyzed"`
+	LicenseConcluded      string            `json:"licenseConcluded"`
+	LicenseDeclared       string            `json:"licenseDeclared"`
+	LicenseComments       string            `json:"licenseComments,omitempty"`
+	CopyrightText         string            `json:"copyrightText"`
+	SourceInfo            string            `json:"sourceInfo,omitempty"`
+	PrimaryPackagePurpose string            `json:"primaryPackagePurpose,omitempty"`
+	ExternalRefs          []spdxExternalRef `json:"externalRefs"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// WriteSPDX writes a software bill of materials of a container image
+// in SPDX 2.3 JSON format.
+func WriteSPDX(w io.Writer, image *Image, packages []schema.ContainerImagePackage, created time.Time) error {
+	namespace, err := newUUIDURN()
+	if err != nil {
+		return err
+	}
+
+	// The container image itself is the package described by the
+	// document, which contains all other packages.
+	const imageId = "SPDXRef-Image"
+	spdxPackages := []spdxPackage{{
+		SPDXID:                imageId,
+		Name:                  image.getName(),
+		VersionInfo:           image.Digest,
+		DownloadLocation:      "NOASSERTION",
+		LicenseConcluded:      "NOASSERTION",
+		LicenseDeclared:       "NOASSERTION",
+		CopyrightText:         "NOASSERTION",
+		PrimaryPackagePurpose: "CONTAINER",
+		ExternalRefs: []spdxExternalRef{{
+			ReferenceCategory: "PACKAGE-MANAGER",
+			ReferenceType:     "purl",
+			ReferenceLocator:  image.getPurl(),
+		}},
+	}}
+	relationships := []spdxRelationship{{
+		SPDXElementID:      "SPDXRef-DOCUMENT",
+		RelationshipType:   "DESCRIBES",
+		RelatedSPDXElement: imageId,
+	}}
+	for i, p := range packages {
+		packageId := "SPDXRef-Package-" + strconv.Itoa(i+1)
+		// Declared licenses are not necessarily valid SPDX
+		// license expressions, so only report them as comments.
+		var licenseComments string
+		if p.License != nil {
+			licenseComments = "Declared license: " + *p.License
+		}
+		spdxPackages = append(spdxPackages, spdxPackage{
+			SPDXID:           packageId,
+			Name:             p.Name,
+			VersionInfo:      p.Version,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			LicenseComments:  licenseComments,
+			CopyrightText:    "NOASSERTION",
+			SourceInfo:       "acquired package info from " + p.Location,
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  p.Purl,
+			}},
+		})
+		relationships = append(relationships, spdxRelationship{
+			SPDXElementID:      imageId,
+			RelationshipType:   "CONTAINS",
+			RelatedSPDXElement: packageId,
+		})
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(struct {
+		SPDXVersion       string `json:"spdxVersion"`
+		DataLicense       string `json:"dataLicense"`
+		SPDXID            string `json:"SPDXID"`
+		Name              string `json:"name"`
+		DocumentNamespace string `json:"documentNamespace"`
+		CreationInfo      struct {
+			Created  string   `json:"created"`
+			Creators []string `json:"creators"`
+		} `json:"creationInfo"`
+		Packages      []spdxPackage      `json:"packages"`
+		Relationships []spdxRelationship `json:"relationships"`
+	}{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              image.getName() + "@" + image.Digest,
+		DocumentNamespace: namespace,
+		CreationInfo: struct {
+			Created  string   `json:"created"`
+			Creators []string `json:"creators"`
+		}{
+			Created:  created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: distfile-mirror"},
+		},
+		Packages:      spdxPackages,
+		Relationships: relationships,
+	})
+}
@@ -0,0 +1,292 @@
+package sbom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Constants of the SQLite database file format
+// (https://www.sqlite.org/fileformat.html).
+const (
+	sqliteHeaderLength = 100
+
+	sqlitePageTypeInteriorTable = 0x05
+	sqlitePageTypeLeafTable     = 0x0d
+)
+
+var sqliteMagic = []byte("SQLite format 3\x00")
+
+// sqliteDatabase is a read-only SQLite database that has been loaded
+// into memory. Only the parts of the file format needed to scan tables
+// are implemented. Write-ahead logs are not taken into account.
+type sqliteDatabase struct {
+	contents   []byte
+	pageSize   int
+	usableSize int
+
+	// Number of bytes that payloads may still occupy. As payloads
+	// are stored in distinct parts of the file, their total size
+	// can't exceed that of the file. This prevents corrupt lengths
+	// and cyclic overflow chains from exhausting memory.
+	remainingPayloadSize int
+}
+
+func (db *sqliteDatabase) getPage(pageNumber uint32) ([]byte, error) {
+	if pageNumber == 0 || uint64(pageNumber) > uint64(len(db.contents)/db.pageSize) {
+		return nil, fmt.Errorf("Page number %d out of range", pageNumber)
+	}
+	start := (int(pageNumber) - 1) * db.pageSize
+	return db.contents[start : start+db.pageSize], nil
+}
+
+// readSQLiteVarint decodes a variable-length integer, returning its value and
+// length.
+func readSQLiteVarint(b []byte) (int64, int) {
+	var value uint64
+	for i := 0; i < 9 && i < len(b); i++ {
+		if i == 8 {
+			return int64(value<<8 | uint64(b[i])), 9
+		}
+		value = value<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return int64(value), i + 1
+		}
+	}
+	return 0, 0
+}
+
+// readPayload returns the payload of a table leaf cell, following its
+// chain of overflow pages if it doesn't fit in the page.
+func (db *sqliteDatabase) readPayload(cell []byte) ([]byte, error) {
+	payloadLength, n := readSQLiteVarint(cell)
+	if n == 0 || payloadLength < 0 {
+		return nil, errors.New("Invalid cell")
+	}
+	cell = cell[n:]
+	if _, n = readSQLiteVarint(cell); n == 0 {
+		return nil, errors.New("Invalid cell")
+	}
+	cell = cell[n:]
+
+	// Compute how much of the payload is stored in the page.
+	total := int(payloadLength)
+	local := total
+	maxLocal := db.usableSize - 35
+	if total > maxLocal {
+		minLocal := (db.usableSize-12)*32/255 - 23
+		local = minLocal + (total-minLocal)%(db.usableSize-4)
+		if local > maxLocal {
+			local = minLocal
+		}
+	}
+	if local > len(cell) || (local < total && local+4 > len(cell)) {
+		return nil, errors.New("Cell is truncated")
+	}
+	if total > db.remainingPayloadSize {
+		return nil, errors.New("Payloads are larger than the database")
+	}
+	db.remainingPayloadSize -= total
+	payload := make([]byte, 0, total)
+	payload = append(payload, cell[:local]...)
+	if local == total {
+		return payload, nil
+	}
+	for pageNumber := binary.BigEndian.Uint32(cell[local:]); len(payload) < total; {
+		page, err := db.getPage(pageNumber)
+		if err != nil {
+			return nil, err
+		}
+		chunk := page[4:db.usableSize]
+		if remaining := total - len(payload); len(chunk) > remaining {
+			chunk = chunk[:remaining]
+		}
+		payload = append(payload, chunk...)
+		pageNumber = binary.BigEndian.Uint32(page)
+	}
+	return payload, nil
+}
+
+// walkTable calls a function for the payload of every row of the table
+// whose b-tree starts at a given page. Pages may only be visited once,
+// as corrupt databases may reference pages multiple times, causing the
+// number of pages visited to grow exponentially.
+func (db *sqliteDatabase) walkTable(pageNumber uint32, depth int, visited map[uint32]bool, f func(payload []byte) error) error {
+	if depth > 64 {
+		return errors.New("Table b-tree is too deep")
+	}
+	if visited[pageNumber] {
+		return fmt.Errorf("Page %d is referenced multiple times", pageNumber)
+	}
+	visited[pageNumber] = true
+	page, err := db.getPage(pageNumber)
+	if err != nil {
+		return err
+	}
+	header := page
+	if pageNumber == 1 {
+		header = page[sqliteHeaderLength:]
+	}
+	headerLength := 8
+	if header[0] == sqlitePageTypeInteriorTable {
+		headerLength = 12
+	}
+	cellCount := int(binary.BigEndian.Uint16(header[3:]))
+	if len(header) < headerLength+2*cellCount {
+		return fmt.Errorf("Page %d has too many cells", pageNumber)
+	}
+	for i := 0; i < cellCount; i++ {
+		offset := int(binary.BigEndian.Uint16(header[headerLength+2*i:]))
+		if offset >= len(page) {
+			return fmt.Errorf("Page %d contains an invalid cell", pageNumber)
+		}
+		cell := page[offset:]
+		switch header[0] {
+		case sqlitePageTypeInteriorTable:
+			if len(cell) < 4 {
+				return fmt.Errorf("Page %d contains an invalid cell", pageNumber)
+			}
+			if err := db.walkTable(binary.BigEndian.Uint32(cell), depth+1, visited, f); err != nil {
+				return err
+			}
+		case sqlitePageTypeLeafTable:
+			payload, err := db.readPayload(cell)
+			if err != nil {
+				return err
+			}
+			if err := f(payload); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("Page %d is not a table b-tree page", pageNumber)
+		}
+	}
+	if header[0] == sqlitePageTypeInteriorTable {
+		return db.walkTable(binary.BigEndian.Uint32(header[8:]), depth+1, visited, f)
+	}
+	return nil
+}
+
+// parseSQLiteRecord decodes the columns of a record. Integers are
+// returned as int64, while text and blobs are returned as []byte.
+func parseSQLiteRecord(payload []byte) ([]interface{}, error) {
+	headerLength, n := readSQLiteVarint(payload)
+	if n == 0 || headerLength < int64(n) || headerLength > int64(len(payload)) {
+		return nil, errors.New("Invalid record header")
+	}
+	header := payload[n:headerLength]
+	body := payload[headerLength:]
+	var columns []interface{}
+	for len(header) > 0 {
+		serialType, n := readSQLiteVarint(header)
+		if n == 0 {
+			return nil, errors.New("Invalid record header")
+		}
+		header = header[n:]
+
+		var length int
+		switch {
+		case serialType == 0 || serialType == 8 || serialType == 9:
+			length = 0
+		case serialType >= 1 && serialType <= 4:
+			length = int(serialType)
+		case serialType == 5:
+			length = 6
+		case serialType == 6 || serialType == 7:
+			length = 8
+		case serialType >= 12:
+			length = int((serialType - 12) / 2)
+		default:
+			return nil, fmt.Errorf("Invalid serial type %d", serialType)
+		}
+		if length > len(body) {
+			return nil, errors.New("Record is truncated")
+		}
+		value := body[:length]
+		body = body[length:]
+
+		switch {
+		case serialType == 0 || serialType == 7:
+			columns = append(columns, nil)
+		case serialType == 8 || serialType == 9:
+			columns = append(columns, serialType-8)
+		case serialType <= 6:
+			// Big-endian two's complement integers.
+			var integer int64
+			if value[0]&0x80 != 0 {
+				integer = -1
+			}
+			for _, b := range value {
+				integer = integer<<8 | int64(b)
+			}
+			columns = append(columns, integer)
+		default:
+			columns = append(columns, value)
+		}
+	}
+	return columns, nil
+}
+
+// readSQLiteColumn returns the values of a text or blob column of all
+// rows of a table in a SQLite database.
+func readSQLiteColumn(contents []byte, tableName string, column int) ([][]byte, error) {
+	if len(contents) < sqliteHeaderLength || !bytes.HasPrefix(contents, sqliteMagic) {
+		return nil, errors.New("Database is not a SQLite database")
+	}
+	db := sqliteDatabase{
+		contents:             contents,
+		pageSize:             int(binary.BigEndian.Uint16(contents[16:])),
+		remainingPayloadSize: len(contents),
+	}
+	if db.pageSize == 1 {
+		db.pageSize = 65536
+	}
+	db.usableSize = db.pageSize - int(contents[20])
+	if db.pageSize < 512 || db.usableSize < 480 {
+		return nil, errors.New("Database has an invalid page size")
+	}
+
+	// Look up the root page of the table in the schema table,
+	// whose columns are type, name, tbl_name, rootpage and sql.
+	var rootPage int64
+	if err := db.walkTable(1, 0, map[uint32]bool{}, func(payload []byte) error {
+		columns, err := parseSQLiteRecord(payload)
+		if err != nil {
+			return err
+		}
+		if len(columns) >= 4 {
+			entryType, _ := columns[0].([]byte)
+			name, _ := columns[1].([]byte)
+			if string(entryType) == "table" && string(name) == tableName {
+				rootPage, _ = columns[3].(int64)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if rootPage <= 0 {
+		return nil, fmt.Errorf("Database does not contain table %#v", tableName)
+	}
+
+	var values [][]byte
+	if err := db.walkTable(uint32(rootPage), 0, map[uint32]bool{}, func(payload []byte) error {
+		columns, err := parseSQLiteRecord(payload)
+		if err != nil {
+			return err
+		}
+		if column >= len(columns) {
+			return errors.New("Row does not contain the requested column")
+		}
+		value, ok := columns[column].([]byte)
+		if !ok {
+			return errors.New("Column does not contain text or a blob")
+		}
+		values = append(values, value)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
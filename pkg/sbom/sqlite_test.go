@@ -0,0 +1,142 @@
+package sbom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func readTestdata(t *testing.T, name string) []byte {
+	t.Helper()
+	contents, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents
+}
+
+func TestReadSQLiteColumn(t *testing.T) {
+	// The fixture contains an RPM database with a page size of 1024
+	// bytes. The second row is stored partially in overflow pages.
+	values, err := readSQLiteColumn(readTestdata(t, "rpmdb.sqlite"), "Packages", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 3 {
+		t.Fatalf("Got %d values, expected 3", len(values))
+	}
+	for i, name := range []string{"bash", "openssl-libs", "gpg-pubkey"} {
+		if !bytes.Contains(values[i], []byte(name+"\x00")) {
+			t.Errorf("Value %d does not contain %#v", i, name)
+		}
+	}
+	if len(values[1]) < 3000 {
+		t.Errorf("Overflowing value has length %d", len(values[1]))
+	}
+}
+
+func TestReadSQLiteColumnInvalid(t *testing.T) {
+	fixture := readTestdata(t, "rpmdb.sqlite")
+	modified := func(f func(contents []byte)) []byte {
+		contents := append([]byte(nil), fixture...)
+		f(contents)
+		return contents
+	}
+	for _, testCase := range []struct {
+		name      string
+		contents  []byte
+		tableName string
+	}{
+		{"Empty", nil, "Packages"},
+		{"TruncatedHeader", fixture[:99], "Packages"},
+		{"BadMagic", modified(func(contents []byte) { contents[0] = 'X' }), "Packages"},
+		{"SmallPageSize", modified(func(contents []byte) {
+			binary.BigEndian.PutUint16(contents[16:], 256)
+		}), "Packages"},
+		{"LargeReservedSpace", modified(func(contents []byte) {
+			binary.BigEndian.PutUint16(contents[16:], 512)
+			contents[20] = 64
+		}), "Packages"},
+		{"PageSizeExceedsFile", modified(func(contents []byte) {
+			binary.BigEndian.PutUint16(contents[16:], 1)
+		}), "Packages"},
+		{"MissingTable", fixture, "Missing"},
+		{"MissingOverflowPage", fixture[:4096], "Packages"},
+		{"CyclicInteriorPage", modified(func(contents []byte) {
+			// Turn the schema table into an interior page whose
+			// right-most child is itself.
+			contents[sqliteHeaderLength] = sqlitePageTypeInteriorTable
+			binary.BigEndian.PutUint16(contents[sqliteHeaderLength+3:], 0)
+			binary.BigEndian.PutUint32(contents[sqliteHeaderLength+8:], 1)
+		}), "Packages"},
+		{"ChildPageOutOfRange", modified(func(contents []byte) {
+			contents[sqliteHeaderLength] = sqlitePageTypeInteriorTable
+			binary.BigEndian.PutUint16(contents[sqliteHeaderLength+3:], 0)
+			binary.BigEndian.PutUint32(contents[sqliteHeaderLength+8:], 0xffffffff)
+		}), "Packages"},
+		{"UnsupportedPageType", modified(func(contents []byte) { contents[1024] = 0x0a }), "Packages"},
+		{"TooManyCells", modified(func(contents []byte) {
+			binary.BigEndian.PutUint16(contents[1024+3:], 0xffff)
+		}), "Packages"},
+		{"CellOffsetOutOfRange", modified(func(contents []byte) {
+			binary.BigEndian.PutUint16(contents[1024+8:], 0xffff)
+		}), "Packages"},
+		{"PayloadLengthExceedsDatabase", modified(func(contents []byte) {
+			// The second row has a two byte payload length.
+			contents[1024+789] = 0xff
+			contents[1024+790] = 0x7f
+		}), "Packages"},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			if _, err := readSQLiteColumn(testCase.contents, testCase.tableName, 1); err == nil {
+				t.Error("Invalid database was accepted")
+			}
+		})
+	}
+}
+
+func TestParseSQLiteRecord(t *testing.T) {
+	columns, err := parseSQLiteRecord([]byte{
+		// Header: NULL, 8-bit integer, 16-bit integer, 1, text
+		// of length 3 and a blob of length 2.
+		7, 0, 1, 2, 9, 19, 16,
+		// Body.
+		0xfe, 0x01, 0x00, 'a', 'b', 'c', 0xde, 0xad,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(columns) != 6 ||
+		columns[0] != nil ||
+		columns[1] != int64(-2) ||
+		columns[2] != int64(256) ||
+		columns[3] != int64(1) ||
+		!bytes.Equal(columns[4].([]byte), []byte("abc")) ||
+		!bytes.Equal(columns[5].([]byte), []byte{0xde, 0xad}) {
+		t.Errorf("Got columns %#v", columns)
+	}
+}
+
+func TestParseSQLiteRecordInvalid(t *testing.T) {
+	for _, testCase := range []struct {
+		name    string
+		payload []byte
+	}{
+		{"Empty", nil},
+		{"HeaderLengthTooSmall", []byte{0, 1}},
+		{"HeaderLengthExceedsPayload", []byte{10, 1}},
+		{"TruncatedSerialType", []byte{2, 0x81}},
+		{"ReservedSerialType", []byte{2, 10}},
+		{"TruncatedInteger", []byte{2, 6, 0, 0, 0}},
+		{"TruncatedBlob", []byte{2, 20, 'a'}},
+		{"OverflowingBlobLength", []byte{10, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			if _, err := parseSQLiteRecord(testCase.payload); err == nil {
+				t.Error("Invalid record was accepted")
+			}
+		})
+	}
+}
@@ -1,5 +1,11 @@
 package schema
 
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
 type ContainerImage struct {
 	// UUID that identifies the container image internally.
 	Id string `gorm:"primary_key"`
@@ -17,6 +23,123 @@ type ContainerImage struct {
 	// Manifest contents of the container image. Only set if the image is
 	// present.
 	Manifest *[]byte
+
+	// Comma separated list of platforms (e.g., "linux/amd64") whose
+	// manifests should be mirrored if the image is a manifest list.
+	// Overrides the policy of the registry.
+	Platforms *string
+
+	// Type of the artifact stored in the image (e.g., a Helm chart
+	// or signature). Only set for OCI manifests.
+	ArtifactType *string
+
+	// Digest of the manifest to which this manifest is attached,
+	// if any. Used to serve the OCI referrers API.
+	SubjectDigest *string
+
+	// Digest of the manifest whose cosign signatures are stored
+	// in this manifest, if any. Used to serve "sha256-*.sig" tags.
+	SignedDigest *string
+
+	// Tag that referred to the image when it was resolved through
+	// the web UI, if any. Only stored for reference, as tags may be
+	// moved to other images afterwards.
+	Tag *string
+
+	// Digest of the config blob of the image. Only set once the
+	// labels stored in the config blob have been indexed.
+	ConfigDigest *string
+
+	// Time at which the packages installed in the image were
+	// stored in the container_image_packages table, if ever.
+	PackagesExtractedAt *time.Time
+
+	// Time at which the image was imported manually from an
+	// uploaded archive, as opposed to being downloaded from its
+	// registry.
+	ImportedAt *time.Time
+
+	// Time at which the image was pushed to the mirror, and the name
+	// of the user that pushed it, if it was pushed.
+	PushedAt *time.Time
+	PushedBy *string
+
+	// Manifest that was pushed into a repository with a signature
+	// policy. It is only served once a signature that is accepted
+	// by the policy has been pushed as well.
+	PendingManifestMediatype *string
+	PendingManifest          *[]byte
+}
+
+// ContainerBlobUpload is an upload of a blob that is in progress, as
+// part of an image being pushed to the mirror. The chunks received so
+// far are stored in the "container-uploads" bucket, keyed by the UUID
+// of the upload and their offset.
+type ContainerBlobUpload struct {
+	// UUID that identifies the upload.
+	Id string `gorm:"primary_key"`
+
+	// UUID of the repository to which the blob is pushed.
+	RepositoryId string
+
+	// Time at which the upload was started.
+	StartedAt time.Time
+
+	// Number of bytes received so far.
+	Size int64
+}
+
+// ContainerForeignLayer records a URL from which a foreign layer (i.e.,
+// one that isn't distributed through registries) was downloaded, so
+// that it can be served at that URL.
+type ContainerForeignLayer struct {
+	Url    string `gorm:"primary_key"`
+	Digest string
+}
+
+// ContainerImageLabel is a label stored in the config of a container
+// image (e.g., "org.opencontainers.image.source"). Labels are indexed,
+// so that images can be searched by label.
+type ContainerImageLabel struct {
+	// UUID of the container image and name of the label.
+	ContainerImageId string `gorm:"primary_key"`
+	Key              string `gorm:"primary_key"`
+
+	Value string
+}
+
+// Types of packages found in container images. These correspond to
+// the types of package URLs (https://github.com/package-url/purl-spec).
+const (
+	PackageTypeApk      = "apk"
+	PackageTypeCargo    = "cargo"
+	PackageTypeComposer = "composer"
+	PackageTypeDeb      = "deb"
+	PackageTypeGem      = "gem"
+	PackageTypeNpm      = "npm"
+	PackageTypePypi     = "pypi"
+	PackageTypeRpm      = "rpm"
+)
+
+// ContainerImagePackage is a package that is installed in a container
+// image according to the package database of its operating system, or
+// that is listed in a lockfile stored in the image.
+type ContainerImagePackage struct {
+	// UUID of the container image, absolute path of the package
+	// database or lockfile listing the package, and the package.
+	ContainerImageId string `gorm:"primary_key"`
+	Location         string `gorm:"primary_key"`
+	Type             string `gorm:"primary_key"`
+	Name             string `gorm:"primary_key"`
+	Version          string `gorm:"primary_key"`
+
+	// License of the package as declared by the package, if any.
+	// Not necessarily an SPDX license expression.
+	License *string
+
+	// Package URL identifying the package (e.g.,
+	// "pkg:deb/debian/bash@5.2.15-2?arch=amd64").
+	Purl string
 }
 
 type ContainerRegistry struct {
@@ -26,6 +149,133 @@ type ContainerRegistry struct {
 	// URI of the container registry (e.g.,
 	// "https://index.docker.io/").
 	Uri string
+
+	// Comma separated list of platforms (e.g., "linux/amd64") whose
+	// manifests should be mirrored for manifest lists stored in this
+	// registry, unless overridden by the image.
+	Platforms *string
+}
+
+// ContainerRegistryCredential holds the credentials that should be
+// used to access a container registry. Secrets are stored encrypted.
+type ContainerRegistryCredential struct {
+	// UUID of the registry to which the credentials apply.
+	RegistryId string `gorm:"primary_key"`
+
+	// Username and encrypted password to use for basic
+	// authentication. Both are empty for anonymous access.
+	Username          *string
+	EncryptedPassword *[]byte
+
+	// Encrypted refresh token obtained from the registry's token
+	// server, and the name of the service for which it was issued.
+	RefreshTokenService   *string
+	EncryptedRefreshToken *[]byte
+
+	// Encrypted digest of the credentials that were used to obtain
+	// the refresh token. The refresh token is discarded when the
+	// credentials change.
+	EncryptedRefreshTokenCredentials *[]byte
+}
+
+// Types of entries in the tarball of a container image layer.
+const (
+	LayerEntryTypeFile      = "file"
+	LayerEntryTypeDirectory = "directory"
+	LayerEntryTypeSymlink   = "symlink"
+	LayerEntryTypeHardlink  = "hardlink"
+	// A file named ".wh.<name>" that marks <name> in lower layers
+	// as deleted.
+	LayerEntryTypeWhiteout = "whiteout"
+	// A file named ".wh..wh..opq" that marks the contents of its
+	// directory in lower layers as deleted.
+	LayerEntryTypeOpaqueWhiteout = "opaque_whiteout"
+	LayerEntryTypeOther          = "other"
+)
+
+// ContainerLayerIndex records that the entries of a container image
+// layer have been stored in the container_layer_entries table.
+type ContainerLayerIndex struct {
+	// Digest of the layer blob.
+	LayerDigest string `gorm:"primary_key"`
+
+	IndexedAt  time.Time
+	EntryCount int64
+}
+
+// ContainerLayerEntry is an entry in the tarball of a container image
+// layer. Whiteouts are stored under their original path.
+type ContainerLayerEntry struct {
+	// Digest of the layer blob and absolute path of the entry.
+	LayerDigest string `gorm:"primary_key"`
+	Path        string `gorm:"primary_key"`
+
+	// Kind of entry. One of the LayerEntryType* constants.
+	Type string
+
+	// Permission bits and size of the entry.
+	Mode int64
+	Size int64
+
+	// Target of a symbolic link, or absolute path of the target of
+	// a hard link.
+	LinkTarget *string
+}
+
+// ContainerSignaturePolicy holds the cosign signatures that images
+// in a container repository must have to be mirrored. Images are
+// accepted if they are signed by one of the public keys, or by the
+// keyless identity.
+type ContainerSignaturePolicy struct {
+	// UUID of the repository to which the policy applies.
+	RepositoryId string `gorm:"primary_key"`
+
+	// PEM encoded public keys.
+	PublicKeys *string
+
+	// Email address or URI of the signer to which a certificate
+	// must be issued by Fulcio, and the URL of the OIDC issuer that
+	// authenticated it.
+	Identity *string
+	Issuer   *string
+}
+
+// ContainerWatchRule describes tags of a container repository that
+// should be polled for new images by dm_cron_watch_tags.
+type ContainerWatchRule struct {
+	// UUID that identifies the watch rule internally.
+	Id string `gorm:"primary_key"`
+
+	// UUID of the repository whose tags are watched.
+	RepositoryId string
+
+	// Glob pattern that tags must match (e.g., "1.*-alpine").
+	TagPattern *string
+
+	// Semantic versioning range that tags must match (e.g.,
+	// ">=1.2 <2").
+	SemverRange *string
+}
+
+// ContainerImageProposal records that a watched tag refers to an image
+// that is not mirrored yet. Proposals are approved by creating the
+// image, or dismissed, so that they are not proposed again.
+type ContainerImageProposal struct {
+	// UUID that identifies the proposal internally.
+	Id string `gorm:"primary_key"`
+
+	// UUID of the repository containing the image.
+	RepositoryId string
+
+	// Tag that referred to the image, and the image's digest.
+	Tag    string
+	Digest string
+
+	// Time at which the tag was first seen referring to the image.
+	DiscoveredAt time.Time
+
+	// Whether an administrator chose not to mirror the image.
+	Dismissed bool
 }
 
 type ContainerRepository struct {
@@ -59,4 +309,124 @@ type File struct {
 
 	// Whether the file has already been downloaded successfully.
 	Present bool
+
+	// Maximum amount of time the downloader may spend downloading
+	// the file during a single run, in seconds. The downloader's
+	// default is used if empty.
+	DownloadTimeoutSeconds *uint64
+
+	// Response headers returned by the upstream server when the
+	// file was last downloaded. These are replayed by the proxy.
+	// The contents of the file are stored as returned by the
+	// upstream server, meaning they are still encoded if a content
+	// encoding is set.
+	ContentType        *string
+	ContentDisposition *string
+	ContentEncoding    *string
+}
+
+// FileDownload records the provenance of the contents of a file, i.e.,
+// when and how it was downloaded from its upstream server. Metadata
+// that was not provided by the upstream server is empty. It is empty
+// entirely if identical contents were already present in storage, or
+// if the contents were imported manually.
+type FileDownload struct {
+	// UUID that identifies the download internally.
+	Id string `gorm:"primary_key"`
+
+	// UUID of the file that was downloaded.
+	FileId string
+
+	// Time at which the download completed.
+	DownloadedAt time.Time
+
+	// Version of the downloader that was used.
+	DownloaderVersion string
+
+	// Whether the contents were uploaded by an administrator instead
+	// of being downloaded, and the name of the uploaded file.
+	ManuallyImported bool
+	UploadedFilename *string
+
+	// URI from which the contents were obtained, after following
+	// redirects.
+	FinalUri *string
+
+	// URIs that were visited before reaching the final URI, in the
+	// order in which they were visited.
+	RedirectChain pq.StringArray
+
+	// Response headers returned by the upstream server.
+	LastModified       *string
+	Etag               *string
+	ContentType        *string
+	ContentDisposition *string
+	ContentEncoding    *string
+
+	// Hex encoded SHA-256 fingerprints of the TLS certificate chain
+	// presented by the upstream server, starting with the leaf
+	// certificate.
+	TlsCertificateFingerprints pq.StringArray
+}
+
+// Outcomes of a drift check.
+const (
+	// The upstream server still serves the artifact as mirrored.
+	DriftStatusUnchanged = "unchanged"
+	// The upstream server serves different contents.
+	DriftStatusChanged = "changed"
+	// The upstream server no longer serves the artifact.
+	DriftStatusMissing = "missing"
+	// The upstream server serves identical contents, but with
+	// different response headers.
+	DriftStatusHeadersChanged = "headers_changed"
+	// The upstream server could not be checked.
+	DriftStatusError = "error"
+)
+
+// DriftCheck records the outcome of comparing a mirrored artifact
+// against the one currently served by its upstream server. Exactly
+// one of FileId and ContainerImageId is set.
+type DriftCheck struct {
+	// UUID that identifies the drift check internally.
+	Id string `gorm:"primary_key"`
+
+	// UUID of the file or container image that was checked.
+	FileId           *string
+	ContainerImageId *string
+
+	// Time at which the check was performed.
+	CheckedAt time.Time
+
+	// Outcome of the check. One of the DriftStatus* constants.
+	Status string
+
+	// Human readable description of the differences observed.
+	Details *string
+}
+
+// Problems that may be found when scrubbing storage.
+const (
+	// An object that is referenced is not present in storage.
+	ScrubStatusMissing = "missing"
+	// The contents of an object don't match its checksum.
+	ScrubStatusCorrupt = "corrupt"
+)
+
+// ScrubFinding records an object in storage that failed verification
+// by dm_scrub. Findings are removed once the object verifies
+// successfully again, e.g. because it has been repaired.
+type ScrubFinding struct {
+	// Name of the S3 bucket and key of the object.
+	Bucket string `gorm:"primary_key"`
+	Key    string `gorm:"primary_key"`
+
+	// Kind of problem found. One of the ScrubStatus* constants.
+	Status string
+
+	// Human readable description of the problem.
+	Details *string
+
+	// Time at which the problem was last observed.
+	DetectedAt time.Time
 }
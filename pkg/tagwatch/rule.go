@@ -0,0 +1,56 @@
+package tagwatch
+
+import (
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/ProdriveTechnologies/distfile-mirror/pkg/schema"
+)
+
+// Rule determines whether a tag in a container repository should be
+// watched for new images.
+type Rule struct {
+	tagPattern  string
+	semverRange semverRange
+}
+
+// NewRule validates and converts a watch rule stored in the database.
+// A tag must match both the tag pattern and the semantic versioning
+// range, if set.
+func NewRule(watchRule *schema.ContainerWatchRule) (*Rule, error) {
+	r := &Rule{}
+	if watchRule.TagPattern != nil {
+		if _, err := path.Match(*watchRule.TagPattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid tag pattern %#v: %s", *watchRule.TagPattern, err)
+		}
+		r.tagPattern = *watchRule.TagPattern
+	}
+	if watchRule.SemverRange != nil {
+		semverRange, err := parseSemverRange(*watchRule.SemverRange)
+		if err != nil {
+			return nil, err
+		}
+		r.semverRange = semverRange
+	}
+	if r.tagPattern == "" && r.semverRange == nil {
+		return nil, errors.New("Watch rule does not contain a tag pattern or version range")
+	}
+	return r, nil
+}
+
+// Matches returns whether a tag is watched by the rule.
+func (r *Rule) Matches(tag string) bool {
+	if r.tagPattern != "" {
+		if matched, _ := path.Match(r.tagPattern, tag); !matched {
+			return false
+		}
+	}
+	if r.semverRange != nil {
+		v, ok := parseVersionTag(tag)
+		if !ok || !r.semverRange.matches(v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+package tagwatch
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Tags of the form "1.2.3" or "v1.2.3". Pre-releases and build
+	// metadata are not matched, as tags with such suffixes tend to
+	// be variants of an image (e.g., "1.2.3-alpine").
+	versionTagPattern = regexp.MustCompile(`^v?(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)$`)
+
+	// Comparators in a range, where the minor and patch components
+	// of the version may be omitted. Omitted components act as
+	// wildcards, as with X-ranges of npm (e.g., "=1.2" matches
+	// "1.2.5" and "<=1.2" matches versions below "1.3.0").
+	comparatorPattern = regexp.MustCompile(`^(>=|<=|>|<|=)?v?(0|[1-9][0-9]*)(?:\.(0|[1-9][0-9]*))?(?:\.(0|[1-9][0-9]*))?$`)
+)
+
+type version [3]int
+
+// compare compares the first components of two versions, returning -1,
+// 0 or 1 if the version is less than, equal to or greater than the
+// other.
+func (v version) compare(other version, components int) int {
+	for i := 0; i < components; i++ {
+		if v[i] < other[i] {
+			return -1
+		} else if v[i] > other[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// parseVersionTag converts a tag to a semantic version, if it has the
+// form of one.
+func parseVersionTag(tag string) (version, bool) {
+	matches := versionTagPattern.FindStringSubmatch(tag)
+	if matches == nil {
+		return version{}, false
+	}
+	var v version
+	for i := range v {
+		component, err := strconv.Atoi(matches[i+1])
+		if err != nil {
+			return version{}, false
+		}
+		v[i] = component
+	}
+	return v, true
+}
+
+// comparator compares versions against a version that may only
+// consist of its first components. Remaining components are ignored.
+type comparator struct {
+	operator   string
+	version    version
+	components int
+}
+
+func (c comparator) matches(v version) bool {
+	result := v.compare(c.version, c.components)
+	switch c.operator {
+	case ">=":
+		return result >= 0
+	case "<=":
+		return result <= 0
+	case ">":
+		return result > 0
+	case "<":
+		return result < 0
+	default:
+		return result == 0
+	}
+}
+
+// semverRange is a list of comparators, all of which a version must
+// match (e.g., ">=1.2 <2").
+type semverRange []comparator
+
+func parseSemverRange(s string) (semverRange, error) {
+	var r semverRange
+	for _, field := range strings.Fields(s) {
+		matches := comparatorPattern.FindStringSubmatch(field)
+		if matches == nil {
+			return nil, fmt.Errorf("Invalid version comparator %#v", field)
+		}
+		c := comparator{operator: matches[1]}
+		for i := range c.version {
+			if matches[i+2] != "" {
+				component, err := strconv.Atoi(matches[i+2])
+				if err != nil {
+					return nil, fmt.Errorf("Invalid version comparator %#v: %s", field, err)
+				}
+				c.version[i] = component
+				c.components = i + 1
+			}
+		}
+		r = append(r, c)
+	}
+	if len(r) == 0 {
+		return nil, fmt.Errorf("Version range %#v does not contain any comparators", s)
+	}
+	return r, nil
+}
+
+func (r semverRange) matches(v version) bool {
+	for _, c := range r {
+		if !c.matches(v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package tagwatch
+
+import (
+	"testing"
+)
+
+func TestSemverRangeMatches(t *testing.T) {
+	for _, testCase := range []struct {
+		semverRange string
+		tag         string
+		matches     bool
+	}{
+		// Full versions.
+		{"=1.2.3", "1.2.3", true},
+		{"1.2.3", "v1.2.3", true},
+		{"=1.2.3", "1.2.4", false},
+		{">=1.2.3", "1.2.3", true},
+		{">1.2.3", "1.2.3", false},
+		{"<1.2.3", "1.2.2", true},
+		{"<=1.2.3", "1.2.4", false},
+
+		// Partial versions act as X-ranges.
+		{"=1.2", "1.2.0", true},
+		{"=1.2", "1.2.5", true},
+		{"=1.2", "1.3.0", false},
+		{"=1", "1.9.9", true},
+		{"<=1.2", "1.2.5", true},
+		{"<=1.2", "1.3.0", false},
+		{"<1.2", "1.1.9", true},
+		{"<1.2", "1.2.0", false},
+		{">=1.2", "1.2.0", true},
+		{">=1.2", "1.1.9", false},
+		{">1.2", "1.2.5", false},
+		{">1.2", "1.3.0", true},
+		{">1", "1.9.9", false},
+		{">1", "2.0.0", true},
+
+		// Ranges consisting of multiple comparators.
+		{">=1.2 <2", "1.9.9", true},
+		{">=1.2 <2", "2.0.0", false},
+		{">=1.2 <2", "1.1.0", false},
+		{">=1.2 <=1.4", "1.4.7", true},
+	} {
+		r, err := parseSemverRange(testCase.semverRange)
+		if err != nil {
+			t.Fatalf("Failed to parse %#v: %s", testCase.semverRange, err)
+		}
+		v, ok := parseVersionTag(testCase.tag)
+		if !ok {
+			t.Fatalf("Failed to parse %#v", testCase.tag)
+		}
+		if matches := r.matches(v); matches != testCase.matches {
+			t.Errorf("Range %#v matching %#v: got %v, expected %v", testCase.semverRange, testCase.tag, matches, testCase.matches)
+		}
+	}
+}
+
+func TestParseSemverRangeInvalid(t *testing.T) {
+	for _, semverRange := range []string{"", "1.2.3.4", "~1.2", "1.x", ">=01.2"} {
+		if _, err := parseSemverRange(semverRange); err == nil {
+			t.Errorf("Range %#v was accepted", semverRange)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// Networks that may not be contacted by default, as they are either
+// private, link-local (e.g., cloud metadata services), loopback or
+// otherwise not part of the public Internet. NAT64 prefixes are denied
+// as well, as they allow IPv4 addresses to be reached through IPv6.
+var defaultDeniedNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"64:ff9b:1::/48",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// DestinationPolicy decides which upstream servers may be contacted. It
+// prevents users of the web UI from letting the downloaders access
+// internal services (server-side request forgery).
+//
+// Schemes and hostnames are checked against every URL, including the
+// ones obtained by following redirects. IP addresses are checked when
+// connections are established, after DNS resolution has taken place.
+type DestinationPolicy struct {
+	allowedSchemes  map[string]bool
+	allowedHosts    []string
+	deniedHosts     []string
+	allowedNetworks []*net.IPNet
+	deniedNetworks  []*net.IPNet
+}
+
+func splitList(list string) []string {
+	var entries []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.ToLower(strings.TrimSpace(entry)); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	var parsedNetworks []*net.IPNet
+	for _, network := range networks {
+		_, parsedNetwork, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network %#v: %s", network, err)
+		}
+		parsedNetworks = append(parsedNetworks, parsedNetwork)
+	}
+	return parsedNetworks, nil
+}
+
+// NewDestinationPolicy creates a DestinationPolicy. All arguments are
+// comma separated lists. If the list of allowed hosts is non-empty,
+// only the hosts listed may be contacted. Denied hosts may never be
+// contacted. Host entries starting with a dot match all subdomains.
+// Private and link-local networks are denied, unless they are part of
+// the list of allowed networks.
+func NewDestinationPolicy(allowedSchemes string, allowedHosts string, deniedHosts string, allowedNetworks string) (*DestinationPolicy, error) {
+	dp := &DestinationPolicy{
+		allowedSchemes: map[string]bool{},
+		allowedHosts:   splitList(allowedHosts),
+		deniedHosts:    splitList(deniedHosts),
+	}
+	for _, scheme := range splitList(allowedSchemes) {
+		dp.allowedSchemes[scheme] = true
+	}
+	var err error
+	if dp.allowedNetworks, err = parseNetworks(splitList(allowedNetworks)); err != nil {
+		return nil, err
+	}
+	if dp.deniedNetworks, err = parseNetworks(defaultDeniedNetworks); err != nil {
+		return nil, err
+	}
+	return dp, nil
+}
+
+func matchesHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if pattern == host || (strings.HasPrefix(pattern, ".") && strings.HasSuffix(host, pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckUrl returns an error if a URL may not be fetched, based on its
+// scheme and hostname. URLs containing literal IP addresses are checked
+// against the list of denied networks as well.
+func (dp *DestinationPolicy) CheckUrl(u *url.URL) error {
+	if !dp.allowedSchemes[strings.ToLower(u.Scheme)] {
+		return fmt.Errorf("Scheme %#v is not allowed", u.Scheme)
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return fmt.Errorf("URL %#v has no hostname", u.String())
+	}
+	if matchesHost(dp.deniedHosts, host) {
+		return fmt.Errorf("Host %#v is denied", host)
+	}
+	if len(dp.allowedHosts) > 0 && !matchesHost(dp.allowedHosts, host) {
+		return fmt.Errorf("Host %#v is not allowed", host)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return dp.CheckIP(ip)
+	}
+	return nil
+}
+
+// CheckIP returns an error if an IP address may not be contacted.
+func (dp *DestinationPolicy) CheckIP(ip net.IP) error {
+	for _, network := range dp.allowedNetworks {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	for _, network := range dp.deniedNetworks {
+		if network.Contains(ip) {
+			return fmt.Errorf("Address %s is part of denied network %s", ip, network)
+		}
+	}
+	return nil
+}
+
+// control can be used as the Control function of a net.Dialer to check
+// the address of a connection right before it is established. At this
+// point the hostname has already been resolved, meaning that it cannot
+// be bypassed by DNS records pointing to internal addresses.
+func (dp *DestinationPolicy) control(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("Cannot connect to non-IP address %#v", host)
+	}
+	return dp.CheckIP(ip)
+}
@@ -0,0 +1,208 @@
+package upstream
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDestinationPolicyCheckUrl(t *testing.T) {
+	dp, err := NewDestinationPolicy("http, HTTPS", "", "internal.example.com,.corp.example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, testCase := range []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://example.com/file", true},
+		{"HTTP://Example.com/file", true},
+		{"ftp://example.com/file", false},
+		{"file:///etc/passwd", false},
+		{"https:///file", false},
+		{"https://internal.example.com/file", false},
+		{"https://corp.example.com/file", true},
+		{"https://host.corp.example.com/file", false},
+		{"https://8.8.8.8/file", true},
+		{"https://10.1.2.3/file", false},
+		{"https://[::1]/file", false},
+		{"https://[::ffff:127.0.0.1]/file", false},
+		{"https://[2001:4860:4860::8888]/file", true},
+	} {
+		t.Run(testCase.url, func(t *testing.T) {
+			u, err := url.Parse(testCase.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := dp.CheckUrl(u); (err == nil) != testCase.allowed {
+				t.Errorf("Got error %v, expected allowed=%v", err, testCase.allowed)
+			}
+		})
+	}
+}
+
+func TestDestinationPolicyAllowedHosts(t *testing.T) {
+	dp, err := NewDestinationPolicy("https", "example.com,.example.org", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, testCase := range []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://example.com/file", true},
+		{"https://www.example.com/file", false},
+		{"https://www.example.org/file", true},
+		{"https://example.org/file", false},
+		{"https://badexample.org/file", false},
+		{"https://example.net/file", false},
+	} {
+		t.Run(testCase.url, func(t *testing.T) {
+			u, err := url.Parse(testCase.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := dp.CheckUrl(u); (err == nil) != testCase.allowed {
+				t.Errorf("Got error %v, expected allowed=%v", err, testCase.allowed)
+			}
+		})
+	}
+}
+
+func TestDestinationPolicyCheckIP(t *testing.T) {
+	dp, err := NewDestinationPolicy("https", "", "", "10.1.0.0/16, fd00:1::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, testCase := range []struct {
+		ip      string
+		allowed bool
+	}{
+		// Public addresses.
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+
+		// Denied IPv4 ranges.
+		{"0.0.0.0", false},
+		{"10.0.0.1", false},
+		{"100.64.0.1", false},
+		{"127.0.0.1", false},
+		{"169.254.169.254", false},
+		{"172.16.0.1", false},
+		{"172.31.255.255", false},
+		{"192.0.0.1", false},
+		{"192.168.1.1", false},
+		{"198.18.0.1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+
+		// Denied IPv6 ranges.
+		{"::", false},
+		{"::1", false},
+		{"fc00::1", false},
+		{"fd12:3456::1", false},
+		{"fe80::1", false},
+		{"ff02::1", false},
+
+		// IPv4-mapped IPv6 addresses are subject to the IPv4
+		// ranges.
+		{"::ffff:8.8.8.8", true},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"::ffff:10.1.2.3", true},
+
+		// NAT64 prefixes embed IPv4 addresses.
+		{"64:ff9b::a9fe:a9fe", false},
+		{"64:ff9b::808:808", false},
+		{"64:ff9b:1::a00:1", false},
+
+		// Allowed networks take precedence.
+		{"10.1.2.3", true},
+		{"10.2.2.3", false},
+		{"fd00:1::1", true},
+		{"fd00:2::1", false},
+	} {
+		t.Run(testCase.ip, func(t *testing.T) {
+			ip := net.ParseIP(testCase.ip)
+			if ip == nil {
+				t.Fatalf("Invalid IP address %#v", testCase.ip)
+			}
+			if err := dp.CheckIP(ip); (err == nil) != testCase.allowed {
+				t.Errorf("Got error %v, expected allowed=%v", err, testCase.allowed)
+			}
+		})
+	}
+}
+
+func TestNewDestinationPolicyInvalidNetwork(t *testing.T) {
+	if _, err := NewDestinationPolicy("https", "", "", "10.0.0.0"); err == nil {
+		t.Error("Invalid network was accepted")
+	}
+}
+
+func newTestClient(t *testing.T, allowedNetworks string) *http.Client {
+	t.Helper()
+	dp, err := NewDestinationPolicy("http,https", "", "", allowedNetworks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Bypass any proxy configured in the environment, so that the
+	// test server is contacted directly.
+	tf, err := NewTransportFactory("", "*", "", "", dp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Transport: tf.NewTransport(nil)}
+}
+
+func TestTransportFactoryRedirects(t *testing.T) {
+	// The test server is allowed explicitly. The policy needs to be
+	// applied to the targets of redirects.
+	client := newTestClient(t, "127.0.0.1/32")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if location := r.URL.Query().Get("location"); location != "" {
+			http.Redirect(w, r, location, http.StatusFound)
+		}
+	}))
+	defer server.Close()
+
+	for _, testCase := range []struct {
+		location string
+		allowed  bool
+	}{
+		{"", true},
+		{"/other", true},
+		{"http://10.0.0.1/", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://[::ffff:169.254.169.254]/", false},
+		{"http://[64:ff9b::a9fe:a9fe]/", false},
+		{"http://[::1]/", false},
+		{"ftp://127.0.0.1/", false},
+	} {
+		t.Run(testCase.location, func(t *testing.T) {
+			response, err := client.Get(server.URL + "/?location=" + url.QueryEscape(testCase.location))
+			if err == nil {
+				response.Body.Close()
+			}
+			if (err == nil) != testCase.allowed {
+				t.Errorf("Got error %v, expected allowed=%v", err, testCase.allowed)
+			}
+		})
+	}
+}
+
+func TestTransportFactoryResolvedAddress(t *testing.T) {
+	// Hostnames pass CheckUrl, but their addresses are checked when
+	// connecting.
+	client := newTestClient(t, "")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	_, err := client.Get(strings.Replace(server.URL, "127.0.0.1", "localhost", 1))
+	if err == nil || !strings.Contains(err.Error(), "denied network") {
+		t.Errorf("Got error %v, expected connection to be denied", err)
+	}
+}
@@ -0,0 +1,45 @@
+package upstream
+
+import (
+	"flag"
+)
+
+// Flags holds the command line flags that control how upstream servers
+// are contacted. They are shared by all programs that contact upstream
+// servers, so that they can be given the same configuration.
+type Flags struct {
+	allowedHosts      *string
+	allowedNetworks   *string
+	allowedSchemes    *string
+	deniedHosts       *string
+	noProxy           *string
+	proxy             *string
+	rootCertificates  *string
+	tlsMinimumVersion *string
+}
+
+// RegisterFlags registers the "upstream.*" command line flags.
+func RegisterFlags() *Flags {
+	return &Flags{
+		allowedHosts:      flag.String("upstream.allowed-hosts", "", "Comma separated list of upstream hosts that may be contacted. Entries starting with a dot match subdomains. All hosts are allowed if empty"),
+		allowedNetworks:   flag.String("upstream.allowed-networks", "", "Comma separated list of private IP ranges that upstream servers may be part of (e.g., 10.1.0.0/16)"),
+		allowedSchemes:    flag.String("upstream.allowed-schemes", "http,https", "Comma separated list of URL schemes that may be used to contact upstream servers"),
+		deniedHosts:       flag.String("upstream.denied-hosts", "", "Comma separated list of upstream hosts that may never be contacted. Entries starting with a dot match subdomains"),
+		noProxy:           flag.String("upstream.no-proxy", "", "Comma separated list of hostnames, domains and IP ranges of upstream servers that should not be contacted through the proxy. Applies to proxies obtained from the environment as well"),
+		proxy:             flag.String("upstream.proxy", "", "URL of the HTTP proxy through which upstream servers should be contacted. Obtained from the environment if not set"),
+		rootCertificates:  flag.String("upstream.root-certificates", "", "Path of a PEM file holding root certificates that should be trusted next to the system's when contacting upstream servers"),
+		tlsMinimumVersion: flag.String("upstream.tls-minimum-version", "", "Minimum TLS version to use when contacting upstream servers (e.g., 1.2)"),
+	}
+}
+
+// NewDestinationPolicy creates a DestinationPolicy based on the values
+// of the command line flags.
+func (f *Flags) NewDestinationPolicy() (*DestinationPolicy, error) {
+	return NewDestinationPolicy(*f.allowedSchemes, *f.allowedHosts, *f.deniedHosts, *f.allowedNetworks)
+}
+
+// NewTransportFactory creates a TransportFactory based on the values of
+// the command line flags.
+func (f *Flags) NewTransportFactory(policy *DestinationPolicy) (*TransportFactory, error) {
+	return NewTransportFactory(*f.proxy, *f.noProxy, *f.rootCertificates, *f.tlsMinimumVersion, policy)
+}
@@ -0,0 +1,273 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TransportFactory creates HTTP transports for connecting to upstream
+// servers, such as the ones serving files and container images. This
+// allows the downloaders to run in networks that can only reach the
+// Internet through a HTTP proxy, potentially performing TLS
+// inspection. All connections are subject to a DestinationPolicy.
+type TransportFactory struct {
+	proxy          func(*http.Request) (*url.URL, error)
+	proxyAddresses map[string]bool
+	rootCAs        *x509.CertPool
+	minVersion     uint16
+	policy         *DestinationPolicy
+}
+
+// getProxyAddress returns the address of a proxy in host:port form, so
+// that it can be compared against addresses being dialed.
+func getProxyAddress(proxyUrl string) (string, error) {
+	if !strings.Contains(proxyUrl, "://") {
+		proxyUrl = "http://" + proxyUrl
+	}
+	parsedProxyUrl, err := url.Parse(proxyUrl)
+	if err != nil {
+		return "", err
+	}
+	if port := parsedProxyUrl.Port(); port != "" {
+		return parsedProxyUrl.Host, nil
+	}
+	if parsedProxyUrl.Scheme == "https" {
+		return net.JoinHostPort(parsedProxyUrl.Hostname(), "443"), nil
+	}
+	return net.JoinHostPort(parsedProxyUrl.Hostname(), "80"), nil
+}
+
+// NewTransportFactory creates a TransportFactory. If no proxy URL is
+// provided, the proxy is obtained from the environment. The no-proxy
+// list is a comma separated list of hostnames, domain names (when
+// prefixed with a dot) and IP ranges that should be contacted directly,
+// even if the environment specifies a proxy for them.
+// Additional root certificates are read from a PEM file and are trusted
+// next to the system's root certificates.
+func NewTransportFactory(proxyUrl string, noProxy string, rootCertificatesPath string, tlsMinimumVersion string, policy *DestinationPolicy) (*TransportFactory, error) {
+	tf := &TransportFactory{
+		proxyAddresses: map[string]bool{},
+		policy:         policy,
+	}
+
+	// Connections to the proxy are not subject to the destination
+	// policy, as the proxy is typically part of the internal network.
+	proxyUrls := []string{proxyUrl}
+	if proxyUrl == "" {
+		for _, name := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy"} {
+			proxyUrls = append(proxyUrls, os.Getenv(name))
+		}
+	}
+	for _, u := range proxyUrls {
+		if u != "" {
+			proxyAddress, err := getProxyAddress(u)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid proxy URL: %s", err)
+			}
+			tf.proxyAddresses[proxyAddress] = true
+		}
+	}
+
+	// The no-proxy list is applied on top of the proxy settings
+	// obtained from the environment, so that it has the same effect
+	// regardless of how the proxy is configured.
+	proxy := http.ProxyFromEnvironment
+	if proxyUrl != "" {
+		parsedProxyUrl, err := url.Parse(proxyUrl)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy URL: %s", err)
+		}
+		proxy = http.ProxyURL(parsedProxyUrl)
+	}
+	noProxyMatcher := newNoProxyMatcher(noProxy)
+	tf.proxy = func(req *http.Request) (*url.URL, error) {
+		if noProxyMatcher.matches(req.URL) {
+			return nil, nil
+		}
+		return proxy(req)
+	}
+
+	if rootCertificatesPath != "" {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			rootCAs = x509.NewCertPool()
+		}
+		rootCertificates, err := ioutil.ReadFile(rootCertificatesPath)
+		if err != nil {
+			return nil, err
+		}
+		if !rootCAs.AppendCertsFromPEM(rootCertificates) {
+			return nil, fmt.Errorf("No certificates found in %s", rootCertificatesPath)
+		}
+		tf.rootCAs = rootCAs
+	}
+
+	if tlsMinimumVersion != "" {
+		minVersion, ok := tlsVersions[tlsMinimumVersion]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported TLS version %#v", tlsMinimumVersion)
+		}
+		tf.minVersion = minVersion
+	}
+	return tf, nil
+}
+
+// NewTransport creates a HTTP transport for connecting to upstream
+// servers, optionally presenting a TLS client certificate. Apart from
+// the proxy, TLS and destination policy settings, it is identical to
+// http.DefaultTransport.
+func (tf *TransportFactory) NewTransport(clientCertificates []tls.Certificate) http.RoundTripper {
+	proxyDialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	upstreamDialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   tf.policy.control,
+	}
+	dialContext := func(ctx context.Context, network string, address string) (net.Conn, error) {
+		if tf.proxyAddresses[address] {
+			return proxyDialer.DialContext(ctx, network, address)
+		}
+		return upstreamDialer.DialContext(ctx, network, address)
+	}
+	return &policyRoundTripper{
+		proxy:  tf.proxy,
+		policy: tf.policy,
+		base: &http.Transport{
+			Proxy:                 tf.proxy,
+			DialContext:           dialContext,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+			TLSClientConfig: &tls.Config{
+				Certificates: clientCertificates,
+				RootCAs:      tf.rootCAs,
+				MinVersion:   tf.minVersion,
+			},
+		},
+	}
+}
+
+// policyRoundTripper checks whether the URLs of outgoing requests are
+// permitted by the DestinationPolicy. As it is invoked for every
+// request, this includes URLs obtained by following redirects.
+type policyRoundTripper struct {
+	proxy  func(*http.Request) (*url.URL, error)
+	policy *DestinationPolicy
+	base   http.RoundTripper
+}
+
+func (rt *policyRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := rt.checkRequest(req); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return rt.base.RoundTrip(req)
+}
+
+func (rt *policyRoundTripper) checkRequest(req *http.Request) error {
+	if err := rt.policy.CheckUrl(req.URL); err != nil {
+		return err
+	}
+
+	// Requests sent through a proxy are resolved by the proxy,
+	// meaning addresses cannot be checked when dialing. Resolve the
+	// hostname here instead. This is only a best effort, as the
+	// proxy may obtain different results.
+	proxyUrl, err := rt.proxy(req)
+	if err != nil || proxyUrl == nil {
+		return err
+	}
+	addresses, err := net.DefaultResolver.LookupIPAddr(req.Context(), req.URL.Hostname())
+	if err != nil {
+		return err
+	}
+	for _, address := range addresses {
+		if err := rt.policy.CheckIP(address.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// noProxyMatcher determines whether a URL should be contacted directly,
+// instead of going through a proxy. It uses the same syntax as the
+// NO_PROXY environment variable.
+type noProxyMatcher struct {
+	matchAll bool
+	hosts    map[string]bool
+	domains  []string
+	networks []*net.IPNet
+}
+
+func newNoProxyMatcher(noProxy string) *noProxyMatcher {
+	m := &noProxyMatcher{hosts: map[string]bool{}}
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			m.matchAll = true
+		} else if _, network, err := net.ParseCIDR(entry); err == nil {
+			m.networks = append(m.networks, network)
+		} else if ip := net.ParseIP(entry); ip != nil {
+			m.hosts[ip.String()] = true
+		} else if strings.HasPrefix(entry, ".") {
+			m.domains = append(m.domains, entry)
+		} else {
+			// Plain hostnames match subdomains as well.
+			m.hosts[entry] = true
+			m.domains = append(m.domains, "."+entry)
+		}
+	}
+	return m
+}
+
+func (m *noProxyMatcher) matches(u *url.URL) bool {
+	if m.matchAll {
+		return true
+	}
+	host := strings.ToLower(u.Hostname())
+	if ip := net.ParseIP(host); ip != nil {
+		if m.hosts[ip.String()] {
+			return true
+		}
+		for _, network := range m.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	if m.hosts[host] {
+		return true
+	}
+	for _, domain := range m.domains {
+		if strings.HasSuffix(host, domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package util
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// IsNotFound returns whether an error returned by S3 indicates that
+// an object is not present.
+func IsNotFound(err error) bool {
+	requestFailure, ok := err.(awserr.RequestFailure)
+	return ok && requestFailure.StatusCode() == http.StatusNotFound
+}
+
+// ObjectExists returns whether an object with a given key is present
+// in an S3 bucket. It can be used to prevent redundant uploads of
+// content addressed objects.
+func ObjectExists(ctx context.Context, s3Client s3iface.S3API, bucket string, key string) (bool, error) {
+	if _, err := s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}); err != nil {
+		if IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// GetObjectContents reads an object from an S3 bucket into memory. It
+// should only be used for small objects (e.g., container image
+// configs).
+func GetObjectContents(ctx context.Context, s3Client s3iface.S3API, bucket string, key string) ([]byte, error) {
+	object, err := s3Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Body.Close()
+	return ioutil.ReadAll(object.Body)
+}
@@ -0,0 +1,54 @@
+package util
+
+import (
+	"fmt"
+	"io"
+
+	oci_digest "github.com/opencontainers/go-digest"
+)
+
+// VerifyingReader wraps the contents of a blob obtained from a
+// registry or a client. It returns an error instead of io.EOF if the
+// contents don't match the expected digest and size. When used as the
+// body of an upload, this causes the upload to be aborted, meaning that
+// corrupt contents are never stored under the blob's digest.
+type VerifyingReader struct {
+	r            io.Reader
+	digest       oci_digest.Digest
+	verifier     oci_digest.Verifier
+	expectedSize int64
+	size         int64
+}
+
+// NewVerifyingReader creates a VerifyingReader. The size of the blob is
+// not checked if expectedSize is zero, as schema 1 manifests don't
+// record the sizes of layers.
+func NewVerifyingReader(r io.Reader, digest oci_digest.Digest, expectedSize int64) (*VerifyingReader, error) {
+	if err := digest.Validate(); err != nil {
+		return nil, err
+	}
+	return &VerifyingReader{
+		r:            r,
+		digest:       digest,
+		verifier:     digest.Verifier(),
+		expectedSize: expectedSize,
+	}, nil
+}
+
+func (vr *VerifyingReader) Read(p []byte) (int, error) {
+	n, err := vr.r.Read(p)
+	vr.verifier.Write(p[:n])
+	vr.size += int64(n)
+	if vr.expectedSize > 0 && vr.size > vr.expectedSize {
+		return n, fmt.Errorf("Blob %s is larger than the expected %d bytes", vr.digest, vr.expectedSize)
+	}
+	if err == io.EOF {
+		if vr.expectedSize > 0 && vr.size != vr.expectedSize {
+			return n, fmt.Errorf("Blob %s has size %d, whereas %d bytes were expected", vr.digest, vr.size, vr.expectedSize)
+		}
+		if !vr.verifier.Verified() {
+			return n, fmt.Errorf("Contents of blob %s do not match its digest", vr.digest)
+		}
+	}
+	return n, err
+}
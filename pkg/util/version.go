@@ -0,0 +1,6 @@
+package util
+
+// Version of Distfile Mirror. It is set at link time when building
+// with stamping enabled. It is recorded as part of the provenance of
+// downloaded artifacts.
+var Version = "unknown"
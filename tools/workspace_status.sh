@@ -0,0 +1,4 @@
+#!/bin/sh
+# Provides the version that is embedded into binaries, so that it can
+# be recorded as part of the provenance of downloaded artifacts.
+echo "STABLE_GIT_COMMIT $(git rev-parse HEAD 2>/dev/null || echo unknown)"